@@ -0,0 +1,111 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
+)
+
+const (
+	artifactsDirEnvName = "E2E_ARTIFACTS_DIR"
+	// artifactsTimeout bounds collection of all artifacts on Close.
+	artifactsTimeout = 2 * time.Minute
+)
+
+// ArtifactCollector writes artifacts of the given runnable into the given directory, e.g. its metrics or profiles.
+// It's invoked for every runnable created in the environment, also for the ones that are not running.
+type ArtifactCollector func(ctx context.Context, r Runnable, dir string) error
+
+var (
+	artifactCollectorsMtx sync.Mutex
+	artifactCollectors    = map[string]ArtifactCollector{}
+)
+
+// AddArtifactCollector registers collector used by all environments collecting artifacts (see WithArtifacts) under
+// the given name, replacing the collector registered under the same name before, if any. Nil collector unregisters it.
+// Packages like e2emon and e2eprof register their collectors when imported.
+func AddArtifactCollector(name string, collector ArtifactCollector) {
+	artifactCollectorsMtx.Lock()
+	defer artifactCollectorsMtx.Unlock()
+
+	if collector == nil {
+		delete(artifactCollectors, name)
+		return
+	}
+	artifactCollectors[name] = collector
+}
+
+// artifactsDirectory returns directory to collect artifacts into, or empty string if artifacts should not be collected.
+func (o environmentOptions) artifactsDirectory() string {
+	if o.artifactsDir != "" {
+		return o.artifactsDir
+	}
+	return os.Getenv(artifactsDirEnvName)
+}
+
+// artifactsCloser returns closer collecting artifacts into the configured directory using the given function, or nil
+// if artifacts should not be collected.
+func (o environmentOptions) artifactsCloser(logger Logger, collect func(ctx context.Context, dir string) error) func() {
+	dir := o.artifactsDirectory()
+	if dir == "" {
+		return nil
+	}
+	return func() {
+		if o.artifactsIf != nil && !o.artifactsIf() {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), artifactsTimeout)
+		defer cancel()
+		logger.Log("Collecting artifacts into", dir)
+		if err := collect(ctx, dir); err != nil {
+			logger.Log("Unable to collect all artifacts:", err.Error())
+		}
+	}
+}
+
+// collectArtifacts writes artifacts of every given runnable into its own subdirectory of dir: logs.txt with its full
+// logs, artifacts written by describe (e.g. engine details about the runnable) and by registered collectors.
+// It continues on errors, returning all of them at the end.
+func collectArtifacts(ctx context.Context, dir string, runnables []Runnable, describe ArtifactCollector) error {
+	artifactCollectorsMtx.Lock()
+	names := make([]string, 0, len(artifactCollectors))
+	collectors := make(map[string]ArtifactCollector, len(artifactCollectors))
+	for name, c := range artifactCollectors {
+		names = append(names, name)
+		collectors[name] = c
+	}
+	artifactCollectorsMtx.Unlock()
+	sort.Strings(names)
+
+	errs := merrors.New()
+	for _, r := range runnables {
+		rDir := filepath.Join(dir, r.Name())
+		if err := os.MkdirAll(rDir, 0750); err != nil {
+			errs.Add(err)
+			continue
+		}
+
+		errs.Add(os.WriteFile(filepath.Join(rDir, "logs.txt"), []byte(r.Logs().String()), 0644))
+		if describe != nil {
+			if err := describe(ctx, r, rDir); err != nil {
+				errs.Add(errors.Wrapf(err, "describe %s", r.Name()))
+			}
+		}
+		for _, name := range names {
+			if err := collectors[name](ctx, r, rDir); err != nil {
+				errs.Add(errors.Wrapf(err, "collect %s artifacts of %s", name, r.Name()))
+			}
+		}
+	}
+	return errs.Err()
+}
@@ -0,0 +1,81 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	AddArtifactCollector("test", func(_ context.Context, r Runnable, dir string) error {
+		if r.Name() == "failing" {
+			return errors.New("failed")
+		}
+		return os.WriteFile(filepath.Join(dir, "test.txt"), []byte(r.Name()), 0644)
+	})
+	t.Cleanup(func() { AddArtifactCollector("test", nil) })
+
+	dir := t.TempDir()
+	e, err := NewProcessEnvironment(WithArtifacts(dir))
+	testutil.Ok(t, err)
+
+	app := e.Runnable("app").Init(StartOptions{Command: NewCommand("sh", "-c", "echo hello && exec sleep 1000")})
+	testutil.Ok(t, app.Start())
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	_, err = app.WaitLogLine(ctx, regexp.MustCompile("^hello$"))
+	testutil.Ok(t, err)
+	_ = e.Runnable("failing").Init(StartOptions{Command: NewCommand("true")})
+
+	err = e.CollectArtifacts(ctx, filepath.Join(dir, "manual"))
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "collect test artifacts of failing: failed", err.Error())
+
+	// Artifacts are collected on close, while runnables are still running.
+	e.Close()
+	b, err := os.ReadFile(filepath.Join(dir, "app", "logs.txt"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello\n", string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "app", "test.txt"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "app", string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "failing", "logs.txt"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", string(b))
+}
+
+func TestArtifactsCloser(t *testing.T) {
+	var collected []string
+	collect := func(_ context.Context, dir string) error {
+		collected = append(collected, dir)
+		return nil
+	}
+	logger := NewLogger(os.Stderr)
+
+	t.Setenv(artifactsDirEnvName, "")
+	testutil.Assert(t, environmentOptions{}.artifactsCloser(logger, collect) == nil)
+
+	failed := false
+	o := environmentOptions{}
+	WithArtifacts("/tmp/artifacts")(&o)
+	withArtifactsCondition(func() bool { return failed })(&o)
+	c := o.artifactsCloser(logger, collect)
+	c()
+	testutil.Equals(t, 0, len(collected))
+	failed = true
+	c()
+	testutil.Equals(t, []string{"/tmp/artifacts"}, collected)
+
+	t.Setenv(artifactsDirEnvName, "/tmp/from-env")
+	environmentOptions{}.artifactsCloser(logger, collect)()
+	testutil.Equals(t, []string{"/tmp/artifacts", "/tmp/from-env"}, collected)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// imageBuild describes image of the runnable built from Dockerfile, see RunnableBuilder.WithBuild.
+type imageBuild struct {
+	// contextDir is the absolute path of the build context.
+	contextDir string
+	// dockerfile is the path of Dockerfile relative to contextDir.
+	dockerfile string
+	args       map[string]string
+}
+
+func newImageBuild(contextDir, dockerfile string, args map[string]string) (*imageBuild, error) {
+	dir, err := filepath.Abs(contextDir)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, errors.Wrap(err, "build context")
+	} else if !fi.IsDir() {
+		return nil, errors.Newf("build context %s is not a directory", dir)
+	}
+
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+	dockerfile = filepath.Clean(dockerfile)
+	if filepath.IsAbs(dockerfile) || dockerfile == ".." || strings.HasPrefix(dockerfile, ".."+string(filepath.Separator)) {
+		return nil, errors.Newf("dockerfile %s has to be relative to the build context %s", dockerfile, dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dockerfile)); err != nil {
+		return nil, errors.Wrap(err, "dockerfile")
+	}
+	return &imageBuild{contextDir: dir, dockerfile: dockerfile, args: args}, nil
+}
+
+// argNames returns names of build arguments in order, so builds are deterministic.
+func (b *imageBuild) argNames() []string {
+	names := make([]string, 0, len(b.args))
+	for k := range b.args {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// imageTag returns tag of the image built for the given runnable. It's derived from the content of the build context
+// and build arguments, so the image is rebuilt only once any of them changes. The whole context is hashed, including
+// files excluded by .dockerignore, so it errs on the side of rebuilding. Image names have to be lower case.
+func (b *imageBuild) imageTag(name string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(b.contextDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b.contextDir, p)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(h, "%s %v %d\n", filepath.ToSlash(rel), fi.Mode(), fi.Size())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintln(h, link)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "hash build context %s", b.contextDir)
+	}
+	_, _ = fmt.Fprintf(h, "dockerfile %s\n", filepath.ToSlash(b.dockerfile))
+	for _, k := range b.argNames() {
+		_, _ = fmt.Fprintf(h, "arg %s=%s\n", k, b.args[k])
+	}
+	return fmt.Sprintf("e2e-build-%s:%x", strings.ToLower(name), h.Sum(nil)[:8]), nil
+}
+
+// buildArgs returns arguments of `docker build` (or `podman build`) building the image with the given tag.
+func (b *imageBuild) buildArgs(tag string) []string {
+	args := []string{"build", "--tag", tag, "--file", filepath.Join(b.contextDir, b.dockerfile)}
+	for _, k := range b.argNames() {
+		args = append(args, "--build-arg", k+"="+b.args[k])
+	}
+	return append(args, b.contextDir)
+}
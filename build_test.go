@@ -0,0 +1,73 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestNewImageBuild(t *testing.T) {
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine"), 0600))
+
+	b, err := newImageBuild(dir, "", nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "Dockerfile", b.dockerfile)
+
+	_, err = newImageBuild(filepath.Join(dir, "missing"), "", nil)
+	testutil.NotOk(t, err)
+	_, err = newImageBuild(filepath.Join(dir, "Dockerfile"), "", nil)
+	testutil.NotOk(t, err)
+	_, err = newImageBuild(dir, "app.Dockerfile", nil)
+	testutil.NotOk(t, err)
+	_, err = newImageBuild(dir, filepath.Join("..", "Dockerfile"), nil)
+	testutil.NotOk(t, err)
+	_, err = newImageBuild(dir, filepath.Join(dir, "Dockerfile"), nil)
+	testutil.NotOk(t, err)
+}
+
+func TestImageBuild_ImageTag(t *testing.T) {
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine"), 0600))
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "app"), []byte("v1"), 0600))
+
+	b, err := newImageBuild(dir, "", map[string]string{"VERSION": "1"})
+	testutil.Ok(t, err)
+	tag, err := b.imageTag("App")
+	testutil.Ok(t, err)
+	testutil.Assert(t, len(tag) == len("e2e-build-app:")+16, "unexpected tag %s", tag)
+	testutil.Equals(t, "e2e-build-app:", tag[:len("e2e-build-app:")])
+
+	// The same content gives the same tag, so the image is not rebuilt.
+	same, err := b.imageTag("App")
+	testutil.Ok(t, err)
+	testutil.Equals(t, tag, same)
+
+	b.args["VERSION"] = "2"
+	changedArgs, err := b.imageTag("App")
+	testutil.Ok(t, err)
+	testutil.Assert(t, changedArgs != tag, "expected different tag on changed build args")
+
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "app"), []byte("v2"), 0600))
+	changedContent, err := b.imageTag("App")
+	testutil.Ok(t, err)
+	testutil.Assert(t, changedContent != changedArgs, "expected different tag on changed build context")
+}
+
+func TestImageBuild_BuildArgs(t *testing.T) {
+	dir := t.TempDir()
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "build"), 0750))
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "build", "Dockerfile"), []byte("FROM alpine"), 0600))
+
+	b, err := newImageBuild(dir, "build/Dockerfile", map[string]string{"B": "2", "A": "1"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{
+		"build", "--tag", "e2e-build-app:1", "--file", filepath.Join(dir, "build", "Dockerfile"),
+		"--build-arg", "A=1", "--build-arg", "B=2", dir,
+	}, b.buildArgs("e2e-build-app:1"))
+}
@@ -0,0 +1,84 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// netAdminImage is the image with network tools (tc, iptables) used to inject network faults
+// from within the network namespace of the runnable.
+const netAdminImage = "nicolaka/netshoot:v0.9"
+
+// Fault represents injected failure (e.g. network partition) that lasts until it's healed.
+type Fault interface {
+	// Heal reverts the fault. It should be ok to Heal more than once, with next invokes being noop.
+	Heal() error
+}
+
+type fault struct {
+	once sync.Once
+	heal func() error
+	err  error
+}
+
+func newFault(heal func() error) Fault {
+	return &fault{heal: heal}
+}
+
+func (f *fault) Heal() error {
+	f.once.Do(func() { f.err = f.heal() })
+	return f.err
+}
+
+// netemConfig represents network conditions of the runnable emulated with tc netem.
+// All conditions are applied together as a single root queueing discipline.
+type netemConfig struct {
+	latency       time.Duration
+	jitter        time.Duration
+	lossPercent   float64
+	bitsPerSecond uint64
+}
+
+// tcArgs returns tc command that applies the config to the given network device.
+func (c netemConfig) tcArgs(dev string) []string {
+	if c == (netemConfig{}) {
+		return []string{"tc", "qdisc", "del", "dev", dev, "root"}
+	}
+
+	args := []string{"tc", "qdisc", "replace", "dev", dev, "root", "netem"}
+	if c.latency > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dus", c.latency.Microseconds()))
+		if c.jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", c.jitter.Microseconds()))
+		}
+	}
+	if c.lossPercent > 0 {
+		args = append(args, "loss", strconv.FormatFloat(c.lossPercent, 'f', -1, 64)+"%")
+	}
+	if c.bitsPerSecond > 0 {
+		args = append(args, "rate", fmt.Sprintf("%dbit", c.bitsPerSecond))
+	}
+	return args
+}
+
+// netemArgs returns command that applies the config to every network device of the network namespace but loopback,
+// so runnables attached to multiple networks are affected on all of them.
+func (c netemConfig) netemArgs() []string {
+	return []string{"sh", "-c", fmt.Sprintf(
+		`set -e; for dev in $(ip -o link show | cut -d: -f2 | cut -d@ -f1); do [ "$dev" = lo ] || %s; done`,
+		strings.Join(c.tcArgs(`"$dev"`), " "),
+	)}
+}
+
+// iptablesDropArgs returns iptables command that adds (action "-A") or deletes (action "-D") rules dropping
+// all incoming traffic from the given IP addresses. Dropping incoming traffic on both sides is enough to partition
+// two runnables, also when they talk through addresses translated outside their network namespaces.
+func iptablesDropArgs(action string, sourceIPs []string) []string {
+	return []string{"iptables", action, "INPUT", "-s", strings.Join(sourceIPs, ","), "-j", "DROP"}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestNetemConfig_TcArgs(t *testing.T) {
+	for _, tcase := range []struct {
+		c        netemConfig
+		expected string
+	}{
+		{expected: "tc qdisc del dev eth0 root"},
+		{c: netemConfig{latency: 100 * time.Millisecond}, expected: "tc qdisc replace dev eth0 root netem delay 100000us"},
+		{c: netemConfig{latency: 100 * time.Millisecond, jitter: 1500 * time.Microsecond}, expected: "tc qdisc replace dev eth0 root netem delay 100000us 1500us"},
+		{c: netemConfig{lossPercent: 12.5}, expected: "tc qdisc replace dev eth0 root netem loss 12.5%"},
+		{c: netemConfig{bitsPerSecond: 1e6}, expected: "tc qdisc replace dev eth0 root netem rate 1000000bit"},
+		{
+			c:        netemConfig{latency: time.Second, lossPercent: 1, bitsPerSecond: 8},
+			expected: "tc qdisc replace dev eth0 root netem delay 1000000us loss 1% rate 8bit",
+		},
+	} {
+		t.Run(tcase.expected, func(t *testing.T) {
+			testutil.Equals(t, tcase.expected, strings.Join(tcase.c.tcArgs("eth0"), " "))
+		})
+	}
+}
+
+func TestNetemConfig_NetemArgs(t *testing.T) {
+	args := netemConfig{lossPercent: 1}.netemArgs()
+	testutil.Equals(t, 3, len(args))
+	testutil.Equals(t, []string{"sh", "-c"}, args[:2])
+	testutil.Equals(t, `set -e; for dev in $(ip -o link show | cut -d: -f2 | cut -d@ -f1); do [ "$dev" = lo ] || tc qdisc replace dev "$dev" root netem loss 1%; done`, args[2])
+}
+
+func TestIptablesDropArgs(t *testing.T) {
+	testutil.Equals(t, "iptables -A INPUT -s 172.18.0.2 -j DROP", strings.Join(iptablesDropArgs("-A", []string{"172.18.0.2"}), " "))
+	testutil.Equals(t, "iptables -D INPUT -s 172.18.0.2,172.19.0.3 -j DROP", strings.Join(iptablesDropArgs("-D", []string{"172.18.0.2", "172.19.0.3"}), " "))
+}
+
+func TestFault_Heal(t *testing.T) {
+	healed := 0
+	f := newFault(func() error {
+		healed++
+		return errors.New("heal failed")
+	})
+	testutil.NotOk(t, f.Heal())
+	testutil.NotOk(t, f.Heal())
+	testutil.Equals(t, 1, healed)
+}
@@ -0,0 +1,366 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+// Package e2ecompose allows to reuse docker compose files (e.g. the ones projects ship for local development)
+// in e2e scenarios, by loading their services as e2e runnables.
+package e2ecompose
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/e2e"
+	e2emon "github.com/efficientgo/e2e/monitoring"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// MetricsPortName is the name of the port (see long syntax of compose ports), that makes the service
+	// wrapped with e2emon.AsInstrumented.
+	MetricsPortName = "metrics"
+	// MetricsPathLabel is the service label that overrides metrics path of the instrumented service.
+	MetricsPathLabel = "e2e.metrics-path"
+)
+
+// Project represents services loaded from the compose file.
+type Project struct {
+	runnables []e2e.Runnable
+	byName    map[string]e2e.Runnable
+}
+
+// Runnables returns runnable for every service, ordered so that services are after services they depend on.
+func (p *Project) Runnables() []e2e.Runnable {
+	return p.runnables
+}
+
+// Runnable returns runnable of the given service or nil if there is no such service.
+func (p *Project) Runnable(service string) e2e.Runnable {
+	return p.byName[service]
+}
+
+// Load parses docker compose file at the given path and initializes runnable named after every service in it,
+// in the given environment. Supported are the most common service fields:
+//
+//   - image, entrypoint, command, environment, user, privileged, cap_add, stop_signal, stop_grace_period.
+//   - volumes in short syntax. Relative host paths are resolved against the compose file directory. Named volumes
+//     (e.g. `data:/var/lib/data`) are mapped to e2e.StartOptions.NamedVolumes, so they are scoped to the environment.
+//   - build (context, dockerfile and args), mapped to RunnableBuilder.WithBuild. Relative context is resolved against
+//     the compose file directory. Other build options (e.g. target or cache_from) are ignored.
+//   - ports, either TCP or UDP. Host ports are always random, use Runnable.Endpoint to access the service. Ports are
+//     named after the target port (e.g. Endpoint("8080")), unless they are named using the long syntax, which is
+//     needed for the same target port with both protocols. Services with port named MetricsPortName are wrapped with
+//     e2emon.AsInstrumented (see also MetricsPathLabel).
+//   - depends_on, mapped to RunnableBuilder.DependsOn, so e2e.StartAndWaitReady starts services in the right order.
+//     Conditions are ignored: services always wait for their dependencies to be ready.
+//   - healthcheck, mapped to e2e.CmdReadinessProbe. Its interval is used as the readiness backoff.
+//
+// Variables in form of $VAR, ${VAR}, ${VAR:-default} and ${VAR-default} are interpolated from the environment
+// of the test process.
+func Load(env e2e.Environment, path string) (*Project, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read compose file")
+	}
+
+	var f file
+	if err := yaml.Unmarshal([]byte(interpolate(string(b), os.LookupEnv)), &f); err != nil {
+		return nil, errors.Wrapf(err, "parse compose file %s", path)
+	}
+	order, err := startOrder(f.Services)
+	if err != nil {
+		return nil, errors.Wrapf(err, "compose file %s", path)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Project{byName: map[string]e2e.Runnable{}}
+	for _, name := range order {
+		r, err := f.Services[name].runnable(env, name, dir, p.byName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "service %s", name)
+		}
+		p.runnables = append(p.runnables, r)
+		p.byName[name] = r
+	}
+	return p, nil
+}
+
+type file struct {
+	Services map[string]service `yaml:"services"`
+}
+
+type service struct {
+	Image           string       `yaml:"image"`
+	Build           *build       `yaml:"build"`
+	Entrypoint      shellCommand `yaml:"entrypoint"`
+	Command         shellCommand `yaml:"command"`
+	Environment     mapOrList    `yaml:"environment"`
+	Labels          mapOrList    `yaml:"labels"`
+	User            string       `yaml:"user"`
+	Privileged      bool         `yaml:"privileged"`
+	CapAdd          []string     `yaml:"cap_add"`
+	Volumes         []string     `yaml:"volumes"`
+	Ports           []port       `yaml:"ports"`
+	DependsOn       dependsOn    `yaml:"depends_on"`
+	Healthcheck     *healthcheck `yaml:"healthcheck"`
+	StopSignal      string       `yaml:"stop_signal"`
+	StopGracePeriod string       `yaml:"stop_grace_period"`
+}
+
+type healthcheck struct {
+	Test     shellCommand `yaml:"test"`
+	Interval string       `yaml:"interval"`
+	Retries  int          `yaml:"retries"`
+	Disable  bool         `yaml:"disable"`
+}
+
+func (s service) runnable(env e2e.Environment, name, dir string, started map[string]e2e.Runnable) (e2e.Runnable, error) {
+	ports := map[string]e2e.PortSpec{}
+	for _, p := range s.Ports {
+		if _, ok := ports[p.Name]; ok {
+			return nil, errors.Newf("port %s declared more than once", p.Name)
+		}
+		ports[p.Name] = e2e.PortSpec{Port: p.Target, Protocol: p.Protocol}
+	}
+
+	b := env.Runnable(name).WithPortSpecs(ports)
+	if s.Build != nil {
+		b = b.WithBuild(s.Build.contextDir(dir), s.Build.Dockerfile, s.Build.Args)
+	}
+	for _, d := range s.DependsOn {
+		b = b.DependsOn(started[d])
+	}
+
+	opts := e2e.StartOptions{
+		Image:      s.Image,
+		EnvVars:    s.Environment,
+		User:       s.User,
+		Privileged: s.Privileged,
+		Command:    command(s.Entrypoint, s.Command),
+	}
+	for _, c := range s.CapAdd {
+		opts.Capabilities = append(opts.Capabilities, e2e.RunnableCapabilities(c))
+	}
+	for _, v := range s.Volumes {
+		volume, target, ok, err := namedVolume(v)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			opts.Volumes = append(opts.Volumes, resolveVolume(v, dir))
+			continue
+		}
+		if opts.NamedVolumes == nil {
+			opts.NamedVolumes = map[string]string{}
+		}
+		opts.NamedVolumes[target] = volume
+	}
+	if s.StopSignal != "" {
+		sig, err := parseSignal(s.StopSignal)
+		if err != nil {
+			return nil, err
+		}
+		opts.StopSignal = sig
+	}
+	if s.StopGracePeriod != "" {
+		d, err := time.ParseDuration(s.StopGracePeriod)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse stop_grace_period")
+		}
+		opts.StopGracePeriod = d
+	}
+	if err := s.Healthcheck.apply(&opts); err != nil {
+		return nil, err
+	}
+
+	r := b.Init(opts)
+	if _, ok := ports[MetricsPortName]; ok {
+		var instrOpts []e2emon.InstrumentedOption
+		if path, ok := s.Labels[MetricsPathLabel]; ok {
+			instrOpts = append(instrOpts, e2emon.WithInstrumentedMetricPath(path))
+		}
+		return e2emon.AsInstrumented(r, MetricsPortName, instrOpts...), nil
+	}
+	return r, nil
+}
+
+// command returns e2e command equivalent to compose entrypoint and command.
+func command(entrypoint, cmd shellCommand) e2e.Command {
+	if len(entrypoint) > 0 {
+		return e2e.NewCommandWithoutEntrypoint(entrypoint[0], append(entrypoint[1:], cmd...)...)
+	}
+	if len(cmd) > 0 {
+		return e2e.NewCommand(cmd[0], cmd[1:]...)
+	}
+	return e2e.Command{}
+}
+
+func (h *healthcheck) apply(opts *e2e.StartOptions) error {
+	if h == nil || h.Disable || len(h.Test) == 0 {
+		return nil
+	}
+
+	var cmd e2e.Command
+	switch h.Test[0] {
+	case "NONE":
+		return nil
+	case "CMD":
+		if len(h.Test) < 2 {
+			return errors.New("healthcheck test CMD requires command")
+		}
+		cmd = e2e.NewCommand(h.Test[1], h.Test[2:]...)
+	case "CMD-SHELL":
+		cmd = e2e.NewCommand("sh", "-c", strings.Join(h.Test[1:], " "))
+	default:
+		// String form is run with shell.
+		cmd = e2e.NewCommand("sh", "-c", strings.Join(h.Test, " "))
+	}
+	opts.Readiness = e2e.NewCmdReadinessProbe(cmd)
+
+	if h.Interval != "" {
+		interval, err := time.ParseDuration(h.Interval)
+		if err != nil {
+			return errors.Wrap(err, "parse healthcheck interval")
+		}
+		retries := 50
+		if h.Retries > 0 {
+			retries = h.Retries
+		}
+		opts.WaitReadyBackoff = &backoff.Config{Min: interval, Max: interval, MaxRetries: retries}
+	}
+	return nil
+}
+
+// resolveVolume resolves relative host path of the short syntax volume against the given dir.
+func resolveVolume(v, dir string) string {
+	if strings.HasPrefix(v, "./") || strings.HasPrefix(v, "../") || v == "." || strings.HasPrefix(v, ".:") {
+		hostPath, rest, _ := strings.Cut(v, ":")
+		resolved := filepath.Join(dir, hostPath)
+		if rest != "" {
+			resolved += ":" + rest
+		}
+		return resolved
+	}
+	return v
+}
+
+// namedVolume returns name of the volume and its container path, if the short syntax volume refers to named volume
+// rather than host path.
+func namedVolume(v string) (name, target string, ok bool, err error) {
+	source, rest, hasTarget := strings.Cut(v, ":")
+	if !hasTarget || source == "" || strings.HasPrefix(source, "/") || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "~") {
+		return "", "", false, nil
+	}
+	target, mode, _ := strings.Cut(rest, ":")
+	if mode != "" && mode != "rw" {
+		return "", "", false, errors.Newf("volume %s: mode %s is not supported for named volumes", v, mode)
+	}
+	return source, target, true, nil
+}
+
+// startOrder returns service names ordered so that every service is after all of its dependencies.
+// Independent services are ordered by name.
+func startOrder(services map[string]service) ([]string, error) {
+	names := make([]string, 0, len(services))
+	for name, s := range services {
+		for _, d := range s.DependsOn {
+			if _, ok := services[d]; !ok {
+				return nil, errors.Newf("service %s depends on undefined service %s", name, d)
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		order    []string
+		visiting = map[string]bool{}
+		visited  = map[string]bool{}
+		visit    func(name string, path []string) error
+	)
+	visit = func(name string, path []string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return errors.Newf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		}
+		visiting[name] = true
+
+		deps := append([]string{}, services[name].DependsOn...)
+		sort.Strings(deps)
+		for _, d := range deps {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visited[name] = true
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+var interpolationPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// interpolate replaces variables in the compose file content with values returned by lookup.
+func interpolate(s string, lookup func(string) (string, bool)) string {
+	return interpolationPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := interpolationPattern.FindStringSubmatch(m)
+		if sub[4] != "" {
+			v, _ := lookup(sub[4])
+			return v
+		}
+
+		v, ok := lookup(sub[1])
+		switch sub[2] {
+		case ":-":
+			if v == "" {
+				return sub[3]
+			}
+		case "-":
+			if !ok {
+				return sub[3]
+			}
+		}
+		return v
+	})
+}
+
+// signals contains stop signals that can be referred to by name. Other signals have to be specified by number.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func parseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signals[strings.ToUpper(s)]; ok {
+		return sig, nil
+	}
+	return 0, errors.Newf("unsupported stop_signal %q", s)
+}
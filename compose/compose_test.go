@@ -0,0 +1,233 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2ecompose
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/efficientgo/e2e"
+	e2emon "github.com/efficientgo/e2e/monitoring"
+	"gopkg.in/yaml.v2"
+)
+
+const testComposeFile = `
+services:
+  app:
+    image: alpine:3.16
+    entrypoint: ["sh", "-c"]
+    command: ["echo ${GREETING:-hello} $$MODE && exec sleep 1000"]
+    environment:
+      - MODE=test
+    ports:
+      - "8080:80"
+      - name: metrics
+        target: 9090
+    labels:
+      e2e.metrics-path: /custom
+    depends_on:
+      db:
+        condition: service_healthy
+    stop_grace_period: 1s
+  db:
+    image: alpine:3.16
+    command: sh -c 'touch ready && exec sleep 1000'
+    healthcheck:
+      test: ["CMD", "test", "-f", "ready"]
+      interval: 100ms
+    stop_signal: SIGKILL
+  worker:
+    image: alpine:3.16
+    command: ["sleep", "1000"]
+    depends_on: [app, db]
+`
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "docker-compose.yml")
+	testutil.Ok(t, os.WriteFile(path, []byte(testComposeFile), os.ModePerm))
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	p, err := Load(e, path)
+	testutil.Ok(t, err)
+
+	var names []string
+	for _, r := range p.Runnables() {
+		names = append(names, r.Name())
+	}
+	testutil.Equals(t, []string{"db", "app", "worker"}, names)
+	testutil.Assert(t, p.Runnable("missing") == nil)
+
+	app, ok := p.Runnable("app").(*e2emon.InstrumentedRunnable)
+	testutil.Assert(t, ok, "expected app to be instrumented")
+	testutil.Equals(t, "/custom", app.MetricTargets()[0].MetricPath)
+	testutil.Assert(t, app.InternalEndpoint("80") != "")
+	_, ok = p.Runnable("db").(*e2emon.InstrumentedRunnable)
+	testutil.Assert(t, !ok)
+
+	testutil.Ok(t, e2e.StartAndWaitReady(p.Runnables()...))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	_, err = app.WaitLogLine(ctx, regexp.MustCompile("^hello test$"))
+	testutil.Ok(t, err)
+
+	for _, r := range p.Runnables() {
+		testutil.Ok(t, r.Stop())
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	for _, tcase := range []struct {
+		name    string
+		compose string
+		err     string
+	}{
+		{
+			name:    "cycle",
+			compose: "services:\n  a:\n    depends_on: [b]\n  b:\n    depends_on: [a]\n",
+			err:     "dependency cycle: a -> b -> a",
+		},
+		{
+			name:    "undefined dependency",
+			compose: "services:\n  a:\n    depends_on: [b]\n",
+			err:     "service a depends on undefined service b",
+		},
+		{
+			name:    "port range",
+			compose: "services:\n  a:\n    ports: ['8000-8010:8000-8010']\n",
+			err:     "ranges are not supported",
+		},
+		{
+			name:    "sctp port",
+			compose: "services:\n  a:\n    ports: ['53:53/sctp']\n",
+			err:     "unsupported protocol sctp",
+		},
+		{
+			name:    "same port with both protocols",
+			compose: "services:\n  a:\n    ports: ['53:53/tcp', '53:53/udp']\n",
+			err:     "port 53 declared more than once",
+		},
+		{
+			name:    "read-only named volume",
+			compose: "services:\n  a:\n    volumes: ['data:/data:ro']\n",
+			err:     "mode ro is not supported for named volumes",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "docker-compose.yml")
+			testutil.Ok(t, os.WriteFile(path, []byte(tcase.compose), os.ModePerm))
+
+			_, err := Load(e, path)
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.Contains(err.Error(), tcase.err), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestLoad_Build(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "docker-compose.yml")
+	testutil.Ok(t, os.WriteFile(path, []byte("services:\n  app:\n    build: .\n"), os.ModePerm))
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	// Build section is not ignored, but passed to the environment, which can't build images.
+	p, err := Load(e, path)
+	testutil.Ok(t, err)
+	err = p.Runnable("app").BuildErr()
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "can't be built from Dockerfile"), "unexpected error %v", err)
+}
+
+func TestService(t *testing.T) {
+	var s service
+	testutil.Ok(t, yaml.Unmarshal([]byte(`
+entrypoint: /bin/server --config="/etc/server config.yml"
+command: [--verbose]
+environment:
+  PORT: 80
+  EMPTY:
+ports: [80, "127.0.0.1:8080:8080/tcp", "8125:8125/udp", {target: 53, protocol: udp, name: dns}]
+volumes: ["./data:/data:ro", "cache:/cache", "/var/run/docker.sock:/var/run/docker.sock"]
+stop_signal: "15"
+`), &s))
+
+	testutil.Equals(t, e2e.NewCommandWithoutEntrypoint("/bin/server", "--config=/etc/server config.yml", "--verbose"), command(s.Entrypoint, s.Command))
+	testutil.Equals(t, mapOrList{"PORT": "80", "EMPTY": ""}, s.Environment)
+	testutil.Equals(t, []port{
+		{Name: "80", Target: 80},
+		{Name: "8080", Target: 8080},
+		{Name: "8125", Target: 8125, Protocol: e2e.UDP},
+		{Name: "dns", Target: 53, Protocol: e2e.UDP},
+	}, s.Ports)
+	testutil.Equals(t, "/compose/data:/data:ro", resolveVolume(s.Volumes[0], "/compose"))
+
+	for i, expected := range []struct {
+		name, target string
+		ok           bool
+	}{{}, {name: "cache", target: "/cache", ok: true}, {}} {
+		name, target, ok, err := namedVolume(s.Volumes[i])
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected.ok, ok, "volume %s", s.Volumes[i])
+		testutil.Equals(t, expected.name, name)
+		testutil.Equals(t, expected.target, target)
+	}
+
+	sig, err := parseSignal(s.StopSignal)
+	testutil.Ok(t, err)
+	testutil.Equals(t, syscall.SIGTERM, sig)
+
+	testutil.Ok(t, yaml.Unmarshal([]byte(`build: ./app`), &s))
+	testutil.Equals(t, &build{Context: "./app"}, s.Build)
+	testutil.Equals(t, "/compose/app", s.Build.contextDir("/compose"))
+
+	testutil.Ok(t, yaml.Unmarshal([]byte(`
+build:
+  context: /src
+  dockerfile: build/Dockerfile
+  args: [VERSION=1.0]
+`), &s))
+	testutil.Equals(t, &build{Context: "/src", Dockerfile: "build/Dockerfile", Args: mapOrList{"VERSION": "1.0"}}, s.Build)
+	testutil.Equals(t, "/src", s.Build.contextDir("/compose"))
+	testutil.Equals(t, "/compose", (&build{}).contextDir("/compose"))
+}
+
+func TestInterpolate(t *testing.T) {
+	lookup := func(k string) (string, bool) {
+		v, ok := map[string]string{"SET": "value", "EMPTY": ""}[k]
+		return v, ok
+	}
+	for in, expected := range map[string]string{
+		"$SET ${SET}":                   "value value",
+		"${EMPTY:-default} ${EMPTY-x}":  "default ",
+		"${UNSET-default} ${UNSET}":     "default ",
+		"$$SET $${SET}":                 "$SET ${SET}",
+		"no variables":                  "no variables",
+		"${SET:-default}/${UNSET:-a/b}": "value/a/b",
+	} {
+		testutil.Equals(t, expected, interpolate(in, lookup), "input %q", in)
+	}
+}
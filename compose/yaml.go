@@ -0,0 +1,234 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2ecompose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/e2e"
+)
+
+// shellCommand is compose command, that can be either a list or a string split like shell would.
+type shellCommand []string
+
+func (c *shellCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*c = list
+		return nil
+	}
+
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	words, err := splitWords(s)
+	if err != nil {
+		return err
+	}
+	*c = words
+	return nil
+}
+
+// splitWords splits string into words separated by white spaces, respecting single and double quotes.
+func splitWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			word.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.Newf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// mapOrList is compose mapping, that can be either a map or a list of KEY=VALUE items.
+type mapOrList map[string]string
+
+func (m *mapOrList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = mapOrList{}
+
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		for _, kv := range list {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				// Like in compose, variable without value is taken from the environment.
+				v = os.Getenv(k)
+			}
+			(*m)[k] = v
+		}
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		if v == nil {
+			(*m)[k] = ""
+			continue
+		}
+		(*m)[k] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+// port is compose port in either short ("[host_ip:][host_port:]container_port[/protocol]") or long syntax.
+type port struct {
+	Name   string
+	Target int
+	// Protocol is empty for TCP ports.
+	Protocol e2e.Protocol
+}
+
+// portProtocol returns protocol of the compose port, which is either tcp or udp.
+func portProtocol(proto string) (e2e.Protocol, error) {
+	switch proto {
+	case "", "tcp":
+		return "", nil
+	case "udp":
+		return e2e.UDP, nil
+	default:
+		return "", errors.Newf("unsupported protocol %s", proto)
+	}
+}
+
+func (p *port) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var long struct {
+		Name     string `yaml:"name"`
+		Target   int    `yaml:"target"`
+		Protocol string `yaml:"protocol"`
+	}
+	if err := unmarshal(&long); err == nil {
+		proto, err := portProtocol(long.Protocol)
+		if err != nil {
+			return errors.Wrapf(err, "port %d", long.Target)
+		}
+		if long.Target <= 0 {
+			return errors.New("port target is required")
+		}
+		p.Target = long.Target
+		p.Protocol = proto
+		p.Name = long.Name
+		if p.Name == "" {
+			p.Name = strconv.Itoa(long.Target)
+		}
+		return nil
+	}
+
+	var short string
+	if err := unmarshal(&short); err != nil {
+		return err
+	}
+	spec, protoName, _ := strings.Cut(short, "/")
+	proto, err := portProtocol(protoName)
+	if err != nil {
+		return errors.Wrapf(err, "port %s", short)
+	}
+	target := spec[strings.LastIndex(spec, ":")+1:]
+	n, err := strconv.Atoi(target)
+	if err != nil {
+		return errors.Newf("port %s: unsupported container port %s; ranges are not supported", short, target)
+	}
+	p.Target = n
+	p.Name = target
+	p.Protocol = proto
+	return nil
+}
+
+// dependsOn is a list of service dependencies, specified either as a list or a map with conditions.
+type dependsOn []string
+
+func (d *dependsOn) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*d = list
+		return nil
+	}
+
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*d = (*d)[:0]
+	for name := range raw {
+		*d = append(*d, name)
+	}
+	sort.Strings(*d)
+	return nil
+}
+
+// build is compose build section, that can be either a context path or a map.
+type build struct {
+	Context    string    `yaml:"context"`
+	Dockerfile string    `yaml:"dockerfile"`
+	Args       mapOrList `yaml:"args"`
+}
+
+func (b *build) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var context string
+	if err := unmarshal(&context); err == nil {
+		*b = build{Context: context}
+		return nil
+	}
+
+	// Type without the method avoids unmarshalling recursively.
+	type long build
+	var l long
+	if err := unmarshal(&l); err != nil {
+		return err
+	}
+	*b = build(l)
+	return nil
+}
+
+// contextDir returns build context resolved against the given dir. Like in compose, context defaults to the dir.
+func (b *build) contextDir(dir string) string {
+	if filepath.IsAbs(b.Context) {
+		return b.Context
+	}
+	return filepath.Join(dir, b.Context)
+}
@@ -0,0 +1,136 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// hostCopyDestination returns the host path src is copied to, when copied to dst. Like with `cp`, it's copied into dst
+// if dst is an existing directory, or as dst otherwise.
+func hostCopyDestination(src, dst string) string {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		return filepath.Join(dst, filepath.Base(src))
+	}
+	return dst
+}
+
+// copyHostPath copies host file or directory src to dst, with `cp -r` semantics.
+func copyHostPath(src, dst string) error {
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(writeTar(pw, src, filepath.Base(src))) }()
+
+	err := extractTar(pr, hostCopyDestination(src, dst))
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+// writeTar writes tar archive of host file or directory src (recursively) to w. The root entry is named name.
+func writeTar(w io.Writer, src, name string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "archive %s", src)
+	}
+	return tw.Close()
+}
+
+// extractTar extracts tar archive with single root entry (file or directory) from r to host path dst. The root entry
+// is extracted as dst, regardless of its name in the archive.
+func extractTar(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read archive")
+		}
+
+		// Replace the root entry with dst, so e.g. `data/a/b` is extracted to `<dst>/a/b`.
+		name := strings.Trim(path.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+		target := dst
+		if _, rel, ok := strings.Cut(name, "/"); ok {
+			target = filepath.Join(dst, filepath.FromSlash(rel))
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				_ = f.Close()
+				return errors.Wrapf(err, "extract %s", hdr.Name)
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			_ = os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, FIFOs and hard links are not needed in tests, skip them.
+		}
+	}
+}
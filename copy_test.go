@@ -0,0 +1,79 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestCopyHostPath(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "conf")
+	testutil.Ok(t, os.MkdirAll(filepath.Join(src, "rules"), 0750))
+	testutil.Ok(t, os.WriteFile(filepath.Join(src, "config.yaml"), []byte("a: 1"), 0600))
+	testutil.Ok(t, os.WriteFile(filepath.Join(src, "rules", "run.sh"), []byte("#!/bin/sh"), 0700))
+	testutil.Ok(t, os.Symlink("config.yaml", filepath.Join(src, "link.yaml")))
+
+	assertCopied := func(t *testing.T, dst string) {
+		t.Helper()
+
+		b, err := os.ReadFile(filepath.Join(dst, "config.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+
+		fi, err := os.Stat(filepath.Join(dst, "rules", "run.sh"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, os.FileMode(0700), fi.Mode().Perm())
+
+		link, err := os.Readlink(filepath.Join(dst, "link.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "config.yaml", link)
+	}
+
+	t.Run("as non-existing path", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "copied")
+		testutil.Ok(t, copyHostPath(src, dst))
+		assertCopied(t, dst)
+	})
+	t.Run("into existing directory", func(t *testing.T) {
+		dst := t.TempDir()
+		testutil.Ok(t, copyHostPath(src, dst))
+		assertCopied(t, filepath.Join(dst, "conf"))
+	})
+	t.Run("single file", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "c.yaml")
+		testutil.Ok(t, copyHostPath(filepath.Join(src, "config.yaml"), dst))
+		b, err := os.ReadFile(dst)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+	})
+	t.Run("missing source", func(t *testing.T) {
+		testutil.NotOk(t, copyHostPath(filepath.Join(src, "missing"), t.TempDir()))
+	})
+}
+
+func TestExtractTar_OutsideOfDestination(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	testutil.Ok(t, tw.WriteHeader(&tar.Header{Name: "data/../../../escaped", Mode: 0600, Size: 2, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("hi"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, tw.Close())
+
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "a", "b")
+	testutil.Ok(t, extractTar(&buf, dst))
+
+	// Path is cleaned as if it was absolute, so it can't escape the destination.
+	_, err = os.Stat(filepath.Join(dir, "escaped"))
+	testutil.Assert(t, os.IsNotExist(err))
+	b, err := os.ReadFile(dst)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hi", string(b))
+}
@@ -258,7 +258,8 @@ func NewAzuriteBlobStorage(env e2e.Environment, name string, opts ...Option) *e2
 	}), "blob")
 }
 
-// NewAzuriteBlobStorageWriter starts a container with azure CLI, to write data into azurite blob storage.
+// NewAzuriteBlobStorageWriter returns a job with azure CLI, that writes data into azurite blob storage. Use Wait to
+// wait until all data is written.
 // This is needed, since Azurite doesn't support copying over dirs, but encodes into https://github.com/techfort/LokiJS db.
 func NewAzuriteBlobStorageWriter(env e2e.Environment, name, containerName, tempDataDir string, opts ...Option) e2e.Runnable {
 	o := options{image: "mcr.microsoft.com/azure-cli:latest", azuriteOptions: azuriteOptions{
@@ -291,6 +292,7 @@ func NewAzuriteBlobStorageWriter(env e2e.Environment, name, containerName, tempD
 			command,
 		),
 		Volumes: []string{tempDataDir + ":/shared"},
+		Job:     true,
 	})
 }
 
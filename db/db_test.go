@@ -38,3 +38,15 @@ func TestMinio(t *testing.T) {
 		minioClient.MakeBucket(context.Background(), "test-bucket", minio.MakeBucketOptions{}),
 	)
 }
+
+func TestThanosSidecar_DependsOnPrometheus(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	prom := e.Runnable("prometheus").WithPorts(map[string]int{AccessPortName: 9090}).Future()
+	sidecar := NewThanosSidecar(e, "sidecar", prom)
+	testutil.Equals(t, []e2e.Linkable{prom}, sidecar.Dependencies())
+}
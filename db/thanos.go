@@ -69,7 +69,7 @@ func NewThanosSidecar(env e2e.Environment, name string, prom e2e.Linkable, opts
 		args = e2e.MergeFlagsWithoutRemovingEmpty(args, o.flagOverride)
 	}
 
-	return e2eobs.AsObservable(env.Runnable(name).WithPorts(ports).Init(e2e.StartOptions{
+	return e2eobs.AsObservable(env.Runnable(name).WithPorts(ports).DependsOn(prom).Init(e2e.StartOptions{
 		Image:     o.image,
 		Command:   e2e.NewCommand("sidecar", e2e.BuildKingpinArgs(args)...),
 		Readiness: e2e.NewHTTPReadinessProbe("http", "/-/ready", 200, 200),
@@ -0,0 +1,1010 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// DockerAPIError is returned by DockerEnvironment using Docker Engine API (see WithDockerEngineAPI),
+// when the engine responds with an error.
+type DockerAPIError struct {
+	// StatusCode is the HTTP status code of the response, e.g. http.StatusNotFound when container,
+	// network or image does not exist and http.StatusConflict when it is in the wrong state.
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerAPIError) Error() string {
+	return fmt.Sprintf("docker engine API: %s (status %d)", e.Message, e.StatusCode)
+}
+
+func isDockerNotFound(err error) bool {
+	var apiErr *DockerAPIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// ignoreNotModified returns nil if the engine replied with 304 Not Modified, which it does when the container is already
+// in the requested state (e.g. stopping container that has exited already).
+func ignoreNotModified(err error) error {
+	var apiErr *DockerAPIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	return err
+}
+
+// dockerSocketPath returns the Unix socket path of Docker Engine API from DOCKER_HOST or the default one.
+func dockerSocketPath() string {
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return defaultDockerSocket
+}
+
+// dockerAPI is dockerBackend talking to Docker Engine API over the Unix socket.
+type dockerAPI struct {
+	socket  string
+	client  *http.Client
+	logger  Logger
+	verbose bool
+
+	// followersMtx guards followers, which maps names of containers to cancel functions of their log followers.
+	followersMtx sync.Mutex
+	followers    map[string]context.CancelFunc
+}
+
+func newDockerAPI(socket string, logger Logger, verbose bool) *dockerAPI {
+	a := &dockerAPI{socket: socket, logger: logger, verbose: verbose, followers: map[string]context.CancelFunc{}}
+	a.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return a.dial(ctx) },
+	}}
+	return a
+}
+
+func (a *dockerAPI) dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", a.socket)
+}
+
+func (a *dockerAPI) newRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	var (
+		r           io.Reader
+		contentType string
+	)
+	switch b := body.(type) {
+	case nil:
+	case io.Reader:
+		// Raw bodies are only used to upload tar archives.
+		r, contentType = b, "application/x-tar"
+	default:
+		j, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "marshal body of %s %s", method, path)
+		}
+		r, contentType = bytes.NewReader(j), "application/json"
+	}
+
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if a.verbose {
+		a.logger.Log("dockerEnv:", method, u)
+	}
+	return req, nil
+}
+
+// do sends the request and returns the response if it was successful. Caller has to close the response body.
+func (a *dockerAPI) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	req, err := a.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s", method, path)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, apiError(resp)
+	}
+	return resp, nil
+}
+
+// call sends the request and decodes JSON response into out, unless it's nil.
+func (a *dockerAPI) call(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	resp, err := a.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(out), "decode response of %s %s", method, path)
+}
+
+func apiError(resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	var msg struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(b, &msg); err != nil || msg.Message == "" {
+		msg.Message = strings.TrimSpace(string(b))
+	}
+	return &DockerAPIError{StatusCode: resp.StatusCode, Message: msg.Message}
+}
+
+func dockerFilters(filters map[string][]string) url.Values {
+	b, _ := json.Marshal(filters)
+	return url.Values{"filters": []string{string(b)}}
+}
+
+func (a *dockerAPI) createNetwork(ctx context.Context, spec dockerNetworkSpec) error {
+	body := map[string]interface{}{
+		"Name":           spec.Name,
+		"Driver":         "bridge",
+		"CheckDuplicate": true,
+		"Internal":       spec.Internal,
+		"EnableIPv6":     spec.IPv6Subnet != "",
+	}
+	var ipam []map[string]string
+	for _, s := range []string{spec.Subnet, spec.IPv6Subnet} {
+		if s != "" {
+			ipam = append(ipam, map[string]string{"Subnet": s})
+		}
+	}
+	if len(ipam) > 0 {
+		body["IPAM"] = map[string]interface{}{"Config": ipam}
+	}
+	return a.call(ctx, http.MethodPost, "/networks/create", nil, body, nil)
+}
+
+func (a *dockerAPI) networkGateway(ctx context.Context, name string) (string, error) {
+	var network struct {
+		IPAM struct {
+			Config []struct {
+				Gateway string `json:"Gateway"`
+			} `json:"Config"`
+		} `json:"IPAM"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/networks/"+url.PathEscape(name), nil, nil, &network); err != nil {
+		return "", err
+	}
+	if len(network.IPAM.Config) != 1 {
+		return "", errors.Newf("unexpected network %s IPAM config; expected exactly one element, got %v", name, network.IPAM.Config)
+	}
+	return network.IPAM.Config[0].Gateway, nil
+}
+
+func (a *dockerAPI) networkExists(ctx context.Context, name string) (bool, error) {
+	err := a.call(ctx, http.MethodGet, "/networks/"+url.PathEscape(name), nil, nil, nil)
+	if isDockerNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (a *dockerAPI) removeNetwork(ctx context.Context, name string) error {
+	return a.call(ctx, http.MethodDelete, "/networks/"+url.PathEscape(name), nil, nil, nil)
+}
+
+func (a *dockerAPI) listVolumes(ctx context.Context, prefix string) ([]string, error) {
+	var resp struct {
+		Volumes []struct {
+			Name string `json:"Name"`
+		} `json:"Volumes"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/volumes", dockerFilters(map[string][]string{"name": {prefix}}), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, v := range resp.Volumes {
+		// Filter matches names containing the prefix anywhere.
+		if strings.HasPrefix(v.Name, prefix) {
+			names = append(names, v.Name)
+		}
+	}
+	return names, nil
+}
+
+func (a *dockerAPI) removeVolume(ctx context.Context, name string) error {
+	return a.call(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(name), url.Values{"force": []string{"1"}}, nil, nil)
+}
+
+func (a *dockerAPI) listContainers(ctx context.Context, network string) ([]string, error) {
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	q := dockerFilters(map[string][]string{"network": {network}})
+	q.Set("all", "1")
+	if err := a.call(ctx, http.MethodGet, "/containers/json", q, nil, &containers); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, c := range containers {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
+func (a *dockerAPI) imageExists(ctx context.Context, image string) (bool, error) {
+	err := a.call(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+	if isDockerNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (a *dockerAPI) pullImage(ctx context.Context, image string, progress io.Writer) error {
+	resp, err := a.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": []string{image}}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Pull errors are reported in the progress stream, after the successful response header.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Status   string `json:"status"`
+			ID       string `json:"id"`
+			Progress string `json:"progress"`
+			Error    string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "decode pull progress of %s", image)
+		}
+		if msg.Error != "" {
+			return &DockerAPIError{StatusCode: resp.StatusCode, Message: msg.Error}
+		}
+		line := strings.TrimSpace(strings.Join([]string{msg.ID, msg.Status, msg.Progress}, " "))
+		_, _ = fmt.Fprintln(progress, line)
+	}
+}
+
+func (a *dockerAPI) buildImage(ctx context.Context, b *imageBuild, tag string, progress io.Writer) error {
+	query := url.Values{"t": []string{tag}, "dockerfile": []string{filepath.ToSlash(b.dockerfile)}, "rm": []string{"1"}}
+	if len(b.args) > 0 {
+		args, err := json.Marshal(b.args)
+		if err != nil {
+			return err
+		}
+		query.Set("buildargs", string(args))
+	}
+
+	// Build context is uploaded as tar archive, with its content in the root.
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(writeTar(pw, b.contextDir, ".")) }()
+	defer pr.Close()
+	resp, err := a.do(ctx, http.MethodPost, "/build", query, pr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Build errors are reported in the progress stream, after the successful response header.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "decode build progress of %s", tag)
+		}
+		if msg.Error != "" {
+			return &DockerAPIError{StatusCode: resp.StatusCode, Message: msg.Error}
+		}
+		_, _ = io.WriteString(progress, msg.Stream)
+	}
+}
+
+func (a *dockerAPI) loadImage(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := a.do(ctx, http.MethodPost, "/images/load", url.Values{"quiet": []string{"1"}}, f)
+	if err != nil {
+		return errors.Wrapf(err, "load images from %s", path)
+	}
+	defer resp.Body.Close()
+
+	// Load errors are reported in the response stream, after the successful response header.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrapf(err, "decode load response of %s", path)
+		}
+		if msg.Error != "" {
+			return &DockerAPIError{StatusCode: resp.StatusCode, Message: msg.Error}
+		}
+	}
+}
+
+func (a *dockerAPI) saveImage(ctx context.Context, image, path string) error {
+	resp, err := a.do(ctx, http.MethodGet, "/images/"+image+"/get", nil, nil)
+	if err != nil {
+		return errors.Wrapf(err, "save image %s", image)
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "save image %s", image)
+	}
+	return f.Close()
+}
+
+// dockerCreateRequest is the body of the container create request.
+type dockerCreateRequest struct {
+	Hostname     string              `json:"Hostname,omitempty"`
+	User         string              `json:"User,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Image        string              `json:"Image"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	HostConfig   dockerHostConfig    `json:"HostConfig"`
+
+	// NetworkingConfig configures endpoint of the network in HostConfig.NetworkMode, if any.
+	NetworkingConfig *dockerNetworkingConfig `json:"NetworkingConfig,omitempty"`
+}
+
+type dockerNetworkingConfig struct {
+	EndpointsConfig map[string]dockerEndpointConfig `json:"EndpointsConfig"`
+}
+
+type dockerEndpointConfig struct {
+	Aliases    []string                  `json:"Aliases,omitempty"`
+	IPAMConfig *dockerEndpointIPAMConfig `json:"IPAMConfig,omitempty"`
+}
+
+type dockerEndpointIPAMConfig struct {
+	IPv4Address string `json:"IPv4Address,omitempty"`
+	IPv6Address string `json:"IPv6Address,omitempty"`
+}
+
+func newDockerEndpointConfig(e dockerNetworkEndpoint) dockerEndpointConfig {
+	c := dockerEndpointConfig{Aliases: e.Aliases}
+	if e.IPv4Address != "" || e.IPv6Address != "" {
+		c.IPAMConfig = &dockerEndpointIPAMConfig{IPv4Address: e.IPv4Address, IPv6Address: e.IPv6Address}
+	}
+	return c
+}
+
+type dockerHostConfig struct {
+	NetworkMode  string                         `json:"NetworkMode,omitempty"`
+	Binds        []string                       `json:"Binds,omitempty"`
+	Tmpfs        map[string]string              `json:"Tmpfs,omitempty"`
+	PortBindings map[string][]dockerHostBinding `json:"PortBindings,omitempty"`
+	AutoRemove   bool                           `json:"AutoRemove,omitempty"`
+	Privileged   bool                           `json:"Privileged,omitempty"`
+	CapAdd       []string                       `json:"CapAdd,omitempty"`
+	UsernsMode   string                         `json:"UsernsMode,omitempty"`
+	Memory       int64                          `json:"Memory,omitempty"`
+	NanoCPUs     int64                          `json:"NanoCpus,omitempty"`
+}
+
+type dockerHostBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+func newDockerCreateRequest(spec dockerContainerSpec) (dockerCreateRequest, error) {
+	req := dockerCreateRequest{
+		Hostname: spec.Hostname,
+		User:     spec.User,
+		Env:      spec.Env,
+		Cmd:      spec.Cmd,
+		Image:    spec.Image,
+		Labels:   spec.Labels,
+		HostConfig: dockerHostConfig{
+			NetworkMode: spec.NetworkMode,
+			Binds:       spec.Volumes,
+			AutoRemove:  spec.AutoRemove,
+			Privileged:  spec.Privileged,
+			CapAdd:      spec.Capabilities,
+			UsernsMode:  spec.UserNs,
+			Memory:      int64(spec.MemoryBytes),
+		},
+	}
+	for _, t := range spec.Tmpfs {
+		if req.HostConfig.Tmpfs == nil {
+			req.HostConfig.Tmpfs = map[string]string{}
+		}
+		req.HostConfig.Tmpfs[t] = ""
+	}
+	if spec.DisableEntrypoint {
+		// Same as `docker run --entrypoint ""`, which resets the entrypoint of the image.
+		req.Entrypoint = []string{""}
+	}
+	if spec.StopSignal != 0 {
+		req.StopSignal = strconv.Itoa(spec.StopSignal)
+	}
+	if spec.CPUs != "" {
+		cpus, err := strconv.ParseFloat(spec.CPUs, 64)
+		if err != nil {
+			return dockerCreateRequest{}, errors.Wrapf(err, "parse CPUs %q", spec.CPUs)
+		}
+		req.HostConfig.NanoCPUs = int64(cpus * 1e9)
+	}
+	if len(spec.Ports) > 0 {
+		req.ExposedPorts = map[string]struct{}{}
+		req.HostConfig.PortBindings = map[string][]dockerHostBinding{}
+	}
+	for _, p := range spec.Ports {
+		port := p.portKey()
+		req.ExposedPorts[port] = struct{}{}
+		b := dockerHostBinding{HostIP: p.HostIP}
+		if p.HostPort > 0 {
+			b.HostPort = strconv.Itoa(p.HostPort)
+		}
+		req.HostConfig.PortBindings[port] = []dockerHostBinding{b}
+	}
+	if e, ok := spec.primaryEndpoint(); ok {
+		req.NetworkingConfig = &dockerNetworkingConfig{
+			EndpointsConfig: map[string]dockerEndpointConfig{e.Network: newDockerEndpointConfig(e)},
+		}
+	}
+	return req, nil
+}
+
+// createContainer creates the container and returns its ID.
+func (a *dockerAPI) createContainer(ctx context.Context, spec dockerContainerSpec) (string, error) {
+	body, err := newDockerCreateRequest(spec)
+	if err != nil {
+		return "", err
+	}
+
+	var q url.Values
+	if spec.Name != "" {
+		q = url.Values{"name": []string{spec.Name}}
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := a.call(ctx, http.MethodPost, "/containers/create", q, body, &created); err != nil {
+		return "", errors.Wrapf(err, "create container %s", spec.Name)
+	}
+	return created.ID, nil
+}
+
+func (a *dockerAPI) startContainer(ctx context.Context, spec dockerContainerSpec, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	id, err := a.createContainer(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	// Container can be connected to the rest of networks only once it's created, but before it starts.
+	for _, e := range spec.extraEndpoints() {
+		if err := a.call(ctx, http.MethodPost, "/networks/"+url.PathEscape(e.Network)+"/connect", nil, map[string]interface{}{
+			"Container":      id,
+			"EndpointConfig": newDockerEndpointConfig(e),
+		}, nil); err != nil {
+			return nil, errors.Wrapf(err, "connect container %s to network %s", spec.Name, e.Network)
+		}
+	}
+	// Engine replies with 304 Not Modified, if the container is already started.
+	if err := ignoreNotModified(a.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)); err != nil {
+		return nil, errors.Wrapf(err, "start container %s", spec.Name)
+	}
+	// Logs are followed from the very beginning, so output written before the follower is attached is not lost.
+	return a.followLogs(id, spec.Name, url.Values{"since": []string{"0"}}, stdout, stderr)
+}
+
+func (a *dockerAPI) attachContainer(_ context.Context, name string, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	return a.followLogs(url.PathEscape(name), name, url.Values{"since": []string{strconv.FormatInt(time.Now().Unix(), 10)}}, stdout, stderr)
+}
+
+// followLogs streams logs of the container with the given ID until it exits or is removed with removeContainer.
+// Returned channel is closed once the container exited and all of its output was written.
+func (a *dockerAPI) followLogs(id, name string, query url.Values, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	query.Set("follow", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+
+	// Following logs lives as long as the container, so it can't be bound to the start context.
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := a.do(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil)
+	if err != nil {
+		cancel()
+		return nil, errors.Wrapf(err, "follow logs of container %s", name)
+	}
+
+	a.followersMtx.Lock()
+	if prev, ok := a.followers[name]; ok {
+		prev()
+	}
+	a.followers[name] = cancel
+	a.followersMtx.Unlock()
+
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		defer cancel()
+		defer resp.Body.Close()
+
+		if err := demuxDockerStream(resp.Body, stdout, stderr); err != nil && ctx.Err() == nil {
+			a.logger.Log("Failed to follow logs of container", name, "err:", err)
+		}
+	}()
+	return exited, nil
+}
+
+// stopFollowingLogs stops following logs of the removed container with the given name, in case the stream was not
+// closed by the engine, so the follower doesn't outlive the container.
+func (a *dockerAPI) stopFollowingLogs(name string) {
+	a.followersMtx.Lock()
+	defer a.followersMtx.Unlock()
+	if cancel, ok := a.followers[name]; ok {
+		cancel()
+		delete(a.followers, name)
+	}
+}
+
+func (a *dockerAPI) runContainer(ctx context.Context, spec dockerContainerSpec) (_ []byte, err error) {
+	autoRemove := spec.AutoRemove
+	// Remove container ourselves, so it's still there when we collect its logs.
+	spec.AutoRemove = false
+
+	id, err := a.createContainer(ctx, spec)
+	if isDockerNotFound(err) {
+		if err = a.pullImage(ctx, spec.Image, io.Discard); err != nil {
+			return nil, err
+		}
+		id, err = a.createContainer(ctx, spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if autoRemove {
+		defer func() {
+			if rerr := a.removeContainer(context.Background(), id, true); rerr != nil && err == nil {
+				err = rerr
+			}
+		}()
+	}
+
+	if err := a.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return nil, errors.Wrapf(err, "start container %s", spec.Name)
+	}
+	var waited struct {
+		StatusCode int `json:"StatusCode"`
+	}
+	if err := a.call(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil, &waited); err != nil {
+		return nil, errors.Wrapf(err, "wait for container %s", spec.Name)
+	}
+
+	resp, err := a.do(ctx, http.MethodGet, "/containers/"+id+"/logs", url.Values{"stdout": []string{"1"}, "stderr": []string{"1"}}, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "logs of container %s", spec.Name)
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	if err := demuxDockerStream(resp.Body, &out, &out); err != nil {
+		return out.Bytes(), errors.Wrapf(err, "read logs of container %s", spec.Name)
+	}
+	if waited.StatusCode != 0 {
+		return out.Bytes(), errors.Newf("container %s exited with code %d: %s", spec.Image, waited.StatusCode, strings.TrimSpace(out.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// waitStarted watches container events instead of polling the state.
+func (a *dockerAPI) waitStarted(ctx context.Context, name string, _ backoff.Config) (dockerContainerState, error) {
+	eventsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before checking the state, so we don't miss the event in between.
+	resp, err := a.do(eventsCtx, http.MethodGet, "/events", dockerFilters(map[string][]string{
+		"type":      {"container"},
+		"container": {name},
+		"event":     {"start", "die"},
+	}), nil)
+	if err != nil {
+		return dockerContainerState{}, errors.Wrap(err, "watch container events")
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		state, err := a.inspectState(ctx, name)
+		if err != nil {
+			return dockerContainerState{}, err
+		}
+		if state.running() || state.exited() {
+			return state, nil
+		}
+
+		var event struct {
+			Action string `json:"Action"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return state, ctx.Err()
+			}
+			return state, errors.Wrapf(err, "watch events of container %s", name)
+		}
+	}
+}
+
+func (a *dockerAPI) inspectState(ctx context.Context, name string) (dockerContainerState, error) {
+	var c struct {
+		State dockerContainerState `json:"State"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &c); err != nil {
+		return dockerContainerState{}, err
+	}
+	return c.State, nil
+}
+
+func (a *dockerAPI) inspect(ctx context.Context, name string) ([]byte, error) {
+	var raw json.RawMessage
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func (a *dockerAPI) containerLabels(ctx context.Context, name string) (map[string]string, error) {
+	var c struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &c); err != nil {
+		return nil, err
+	}
+	return c.Config.Labels, nil
+}
+
+func (a *dockerAPI) hostPort(ctx context.Context, name string, containerPort int, protocol string) (int, error) {
+	var c struct {
+		NetworkSettings struct {
+			Ports map[string][]dockerHostBinding `json:"Ports"`
+		} `json:"NetworkSettings"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &c); err != nil {
+		return 0, err
+	}
+
+	for _, b := range c.NetworkSettings.Ports[dockerPortBinding{ContainerPort: containerPort, Protocol: protocol}.portKey()] {
+		if b.HostPort != "" {
+			return strconv.Atoi(b.HostPort)
+		}
+	}
+	return 0, errors.Newf("container port %d of %s is not published", containerPort, name)
+}
+
+func (a *dockerAPI) containerIP(ctx context.Context, name, network string) (string, error) {
+	var c struct {
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, nil, &c); err != nil {
+		return "", err
+	}
+
+	n, ok := c.NetworkSettings.Networks[network]
+	if !ok {
+		return "", errors.Newf("container %s is not connected to network %s", name, network)
+	}
+	return n.IPAddress, nil
+}
+
+func (a *dockerAPI) stopContainer(ctx context.Context, name string, timeoutSeconds int) error {
+	return ignoreNotModified(a.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/stop", url.Values{"t": []string{strconv.Itoa(timeoutSeconds)}}, nil, nil))
+}
+
+func (a *dockerAPI) removeContainer(ctx context.Context, name string, force bool) error {
+	var q url.Values
+	if force {
+		q = url.Values{"force": []string{"1"}}
+	}
+	if err := a.call(ctx, http.MethodDelete, "/containers/"+url.PathEscape(name), q, nil, nil); err != nil {
+		return err
+	}
+	a.stopFollowingLogs(name)
+	return nil
+}
+
+func (a *dockerAPI) pauseContainer(ctx context.Context, name string) error {
+	return ignoreNotModified(a.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/pause", nil, nil, nil))
+}
+
+func (a *dockerAPI) unpauseContainer(ctx context.Context, name string) error {
+	return ignoreNotModified(a.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/unpause", nil, nil, nil))
+}
+
+func (a *dockerAPI) signalContainer(ctx context.Context, name string, signal int) error {
+	return ignoreNotModified(a.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/kill", url.Values{"signal": []string{strconv.Itoa(signal)}}, nil, nil))
+}
+
+func (a *dockerAPI) exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := a.call(ctx, http.MethodPost, "/containers/"+url.PathEscape(name)+"/exec", nil, map[string]interface{}{
+		"AttachStdin":  stdin != nil,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          cmd,
+	}, &created); err != nil {
+		return errors.Wrapf(err, "create exec in container %s", name)
+	}
+
+	conn, r, err := a.hijack(ctx, "/exec/"+created.ID+"/start", map[string]interface{}{"Detach": false, "Tty": false})
+	if err != nil {
+		return errors.Wrapf(err, "start exec in container %s", name)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(conn, stdin)
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		}()
+	}
+	if err := demuxDockerStream(r, stdout, stderr); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(err, "read exec output of container %s", name)
+	}
+
+	var inspected struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := a.call(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, nil, &inspected); err != nil {
+		return errors.Wrapf(err, "inspect exec in container %s", name)
+	}
+	if inspected.ExitCode != 0 {
+		return errors.Newf("command %v in container %s exited with code %d", cmd, name, inspected.ExitCode)
+	}
+	return nil
+}
+
+// dockerAPIStats is the subset of container stats returned by Docker Engine API.
+type dockerAPIStats struct {
+	CPUStats struct {
+		CPUUsage struct {
+			TotalUsage uint64 `json:"total_usage"`
+		} `json:"cpu_usage"`
+	} `json:"cpu_stats"`
+	MemoryStats struct {
+		Usage uint64            `json:"usage"`
+		Stats map[string]uint64 `json:"stats"`
+	} `json:"memory_stats"`
+	Networks map[string]struct {
+		RxBytes uint64 `json:"rx_bytes"`
+		TxBytes uint64 `json:"tx_bytes"`
+	} `json:"networks"`
+	BlkioStats struct {
+		IOServiceBytesRecursive []struct {
+			Op    string `json:"op"`
+			Value uint64 `json:"value"`
+		} `json:"io_service_bytes_recursive"`
+	} `json:"blkio_stats"`
+	PidsStats struct {
+		Current uint64 `json:"current"`
+	} `json:"pids_stats"`
+}
+
+func (s dockerAPIStats) runnableStats() RunnableStats {
+	stats := RunnableStats{
+		CPUTime: time.Duration(s.CPUStats.CPUUsage.TotalUsage),
+		PIDs:    s.PidsStats.Current,
+	}
+	stats.MemoryRSSBytes, stats.MemoryWorkingSetBytes = cgroupMemory(s.MemoryStats.Usage, s.MemoryStats.Stats)
+	for _, n := range s.Networks {
+		stats.NetworkRxBytes += n.RxBytes
+		stats.NetworkTxBytes += n.TxBytes
+	}
+	// Operations are capitalized with cgroup v1 and lowercase with v2.
+	for _, e := range s.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			stats.BlockReadBytes += e.Value
+		case "write":
+			stats.BlockWriteBytes += e.Value
+		}
+	}
+	return stats
+}
+
+func (a *dockerAPI) stats(ctx context.Context, name string) (RunnableStats, error) {
+	var s dockerAPIStats
+	if err := a.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/stats", url.Values{
+		"stream":   []string{"false"},
+		"one-shot": []string{"true"},
+	}, nil, &s); err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "get stats of container %s", name)
+	}
+	return s.runnableStats(), nil
+}
+
+// isDir returns true if the given path in the container is an existing directory.
+func (a *dockerAPI) isDir(ctx context.Context, name, containerPath string) (bool, error) {
+	resp, err := a.do(ctx, http.MethodHead, "/containers/"+url.PathEscape(name)+"/archive", url.Values{"path": []string{containerPath}}, nil)
+	if err != nil {
+		if isDockerNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	b, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Docker-Container-Path-Stat"))
+	if err != nil {
+		return false, errors.Wrapf(err, "decode stat of %s in container %s", containerPath, name)
+	}
+	var stat struct {
+		Mode os.FileMode `json:"mode"`
+	}
+	if err := json.Unmarshal(b, &stat); err != nil {
+		return false, errors.Wrapf(err, "decode stat of %s in container %s", containerPath, name)
+	}
+	return stat.Mode.IsDir(), nil
+}
+
+func (a *dockerAPI) copyTo(ctx context.Context, name, hostPath, containerPath string) error {
+	if _, err := os.Stat(hostPath); err != nil {
+		return err
+	}
+
+	// Archive is extracted into the given directory, so upload it to the parent directory, unless the destination
+	// is an existing directory already.
+	dir, base := path.Dir(containerPath), path.Base(containerPath)
+	isDir, err := a.isDir(ctx, name, containerPath)
+	if err != nil {
+		return err
+	}
+	if isDir {
+		dir, base = containerPath, filepath.Base(hostPath)
+	}
+
+	pr, pw := io.Pipe()
+	go func() { _ = pw.CloseWithError(writeTar(pw, hostPath, base)) }()
+	defer pr.Close()
+	return errors.Wrapf(
+		a.call(ctx, http.MethodPut, "/containers/"+url.PathEscape(name)+"/archive", url.Values{"path": []string{dir}}, pr, nil),
+		"copy %s to %s in container %s", hostPath, containerPath, name,
+	)
+}
+
+func (a *dockerAPI) copyFrom(ctx context.Context, name, containerPath, hostPath string) error {
+	resp, err := a.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/archive", url.Values{"path": []string{containerPath}}, nil)
+	if err != nil {
+		return errors.Wrapf(err, "copy %s from container %s", containerPath, name)
+	}
+	defer resp.Body.Close()
+	return extractTar(resp.Body, hostCopyDestination(containerPath, hostPath))
+}
+
+// hijack sends the request upgrading connection to raw stream, as required to attach stdin.
+func (a *dockerAPI) hijack(ctx context.Context, path string, body interface{}) (net.Conn, *bufio.Reader, error) {
+	req, err := a.newRequest(ctx, http.MethodPost, path, nil, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, apiError(resp)
+	}
+	return conn, r, nil
+}
+
+// demuxDockerStream copies multiplexed stdout and stderr stream of the container without TTY to the given writers.
+// Each frame starts with 8 bytes header: stream type, 3 bytes of padding and big-endian uint32 frame size.
+func demuxDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		w := io.Discard
+		switch header[0] {
+		case 1:
+			w = stdout
+		case 2:
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,540 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+// stubDockerEngine emulates the subset of Docker Engine API used by dockerAPI, for a single container.
+type stubDockerEngine struct {
+	t *testing.T
+
+	mtx     sync.Mutex
+	status  string
+	created dockerCreateRequest
+	// uploaded maps paths of files uploaded to the container to their content.
+	uploaded map[string]string
+	// buildContext maps paths of regular files in the uploaded build context to their content.
+	buildContext map[string]string
+	// network is the body of the latest network create request.
+	network map[string]interface{}
+	// connected maps networks the container was connected to after creation to endpoint configs.
+	connected map[string]dockerEndpointConfig
+}
+
+func dockerFrame(stream byte, payload string) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	b[0] = stream
+	binary.BigEndian.PutUint32(b[4:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func (s *stubDockerEngine) setStatus(status string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status = status
+}
+
+func (s *stubDockerEngine) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	testutil.Ok(s.t, json.NewEncoder(w).Encode(v))
+}
+
+func (s *stubDockerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	notFound := func(what string) {
+		s.writeJSON(w, http.StatusNotFound, map[string]string{"message": "No such " + what})
+	}
+
+	switch p := r.URL.Path; {
+	case p == "/networks/create":
+		s.mtx.Lock()
+		testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&s.network))
+		s.mtx.Unlock()
+		s.writeJSON(w, http.StatusCreated, map[string]string{"Id": "net1"})
+	case strings.HasPrefix(p, "/networks/") && strings.HasSuffix(p, "/connect"):
+		var req struct {
+			Container      string
+			EndpointConfig dockerEndpointConfig
+		}
+		testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&req))
+		testutil.Equals(s.t, "c1", req.Container)
+		s.mtx.Lock()
+		if s.connected == nil {
+			s.connected = map[string]dockerEndpointConfig{}
+		}
+		s.connected[strings.TrimSuffix(strings.TrimPrefix(p, "/networks/"), "/connect")] = req.EndpointConfig
+		s.mtx.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case p == "/networks/e2e":
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"IPAM": map[string]interface{}{"Config": []map[string]string{{"Gateway": "172.18.0.1"}}}})
+	case strings.HasPrefix(p, "/networks/"):
+		notFound("network")
+	case p == "/containers/create" && r.URL.Query().Get("name") == "e2e-exited":
+		s.writeJSON(w, http.StatusCreated, map[string]string{"Id": "e2e-exited"})
+	case p == "/containers/create":
+		testutil.Equals(s.t, "e2e-app", r.URL.Query().Get("name"))
+		s.mtx.Lock()
+		testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&s.created))
+		s.status = "created"
+		s.mtx.Unlock()
+		s.writeJSON(w, http.StatusCreated, map[string]string{"Id": "c1"})
+	case p == "/containers/c1/start":
+		w.WriteHeader(http.StatusNoContent)
+	case p == "/containers/c1/logs", p == "/containers/e2e-app/logs", p == "/containers/e2e-exited/logs":
+		testutil.Equals(s.t, "1", r.URL.Query().Get("follow"))
+		if since := r.URL.Query().Get("since"); p == "/containers/e2e-app/logs" {
+			// Attaching to already running container should skip old logs.
+			testutil.Assert(s.t, since != "" && since != "0", "expected since to be set, got %q", since)
+		} else {
+			// Logs of started container are followed from the beginning.
+			testutil.Equals(s.t, "0", since)
+		}
+		_, _ = w.Write(dockerFrame(1, "hello\n"))
+		_, _ = w.Write(dockerFrame(2, "oops\n"))
+	case p == "/events":
+		var filters map[string][]string
+		testutil.Ok(s.t, json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters))
+		testutil.Equals(s.t, []string{"e2e-app"}, filters["container"])
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// Give client time to inspect the created container, before it starts.
+		time.Sleep(100 * time.Millisecond)
+		s.setStatus("running")
+		_, _ = fmt.Fprintln(w, `{"Type":"container","Action":"start","Actor":{"ID":"c1"}}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	case p == "/containers/e2e-app/json":
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{
+			"State":  map[string]interface{}{"Status": s.status},
+			"Config": map[string]interface{}{"Labels": s.created.Labels},
+			"NetworkSettings": map[string]interface{}{
+				"Ports":    map[string][]dockerHostBinding{"80/tcp": {{HostIP: "0.0.0.0", HostPort: "32768"}}},
+				"Networks": map[string]interface{}{"e2e": map[string]string{"IPAddress": "172.18.0.2"}},
+			},
+		})
+	case p == "/containers/e2e-app/exec":
+		var req struct {
+			AttachStdin bool
+			Cmd         []string
+		}
+		testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&req))
+		s.writeJSON(w, http.StatusCreated, map[string]string{"Id": req.Cmd[0]})
+	case strings.HasPrefix(p, "/exec/") && strings.HasSuffix(p, "/start"):
+		testutil.Equals(s.t, "tcp", r.Header.Get("Upgrade"))
+		var req struct{ Detach, Tty bool }
+		testutil.Ok(s.t, json.NewDecoder(r.Body).Decode(&req))
+		testutil.Equals(s.t, false, req.Detach)
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		testutil.Ok(s.t, err)
+		defer conn.Close()
+
+		_, _ = rw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		testutil.Ok(s.t, rw.Flush())
+		// Echo stdin until client closes its side.
+		stdin, err := io.ReadAll(rw)
+		testutil.Ok(s.t, err)
+		_, _ = conn.Write(dockerFrame(1, string(stdin)))
+	case p == "/containers/e2e-app/stats":
+		testutil.Equals(s.t, "false", r.URL.Query().Get("stream"))
+		_, _ = io.WriteString(w, `{
+			"cpu_stats": {"cpu_usage": {"total_usage": 1500000000}},
+			"memory_stats": {"usage": 10000, "stats": {"anon": 6000, "inactive_file": 3000}},
+			"networks": {"eth0": {"rx_bytes": 100, "tx_bytes": 10}, "eth1": {"rx_bytes": 200, "tx_bytes": 20}},
+			"blkio_stats": {"io_service_bytes_recursive": [{"op": "read", "value": 4096}, {"op": "write", "value": 8192}]},
+			"pids_stats": {"current": 3}
+		}`)
+	case p == "/containers/e2e-app/archive" && r.Method == http.MethodHead:
+		if r.URL.Query().Get("path") != "/etc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		stat, err := json.Marshal(map[string]interface{}{"name": "etc", "mode": os.ModeDir | 0755})
+		testutil.Ok(s.t, err)
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(stat))
+	case p == "/containers/e2e-app/archive" && r.Method == http.MethodPut:
+		testutil.Equals(s.t, "application/x-tar", r.Header.Get("Content-Type"))
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.uploaded = map[string]string{}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			testutil.Ok(s.t, err)
+			b, err := io.ReadAll(tr)
+			testutil.Ok(s.t, err)
+			s.uploaded[path.Join(r.URL.Query().Get("path"), hdr.Name)] = string(b)
+		}
+	case p == "/containers/e2e-app/archive" && r.Method == http.MethodGet:
+		testutil.Equals(s.t, "/etc/hosts", r.URL.Query().Get("path"))
+		tw := tar.NewWriter(w)
+		testutil.Ok(s.t, tw.WriteHeader(&tar.Header{Name: "hosts", Mode: 0644, Size: 19, Typeflag: tar.TypeReg}))
+		_, _ = io.WriteString(tw, "127.0.0.1 localhost")
+		testutil.Ok(s.t, tw.Close())
+	case p == "/build":
+		testutil.Equals(s.t, "application/x-tar", r.Header.Get("Content-Type"))
+		testutil.Equals(s.t, "build/Dockerfile", r.URL.Query().Get("dockerfile"))
+		testutil.Equals(s.t, `{"VERSION":"1"}`, r.URL.Query().Get("buildargs"))
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.buildContext = map[string]string{}
+		tr := tar.NewReader(r.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			testutil.Ok(s.t, err)
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			b, err := io.ReadAll(tr)
+			testutil.Ok(s.t, err)
+			s.buildContext[hdr.Name] = string(b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"stream":"Step 1/1 : FROM alpine\n"}`+"\n")
+		if r.URL.Query().Get("t") == "broken" {
+			_, _ = io.WriteString(w, `{"error":"no such image alpine"}`+"\n")
+		}
+	case p == "/images/load":
+		testutil.Equals(s.t, "application/x-tar", r.Header.Get("Content-Type"))
+		b, err := io.ReadAll(r.Body)
+		testutil.Ok(s.t, err)
+		w.Header().Set("Content-Type", "application/json")
+		if string(b) != "alpine image" {
+			_, _ = io.WriteString(w, `{"error":"invalid tar header"}`+"\n")
+			return
+		}
+		_, _ = io.WriteString(w, `{"stream":"Loaded image: alpine:3.16\n"}`+"\n")
+	case p == "/images/alpine:3.16/get":
+		_, _ = io.WriteString(w, "alpine image")
+	case p == "/exec/cat/json":
+		s.writeJSON(w, http.StatusOK, map[string]int{"ExitCode": 0})
+	case p == "/exec/false/json":
+		s.writeJSON(w, http.StatusOK, map[string]int{"ExitCode": 1})
+	case p == "/containers/e2e-hanging/logs":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	case p == "/containers/e2e-hanging" && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(p, "/containers/e2e-exited/"):
+		// Engine replies with 304 Not Modified, if the container is already in the requested state.
+		w.WriteHeader(http.StatusNotModified)
+	case strings.HasPrefix(p, "/containers/"):
+		notFound("container")
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func TestDockerAPI(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	testutil.Ok(t, err)
+
+	engine := &stubDockerEngine{t: t}
+	srv := &http.Server{Handler: engine}
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	a := newDockerAPI(socket, NewLogger(io.Discard), false)
+
+	t.Run("networks", func(t *testing.T) {
+		testutil.Ok(t, a.createNetwork(ctx, dockerNetworkSpec{Name: "e2e"}))
+		engine.mtx.Lock()
+		testutil.Equals(t, map[string]interface{}{"Name": "e2e", "Driver": "bridge", "CheckDuplicate": true, "Internal": false, "EnableIPv6": false}, engine.network)
+		engine.mtx.Unlock()
+
+		testutil.Ok(t, a.createNetwork(ctx, dockerNetworkSpec{Name: "e2e-backend", Subnet: "172.30.0.0/24", IPv6Subnet: "fd00:e2e::/64", Internal: true}))
+		engine.mtx.Lock()
+		testutil.Equals(t, map[string]interface{}{
+			"Name": "e2e-backend", "Driver": "bridge", "CheckDuplicate": true, "Internal": true, "EnableIPv6": true,
+			"IPAM": map[string]interface{}{"Config": []interface{}{
+				map[string]interface{}{"Subnet": "172.30.0.0/24"},
+				map[string]interface{}{"Subnet": "fd00:e2e::/64"},
+			}},
+		}, engine.network)
+		engine.mtx.Unlock()
+
+		gw, err := a.networkGateway(ctx, "e2e")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "172.18.0.1", gw)
+
+		ok, err := a.networkExists(ctx, "e2e")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok)
+
+		ok, err = a.networkExists(ctx, "missing")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok)
+	})
+	t.Run("typed errors", func(t *testing.T) {
+		err := a.removeContainer(ctx, "missing", true)
+		testutil.NotOk(t, err)
+
+		var apiErr *DockerAPIError
+		testutil.Assert(t, errors.As(err, &apiErr))
+		testutil.Equals(t, http.StatusNotFound, apiErr.StatusCode)
+		testutil.Equals(t, "No such container", apiErr.Message)
+	})
+	t.Run("not modified", func(t *testing.T) {
+		// Start of container that is already started.
+		exited, err := a.startContainer(ctx, dockerContainerSpec{Name: "e2e-exited", NetworkMode: "e2e", Image: "alpine"}, io.Discard, io.Discard)
+		testutil.Ok(t, err)
+		<-exited
+		// Stop and kill of container that is already stopped.
+		testutil.Ok(t, a.stopContainer(ctx, "e2e-exited", 10))
+		testutil.Ok(t, a.signalContainer(ctx, "e2e-exited", 9))
+		testutil.Ok(t, a.pauseContainer(ctx, "e2e-exited"))
+		testutil.Ok(t, a.unpauseContainer(ctx, "e2e-exited"))
+
+		var apiErr *DockerAPIError
+		testutil.Assert(t, errors.As(a.stopContainer(ctx, "missing", 10), &apiErr))
+		testutil.Equals(t, http.StatusNotFound, apiErr.StatusCode)
+	})
+	t.Run("container lifecycle", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		exited, err := a.startContainer(ctx, dockerContainerSpec{
+			Name:              "e2e-app",
+			NetworkMode:       "e2e",
+			Image:             "alpine",
+			DisableEntrypoint: true,
+			Cmd:               []string{"sleep", "1000"},
+			CPUs:              "0.5",
+			Ports:             []dockerPortBinding{{ContainerPort: 80}, {ContainerPort: 443, HostPort: 8443}},
+			StopSignal:        2,
+			Labels:            map[string]string{dockerSpecHashLabel: "abc"},
+		}, &stdout, &stderr)
+		testutil.Ok(t, err)
+		engine.mtx.Lock()
+		testutil.Equals(t, []string{"sleep", "1000"}, engine.created.Cmd)
+		engine.mtx.Unlock()
+
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			t.Fatal("logs were not followed until the end")
+		}
+		testutil.Equals(t, "hello\n", stdout.String())
+		testutil.Equals(t, "oops\n", stderr.String())
+
+		state, err := a.waitStarted(ctx, "e2e-app", backoff.Config{})
+		testutil.Ok(t, err)
+		testutil.Assert(t, state.running())
+
+		port, err := a.hostPort(ctx, "e2e-app", 80, "tcp")
+		testutil.Ok(t, err)
+		testutil.Equals(t, 32768, port)
+		_, err = a.hostPort(ctx, "e2e-app", 81, "tcp")
+		testutil.NotOk(t, err)
+		_, err = a.hostPort(ctx, "e2e-app", 80, "udp")
+		testutil.NotOk(t, err)
+
+		ip, err := a.containerIP(ctx, "e2e-app", "e2e")
+		testutil.Ok(t, err)
+		testutil.Equals(t, "172.18.0.2", ip)
+	})
+	t.Run("remove stops following logs", func(t *testing.T) {
+		// Engine doesn't close the stream, e.g. because it didn't notice the container is gone.
+		exited, err := a.followLogs("e2e-hanging", "e2e-hanging", url.Values{}, io.Discard, io.Discard)
+		testutil.Ok(t, err)
+		testutil.Ok(t, a.removeContainer(ctx, "e2e-hanging", true))
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			t.Fatal("logs were followed after container was removed")
+		}
+	})
+	t.Run("attach", func(t *testing.T) {
+		labels, err := a.containerLabels(ctx, "e2e-app")
+		testutil.Ok(t, err)
+		testutil.Equals(t, map[string]string{dockerSpecHashLabel: "abc"}, labels)
+
+		var stdout, stderr bytes.Buffer
+		exited, err := a.attachContainer(ctx, "e2e-app", &stdout, &stderr)
+		testutil.Ok(t, err)
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			t.Fatal("logs were not followed until the end")
+		}
+		testutil.Equals(t, "hello\n", stdout.String())
+		testutil.Equals(t, "oops\n", stderr.String())
+	})
+	t.Run("exec", func(t *testing.T) {
+		var stdout bytes.Buffer
+		testutil.Ok(t, a.exec(ctx, "e2e-app", []string{"cat"}, strings.NewReader("ping"), &stdout, io.Discard))
+		testutil.Equals(t, "ping", stdout.String())
+
+		err := a.exec(ctx, "e2e-app", []string{"false"}, strings.NewReader(""), io.Discard, io.Discard)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "command [false] in container e2e-app exited with code 1", err.Error())
+	})
+	t.Run("copy", func(t *testing.T) {
+		dir := t.TempDir()
+		testutil.Ok(t, os.WriteFile(filepath.Join(dir, "app.yaml"), []byte("a: 1"), 0600))
+
+		// Existing directory, so file is copied into it.
+		testutil.Ok(t, a.copyTo(ctx, "e2e-app", filepath.Join(dir, "app.yaml"), "/etc"))
+		engine.mtx.Lock()
+		testutil.Equals(t, map[string]string{"/etc/app.yaml": "a: 1"}, engine.uploaded)
+		engine.mtx.Unlock()
+
+		// Non-existing path, so file is copied as it.
+		testutil.Ok(t, a.copyTo(ctx, "e2e-app", filepath.Join(dir, "app.yaml"), "/etc/config.yaml"))
+		engine.mtx.Lock()
+		testutil.Equals(t, map[string]string{"/etc/config.yaml": "a: 1"}, engine.uploaded)
+		engine.mtx.Unlock()
+
+		testutil.Ok(t, a.copyFrom(ctx, "e2e-app", "/etc/hosts", dir))
+		b, err := os.ReadFile(filepath.Join(dir, "hosts"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "127.0.0.1 localhost", string(b))
+
+		testutil.Ok(t, a.copyFrom(ctx, "e2e-app", "/etc/hosts", filepath.Join(dir, "hosts.txt")))
+		b, err = os.ReadFile(filepath.Join(dir, "hosts.txt"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "127.0.0.1 localhost", string(b))
+	})
+	t.Run("build", func(t *testing.T) {
+		dir := t.TempDir()
+		testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "build"), 0750))
+		testutil.Ok(t, os.WriteFile(filepath.Join(dir, "build", "Dockerfile"), []byte("FROM alpine"), 0600))
+		b, err := newImageBuild(dir, "build/Dockerfile", map[string]string{"VERSION": "1"})
+		testutil.Ok(t, err)
+
+		var progress bytes.Buffer
+		testutil.Ok(t, a.buildImage(ctx, b, "e2e-build-app:1", &progress))
+		testutil.Equals(t, "Step 1/1 : FROM alpine\n", progress.String())
+		engine.mtx.Lock()
+		testutil.Equals(t, map[string]string{"build/Dockerfile": "FROM alpine"}, engine.buildContext)
+		engine.mtx.Unlock()
+
+		err = a.buildImage(ctx, b, "broken", io.Discard)
+		var apiErr *DockerAPIError
+		testutil.Assert(t, errors.As(err, &apiErr), "expected DockerAPIError, got %v", err)
+		testutil.Equals(t, "no such image alpine", apiErr.Message)
+	})
+	t.Run("images", func(t *testing.T) {
+		f := filepath.Join(t.TempDir(), "alpine.tar")
+		testutil.Ok(t, a.saveImage(ctx, "alpine:3.16", f))
+		b, err := os.ReadFile(f)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "alpine image", string(b))
+		testutil.Ok(t, a.loadImage(ctx, f))
+
+		testutil.Ok(t, os.WriteFile(f, []byte("broken"), 0600))
+		err = a.loadImage(ctx, f)
+		var apiErr *DockerAPIError
+		testutil.Assert(t, errors.As(err, &apiErr), "expected DockerAPIError, got %v", err)
+		testutil.Equals(t, "invalid tar header", apiErr.Message)
+	})
+	t.Run("stats", func(t *testing.T) {
+		stats, err := a.stats(ctx, "e2e-app")
+		testutil.Ok(t, err)
+		testutil.Equals(t, RunnableStats{
+			CPUTime:               1500 * time.Millisecond,
+			MemoryRSSBytes:        6000,
+			MemoryWorkingSetBytes: 7000,
+			NetworkRxBytes:        300,
+			NetworkTxBytes:        30,
+			BlockReadBytes:        4096,
+			BlockWriteBytes:       8192,
+			PIDs:                  3,
+		}, stats)
+	})
+	t.Run("multiple networks", func(t *testing.T) {
+		exited, err := a.startContainer(ctx, dockerContainerSpec{
+			Name:        "e2e-app",
+			NetworkMode: "e2e",
+			Endpoints: []dockerNetworkEndpoint{
+				{Network: "e2e", Aliases: []string{"app"}},
+				{Network: "e2e-backend", Aliases: []string{"db"}, IPv4Address: "172.30.0.10", IPv6Address: "fd00:e2e::10"},
+			},
+			Image: "alpine",
+		}, io.Discard, io.Discard)
+		testutil.Ok(t, err)
+		<-exited
+
+		engine.mtx.Lock()
+		defer engine.mtx.Unlock()
+		testutil.Equals(t, &dockerNetworkingConfig{EndpointsConfig: map[string]dockerEndpointConfig{"e2e": {Aliases: []string{"app"}}}}, engine.created.NetworkingConfig)
+		testutil.Equals(t, map[string]dockerEndpointConfig{"e2e-backend": {
+			Aliases:    []string{"db"},
+			IPAMConfig: &dockerEndpointIPAMConfig{IPv4Address: "172.30.0.10", IPv6Address: "fd00:e2e::10"},
+		}}, engine.connected)
+	})
+}
+
+func TestNewDockerCreateRequest(t *testing.T) {
+	req, err := newDockerCreateRequest(dockerContainerSpec{
+		NetworkMode:       "e2e",
+		Image:             "alpine",
+		DisableEntrypoint: true,
+		CPUs:              "0.5",
+		Ports:             []dockerPortBinding{{ContainerPort: 80}, {ContainerPort: 443, HostPort: 8443}},
+		StopSignal:        2,
+	})
+	testutil.Ok(t, err)
+
+	b, err := json.Marshal(req)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"Entrypoint":[""],"Image":"alpine","ExposedPorts":{"443/tcp":{},"80/tcp":{}},"StopSignal":"2","HostConfig":{"NetworkMode":"e2e","PortBindings":{"443/tcp":[{"HostIp":"","HostPort":"8443"}],"80/tcp":[{"HostIp":"","HostPort":""}]},"NanoCpus":500000000}}`, string(b))
+
+	_, err = newDockerCreateRequest(dockerContainerSpec{CPUs: "many"})
+	testutil.NotOk(t, err)
+
+	req, err = newDockerCreateRequest(dockerContainerSpec{
+		Image: "statsd",
+		Ports: []dockerPortBinding{{ContainerPort: 8125, Protocol: "udp", HostPort: 8125, HostIP: "127.0.0.1"}},
+	})
+	testutil.Ok(t, err)
+	b, err = json.Marshal(req)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `{"Image":"statsd","ExposedPorts":{"8125/udp":{}},"HostConfig":{"PortBindings":{"8125/udp":[{"HostIp":"127.0.0.1","HostPort":"8125"}]}}}`, string(b))
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	in := append(append(dockerFrame(1, "out"), dockerFrame(2, "err")...), dockerFrame(1, "!")...)
+	testutil.Ok(t, demuxDockerStream(bytes.NewReader(in), &stdout, &stderr))
+	testutil.Equals(t, "out!", stdout.String())
+	testutil.Equals(t, "err", stderr.String())
+
+	testutil.NotOk(t, demuxDockerStream(bytes.NewReader(in[:len(in)-1]), &stdout, &stderr))
+}
@@ -0,0 +1,697 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+)
+
+// dockerBackend is the way DockerEnvironment talks to the container engine. Containers are referenced by name.
+type dockerBackend interface {
+	createNetwork(ctx context.Context, spec dockerNetworkSpec) error
+	// networkGateway returns gateway IP address of the given network.
+	networkGateway(ctx context.Context, name string) (string, error)
+	networkExists(ctx context.Context, name string) (bool, error)
+	removeNetwork(ctx context.Context, name string) error
+	// listVolumes returns names of all volumes with the given name prefix.
+	listVolumes(ctx context.Context, prefix string) ([]string, error)
+	removeVolume(ctx context.Context, name string) error
+	// listContainers returns IDs of all containers (also not running ones) connected to the given network.
+	listContainers(ctx context.Context, network string) ([]string, error)
+
+	imageExists(ctx context.Context, image string) (bool, error)
+	// pullImage pulls the image writing human-readable progress to the given writer.
+	pullImage(ctx context.Context, image string, progress io.Writer) error
+	// buildImage builds the image with the given tag, writing human-readable progress to the given writer.
+	buildImage(ctx context.Context, b *imageBuild, tag string, progress io.Writer) error
+	// loadImage loads images from the tarball (as created by saveImage) at the given host path.
+	loadImage(ctx context.Context, path string) error
+	// saveImage saves the image into a tarball at the given host path.
+	saveImage(ctx context.Context, image, path string) error
+
+	// startContainer creates and starts the container described by spec. Context bounds only the start itself.
+	// Container output is streamed to the given writers until it exits. Returned channel is closed
+	// once the container exited and all of its output was written.
+	startContainer(ctx context.Context, spec dockerContainerSpec, stdout, stderr io.Writer) (exited <-chan struct{}, err error)
+	// runContainer runs the container described by spec to completion and returns its combined output.
+	// It returns error if container exits with non-zero code.
+	runContainer(ctx context.Context, spec dockerContainerSpec) ([]byte, error)
+	// waitStarted waits until the container is running or has exited already and returns its state.
+	// Backends that have to poll for the state, use the given backoff.
+	waitStarted(ctx context.Context, name string, poll backoff.Config) (dockerContainerState, error)
+	inspectState(ctx context.Context, name string) (dockerContainerState, error)
+	// inspect returns engine details about the container in JSON.
+	inspect(ctx context.Context, name string) ([]byte, error)
+	// containerLabels returns labels of the given container.
+	containerLabels(ctx context.Context, name string) (map[string]string, error)
+	// attachContainer streams output the already running container produces from now on to the given writers.
+	// Returned channel is closed once the container exited and all of its output was written.
+	attachContainer(ctx context.Context, name string, stdout, stderr io.Writer) (exited <-chan struct{}, err error)
+	// hostPort returns host port the given container port is published on.
+	hostPort(ctx context.Context, name string, containerPort int, protocol string) (int, error)
+	// containerIP returns IP address of the container in the given network.
+	containerIP(ctx context.Context, name, network string) (string, error)
+	stopContainer(ctx context.Context, name string, timeoutSeconds int) error
+	// removeContainer removes the container. If force is true, running container is killed first.
+	removeContainer(ctx context.Context, name string, force bool) error
+	pauseContainer(ctx context.Context, name string) error
+	unpauseContainer(ctx context.Context, name string) error
+	signalContainer(ctx context.Context, name string, signal int) error
+	// exec runs the command in the running container. It returns error if command exits with non-zero code.
+	exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error
+	// stats returns current resource usage of the running container.
+	stats(ctx context.Context, name string) (RunnableStats, error)
+	// copyTo copies host file or directory to the container, into containerPath if it's an existing directory or
+	// as containerPath otherwise.
+	copyTo(ctx context.Context, name, hostPath, containerPath string) error
+	// copyFrom copies file or directory from the container to the host, into hostPath if it's an existing directory
+	// or as hostPath otherwise.
+	copyFrom(ctx context.Context, name, containerPath, hostPath string) error
+}
+
+// dockerContainerSpec describes container to run, independently of the backend.
+type dockerContainerSpec struct {
+	Name     string
+	Hostname string
+	// NetworkMode is the name of the network to connect container to or `container:<name>` to share
+	// network namespace of another container.
+	NetworkMode string
+	// Endpoints configure networks the container is attached to, the one in NetworkMode first. Container is connected
+	// to the rest of them before it starts.
+	Endpoints []dockerNetworkEndpoint
+
+	Image             string
+	DisableEntrypoint bool
+	Cmd               []string
+	// Env contains environment variables in KEY=VALUE form.
+	Env []string
+	// Volumes contains bind mounts and named volumes in the `docker run -v` form.
+	Volumes []string
+	User    string
+	UserNs  string
+	// Tmpfs contains container paths to mount tmpfs at.
+	Tmpfs []string
+
+	Privileged   bool
+	Capabilities []string
+	MemoryBytes  uint
+	// CPUs is the number of CPUs in the `docker run --cpus` form.
+	CPUs       string
+	Ports      []dockerPortBinding
+	StopSignal int
+	// AutoRemove makes engine remove the container once it exits.
+	AutoRemove bool
+	Labels     map[string]string
+}
+
+// hash returns hash of the spec, that changes whenever the container would be started differently.
+func (s dockerContainerSpec) hash() string {
+	s.Labels = nil
+	// Marshalling structs and maps is deterministic.
+	b, _ := json.Marshal(s)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+type dockerPortBinding struct {
+	ContainerPort int
+	// Protocol is either tcp or udp. Empty means tcp.
+	Protocol string
+	// HostPort is the port on the host container port is published on. Zero means random port.
+	HostPort int
+	// HostIP is the host address container port is published on. Empty means all interfaces.
+	HostIP string
+}
+
+// publishArg returns the port in the `docker run -p` form, e.g. `127.0.0.1:8125:8125/udp`.
+func (p dockerPortBinding) publishArg() string {
+	arg := strconv.Itoa(p.ContainerPort)
+	if p.HostPort > 0 {
+		arg = strconv.Itoa(p.HostPort) + ":" + arg
+	}
+	if p.HostIP != "" {
+		if p.HostPort == 0 {
+			// Random host port on the given address.
+			arg = ":" + arg
+		}
+		host := p.HostIP
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		arg = host + ":" + arg
+	}
+	if p.Protocol != "" && p.Protocol != string(TCP) {
+		arg += "/" + p.Protocol
+	}
+	return arg
+}
+
+// portKey returns the port in the `<port>/<protocol>` form used by the engine.
+func (p dockerPortBinding) portKey() string {
+	if p.Protocol == "" {
+		return strconv.Itoa(p.ContainerPort) + "/" + string(TCP)
+	}
+	return strconv.Itoa(p.ContainerPort) + "/" + p.Protocol
+}
+
+// dockerNetworkSpec describes bridge network to create, independently of the backend.
+type dockerNetworkSpec struct {
+	Name string
+	// Subnet and IPv6Subnet are subnets in CIDR notation. Engine picks IPv4 one, if empty, and disables IPv6.
+	Subnet     string
+	IPv6Subnet string
+	Internal   bool
+}
+
+// createArgs returns `docker network create` arguments for the spec.
+func (s dockerNetworkSpec) createArgs() []string {
+	args := []string{"network", "create", "-d", "bridge"}
+	if s.Subnet != "" {
+		args = append(args, "--subnet", s.Subnet)
+	}
+	if s.IPv6Subnet != "" {
+		args = append(args, "--ipv6", "--subnet", s.IPv6Subnet)
+	}
+	if s.Internal {
+		args = append(args, "--internal")
+	}
+	return append(args, s.Name)
+}
+
+// dockerNetworkEndpoint describes attachment of the container to the network.
+type dockerNetworkEndpoint struct {
+	Network     string
+	Aliases     []string
+	IPv4Address string
+	IPv6Address string
+}
+
+// endpointArgs returns `docker run` (or `docker network connect`) arguments configuring the endpoint.
+func (e dockerNetworkEndpoint) endpointArgs() []string {
+	var args []string
+	for _, a := range e.Aliases {
+		args = append(args, "--network-alias="+a)
+	}
+	if e.IPv4Address != "" {
+		args = append(args, "--ip="+e.IPv4Address)
+	}
+	if e.IPv6Address != "" {
+		args = append(args, "--ip6="+e.IPv6Address)
+	}
+	return args
+}
+
+// primaryEndpoint returns endpoint of the network in NetworkMode, if configured.
+func (s dockerContainerSpec) primaryEndpoint() (dockerNetworkEndpoint, bool) {
+	if len(s.Endpoints) == 0 || s.Endpoints[0].Network != s.NetworkMode {
+		return dockerNetworkEndpoint{}, false
+	}
+	return s.Endpoints[0], true
+}
+
+// extraEndpoints returns endpoints of networks the container is connected to after it's created.
+func (s dockerContainerSpec) extraEndpoints() []dockerNetworkEndpoint {
+	if _, ok := s.primaryEndpoint(); ok {
+		return s.Endpoints[1:]
+	}
+	return s.Endpoints
+}
+
+// runArgs returns `docker run` arguments for the spec.
+func (s dockerContainerSpec) runArgs() []string {
+	var args []string
+	if s.AutoRemove {
+		args = append(args, "--rm")
+	}
+	if s.NetworkMode != "" {
+		args = append(args, "--net="+s.NetworkMode)
+	}
+	if s.Name != "" {
+		args = append(args, "--name="+s.Name)
+	}
+	if s.Hostname != "" {
+		args = append(args, "--hostname="+s.Hostname)
+	}
+	if e, ok := s.primaryEndpoint(); ok {
+		args = append(args, e.endpointArgs()...)
+	}
+	labels := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		args = append(args, "--label", l)
+	}
+	for _, v := range s.Volumes {
+		args = append(args, "-v", v)
+	}
+	for _, t := range s.Tmpfs {
+		args = append(args, "--tmpfs", t)
+	}
+	if s.CPUs != "" {
+		args = append(args, "--cpus", s.CPUs)
+	}
+	for _, e := range s.Env {
+		args = append(args, "-e", e)
+	}
+	if s.User != "" {
+		args = append(args, "--user", s.User)
+	}
+	if s.UserNs != "" {
+		args = append(args, "--userns", s.UserNs)
+	}
+	if s.Privileged {
+		args = append(args, "--privileged")
+	}
+	for _, c := range s.Capabilities {
+		args = append(args, "--cap-add", c)
+	}
+	if s.MemoryBytes > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%db", s.MemoryBytes))
+	}
+	for _, p := range s.Ports {
+		args = append(args, "-p", p.publishArg())
+	}
+	if s.StopSignal != 0 {
+		args = append(args, "--stop-signal", strconv.Itoa(s.StopSignal))
+	}
+	if s.DisableEntrypoint {
+		args = append(args, "--entrypoint", "")
+	}
+	args = append(args, s.Image)
+	return append(args, s.Cmd...)
+}
+
+// dockerContainerState represents state of the container as reported by the engine.
+type dockerContainerState struct {
+	Status     string
+	ExitCode   int
+	OOMKilled  bool
+	FinishedAt time.Time
+}
+
+func (s dockerContainerState) running() bool { return s.Status == "running" }
+func (s dockerContainerState) exited() bool  { return s.Status == "exited" || s.Status == "dead" }
+
+func (s dockerContainerState) exitStatus() ExitStatus {
+	return ExitStatus{ExitCode: s.ExitCode, OOMKilled: s.OOMKilled, FinishedAt: s.FinishedAt}
+}
+
+func parseDockerContainerState(out []byte) (dockerContainerState, error) {
+	var state dockerContainerState
+	if err := json.Unmarshal(out, &state); err != nil {
+		return dockerContainerState{}, errors.Wrapf(err, "unmarshal docker inspect state %q", strings.TrimSpace(string(out)))
+	}
+	return state, nil
+}
+
+// dockerCLI is dockerBackend that shells out to the docker command line tool.
+type dockerCLI struct {
+	bin     string
+	logger  Logger
+	verbose bool
+	// unsupportedStatsOnce makes sure stats not reported by the CLI are logged only once.
+	unsupportedStatsOnce sync.Once
+}
+
+func newDockerCLI(logger Logger, verbose bool) *dockerCLI {
+	return &dockerCLI{bin: "docker", logger: logger, verbose: verbose}
+}
+
+func (c *dockerCLI) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := NewCommand(c.bin, args...)
+	if c.verbose {
+		c.logger.Log("dockerEnv:", cmd.toString())
+	}
+	return cmd.exec(ctx)
+}
+
+// run runs the command and returns its combined output, which is also attached to the returned error.
+func (c *dockerCLI) run(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := c.command(ctx, args...).CombinedOutput()
+	if err != nil {
+		return out, errors.Wrapf(err, "%s %s: %s", c.bin, args[0], strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func (c *dockerCLI) createNetwork(ctx context.Context, spec dockerNetworkSpec) error {
+	_, err := c.run(ctx, spec.createArgs()...)
+	return err
+}
+
+func (c *dockerCLI) networkGateway(ctx context.Context, name string) (string, error) {
+	out, err := c.run(ctx, "network", "inspect", name)
+	if err != nil {
+		return "", err
+	}
+
+	var inspectDetails []struct {
+		IPAM struct {
+			Config []struct {
+				Gateway string `json:"Gateway"`
+			} `json:"Config"`
+		} `json:"IPAM"`
+	}
+	if err := json.Unmarshal(out, &inspectDetails); err != nil {
+		return "", errors.Wrap(err, "unmarshall docker inspect details to obtain Gateway IP")
+	}
+
+	if len(inspectDetails) != 1 || len(inspectDetails[0].IPAM.Config) != 1 {
+		return "", errors.Newf("unexpected format of docker inspect; expected exactly one element in root and IPAM.Config, got %v", string(out))
+	}
+	return inspectDetails[0].IPAM.Config[0].Gateway, nil
+}
+
+func (c *dockerCLI) networkExists(ctx context.Context, name string) (bool, error) {
+	out, err := c.run(ctx, "network", "ls", "--quiet", "--filter", fmt.Sprintf("name=%s", name))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) != "", nil
+}
+
+func (c *dockerCLI) removeNetwork(ctx context.Context, name string) error {
+	_, err := c.run(ctx, "network", "rm", name)
+	return err
+}
+
+func (c *dockerCLI) listVolumes(ctx context.Context, prefix string) ([]string, error) {
+	out, err := c.run(ctx, "volume", "ls", "--quiet", "--filter", "name="+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range strings.Split(string(out), "\n") {
+		// Filter matches names containing the prefix anywhere.
+		if name = strings.TrimSpace(name); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (c *dockerCLI) removeVolume(ctx context.Context, name string) error {
+	_, err := c.run(ctx, "volume", "rm", "--force", name)
+	return err
+}
+
+func (c *dockerCLI) listContainers(ctx context.Context, network string) ([]string, error) {
+	out, err := c.run(ctx, "ps", "-a", "--quiet", "--filter", fmt.Sprintf("network=%s", network))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, id := range strings.Split(string(out), "\n") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *dockerCLI) imageExists(ctx context.Context, image string) (bool, error) {
+	// Assuming Error: No such image: <image>.
+	if _, err := c.command(ctx, "image", "inspect", image).CombinedOutput(); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (c *dockerCLI) pullImage(ctx context.Context, image string, progress io.Writer) error {
+	cmd := c.command(ctx, "pull", image)
+	cmd.Stdout = progress
+	cmd.Stderr = progress
+	return cmd.Run()
+}
+
+func (c *dockerCLI) buildImage(ctx context.Context, b *imageBuild, tag string, progress io.Writer) error {
+	cmd := c.command(ctx, b.buildArgs(tag)...)
+	cmd.Stdout = progress
+	cmd.Stderr = progress
+	return cmd.Run()
+}
+
+func (c *dockerCLI) loadImage(ctx context.Context, path string) error {
+	_, err := c.run(ctx, "load", "--input", path)
+	return err
+}
+
+func (c *dockerCLI) saveImage(ctx context.Context, image, path string) error {
+	_, err := c.run(ctx, "save", "--output", path, image)
+	return err
+}
+
+func (c *dockerCLI) startContainer(ctx context.Context, spec dockerContainerSpec, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	extra := spec.extraEndpoints()
+	if len(extra) == 0 {
+		return c.runAttached(spec.runArgs(), stdout, stderr)
+	}
+
+	// Container can be connected to the rest of networks only once it's created, but before it starts.
+	if _, err := c.run(ctx, append([]string{"create"}, spec.runArgs()...)...); err != nil {
+		return nil, err
+	}
+	for _, e := range extra {
+		if _, err := c.run(ctx, append(append([]string{"network", "connect"}, e.endpointArgs()...), e.Network, spec.Name)...); err != nil {
+			return nil, err
+		}
+	}
+	return c.attached([]string{"start", "--attach", spec.Name}, stdout, stderr)
+}
+
+// runAttached starts `run` command with given arguments, streaming container output to the given writers.
+// Returned channel is closed once the command exits.
+func (c *dockerCLI) runAttached(runArgs []string, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	return c.attached(append([]string{"run"}, runArgs...), stdout, stderr)
+}
+
+// attached starts command attached to the container, streaming container output to the given writers.
+// Returned channel is closed once the command exits.
+func (c *dockerCLI) attached(args []string, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	// The attached command lives as long as the container, so it can't be bound to the start context.
+	cmd := c.command(context.Background(), args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	return exited, nil
+}
+
+func (c *dockerCLI) runContainer(ctx context.Context, spec dockerContainerSpec) ([]byte, error) {
+	return c.run(ctx, append([]string{"run"}, spec.runArgs()...)...)
+}
+
+func (c *dockerCLI) waitStarted(ctx context.Context, name string, poll backoff.Config) (state dockerContainerState, err error) {
+	for b := backoff.New(ctx, poll); b.Ongoing(); {
+		// Enforce a timeout on the command execution because we've seen some flaky tests
+		// stuck here.
+		inspectCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		state, err = c.inspectState(inspectCtx, name)
+		cancel()
+		if err == nil {
+			if state.running() || state.exited() {
+				return state, nil
+			}
+			err = errors.Newf("container is %s", state.Status)
+		}
+		b.Wait()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return state, err
+}
+
+func (c *dockerCLI) inspectState(ctx context.Context, name string) (dockerContainerState, error) {
+	out, err := c.run(ctx, "inspect", "--format={{json .State}}", name)
+	if err != nil {
+		return dockerContainerState{}, err
+	}
+	return parseDockerContainerState(out)
+}
+
+func (c *dockerCLI) inspect(ctx context.Context, name string) ([]byte, error) {
+	return c.run(ctx, "inspect", name)
+}
+
+func (c *dockerCLI) containerLabels(ctx context.Context, name string) (map[string]string, error) {
+	out, err := c.run(ctx, "inspect", "--format={{json .Config.Labels}}", name)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	if err := json.Unmarshal(out, &labels); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal labels of container %s", name)
+	}
+	return labels, nil
+}
+
+func (c *dockerCLI) attachContainer(_ context.Context, name string, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	// Following logs lives as long as the container, so it can't be bound to the given context.
+	cmd := c.command(context.Background(), "logs", "--follow", "--since", strconv.FormatInt(time.Now().Unix(), 10), name)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	return exited, nil
+}
+
+func (c *dockerCLI) hostPort(ctx context.Context, name string, containerPort int, protocol string) (int, error) {
+	out, err := c.run(ctx, "port", name, dockerPortBinding{ContainerPort: containerPort, Protocol: protocol}.portKey())
+	if err != nil {
+		return 0, err
+	}
+	return getDockerPortMapping(out)
+}
+
+func (c *dockerCLI) containerIP(ctx context.Context, name, network string) (string, error) {
+	out, err := c.run(ctx, "inspect", fmt.Sprintf("--format={{(index .NetworkSettings.Networks %q).IPAddress}}", network), name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (c *dockerCLI) stopContainer(ctx context.Context, name string, timeoutSeconds int) error {
+	_, err := c.run(ctx, "stop", "--time="+strconv.Itoa(timeoutSeconds), name)
+	return err
+}
+
+func (c *dockerCLI) removeContainer(ctx context.Context, name string, force bool) error {
+	args := []string{"rm"}
+	if force {
+		args = append(args, "--force")
+	}
+	_, err := c.run(ctx, append(args, name)...)
+	return err
+}
+
+func (c *dockerCLI) pauseContainer(ctx context.Context, name string) error {
+	_, err := c.run(ctx, "pause", name)
+	return err
+}
+
+func (c *dockerCLI) unpauseContainer(ctx context.Context, name string) error {
+	_, err := c.run(ctx, "unpause", name)
+	return err
+}
+
+func (c *dockerCLI) signalContainer(ctx context.Context, name string, signal int) error {
+	_, err := c.run(ctx, "kill", "--signal", strconv.Itoa(signal), name)
+	return err
+}
+
+func (c *dockerCLI) exec(ctx context.Context, name string, cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	args := []string{"exec"}
+	if stdin != nil {
+		args = append(args, "-i")
+	}
+	args = append(args, name)
+	args = append(args, cmd...)
+
+	c2 := c.command(ctx, args...)
+	if stdin != nil {
+		c2.Stdin = stdin
+	}
+	c2.Stdout = stdout
+	c2.Stderr = stderr
+	return c2.Run()
+}
+
+func (c *dockerCLI) copyTo(ctx context.Context, name, hostPath, containerPath string) error {
+	_, err := c.run(ctx, "cp", hostPath, name+":"+containerPath)
+	return err
+}
+
+func (c *dockerCLI) copyFrom(ctx context.Context, name, containerPath, hostPath string) error {
+	_, err := c.run(ctx, "cp", name+":"+containerPath, hostPath)
+	return err
+}
+
+// stats returns resource usage reported by `docker stats`. CPU time and RSS are not reported there, so they are zero,
+// see RunnableStats.
+func (c *dockerCLI) stats(ctx context.Context, name string) (RunnableStats, error) {
+	c.logUnsupportedStats("CPU time and RSS are not reported by `docker stats`, so they are zero; use WithDockerEngineAPI to get them")
+
+	out, err := c.run(ctx, "stats", "--no-stream", "--format={{json .}}", name)
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	stats, err := parseDockerCLIStats(out)
+	if err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "parse stats of container %s", name)
+	}
+	return stats, nil
+}
+
+// logUnsupportedStats logs the given message about stats the CLI doesn't report, once per environment.
+func (c *dockerCLI) logUnsupportedStats(msg string) {
+	c.unsupportedStatsOnce.Do(func() { c.logger.Log(msg) })
+}
+
+// parseDockerCLIStats parses single line of `docker stats --format={{json .}}` output.
+func parseDockerCLIStats(out []byte) (RunnableStats, error) {
+	var s struct {
+		MemUsage string `json:"MemUsage"`
+		NetIO    string `json:"NetIO"`
+		BlockIO  string `json:"BlockIO"`
+		PIDs     string `json:"PIDs"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(out), &s); err != nil {
+		return RunnableStats{}, err
+	}
+
+	var (
+		stats RunnableStats
+		err   error
+	)
+	// Docker reports memory usage without inactive page cache (as in working set), followed by the limit.
+	if stats.MemoryWorkingSetBytes, _, err = parseHumanSizePair(s.MemUsage); err != nil {
+		return RunnableStats{}, err
+	}
+	if stats.NetworkRxBytes, stats.NetworkTxBytes, err = parseHumanSizePair(s.NetIO); err != nil {
+		return RunnableStats{}, err
+	}
+	if stats.BlockReadBytes, stats.BlockWriteBytes, err = parseHumanSizePair(s.BlockIO); err != nil {
+		return RunnableStats{}, err
+	}
+	if s.PIDs != "" && s.PIDs != "--" {
+		if stats.PIDs, err = strconv.ParseUint(s.PIDs, 10, 64); err != nil {
+			return RunnableStats{}, errors.Wrapf(err, "parse PIDs %q", s.PIDs)
+		}
+	}
+	return stats, nil
+}
@@ -10,8 +10,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/efficientgo/core/backoff"
@@ -29,6 +32,23 @@ type environmentOptions struct {
 
 	volumes []string
 	cpus    string
+
+	dockerAPI       bool
+	dockerAPISocket string
+
+	reuse         bool
+	keepOnFailure bool
+
+	artifactsDir string
+	// artifactsIf tells if artifacts should be collected on close. Always, if nil.
+	artifactsIf func() bool
+
+	imageCacheDir string
+
+	networks []Network
+
+	// logHistoryLimit is the maximum number of lines in runnable log history, see WithLogHistoryLimit.
+	logHistoryLimit int
 }
 
 func WithCPUs(cpus string) EnvironmentOption {
@@ -71,6 +91,59 @@ func WithVolumes(volumes ...string) EnvironmentOption {
 	}
 }
 
+// WithDockerEngineAPI tells docker environment to talk to Docker Engine API over the given Unix socket
+// instead of shelling out to the docker CLI. Empty socket path means the socket from DOCKER_HOST
+// or /var/run/docker.sock. Engine errors are returned as *DockerAPIError.
+func WithDockerEngineAPI(socketPath string) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.dockerAPI = true
+		o.dockerAPISocket = socketPath
+	}
+}
+
+// WithReuse tells docker environment to keep its network, shared directory and running runnables on Close, so the
+// next test run (e.g. the next `go test` invocation) can reuse them. Runnable that is started with exactly the same
+// options as its still running container is reattached instead of started from scratch, others are recreated.
+// Reuse can also be enabled with E2E_REUSE=1 environment variable. Environment has to have the same name in both runs,
+// which is the case by default (see WithName). Next run without reuse cleans all the resources.
+//
+// NOTE: Reattached runnable keeps its state (e.g. data in its directory) from the previous run, jobs are always started
+// again. Runnables are reused based on their options, not image content, so mutable tags (e.g. `latest`) are not
+// updated automatically.
+func WithReuse() EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.reuse = true
+	}
+}
+
+// WithKeepOnFailure tells environment created with NewForTest to stay alive if the test fails, so the broken state can
+// be inspected. Instead of closing the environment, endpoints of all started runnables and commands to tear the
+// environment down are printed. It can also be enabled with E2E_KEEP_ON_FAILURE=1 environment variable.
+func WithKeepOnFailure() EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.keepOnFailure = true
+	}
+}
+
+// WithArtifacts tells environment to collect artifacts of every runnable into the given directory on Close, before
+// runnables are killed. Every runnable gets its own subdirectory with its logs (see WithLogHistoryLimit), engine specific
+// details (e.g. docker inspect output) and artifacts written by registered collectors (see AddArtifactCollector), e.g.
+// last metrics scrape of e2emon instrumented runnables. It can also be enabled with E2E_ARTIFACTS_DIR environment variable.
+//
+// Environments created with NewForTest collect artifacts only when the test fails, into the directory of the test.
+func WithArtifacts(dir string) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.artifactsDir = dir
+	}
+}
+
+// withArtifactsCondition makes environment collect artifacts only if the given function returns true on Close.
+func withArtifactsCondition(f func() bool) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.artifactsIf = f
+	}
+}
+
 // Environment defines how to run Runnable in isolated area e.g via docker in isolated docker network.
 type Environment interface {
 	// Name returns environment name.
@@ -83,12 +156,23 @@ type Environment interface {
 	Runnable(name string) RunnableBuilder
 	// AddListener registers given listener to be notified on environment runnable changes.
 	AddListener(listener EnvironmentListener)
+	// AddEventListener registers given listener to be notified on given lifecycle events of all runnables in the environment.
+	// Listener is notified on all events, if no event types are given.
+	AddEventListener(listener RunnableEventListener, types ...RunnableEventType)
 	// AddCloser registers function to be invoked on close, before all containers are sent kill signal.
 	AddCloser(func())
+	// PrePull makes images of the given initialized runnables (or all initialized runnables of the environment, if none
+	// are given) available in parallel, according to their pull policy, so the following starts don't wait for it.
+	// Images declared with RunnableBuilder.WithBuild are built.
+	PrePull(ctx context.Context, runnables ...Linkable) error
+	// Partition drops all network traffic between given running runnables until returned fault is healed.
+	Partition(a, b Linkable) (Fault, error)
 	// Close shutdowns isolated environment and cleans its resources.
 	Close()
 }
 
+// EnvironmentListener is notified with all started runnables whenever runnable is started or stopped. Use
+// Environment.AddEventListener to be notified on specific lifecycle events instead.
 type EnvironmentListener interface {
 	OnRunnableChange(started []Runnable) error
 }
@@ -107,8 +191,99 @@ type StartOptions struct {
 	Privileged       bool
 	Capabilities     []RunnableCapabilities
 
+	// Files maps absolute container paths to files created there before the runnable starts, e.g. configuration
+	// or certificates. Unlike Volumes, it works the same in every environment: Docker bind mounts them from the shared
+	// directory and Kind mounts them from a ConfigMap (or a Secret, see File.Secret). Files are read-only for the
+	// runnable. Process environment writes them under Dir, at the container path (e.g. to <Dir>/etc/app.yaml).
+	Files map[string]File
+	// Tmpfs lists absolute container paths to mount in-memory file systems at. Ignored by process environment.
+	Tmpfs []string
+	// NamedVolumes maps absolute container paths to names of volumes mounted there. Volumes are created on first use,
+	// keep their content across restarts, can be shared by runnables of the environment and are removed on Close.
+	// Ignored by process environment.
+	NamedVolumes map[string]string
+
+	// Networks maps names of networks runnable is attached to (extra networks declared with WithNetworks, or
+	// environment name for the default network) to attachment settings, e.g. aliases or static addresses. Runnable is
+	// attached only to the default network, if empty. InternalEndpoint is reachable from runnables sharing any network
+	// with the runnable. Supported only by docker and podman environments.
+	Networks map[string]NetworkAttachment
+
 	LimitMemoryBytes uint
 	LimitCPUs        float64
+
+	// StopSignal is the signal sent to the runnable on Stop. Docker's default (SIGTERM, unless image says otherwise)
+	// is used if nil. Only syscall.Signal values are supported.
+	StopSignal os.Signal
+	// StopGracePeriod is the time given to the runnable to stop after StopSignal, before it's killed. Defaults to 30s.
+	StopGracePeriod time.Duration
+
+	// PinHostPorts makes runnable reuse host ports assigned on the first start, when started again after Stop or Kill,
+	// so clients built using Endpoint keep working. Restart always reuses host ports.
+	PinHostPorts bool
+
+	// Job marks runnable as a one-shot job (e.g. migration or seed step) that is expected to exit on its own.
+	// Use Runnable.Wait to wait for it to finish and get its exit status.
+	Job bool
+
+	// PullPolicy tells when Image is pulled before the start. Defaults to PullIfNotPresent. Ignored by process
+	// environment and for images built with RunnableBuilder.WithBuild.
+	PullPolicy PullPolicy
+}
+
+const defaultStopGracePeriod = 30 * time.Second
+
+// stopGracePeriodSeconds returns stop grace period from options (or the default one) in whole seconds, rounded up.
+func stopGracePeriodSeconds(opts StartOptions) int {
+	if opts.StopGracePeriod <= 0 {
+		return int(defaultStopGracePeriod / time.Second)
+	}
+	return int((opts.StopGracePeriod + time.Second - 1) / time.Second)
+}
+
+// signalNumber returns number of the given signal, as understood by container runtimes.
+func signalNumber(sig os.Signal) (int, error) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return 0, errors.Newf("unsupported signal %v; expected syscall.Signal", sig)
+	}
+	return int(s), nil
+}
+
+// ExitStatus represents the way job runnable exited.
+type ExitStatus struct {
+	ExitCode int
+	// OOMKilled is true if runnable was killed due to exceeding its memory limit.
+	OOMKilled  bool
+	FinishedAt time.Time
+}
+
+// terminatedErrorLogLines is the number of last log lines attached to TerminatedError.
+const terminatedErrorLogLines = 20
+
+// TerminatedError is returned when runnable terminates while it's expected to run, e.g. when it crashes
+// during start or before it's ready.
+type TerminatedError struct {
+	Name   string
+	Status ExitStatus
+	// LastLogs contains last lines printed by runnable before it terminated.
+	LastLogs []LogLine
+}
+
+func (e *TerminatedError) Error() string {
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("service %s terminated with exit code %d", e.Name, e.Status.ExitCode))
+	if e.Status.OOMKilled {
+		b.WriteString(" (OOM killed)")
+	}
+	if len(e.LastLogs) > 0 {
+		b.WriteString("; last logs:")
+		for _, l := range e.LastLogs {
+			b.WriteString("\n\t")
+			b.WriteString(l.Text)
+		}
+	}
+	return b.String()
 }
 
 type RunnableCapabilities string
@@ -148,6 +323,18 @@ type RunnableBuilder interface {
 	// WithPorts adds ports to runnable, allowing caller to
 	// use `InternalEndpoint` and `Endpoint` methods by referencing port by name.
 	WithPorts(map[string]int) RunnableBuilder
+	// WithPortSpecs is like WithPorts, but ports are described by specs, e.g. UDP ports or ports published on fixed host
+	// port. Endpoint and InternalEndpoint return host:port of the port in the given protocol, e.g. to use with
+	// net.Dial("udp", ...). WithPorts(ports) is the same as WithPortSpecs with TCPPort spec of every port.
+	WithPortSpecs(map[string]PortSpec) RunnableBuilder
+	// DependsOn declares that runnable can be started only once all given runnables are ready.
+	// See StartAndWaitReady for details.
+	DependsOn(...Linkable) RunnableBuilder
+	// WithBuild builds image of the runnable from the Dockerfile (relative to contextDir, "Dockerfile" if empty) in
+	// contextDir with the given build arguments on every start, instead of using StartOptions.Image. Images are
+	// tagged by the hash of the build context and arguments, so unchanged images are not rebuilt. Kind environment
+	// loads the built image into the cluster. Not supported by process environment.
+	WithBuild(contextDir, dockerfile string, buildArgs map[string]string) RunnableBuilder
 	// Future returns future runnable
 	Future() FutureRunnable
 	// Init returns runnable.
@@ -163,13 +350,24 @@ type runnable interface {
 	// IsRunning returns if runnable was started.
 	IsRunning() bool
 
+	// Dependencies returns runnables declared with RunnableBuilder.DependsOn.
+	Dependencies() []Linkable
+
 	// Start tells Runnable to start.
 	Start() error
 
+	// StartContext is like Start, but it gives up and cleans up partially started runnable when the given
+	// context is done (e.g. on test deadline or interrupt). Context only bounds the start itself, not the
+	// lifetime of the started runnable.
+	StartContext(ctx context.Context) error
+
 	// WaitReady waits until the Runnable is ready. It should return error if runnable is stopped in mean time or
 	// it was stopped before.
 	WaitReady() error
 
+	// WaitReadyContext is like WaitReady, but it returns early with error when the given context is done.
+	WaitReadyContext(ctx context.Context) error
+
 	// Kill tells Runnable to get killed immediately.
 	// It should be ok to Stop and Kill more than once, with next invokes being noop.
 	Kill() error
@@ -178,11 +376,72 @@ type runnable interface {
 	// It should be ok to Stop and Kill more than once, with next invokes being noop.
 	Stop() error
 
+	// StopContext is like Stop, but it returns early with error when the given context is done.
+	StopContext(ctx context.Context) error
+
+	// Restart gracefully stops the running runnable, starts it again and waits until it's ready. Host ports are
+	// reused, so Endpoint returns the same addresses as before. Data in Dir is preserved. Jobs can't be restarted.
+	Restart(ctx context.Context) error
+
+	// Pause freezes all processes of the runnable (e.g. to simulate long GC pause or hung node) until Unpause is invoked.
+	Pause() error
+
+	// Unpause resumes processes of the runnable frozen by Pause.
+	Unpause() error
+
+	// Signal sends given signal to the main process of the runnable. Only syscall.Signal values are supported.
+	Signal(sig os.Signal) error
+
 	// Exec runs the provided command inside the same process context (e.g. in the running docker container).
 	// It returns error response from attempting to run the command.
 	// See ExecOptions for more options like returning output or attaching to e2e logging.
 	Exec(Command, ...ExecOption) error
 
+	// ExecContext is like Exec, but the executed command is killed when the given context is done.
+	ExecContext(context.Context, Command, ...ExecOption) error
+
+	// Wait waits until the job runnable (see StartOptions.Job) exits and returns its exit status. Non-zero exit code
+	// is not treated as error. Once Wait returns, the runnable is stopped and can be started again.
+	// It returns error for runnables that are not jobs or were not started.
+	Wait(ctx context.Context) (ExitStatus, error)
+
+	// InjectLatency delays outgoing network packets of the runnable by given latency (+/- jitter) until returned
+	// fault is healed. Injecting latency again replaces the previous one. Network faults of different kinds
+	// (latency, packet loss, bandwidth) are combined and apply to all network interfaces of the runnable but loopback.
+	InjectLatency(latency, jitter time.Duration) (Fault, error)
+
+	// InjectPacketLoss drops given percent (0-100) of outgoing network packets of the runnable until returned
+	// fault is healed. Injecting packet loss again replaces the previous one.
+	InjectPacketLoss(percent float64) (Fault, error)
+
+	// LimitBandwidth limits outgoing network bandwidth of the runnable to given bits per second until returned
+	// fault is healed. Limiting bandwidth again replaces the previous limit.
+	LimitBandwidth(bitsPerSecond uint64) (Fault, error)
+
+	// Stats returns current resource usage of the runnable: CPU time, memory, network and block I/O counters and
+	// number of processes. Stats that environment can't measure are zero. It returns error if runnable is not running.
+	// See WaitStats for waiting until stats meet expectations.
+	Stats(ctx context.Context) (RunnableStats, error)
+
+	// CopyTo copies the host file or directory to the given path in the runnable (e.g. in the docker container),
+	// which works also for paths baked into the image, unlike the shared Dir. Like with `cp -r`, it's copied into
+	// containerPath if it's an existing directory, or as containerPath otherwise. The runnable has to be running.
+	CopyTo(ctx context.Context, hostPath, containerPath string) error
+
+	// CopyFrom copies the file or directory from the given path in the runnable to the host. Like with `cp -r`, it's
+	// copied into hostPath if it's an existing directory, or as hostPath otherwise. The runnable has to be running.
+	CopyFrom(ctx context.Context, containerPath, hostPath string) error
+
+	// Logs returns history of lines the runnable printed to stdout and stderr.
+	Logs() *Logs
+
+	// WaitLogLine waits until the runnable prints line matching given pattern and returns it.
+	// It returns error if runnable is stopped or the context is done before that.
+	// By default, only lines printed since the latest start are considered. See LogLineOption for more options.
+	// Lines already evicted from the log history (see WithLogHistoryLimit) are not considered, even if the requested
+	// offset points to them.
+	WaitLogLine(ctx context.Context, pattern *regexp.Regexp, opts ...LogLineOption) (LogLine, error)
+
 	// Endpoint returns external runnable endpoint (host:port) for given port name.
 	// External means that it will be accessible only from host, but not from docker containers.
 	//
@@ -234,18 +493,14 @@ type Runnable interface {
 	Linkable
 }
 
+// StartAndWaitReady starts given runnables and waits until all of them are ready.
+// Runnable with declared dependencies (see RunnableBuilder.DependsOn) is started once all of them are ready, in
+// parallel with other runnables. Runnables without declared dependencies are started one by one in the given order,
+// as before dependencies were introduced. Dependencies that are not part of given runnables are considered satisfied,
+// as they are managed by the caller. On first failure, runnables not yet started are not started anymore and errors
+// are returned, naming the dependency edge that failed.
 func StartAndWaitReady(runnables ...Runnable) error {
-	for _, r := range runnables {
-		if err := r.Start(); err != nil {
-			return err
-		}
-	}
-	for _, r := range runnables {
-		if err := r.WaitReady(); err != nil {
-			return err
-		}
-	}
-	return nil
+	return StartAndWaitReadyContext(context.Background(), runnables...)
 }
 
 type Command struct {
@@ -397,3 +652,22 @@ func NewCmdReadinessProbe(cmd Command) *CmdReadinessProbe {
 func (p *CmdReadinessProbe) Ready(runnable Runnable) error {
 	return runnable.Exec(p.cmd)
 }
+
+// LogReadinessProbe checks readiness by looking for log line matching the given pattern, printed since the latest start.
+type LogReadinessProbe struct {
+	pattern *regexp.Regexp
+}
+
+func NewLogReadinessProbe(pattern *regexp.Regexp) *LogReadinessProbe {
+	return &LogReadinessProbe{pattern: pattern}
+}
+
+func (p *LogReadinessProbe) Ready(runnable Runnable) error {
+	logs := runnable.Logs()
+	for _, line := range logs.Since(logs.StartOffset()) {
+		if p.pattern.MatchString(line.Text) {
+			return nil
+		}
+	}
+	return errors.Newf("no log line matching %q found", p.pattern.String())
+}
@@ -7,22 +7,26 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/efficientgo/e2e/host"
 
 	"github.com/efficientgo/core/backoff"
 	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
 )
 
 const (
@@ -37,22 +41,48 @@ var (
 )
 
 // DockerEnvironment defines single node docker engine that allows to run Services.
+// Environment and its runnables are safe for concurrent use, e.g. replicas can be started from multiple goroutines.
 type DockerEnvironment struct {
 	dir         string
 	logger      Logger
 	networkName string
+	backend     dockerBackend
 
 	hostAddr      string
 	dockerVolumes []string
 	cpus          string
+	// userNs is the user namespace mode of runnables that don't set StartOptions.UserNs.
+	userNs string
+	// rootOwnedFiles is true if files created by containers in the shared dir might be owned by root,
+	// so they have to be made writable before removing the dir.
+	rootOwnedFiles bool
+	// reuse is true if environment resources are kept on Close for the next run. See WithReuse.
+	reuse bool
+	// artifactsCloser collects artifacts if configured (see WithArtifacts), nil otherwise.
+	artifactsCloser func()
+	// imageCacheDir is the directory of image tarballs, if configured (see WithImageCache).
+	imageCacheDir string
+	// networks are extra networks of the environment, see WithNetworks.
+	networks []Network
+	// logHistoryLimit is the maximum number of lines in log history of runnables, 0 means no limit.
+	logHistoryLimit int
 
+	verbose bool
+
+	// mutex guards registered, runnables, closers and closed, as runnables can be created concurrently.
+	mutex      sync.Mutex
 	registered map[string]struct{}
+	// runnables contains all runnables created in the environment, in creation order.
+	runnables []*dockerRunnable
+	closers   []func()
+	closed    bool
+
+	// startedMtx guards listeners and started, as runnables can be started concurrently.
+	startedMtx sync.Mutex
 	listeners  []EnvironmentListener
 	started    []Runnable
 
-	verbose bool
-	closers []func()
-	closed  bool
+	events runnableEvents
 }
 
 func generateName() (string, error) {
@@ -90,6 +120,12 @@ func NewDockerEnvironment(name string, opts ...EnvironmentOption) (_ *DockerEnvi
 
 // New creates new, isolated docker environment.
 func New(opts ...EnvironmentOption) (_ *DockerEnvironment, err error) {
+	return NewContext(context.Background(), opts...)
+}
+
+// NewContext creates new, isolated docker environment. Context bounds the setup of the environment, e.g. creation of
+// its networks. If setup fails, resources created so far are removed regardless of the context.
+func NewContext(ctx context.Context, opts ...EnvironmentOption) (_ *DockerEnvironment, err error) {
 	e := environmentOptions{}
 	for _, o := range opts {
 		o(&e)
@@ -103,6 +139,9 @@ func New(opts ...EnvironmentOption) (_ *DockerEnvironment, err error) {
 	if err := validateName(e.name); err != nil {
 		return nil, err
 	}
+	if err := validateNetworks(e.name, e.networks); err != nil {
+		return nil, err
+	}
 
 	if e.logger == nil {
 		e.logger = NewLogger(os.Stdout)
@@ -115,92 +154,223 @@ func New(opts ...EnvironmentOption) (_ *DockerEnvironment, err error) {
 		registered:    map[string]struct{}{},
 		dockerVolumes: e.volumes,
 		cpus:          e.cpus,
+		backend:       newDockerCLI(e.logger, e.verbose),
+		// Containers run as root by default.
+		rootOwnedFiles: true,
+		reuse:          e.reuseEnabled(),
+		imageCacheDir:  e.imageCacheDirectory(),
+		networks:       e.networks,
+
+		logHistoryLimit: e.logHistoryLimitOrDefault(),
+	}
+	if e.dockerAPI {
+		socket := e.dockerAPISocket
+		if socket == "" {
+			socket = dockerSocketPath()
+		}
+		d.backend = newDockerAPI(socket, e.logger, e.verbose)
 	}
 
-	// Force a shutdown in order to cleanup from a spurious situation in case
-	// the previous tests run didn't cleanup correctly.
-	d.close()
-
-	dir, err := getTmpDirectory()
-	if err != nil {
+	if err := d.setup(ctx); err != nil {
 		return nil, err
 	}
-	d.dir = dir
-
-	// Setup the docker network.
-	if out, err := d.exec("docker", "network", "create", "-d", "bridge", d.networkName).CombinedOutput(); err != nil {
-		e.logger.Log(string(out))
-		d.Close()
-		return nil, errors.Wrapf(err, "create docker network '%s'", d.networkName)
-	}
+	d.addArtifactsCloser(e)
 
 	switch host.OSPlatform() {
 	case "darwin", "WSL2":
 		d.hostAddr = dockerGatewayAddr
 	default: // the "linux" behavior is default
-		out, err := d.exec("docker", "network", "inspect", d.networkName).CombinedOutput()
+		d.hostAddr, err = d.backend.networkGateway(ctx, d.networkName)
 		if err != nil {
-			e.logger.Log(string(out))
 			d.Close()
 			return nil, errors.Wrapf(err, "inspect docker network '%s'", d.networkName)
 		}
+	}
+
+	return d, e.logger.Log("msg", "started docker environment", "name", d.networkName)
+}
 
-		var inspectDetails []struct {
-			IPAM struct {
-				Config []struct {
-					Gateway string `json:"Gateway"`
-				} `json:"Config"`
-			} `json:"IPAM"`
+const reuseEnvName = "E2E_REUSE"
+
+// reuseEnabled returns true if environment should be reused, either because of WithReuse or E2E_REUSE environment variable.
+func (o environmentOptions) reuseEnabled() bool {
+	if o.reuse {
+		return true
+	}
+	reuse, _ := strconv.ParseBool(os.Getenv(reuseEnvName))
+	return reuse
+}
+
+// setup creates shared directory and network of the environment.
+func (e *DockerEnvironment) setup(ctx context.Context) error {
+	reusedDir, err := getReusedTmpDirectory(e.networkName)
+	if err != nil {
+		return err
+	}
+
+	if e.reuse {
+		return e.setupReused(ctx, reusedDir)
+	}
+
+	// Force a shutdown in order to cleanup from a spurious situation in case
+	// the previous tests run didn't cleanup correctly.
+	e.close(ctx)
+	// Previous run might have been kept for reuse.
+	if _, err := os.Stat(reusedDir); err == nil {
+		e.removeSharedDir(reusedDir)
+	}
+
+	dir, err := getTmpDirectory()
+	if err != nil {
+		return err
+	}
+	e.dir = dir
+
+	// Setup the docker networks.
+	if err := e.createNetworks(ctx, false); err != nil {
+		e.Close()
+		return err
+	}
+	return nil
+}
+
+// setupReused sets up environment reusing networks and shared directory kept by the previous run, if any. Directory is
+// created once networks are set up, so failed setup doesn't leave it behind.
+func (e *DockerEnvironment) setupReused(ctx context.Context, dir string) error {
+	if err := e.createNetworks(ctx, true); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	e.dir = dir
+	return nil
+}
+
+// networkSpecs returns specs of the default network and extra networks of the environment (see WithNetworks).
+func (e *DockerEnvironment) networkSpecs() []dockerNetworkSpec {
+	specs := []dockerNetworkSpec{{Name: e.networkName}}
+	for _, n := range e.networks {
+		specs = append(specs, dockerNetworkSpec{
+			Name:       dockerNetworkName(e.networkName, n.Name),
+			Subnet:     n.Subnet,
+			IPv6Subnet: n.IPv6Subnet,
+			Internal:   n.Internal,
+		})
+	}
+	return specs
+}
+
+// createNetworks creates networks of the environment. If reuse is true, networks kept by the previous run are reused.
+func (e *DockerEnvironment) createNetworks(ctx context.Context, reuse bool) error {
+	for _, n := range e.networkSpecs() {
+		if reuse {
+			ok, err := e.existDockerNetwork(ctx, n.Name)
+			if err != nil {
+				return err
+			}
+			if ok {
+				e.logger.Log("Reusing docker network", n.Name)
+				continue
+			}
 		}
-		if err := json.Unmarshal(out, &inspectDetails); err != nil {
-			return nil, errors.Wrap(err, "unmarshall docker inspect details to obtain Gateway IP")
+		if err := e.backend.createNetwork(ctx, n); err != nil {
+			return errors.Wrapf(err, "create docker network '%s'", n.Name)
 		}
+	}
+	return nil
+}
 
-		if len(inspectDetails) != 1 || len(inspectDetails[0].IPAM.Config) != 1 {
-			return nil, errors.Newf("unexpected format of docker inspect; expected exactly one element in root and IPAM.Config, got %v", string(out))
-		}
-		d.hostAddr = inspectDetails[0].IPAM.Config[0].Gateway
+// addArtifactsCloser registers closer collecting artifacts, if configured in the given options.
+func (e *DockerEnvironment) addArtifactsCloser(o environmentOptions) {
+	if c := o.artifactsCloser(e.logger, e.CollectArtifacts); c != nil {
+		e.artifactsCloser = c
+		e.AddCloser(c)
 	}
+}
 
-	return d, e.logger.Log("msg", "started docker environment", "name", d.networkName)
+// CollectArtifacts writes artifacts of every runnable created in the environment into its own subdirectory of dir,
+// including `docker inspect` output of running containers. See WithArtifacts for details.
+func (e *DockerEnvironment) CollectArtifacts(ctx context.Context, dir string) error {
+	e.mutex.Lock()
+	runnables := make([]Runnable, 0, len(e.runnables))
+	for _, r := range e.runnables {
+		runnables = append(runnables, r)
+	}
+	e.mutex.Unlock()
+	return collectArtifacts(ctx, dir, runnables, func(ctx context.Context, r Runnable, dir string) error {
+		d := r.(*dockerRunnable)
+		if !d.IsRunning() {
+			return nil
+		}
+		out, err := e.backend.inspect(ctx, d.containerName())
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "inspect.json"), out, 0644)
+	})
 }
 
 func (e *DockerEnvironment) HostAddr() string { return e.hostAddr }
 func (e *DockerEnvironment) Name() string     { return e.networkName }
 
 func (e *DockerEnvironment) AddCloser(f func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	e.closers = append(e.closers, f)
 }
 
 func (e *DockerEnvironment) Runnable(name string) RunnableBuilder {
+	e.mutex.Lock()
+	d, err := e.newRunnable(name)
+	e.mutex.Unlock()
+	if err != nil {
+		return errorer{name: name, err: err}
+	}
+	e.events.emit(RunnableEvent{Type: RunnableCreated, Runnable: d})
+	return d
+}
+
+// newRunnable creates and registers runnable with the given name. The mutex must be held.
+func (e *DockerEnvironment) newRunnable(name string) (*dockerRunnable, error) {
 	if e.closed {
-		return errorer{name: name, err: errors.New("environment close was invoked already.")}
+		return nil, errors.New("environment close was invoked already.")
 	}
 
 	if e.isRegistered(name) {
-		return errorer{name: name, err: errors.Newf("there is already one runnable created with the same name %v", name)}
+		return nil, errors.Newf("there is already one runnable created with the same name %v", name)
 	}
 
 	d := &dockerRunnable{
 		env:        e,
 		name:       name,
 		logger:     e.logger,
-		ports:      map[string]int{},
+		ports:      map[string]PortSpec{},
 		hostPorts:  map[string]int{},
 		extensions: map[any]any{},
+		logs:       newLogs(e.logHistoryLimit),
 	}
 	if err := os.MkdirAll(d.Dir(), 0750); err != nil {
-		return errorer{name: name, err: err}
+		return nil, err
 	}
 	e.register(name)
-	return d
+	e.runnables = append(e.runnables, d)
+	return d, nil
 }
 
 // AddListener registers given listener to be notified on environment runnable changes.
 func (e *DockerEnvironment) AddListener(listener EnvironmentListener) {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
 	e.listeners = append(e.listeners, listener)
 }
 
+// AddEventListener registers given listener to be notified on given lifecycle events of all runnables in the environment.
+// Listener is notified on all events, if no event types are given.
+func (e *DockerEnvironment) AddEventListener(listener RunnableEventListener, types ...RunnableEventType) {
+	e.events.add(listener, types...)
+}
+
 type errorer struct {
 	name string
 	err  error
@@ -214,23 +384,50 @@ func NewFailedRunnable(name string, err error) Runnable {
 	}
 }
 
-func (e errorer) BuildErr() error                          { return e.err }
-func (e errorer) Name() string                             { return e.name }
-func (errorer) Dir() string                                { return "" }
-func (errorer) InternalDir() string                        { return "" }
-func (e errorer) Start() error                             { return e.BuildErr() }
-func (e errorer) WaitReady() error                         { return e.BuildErr() }
-func (e errorer) Kill() error                              { return e.BuildErr() }
-func (e errorer) Stop() error                              { return e.BuildErr() }
-func (e errorer) Exec(Command, ...ExecOption) error        { return e.BuildErr() }
-func (errorer) Endpoint(string) string                     { return "" }
-func (errorer) InternalEndpoint(string) string             { return "" }
-func (errorer) IsRunning() bool                            { return false }
+func (e errorer) BuildErr() error                                           { return e.err }
+func (e errorer) Name() string                                              { return e.name }
+func (errorer) Dir() string                                                 { return "" }
+func (errorer) InternalDir() string                                         { return "" }
+func (e errorer) Start() error                                              { return e.BuildErr() }
+func (e errorer) StartContext(context.Context) error                        { return e.BuildErr() }
+func (e errorer) WaitReady() error                                          { return e.BuildErr() }
+func (e errorer) WaitReadyContext(context.Context) error                    { return e.BuildErr() }
+func (e errorer) Kill() error                                               { return e.BuildErr() }
+func (e errorer) Stop() error                                               { return e.BuildErr() }
+func (e errorer) StopContext(context.Context) error                         { return e.BuildErr() }
+func (e errorer) Exec(Command, ...ExecOption) error                         { return e.BuildErr() }
+func (e errorer) ExecContext(context.Context, Command, ...ExecOption) error { return e.BuildErr() }
+func (e errorer) Wait(context.Context) (ExitStatus, error)                  { return ExitStatus{}, e.BuildErr() }
+func (e errorer) InjectLatency(_, _ time.Duration) (Fault, error)           { return nil, e.BuildErr() }
+func (e errorer) InjectPacketLoss(float64) (Fault, error)                   { return nil, e.BuildErr() }
+func (e errorer) LimitBandwidth(uint64) (Fault, error)                      { return nil, e.BuildErr() }
+func (e errorer) Restart(context.Context) error                             { return e.BuildErr() }
+func (e errorer) Pause() error                                              { return e.BuildErr() }
+func (e errorer) Unpause() error                                            { return e.BuildErr() }
+func (e errorer) Signal(os.Signal) error                                    { return e.BuildErr() }
+func (e errorer) Stats(context.Context) (RunnableStats, error)              { return RunnableStats{}, e.BuildErr() }
+func (e errorer) CopyTo(_ context.Context, _, _ string) error               { return e.BuildErr() }
+func (e errorer) CopyFrom(_ context.Context, _, _ string) error             { return e.BuildErr() }
+func (errorer) Endpoint(string) string                                      { return "" }
+func (errorer) InternalEndpoint(string) string                              { return "" }
+func (errorer) IsRunning() bool                                             { return false }
+func (errorer) Dependencies() []Linkable                                    { return nil }
+func (errorer) Logs() *Logs                                                 { return newLogs(0) }
+func (e errorer) WaitLogLine(context.Context, *regexp.Regexp, ...LogLineOption) (LogLine, error) {
+	return LogLine{}, e.BuildErr()
+}
 func (errorer) SetMetadata(_, _ any)                       {}
 func (errorer) GetMetadata(any) (any, bool)                { return nil, false }
 func (e errorer) Init(StartOptions) Runnable               { return e }
 func (e errorer) WithPorts(map[string]int) RunnableBuilder { return e }
-func (e errorer) Future() FutureRunnable                   { return e }
+func (e errorer) DependsOn(...Linkable) RunnableBuilder    { return e }
+func (e errorer) WithBuild(string, string, map[string]string) RunnableBuilder {
+	return e
+}
+func (e errorer) WithPortSpecs(map[string]PortSpec) RunnableBuilder {
+	return e
+}
+func (e errorer) Future() FutureRunnable { return e }
 
 func (e *DockerEnvironment) isRegistered(name string) bool {
 	_, ok := e.registered[name]
@@ -242,6 +439,9 @@ func (e *DockerEnvironment) register(name string) {
 }
 
 func (e *DockerEnvironment) registerStarted(r Runnable) error {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
+
 	e.started = append(e.started, r)
 
 	for _, l := range e.listeners {
@@ -253,6 +453,9 @@ func (e *DockerEnvironment) registerStarted(r Runnable) error {
 }
 
 func (e *DockerEnvironment) registerStopped(name string) error {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
+
 	for i, r := range e.started {
 		if r.Name() == name {
 			e.started = append(e.started[:i], e.started[i+1:]...)
@@ -271,93 +474,135 @@ func (e *DockerEnvironment) SharedDir() string {
 	return e.dir
 }
 
-const dockerCPUEnvName = "E2E_DOCKER_CPUS"
+const (
+	dockerCPUEnvName = "E2E_DOCKER_CPUS"
+	// dockerSpecHashLabel is the label with hash of the container spec, set in reuse mode.
+	dockerSpecHashLabel = "e2e.spec-hash"
+)
 
-func (e *DockerEnvironment) buildDockerRunArgs(name string, ports map[string]int, opts StartOptions) []string {
-	args := []string{"--rm", "--net=" + e.networkName, "--name=" + dockerNetworkContainerHost(e.networkName, name), "--hostname=" + name}
+// containerSpec returns spec of the runnable container. Ports without fixed host port, but with non-zero host port in
+// hostPorts are published on that host port, others on random one.
+func (e *DockerEnvironment) containerSpec(name string, ports map[string]PortSpec, hostPorts map[string]int, opts StartOptions) dockerContainerSpec {
+	// Containers are not auto removed, so we can tell why they exited. They are removed on Stop, Kill or Wait instead.
+	spec := dockerContainerSpec{
+		Name:              dockerNetworkContainerHost(e.networkName, name),
+		Hostname:          name,
+		NetworkMode:       e.networkName,
+		Image:             opts.Image,
+		DisableEntrypoint: opts.Command.EntrypointDisabled,
+		User:              opts.User,
+		UserNs:            e.userNs,
+		Privileged:        opts.Privileged,
+		MemoryBytes:       opts.LimitMemoryBytes,
+	}
+
+	if opts.UserNs != "" {
+		spec.UserNs = opts.UserNs
+	}
+
+	// Container is created in the first of its networks (the default one, if attached to it) and connected to the rest.
+	for _, n := range attachedNetworks(e.networkName, opts.Networks) {
+		a := opts.Networks[n]
+		spec.Endpoints = append(spec.Endpoints, dockerNetworkEndpoint{
+			Network:     dockerNetworkName(e.networkName, n),
+			Aliases:     a.Aliases,
+			IPv4Address: a.IPv4Address,
+			IPv6Address: a.IPv6Address,
+		})
+	}
+	if len(spec.Endpoints) > 0 {
+		spec.NetworkMode = spec.Endpoints[0].Network
+	}
 
 	// Mount the docker env working directory into the container. It's shared across all containers to allow easier scenarios.
-	args = append(args, "-v", fmt.Sprintf("%s:%s:z", e.dir, e.dir))
+	spec.Volumes = append(spec.Volumes, fmt.Sprintf("%s:%s:z", e.dir, e.dir))
+	spec.Volumes = append(spec.Volumes, e.dockerVolumes...)
+	spec.Volumes = append(spec.Volumes, opts.Volumes...)
+	// Files are written to the shared directory on start and mounted one by one, so the rest of the directory stays intact.
+	for _, p := range filePaths(opts.Files) {
+		spec.Volumes = append(spec.Volumes, fmt.Sprintf("%s:%s:ro,z", filepath.Join(e.filesDir(name), filepath.FromSlash(p)), p))
+	}
+	for _, p := range volumePaths(opts.NamedVolumes) {
+		spec.Volumes = append(spec.Volumes, dockerVolumeName(e.networkName, opts.NamedVolumes[p])+":"+p)
+	}
+	spec.Tmpfs = opts.Tmpfs
 
 	// Allow reducing available CPU Time via environment variables or
 	// environment parameters. The latter takes precedence.
-	dockerCPUsParam := ""
 	dockerCPUsEnv := os.Getenv(dockerCPUEnvName)
 	if dockerCPUsEnv != "" {
-		dockerCPUsParam = dockerCPUsEnv
+		spec.CPUs = dockerCPUsEnv
 	}
 	if e.cpus != "" {
-		dockerCPUsParam = e.cpus
-	}
-	if dockerCPUsParam != "" {
-		args = append(args, "--cpus", dockerCPUsParam)
+		spec.CPUs = e.cpus
 	}
-
-	for _, v := range e.dockerVolumes {
-		args = append(args, "-v", v)
-	}
-
-	for _, v := range opts.Volumes {
-		args = append(args, "-v", v)
+	if opts.LimitCPUs > 0 {
+		spec.CPUs = fmt.Sprintf("%f", opts.LimitCPUs)
 	}
 
-	// Environment variables
 	for name, value := range opts.EnvVars {
-		args = append(args, "-e", name+"="+value)
-	}
-
-	if opts.User != "" {
-		args = append(args, "--user", opts.User)
-	}
-
-	if opts.UserNs != "" {
-		args = append(args, "--userns", opts.UserNs)
-	}
-
-	if opts.Privileged {
-		args = append(args, "--privileged")
+		spec.Env = append(spec.Env, name+"="+value)
 	}
+	sort.Strings(spec.Env)
 
 	for _, c := range opts.Capabilities {
-		args = append(args, "--cap-add", string(c))
-	}
-
-	if opts.LimitMemoryBytes > 0 {
-		args = append(args, "--memory", fmt.Sprintf("%db", opts.LimitMemoryBytes))
-	}
-
-	if opts.LimitCPUs > 0 {
-		args = append(args, "--cpus", fmt.Sprintf("%f", opts.LimitCPUs))
+		spec.Capabilities = append(spec.Capabilities, string(c))
 	}
 
 	// Published ports.
-	for _, port := range ports {
-		args = append(args, "-p", strconv.Itoa(port))
+	portNames := make([]string, 0, len(ports))
+	for portName := range ports {
+		portNames = append(portNames, portName)
+	}
+	sort.Strings(portNames)
+	for _, portName := range portNames {
+		p := ports[portName]
+		b := dockerPortBinding{ContainerPort: p.Port, Protocol: string(p.protocol()), HostPort: p.HostPort, HostIP: p.HostIP}
+		if b.HostPort == 0 {
+			b.HostPort = hostPorts[portName]
+		}
+		spec.Ports = append(spec.Ports, b)
 	}
 
-	// Disable entrypoint if required.
-	if opts.Command.EntrypointDisabled {
-		args = append(args, "--entrypoint", "")
+	if opts.StopSignal != nil {
+		// Validated on Init.
+		spec.StopSignal, _ = signalNumber(opts.StopSignal)
 	}
 
-	args = append(args, opts.Image)
 	if opts.Command.Cmd != "" {
-		args = append(args, opts.Command.Cmd)
+		spec.Cmd = append(spec.Cmd, opts.Command.Cmd)
 	}
-	if len(opts.Command.Args) > 0 {
-		args = append(args, opts.Command.Args...)
+	spec.Cmd = append(spec.Cmd, opts.Command.Args...)
+
+	if e.reuse {
+		// Allows to tell if the running container can be reused.
+		spec.Labels = map[string]string{dockerSpecHashLabel: spec.hash()}
 	}
-	return args
+	return spec
 }
 
 type dockerRunnable struct {
-	env   *DockerEnvironment
-	name  string
-	ports map[string]int
-
-	logger           Logger
-	opts             StartOptions
-	waitBackoffReady *backoff.Backoff
+	env    *DockerEnvironment
+	name   string
+	logger Logger
+	logs   *Logs
+
+	// lifecycle serializes operations changing the container state (e.g. start, stop or kill), so they don't interleave.
+	lifecycle sync.Mutex
+	// netem represents network faults injected into the running container. Guarded by lifecycle.
+	netem netemConfig
+	// paused is true if the running container is paused. Guarded by lifecycle.
+	paused bool
+
+	// mutex guards the following fields, so runnable can be used from multiple goroutines.
+	mutex sync.Mutex
+	ports map[string]PortSpec
+	deps  []Linkable
+	opts  StartOptions
+	// build describes image built on start, if any. See WithBuild.
+	build *imageBuild
+	// prePulled is true if image was made available by PrePull after the last start.
+	prePulled bool
 
 	// usedNetworkName is docker NetworkName used to start this container.
 	// If empty it means container is stopped.
@@ -367,6 +612,11 @@ type dockerRunnable struct {
 	hostPorts map[string]int
 
 	extensions map[any]any
+	// exited is closed once container started by the latest Start exits.
+	exited chan struct{}
+	// stopping is set once container started by the latest Start is stopped or killed on purpose, so its exit is not
+	// reported as crash.
+	stopping *int32
 }
 
 func (d *dockerRunnable) Name() string {
@@ -393,67 +643,223 @@ func (d *dockerRunnable) Init(opts StartOptions) Runnable {
 			MaxRetries: 50, // Sometimes the CI is slow ¯\_(ツ)_/¯.
 		}
 	}
+	if opts.StopSignal != nil {
+		if _, err := signalNumber(opts.StopSignal); err != nil {
+			return errorer{name: d.Name(), err: err}
+		}
+	}
+	if err := validateMounts(opts); err != nil {
+		return errorer{name: d.Name(), err: err}
+	}
+	if err := opts.PullPolicy.validate(); err != nil {
+		return errorer{name: d.Name(), err: err}
+	}
+	if err := validateNetworkAttachments(d.env.networkName, d.env.networks, opts.Networks); err != nil {
+		return errorer{name: d.Name(), err: err}
+	}
 
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.opts = opts
-	d.waitBackoffReady = backoff.New(context.Background(), *opts.WaitReadyBackoff)
 	return d
 }
 
+// options returns start options of the runnable.
+func (d *dockerRunnable) options() StartOptions {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.opts
+}
+
 func (d *dockerRunnable) WithPorts(ports map[string]int) RunnableBuilder {
+	return d.WithPortSpecs(tcpPortSpecs(ports))
+}
+
+func (d *dockerRunnable) WithPortSpecs(ports map[string]PortSpec) RunnableBuilder {
+	if err := validatePortSpecs(ports); err != nil {
+		return errorer{name: d.Name(), err: err}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.ports = ports
 	return d
 }
 
+func (d *dockerRunnable) DependsOn(deps ...Linkable) RunnableBuilder {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.deps = append(d.deps, deps...)
+	return d
+}
+
+func (d *dockerRunnable) WithBuild(contextDir, dockerfile string, buildArgs map[string]string) RunnableBuilder {
+	b, err := newImageBuild(contextDir, dockerfile, buildArgs)
+	if err != nil {
+		return errorer{name: d.Name(), err: err}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.build = b
+	return d
+}
+
+func (d *dockerRunnable) Dependencies() []Linkable {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.deps
+}
+
 func (d *dockerRunnable) SetMetadata(key, value any) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.extensions[key] = value
 }
 
 func (d *dockerRunnable) GetMetadata(key any) (any, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	v, ok := d.extensions[key]
 	return v, ok
 }
 
+func (d *dockerRunnable) Logs() *Logs {
+	return d.logs
+}
+
+func (d *dockerRunnable) WaitLogLine(ctx context.Context, pattern *regexp.Regexp, opts ...LogLineOption) (LogLine, error) {
+	return d.logs.waitLine(ctx, d.Name(), d.IsRunning, pattern, opts...)
+}
+
 func (d *dockerRunnable) Future() FutureRunnable {
 	return d
 }
 
 func (d *dockerRunnable) IsRunning() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.usedNetworkName != ""
 }
 
+// setStopped marks the runnable as stopped.
+func (d *dockerRunnable) setStopped() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.usedNetworkName = ""
+}
+
 // Start starts runnable.
-func (d *dockerRunnable) Start() (err error) {
+func (d *dockerRunnable) Start() error {
+	return d.StartContext(context.Background())
+}
+
+// StartContext starts runnable. If the context is done before the container is running, the container is removed.
+func (d *dockerRunnable) StartContext(ctx context.Context) (err error) {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	return d.start(ctx, d.options().PinHostPorts)
+}
+
+// Restart stops and starts the container again, reusing its host ports.
+func (d *dockerRunnable) Restart(ctx context.Context) error {
+	if err := d.restart(ctx); err != nil {
+		return err
+	}
+	return d.WaitReadyContext(ctx)
+}
+
+func (d *dockerRunnable) restart(ctx context.Context) error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
+	}
+	if d.options().Job {
+		return errors.Newf("service %s is a job; jobs can't be restarted, wait for it and start it again instead", d.Name())
+	}
+
+	d.logger.Log("Restarting", d.Name())
+	if err := d.stop(ctx); err != nil {
+		return err
+	}
+	return d.start(ctx, true)
+}
+
+// start starts the container. The lifecycle mutex must be held.
+func (d *dockerRunnable) start(ctx context.Context, pinHostPorts bool) (err error) {
 	if d.IsRunning() {
 		return errors.Newf("%v is running. Stop or kill it first to restart.", d.Name())
 	}
 
 	d.logger.Log("Starting", d.Name())
+	begin := time.Now()
 
 	// In case of any error, if the container was already created, we
 	// have to cleanup removing it. We ignore the error of the "docker rm"
 	// because we don't know if the container was created or not.
 	defer func() {
 		if err != nil {
-			_, _ = d.env.exec("docker", "rm", "--force", d.Name()).CombinedOutput()
+			d.markStopping()
+			_ = d.env.backend.removeContainer(context.Background(), dockerNetworkContainerHost(d.env.networkName, d.Name()), true)
+			d.setStopped()
 		}
 	}()
 
-	// Make sure the image is available locally; if not wait for it to download.
-	if err := d.prePullImage(context.TODO()); err != nil {
+	if err := d.buildImage(ctx); err != nil {
 		return err
 	}
 
-	cmd := d.env.exec("docker", append([]string{"run"}, d.env.buildDockerRunArgs(d.name, d.ports, d.opts)...)...)
+	d.mutex.Lock()
+	opts, ports := d.opts, d.ports
+	var hostPorts map[string]int
+	if pinHostPorts {
+		hostPorts = d.hostPorts
+	}
+	spec := d.env.containerSpec(d.name, ports, hostPorts, opts)
+	d.mutex.Unlock()
+	if err := writeFiles(d.env.filesDir(d.name), opts.Files); err != nil {
+		return errors.Wrapf(err, "write files of %s", d.Name())
+	}
 	l := &LinePrefixLogger{prefix: d.Name() + ": ", logger: d.logger}
-	cmd.Stdout = l
-	cmd.Stderr = l
-	if err := cmd.Start(); err != nil {
+	stdout, stderr := d.logs.writer(LogStreamStdout), d.logs.writer(LogStreamStderr)
+	d.logs.markStart()
+	containerExited, err := d.reattach(ctx, spec, io.MultiWriter(l, stdout), io.MultiWriter(l, stderr))
+	if err != nil {
 		return err
 	}
+	if containerExited == nil {
+		// Make sure the image is available locally; if not wait for it to download.
+		if err := d.prePullImage(ctx); err != nil {
+			return err
+		}
+		containerExited, err = d.env.backend.startContainer(ctx, spec, io.MultiWriter(l, stdout), io.MultiWriter(l, stderr))
+		if err != nil {
+			return err
+		}
+	}
+	exited, stopping := make(chan struct{}), new(int32)
+	go func(job bool) {
+		// Flush incomplete lines once container exits.
+		<-containerExited
+		_ = stdout.Close()
+		_ = stderr.Close()
+		// Report crash before exited is closed, so the container is not removed yet.
+		if !job && atomic.LoadInt32(stopping) == 0 {
+			d.reportCrash(spec.Name)
+		}
+		close(exited)
+	}(opts.Job)
+	d.mutex.Lock()
+	d.exited, d.stopping = exited, stopping
 	d.usedNetworkName = d.env.networkName
+	d.mutex.Unlock()
+	d.netem = netemConfig{}
+	d.paused = false
 
 	// Wait until the container has been started.
-	if err := d.waitForRunning(); err != nil {
+	if err := d.waitForRunning(ctx); err != nil {
 		return err
 	}
 
@@ -462,25 +868,225 @@ func (d *dockerRunnable) Start() (err error) {
 	}
 
 	// Get the dynamic local ports mapped to the container.
-	for portName, containerPort := range d.ports {
-		var out []byte
-		out, err = d.env.exec("docker", "port", d.containerName(), strconv.Itoa(containerPort)).CombinedOutput()
+	mapped := make(map[string]int, len(ports))
+	for portName, p := range ports {
+		hostPort, err := d.env.backend.hostPort(ctx, d.containerName(), p.Port, string(p.protocol()))
 		if err != nil {
 			// Catch init errors.
-			if werr := d.waitForRunning(); werr != nil {
+			if werr := d.waitForRunning(ctx); werr != nil {
 				return errors.Wrapf(werr, "failed to get mapping for port as container %s exited: %v", d.containerName(), err)
 			}
-			return errors.Wrapf(err, "unable to get mapping for port %d; service: %s; output: %q", containerPort, d.Name(), out)
+			return errors.Wrapf(err, "unable to get mapping for port %d/%s; service: %s", p.Port, p.protocol(), d.Name())
+		}
+		mapped[portName] = hostPort
+	}
+	d.mutex.Lock()
+	d.hostPorts = mapped
+	d.mutex.Unlock()
+
+	d.logger.Log("Ports for container", d.containerName(), ">> Local ports:", ports, "Ports available from host:", mapped)
+	d.env.events.emit(RunnableEvent{Type: RunnableStarted, Runnable: d, Duration: time.Since(begin)})
+	return nil
+}
+
+// markStopping marks container started by the latest Start as stopped on purpose.
+func (d *dockerRunnable) markStopping() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopping != nil {
+		atomic.StoreInt32(d.stopping, 1)
+	}
+}
+
+// reportCrash emits crash event of the exited container with the given name.
+func (d *dockerRunnable) reportCrash(containerName string) {
+	var status ExitStatus
+	if state, err := d.env.backend.inspectState(context.Background(), containerName); err == nil && state.exited() {
+		status = state.exitStatus()
+	}
+	d.env.events.emit(crashEvent(d, status))
+}
+
+// reattach attaches to the container kept running by the previous run in reuse mode, if it was started
+// with the same spec. Otherwise, it removes the outdated container and returns nil channel.
+func (d *dockerRunnable) reattach(ctx context.Context, spec dockerContainerSpec, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	if !d.env.reuse || d.options().Job {
+		return nil, nil
+	}
+
+	labels, err := d.env.backend.containerLabels(ctx, spec.Name)
+	if err != nil {
+		// Assuming there is no such container.
+		return nil, nil
+	}
+	if state, err := d.env.backend.inspectState(ctx, spec.Name); err == nil && state.running() && labels[dockerSpecHashLabel] == spec.Labels[dockerSpecHashLabel] {
+		d.logger.Log("Reattaching to running", d.Name())
+		return d.env.backend.attachContainer(ctx, spec.Name, stdout, stderr)
+	}
+
+	d.logger.Log("Removing outdated container of", d.Name())
+	if err := d.env.backend.removeContainer(ctx, spec.Name, true); err != nil {
+		return nil, errors.Wrapf(err, "remove outdated container %s", spec.Name)
+	}
+	return nil, nil
+}
+
+func (d *dockerRunnable) InjectLatency(latency, jitter time.Duration) (Fault, error) {
+	return d.injectNetem(
+		func(c *netemConfig) { c.latency, c.jitter = latency, jitter },
+		func(c *netemConfig) { c.latency, c.jitter = 0, 0 },
+	)
+}
+
+func (d *dockerRunnable) InjectPacketLoss(percent float64) (Fault, error) {
+	if percent < 0 || percent > 100 {
+		return nil, errors.Newf("packet loss has to be between 0 and 100 percent, got %v", percent)
+	}
+	return d.injectNetem(
+		func(c *netemConfig) { c.lossPercent = percent },
+		func(c *netemConfig) { c.lossPercent = 0 },
+	)
+}
+
+func (d *dockerRunnable) LimitBandwidth(bitsPerSecond uint64) (Fault, error) {
+	return d.injectNetem(
+		func(c *netemConfig) { c.bitsPerSecond = bitsPerSecond },
+		func(c *netemConfig) { c.bitsPerSecond = 0 },
+	)
+}
+
+// injectNetem applies network conditions modified by inject and returns fault that reverts the modification with heal.
+func (d *dockerRunnable) injectNetem(inject, heal func(*netemConfig)) (Fault, error) {
+	if !d.IsRunning() {
+		return nil, errors.Newf("service %s is stopped", d.Name())
+	}
+
+	apply := func(modify func(*netemConfig)) error {
+		// Faults are applied one at a time and not during restarts, which reset them.
+		d.lifecycle.Lock()
+		defer d.lifecycle.Unlock()
+
+		c := d.netem
+		modify(&c)
+		if c == d.netem {
+			return nil
+		}
+		if err := d.env.runNetAdmin(d.containerName(), c.netemArgs()...); err != nil {
+			return errors.Wrapf(err, "apply network conditions to %s", d.Name())
+		}
+		d.netem = c
+		return nil
+	}
+	if err := apply(inject); err != nil {
+		return nil, err
+	}
+	return newFault(func() error {
+		// Restarted container starts without faults.
+		if !d.IsRunning() {
+			return nil
+		}
+		return apply(heal)
+	}), nil
+}
+
+// PrePull makes images of the given runnables available in parallel, see Environment.PrePull.
+func (e *DockerEnvironment) PrePull(ctx context.Context, runnables ...Linkable) error {
+	all := len(runnables) == 0
+	e.mutex.Lock()
+	byName := make(map[string]*dockerRunnable, len(e.runnables))
+	for _, r := range e.runnables {
+		byName[r.Name()] = r
+		if all && r.initialized() {
+			runnables = append(runnables, r)
+		}
+	}
+	e.mutex.Unlock()
+
+	return prePullParallel(runnables, func(l Linkable) error {
+		r, ok := byName[l.Name()]
+		if !ok {
+			return errors.Newf("runnable %s is not part of the environment", l.Name())
+		}
+		return r.prePull(ctx)
+	})
+}
+
+// Partition drops all network traffic between given running runnables until returned fault is healed.
+// Traffic is dropped on all networks runnables are attached to (see StartOptions.Networks).
+func (e *DockerEnvironment) Partition(a, b Linkable) (Fault, error) {
+	aName, bName := dockerNetworkContainerHost(e.networkName, a.Name()), dockerNetworkContainerHost(e.networkName, b.Name())
+	aIP, err := e.containerIPs(a.Name())
+	if err != nil {
+		return nil, err
+	}
+	bIP, err := e.containerIPs(b.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.runNetAdmin(aName, iptablesDropArgs("-A", bIP)...); err != nil {
+		return nil, errors.Wrapf(err, "partition %s from %s", a.Name(), b.Name())
+	}
+	if err := e.runNetAdmin(bName, iptablesDropArgs("-A", aIP)...); err != nil {
+		_ = e.runNetAdmin(aName, iptablesDropArgs("-D", bIP)...)
+		return nil, errors.Wrapf(err, "partition %s from %s", b.Name(), a.Name())
+	}
+	e.logger.Log("Partitioned", a.Name(), "and", b.Name())
+
+	return newFault(func() error {
+		errs := merrors.New()
+		errs.Add(e.runNetAdmin(aName, iptablesDropArgs("-D", bIP)...))
+		errs.Add(e.runNetAdmin(bName, iptablesDropArgs("-D", aIP)...))
+		if err := errs.Err(); err != nil {
+			return errors.Wrapf(err, "heal partition between %s and %s", a.Name(), b.Name())
+		}
+		e.logger.Log("Healed partition between", a.Name(), "and", b.Name())
+		return nil
+	}), nil
+}
+
+// containerIPs returns IP addresses of the container of the given running runnable in all networks it's attached to.
+func (e *DockerEnvironment) containerIPs(name string) ([]string, error) {
+	networks := []string{e.networkName}
+	e.mutex.Lock()
+	for _, r := range e.runnables {
+		if r.Name() != name {
+			continue
+		}
+		if attached := attachedNetworks(e.networkName, r.options().Networks); len(attached) > 0 {
+			networks = networks[:0]
+			for _, n := range attached {
+				networks = append(networks, dockerNetworkName(e.networkName, n))
+			}
 		}
+	}
+	e.mutex.Unlock()
 
-		d.hostPorts[portName], err = getDockerPortMapping(out)
+	containerName := dockerNetworkContainerHost(e.networkName, name)
+	ips := make([]string, 0, len(networks))
+	for _, n := range networks {
+		ip, err := e.backend.containerIP(context.Background(), containerName, n)
 		if err != nil {
-			return errors.Wrapf(err, "unable to get mapping for port %d; service: %s", containerPort, d.Name())
+			return nil, errors.Wrapf(err, "get IP address of container %s in network %s", containerName, n)
+		}
+		if ip == "" {
+			return nil, errors.Newf("container %s has no IP address in network %s; is it running?", containerName, n)
 		}
+		ips = append(ips, ip)
 	}
+	return ips, nil
+}
 
-	d.logger.Log("Ports for container", d.containerName(), ">> Local ports:", d.ports, "Ports available from host:", d.hostPorts)
-	return nil
+// runNetAdmin runs given command in the network namespace of the given container with NET_ADMIN capability.
+func (e *DockerEnvironment) runNetAdmin(containerName string, cmd ...string) error {
+	_, err := e.backend.runContainer(context.Background(), dockerContainerSpec{
+		NetworkMode:  "container:" + containerName,
+		Capabilities: []string{"NET_ADMIN"},
+		Image:        netAdminImage,
+		Cmd:          cmd,
+		AutoRemove:   true,
+	})
+	return err
 }
 
 func getDockerPortMapping(out []byte) (int, error) {
@@ -493,37 +1099,188 @@ func getDockerPortMapping(out []byte) (int, error) {
 }
 
 func (d *dockerRunnable) Stop() error {
+	return d.StopContext(context.Background())
+}
+
+func (d *dockerRunnable) StopContext(ctx context.Context) error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	return d.stop(ctx)
+}
+
+// stop stops and removes the container. The lifecycle mutex must be held.
+func (d *dockerRunnable) stop(ctx context.Context) error {
 	if !d.IsRunning() {
 		return nil
 	}
 
 	d.logger.Log("Stopping", d.Name())
-	if out, err := d.env.exec("docker", "stop", "--time=30", d.containerName()).CombinedOutput(); err != nil {
-		d.logger.Log(string(out))
+	begin := time.Now()
+	d.markStopping()
+	// Paused processes can't handle the stop signal.
+	if d.paused {
+		if err := d.unpause(); err != nil {
+			return err
+		}
+	}
+	if err := d.env.backend.stopContainer(ctx, d.containerName(), stopGracePeriodSeconds(d.options())); err != nil {
 		return err
 	}
-	d.usedNetworkName = ""
+	if err := d.env.backend.removeContainer(ctx, d.containerName(), false); err != nil {
+		return err
+	}
+	d.setStopped()
+	d.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: d, Duration: time.Since(begin)})
 	return d.env.registerStopped(d.Name())
 }
 
+func (d *dockerRunnable) Pause() error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
+	}
+
+	d.logger.Log("Pausing", d.Name())
+	if err := d.env.backend.pauseContainer(context.Background(), d.containerName()); err != nil {
+		return err
+	}
+	d.paused = true
+	return nil
+}
+
+func (d *dockerRunnable) Unpause() error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	return d.unpause()
+}
+
+// unpause resumes the paused container. The lifecycle mutex must be held.
+func (d *dockerRunnable) unpause() error {
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
+	}
+
+	d.logger.Log("Unpausing", d.Name())
+	if err := d.env.backend.unpauseContainer(context.Background(), d.containerName()); err != nil {
+		return err
+	}
+	d.paused = false
+	return nil
+}
+
+func (d *dockerRunnable) Signal(sig os.Signal) error {
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
+	}
+
+	n, err := signalNumber(sig)
+	if err != nil {
+		return err
+	}
+	return d.env.backend.signalContainer(context.Background(), d.containerName(), n)
+}
+
 func (d *dockerRunnable) Kill() error {
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+
 	if !d.IsRunning() {
 		return nil
 	}
 
 	d.logger.Log("Killing", d.Name())
+	d.markStopping()
 
-	if out, err := d.env.exec("docker", "kill", d.containerName()).CombinedOutput(); err != nil {
-		d.logger.Log(string(out))
+	// Container might have exited already, so it can't be killed. Forced removal kills it if needed.
+	if err := d.env.backend.removeContainer(context.Background(), d.containerName(), true); err != nil {
 		return err
 	}
+	d.setStopped()
+	d.env.events.emit(RunnableEvent{Type: RunnableKilled, Runnable: d})
+	return d.env.registerStopped(d.Name())
+}
+
+// Wait waits until the job container exits, returns its exit status and removes the container.
+func (d *dockerRunnable) Wait(ctx context.Context) (ExitStatus, error) {
+	if !d.options().Job {
+		return ExitStatus{}, errors.Newf("service %s is not a job; only runnables started with StartOptions.Job can be waited for", d.Name())
+	}
+	if !d.IsRunning() {
+		return ExitStatus{}, errors.Newf("service %s is stopped", d.Name())
+	}
 
-	// Wait until the container actually stopped. However, this could fail if
-	// the container already exited, so we just ignore the error.
-	_, _ = d.env.exec("docker", "wait", d.containerName()).CombinedOutput()
+	select {
+	case <-ctx.Done():
+		return ExitStatus{}, errors.Wrapf(ctx.Err(), "waiting for job %s to exit", d.Name())
+	case <-d.exitedChan():
+	}
 
-	d.usedNetworkName = ""
-	return d.env.registerStopped(d.Name())
+	d.lifecycle.Lock()
+	defer d.lifecycle.Unlock()
+	// Job might have been killed or waited for concurrently.
+	if !d.IsRunning() {
+		return ExitStatus{}, errors.Newf("service %s is stopped", d.Name())
+	}
+
+	status, err := d.exitStatus(ctx)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+
+	if err := d.env.backend.removeContainer(ctx, d.containerName(), false); err != nil {
+		return status, err
+	}
+	d.logger.Log("Job", d.Name(), "exited with code", status.ExitCode)
+	d.setStopped()
+	d.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: d, Status: status})
+	return status, d.env.registerStopped(d.Name())
+}
+
+// hasExited returns true if container started by the latest Start has exited.
+func (d *dockerRunnable) hasExited() bool {
+	select {
+	case <-d.exitedChan():
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *dockerRunnable) exitStatus(ctx context.Context) (ExitStatus, error) {
+	state, err := d.env.backend.inspectState(ctx, d.containerName())
+	if err != nil {
+		return ExitStatus{}, errors.Wrapf(err, "inspect exited container %s", d.containerName())
+	}
+	if !state.exited() {
+		return ExitStatus{}, errors.Newf("exit status of container %s: container is %s; expected exited", d.containerName(), state.Status)
+	}
+	return state.exitStatus(), nil
+}
+
+// exitedChan returns channel closed once container started by the latest Start exits.
+func (d *dockerRunnable) exitedChan() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.exited
+}
+
+// terminatedError returns TerminatedError for container that exited unexpectedly.
+func (d *dockerRunnable) terminatedError(ctx context.Context) error {
+	// Container state might be updated before attached `docker run` flushes the remaining output.
+	flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	select {
+	case <-flushCtx.Done():
+	case <-d.exitedChan():
+	}
+
+	status, err := d.exitStatus(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "service %s terminated", d.Name())
+	}
+	return &TerminatedError{Name: d.Name(), Status: status, LastLogs: d.logs.lastLines(terminatedErrorLogLines)}
 }
 
 // Endpoint returns external (from host perspective) service endpoint (host:port) for given port name.
@@ -536,7 +1293,10 @@ func (d *dockerRunnable) Endpoint(portName string) string {
 	}
 
 	// Map the container port to the local port.
+	d.mutex.Lock()
 	localPort, ok := d.hostPorts[portName]
+	spec := d.ports[portName]
+	d.mutex.Unlock()
 	if !ok {
 		return ""
 	}
@@ -553,7 +1313,8 @@ func (d *dockerRunnable) Endpoint(portName string) string {
 		}
 	}
 
-	return fmt.Sprintf("%s:%d", addr, localPort)
+	// Ports published on the given host address are reachable only there.
+	return endpointAddress(addr, spec, localPort)
 }
 
 // InternalEndpoint returns internal service endpoint (host:port) for given internal port.
@@ -562,12 +1323,25 @@ func (d *dockerRunnable) Endpoint(portName string) string {
 // as well. Use `Endpoint` for host access.
 func (d *dockerRunnable) InternalEndpoint(portName string) string {
 	// Map the port name to the container port.
+	d.mutex.Lock()
 	port, ok := d.ports[portName]
+	d.mutex.Unlock()
 	if !ok {
 		return ""
 	}
 
-	return dockerNetworkContainerHostPort(d.env.networkName, d.Name(), port)
+	return dockerNetworkContainerHostPort(d.env.networkName, d.Name(), port.Port)
+}
+
+// dockerVolumeName returns name of the docker volume for the named volume of the environment. Environment names can't
+// contain underscores, so volumes of different environments can't be mistaken.
+func dockerVolumeName(networkName, volumeName string) string {
+	return networkName + "_" + volumeName
+}
+
+// filesDir returns host directory that StartOptions.Files of the given runnable are written to.
+func (e *DockerEnvironment) filesDir(name string) string {
+	return filepath.Join(e.dir, "files", name)
 }
 
 // dockerNetworkContainerHost return the host address of a container within the network.
@@ -586,61 +1360,68 @@ func (d *dockerRunnable) Ready() error {
 	}
 
 	// Ensure the service has a readiness probe configure.
-	if d.opts.Readiness == nil {
+	readiness := d.options().Readiness
+	if readiness == nil {
 		return nil
 	}
 
-	return d.opts.Readiness.Ready(d)
+	return readiness.Ready(d)
 }
 
 func (d *dockerRunnable) containerName() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return dockerNetworkContainerHost(d.usedNetworkName, d.Name())
 }
 
-func (d *dockerRunnable) waitForRunning() (err error) {
+func (d *dockerRunnable) waitForRunning(ctx context.Context) error {
 	if !d.IsRunning() {
 		return errors.Newf("service %s is stopped", d.Name())
 	}
 
-	var out []byte
-	for d.waitBackoffReady.Reset(); d.waitBackoffReady.Ongoing(); {
-		// Enforce a timeout on the command execution because we've seen some flaky tests
-		// stuck here.
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		out, err = d.env.execContext(
-			ctx,
-			"docker",
-			"inspect",
-			"--format={{json .State.Running}}",
-			d.containerName(),
-		).CombinedOutput()
-		if err != nil {
-			d.waitBackoffReady.Wait()
-			continue
-		}
-
-		if out == nil {
-			err = errors.Newf("nil output")
-			d.waitBackoffReady.Wait()
-			continue
-		}
-
-		str := strings.TrimSpace(string(out))
-		if str != "true" {
-			err = errors.Newf("unexpected output: %q", str)
-			d.waitBackoffReady.Wait()
-			continue
-		}
+	opts := d.options()
+	state, err := d.env.backend.waitStarted(ctx, d.containerName(), *opts.WaitReadyBackoff)
+	if err != nil {
+		return errors.Wrapf(err, "docker container %s failed to start", d.Name())
+	}
+	// Jobs might finish before we manage to observe them running.
+	if state.exited() && !opts.Job {
+		return d.terminatedError(ctx)
+	}
+	return nil
+}
 
+// buildImage builds image of the runnable declared with WithBuild, unless it's built already, and uses it as the image
+// of the runnable.
+func (d *dockerRunnable) buildImage(ctx context.Context) error {
+	d.mutex.Lock()
+	b := d.build
+	d.mutex.Unlock()
+	if b == nil {
 		return nil
 	}
 
-	if len(out) > 0 {
-		d.logger.Log(string(out))
+	tag, err := b.imageTag(d.Name())
+	if err != nil {
+		return err
+	}
+	ok, err := d.env.backend.imageExists(ctx, tag)
+	if err != nil {
+		return err
 	}
-	return errors.Wrapf(err, "docker container %s failed to start", d.Name())
+	if !ok {
+		l := &LinePrefixLogger{prefix: d.Name() + ": ", logger: d.logger}
+		begin := time.Now()
+		if err := d.env.backend.buildImage(ctx, b, tag, l); err != nil {
+			return errors.Wrapf(err, "docker image %s failed to build", tag)
+		}
+		d.env.events.emit(RunnableEvent{Type: RunnableImageBuilt, Runnable: d, Duration: time.Since(begin)})
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.opts.Image = tag
+	return nil
 }
 
 func (d *dockerRunnable) prePullImage(ctx context.Context) (err error) {
@@ -648,33 +1429,82 @@ func (d *dockerRunnable) prePullImage(ctx context.Context) (err error) {
 		return errors.Newf("service %s is running; expected stopped", d.Name())
 	}
 
-	if _, err = d.env.execContext(ctx, "docker", "image", "inspect", d.opts.Image).CombinedOutput(); err == nil {
+	d.mutex.Lock()
+	prePulled := d.prePulled
+	d.prePulled = false
+	d.mutex.Unlock()
+	if prePulled {
+		return nil
+	}
+	return d.pullImage(ctx)
+}
+
+// pullImage makes the image available according to the pull policy of the runnable.
+func (d *dockerRunnable) pullImage(ctx context.Context) error {
+	d.mutex.Lock()
+	opts, built := d.opts, d.build != nil
+	d.mutex.Unlock()
+	if built {
 		return nil
 	}
 
-	// Assuming Error: No such image: <image>.
-	cmd := d.env.execContext(ctx, "docker", "pull", d.opts.Image)
 	l := &LinePrefixLogger{prefix: d.Name() + ": ", logger: d.logger}
-	cmd.Stdout = l
-	cmd.Stderr = l
-	if err = cmd.Run(); err != nil {
-		return errors.Wrapf(err, "docker image %s failed to download", d.opts.Image)
+	begin := time.Now()
+	pulled, err := ensureImage(ctx, d.env.backend, opts.Image, opts.PullPolicy, d.env.imageCacheDir, l)
+	if pulled {
+		d.env.events.emit(RunnableEvent{Type: RunnableImagePulled, Runnable: d, Duration: time.Since(begin)})
+	}
+	return err
+}
+
+// prePull builds or pulls the image of the runnable, so the next start doesn't have to.
+func (d *dockerRunnable) prePull(ctx context.Context) error {
+	if err := d.buildImage(ctx); err != nil {
+		return err
+	}
+	if err := d.pullImage(ctx); err != nil {
+		return err
 	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.prePulled = true
 	return nil
 }
 
-func (d *dockerRunnable) WaitReady() (err error) {
+// initialized returns true if runnable was initialized with image or with image build.
+func (d *dockerRunnable) initialized() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.opts.Image != "" || d.build != nil
+}
+
+func (d *dockerRunnable) WaitReady() error {
+	return d.WaitReadyContext(context.Background())
+}
+
+func (d *dockerRunnable) WaitReadyContext(ctx context.Context) (err error) {
 	if !d.IsRunning() {
 		return errors.Newf("service %s is stopped", d.Name())
 	}
 
-	for d.waitBackoffReady.Reset(); d.waitBackoffReady.Ongoing(); {
+	opts := d.options()
+	begin := time.Now()
+	for b := backoff.New(ctx, *opts.WaitReadyBackoff); b.Ongoing(); {
 		err = d.Ready()
 		if err == nil {
+			d.env.events.emit(RunnableEvent{Type: RunnableReady, Runnable: d, Duration: time.Since(begin)})
 			return nil
 		}
+		// There is no point in waiting for crashed container.
+		if !opts.Job && d.hasExited() {
+			return d.terminatedError(ctx)
+		}
 
-		d.waitBackoffReady.Wait()
+		b.Wait()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
 	return errors.Wrapf(err, "the service %s is not ready", d.Name())
 }
@@ -682,6 +1512,12 @@ func (d *dockerRunnable) WaitReady() (err error) {
 // Exec runs the provided command against the docker container specified by this
 // service.
 func (d *dockerRunnable) Exec(command Command, opts ...ExecOption) error {
+	return d.ExecContext(context.Background(), command, opts...)
+}
+
+// ExecContext runs the provided command against the docker container specified by this
+// service. The command is killed when the context is done.
+func (d *dockerRunnable) ExecContext(ctx context.Context, command Command, opts ...ExecOption) error {
 	if !d.IsRunning() {
 		return errors.Newf("service %s is stopped", d.Name())
 	}
@@ -692,48 +1528,52 @@ func (d *dockerRunnable) Exec(command Command, opts ...ExecOption) error {
 		opt(&o)
 	}
 
-	args := []string{"exec", d.containerName()}
-	args = append(args, command.Cmd)
-	args = append(args, command.Args...)
-	if o.Stdin != nil {
-		args = append(args[:1], append([]string{"-i"}, args[1:]...)...)
+	begin := time.Now()
+	err := d.env.backend.exec(ctx, d.containerName(), append([]string{command.Cmd}, command.Args...), o.Stdin, o.Stdout, o.Stderr)
+	d.env.events.emit(RunnableEvent{Type: RunnableExecRun, Runnable: d, Duration: time.Since(begin), Command: command, Err: err})
+	return err
+}
+
+// Stats returns current resource usage of the docker container.
+func (d *dockerRunnable) Stats(ctx context.Context) (RunnableStats, error) {
+	if !d.IsRunning() {
+		return RunnableStats{}, errors.Newf("service %s is stopped", d.Name())
 	}
-	cmd := d.env.exec("docker", args...)
-	if o.Stdin != nil {
-		cmd.Stdin = o.Stdin
+	return d.env.backend.stats(ctx, d.containerName())
+}
+
+// CopyTo copies the host file or directory to the docker container.
+func (d *dockerRunnable) CopyTo(ctx context.Context, hostPath, containerPath string) error {
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
 	}
-	cmd.Stdout = o.Stdout
-	cmd.Stderr = o.Stderr
-	return cmd.Run()
+	return d.env.backend.copyTo(ctx, d.containerName(), hostPath, containerPath)
 }
 
-func (e *DockerEnvironment) existDockerNetwork() (bool, error) {
-	out, err := e.exec("docker", "network", "ls", "--quiet", "--filter", fmt.Sprintf("name=%s", e.networkName)).CombinedOutput()
+// CopyFrom copies the file or directory from the docker container to the host.
+func (d *dockerRunnable) CopyFrom(ctx context.Context, containerPath, hostPath string) error {
+	if !d.IsRunning() {
+		return errors.Newf("service %s is stopped", d.Name())
+	}
+	return d.env.backend.copyFrom(ctx, d.containerName(), containerPath, hostPath)
+}
+
+func (e *DockerEnvironment) existDockerNetwork(ctx context.Context, name string) (bool, error) {
+	ok, err := e.backend.networkExists(ctx, name)
 	if err != nil {
-		e.logger.Log(string(out))
-		e.logger.Log("Unable to check if docker network", e.networkName, "exists:", err.Error())
+		e.logger.Log("Unable to check if docker network", name, "exists:", err.Error())
 		return false, err
 	}
-
-	return strings.TrimSpace(string(out)) != "", nil
+	return ok, nil
 }
 
 // getTmpDirectory creates a temporary directory for shared integration
 // test files, either in the working directory or a directory referenced by
 // the E2E_TEMP_DIR environment variable.
 func getTmpDirectory() (string, error) {
-	var (
-		dir string
-		err error
-	)
-	// If a temp dir is referenced, return that.
-	if os.Getenv("E2E_TEMP_DIR") != "" {
-		dir = os.Getenv("E2E_TEMP_DIR")
-	} else {
-		dir, err = os.Getwd()
-		if err != nil {
-			return "", err
-		}
+	dir, err := tmpBaseDirectory()
+	if err != nil {
+		return "", err
 	}
 
 	tmpDir, err := os.MkdirTemp(dir, "e2e_")
@@ -749,11 +1589,50 @@ func getTmpDirectory() (string, error) {
 	return absDir, nil
 }
 
+// getReusedTmpDirectory returns path of the shared directory of the environment with the given name in reuse mode.
+// Unlike getTmpDirectory, the path is the same across runs.
+func getReusedTmpDirectory(name string) (string, error) {
+	dir, err := tmpBaseDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(filepath.Join(dir, "e2e_reused_"+name))
+}
+
+// tmpBaseDirectory returns directory referenced by the E2E_TEMP_DIR environment variable or the working directory.
+func tmpBaseDirectory() (string, error) {
+	// If a temp dir is referenced, return that.
+	if os.Getenv("E2E_TEMP_DIR") != "" {
+		return os.Getenv("E2E_TEMP_DIR"), nil
+	}
+	return os.Getwd()
+}
+
 func (e *DockerEnvironment) Close() {
-	for _, c := range e.closers {
+	e.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but context bounds removal of containers, volumes and networks of the environment.
+// Closers added with AddCloser and killing of started runnables are not bound by the context.
+func (e *DockerEnvironment) CloseContext(ctx context.Context) {
+	// Closers are invoked without holding the mutex, as they might use the environment.
+	e.mutex.Lock()
+	closers, closed := append([]func(){}, e.closers...), e.closed
+	e.mutex.Unlock()
+
+	for _, c := range closers {
 		c()
 	}
-	e.close()
+	if e.reuse {
+		if !closed {
+			e.logger.Log("Keeping docker environment", e.networkName, "for reuse; run without", reuseEnvName, "to clean it up")
+		}
+	} else {
+		e.close(ctx)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
 	e.closed = true
 }
 
@@ -770,61 +1649,82 @@ func (e *DockerEnvironment) execContext(ctx context.Context, cmd string, args ..
 	return c.exec(ctx)
 }
 
-func (e *DockerEnvironment) close() {
-	if e == nil || e.closed {
+func (e *DockerEnvironment) close(ctx context.Context) {
+	if e == nil {
+		return
+	}
+	e.mutex.Lock()
+	closed := e.closed
+	e.mutex.Unlock()
+	if closed {
 		return
 	}
 
 	// Kill the services in the opposite order.
-	for i := len(e.started) - 1; i >= 0; i-- {
-		n := e.started[i].Name()
-		if err := e.started[i].Kill(); err != nil {
+	e.startedMtx.Lock()
+	started := append([]Runnable{}, e.started...)
+	e.startedMtx.Unlock()
+	for i := len(started) - 1; i >= 0; i-- {
+		n := started[i].Name()
+		if err := started[i].Kill(); err != nil {
 			e.logger.Log("Unable to kill service", n, ":", err.Error())
 		}
 	}
 
-	// Ensure there are no leftover containers.
-	if out, err := e.exec(
-		"docker",
-		"ps",
-		"-a",
-		"--quiet",
-		"--filter",
-		fmt.Sprintf("network=%s", e.networkName),
-	).CombinedOutput(); err == nil {
-		for _, containerID := range strings.Split(string(out), "\n") {
-			containerID = strings.TrimSpace(containerID)
-			if containerID == "" {
+	// Ensure there are no leftover containers. Containers attached to multiple networks are removed only once.
+	removed := map[string]struct{}{}
+	for _, n := range e.networkSpecs() {
+		containerIDs, err := e.backend.listContainers(ctx, n.Name)
+		if err != nil {
+			e.logger.Log("Unable to cleanup leftover containers:", err.Error())
+			continue
+		}
+		for _, containerID := range containerIDs {
+			if _, ok := removed[containerID]; ok {
 				continue
 			}
-
-			if out, err = e.exec("docker", "rm", "--force", containerID).CombinedOutput(); err != nil {
-				e.logger.Log(string(out))
+			removed[containerID] = struct{}{}
+			if err := e.backend.removeContainer(ctx, containerID, true); err != nil {
 				e.logger.Log("Unable to cleanup leftover container", containerID, ":", err.Error())
 			}
 		}
+	}
+
+	// Named volumes are not removed together with containers.
+	if volumes, err := e.backend.listVolumes(ctx, dockerVolumeName(e.networkName, "")); err == nil {
+		for _, v := range volumes {
+			if err := e.backend.removeVolume(ctx, v); err != nil {
+				e.logger.Log("Unable to remove docker volume", v, ":", err.Error())
+			}
+		}
 	} else {
-		e.logger.Log(string(out))
-		e.logger.Log("Unable to cleanup leftover containers:", err.Error())
+		e.logger.Log("Unable to cleanup docker volumes:", err.Error())
 	}
 
-	// Teardown the docker network. In case the network does not exists (ie. this function
+	// Teardown the docker networks. In case the network does not exists (ie. this function
 	// is called during the setup of the scenario) we skip the removal in order to not log
 	// an error which may be misleading.
-	if ok, err := e.existDockerNetwork(); ok || err != nil {
-		if out, err := e.exec("docker", "network", "rm", e.networkName).CombinedOutput(); err != nil {
-			e.logger.Log(string(out))
-			e.logger.Log("Unable to remove docker network", e.networkName, ":", err.Error())
+	for _, n := range e.networkSpecs() {
+		if ok, err := e.existDockerNetwork(ctx, n.Name); ok || err != nil {
+			if err := e.backend.removeNetwork(ctx, n.Name); err != nil {
+				e.logger.Log("Unable to remove docker network", n.Name, ":", err.Error())
+			}
 		}
 	}
 
 	if e.dir != "" {
-		if out, err := e.exec("chmod", "-R", "777", e.dir).CombinedOutput(); err != nil {
+		e.removeSharedDir(e.dir)
+	}
+}
+
+func (e *DockerEnvironment) removeSharedDir(dir string) {
+	if e.rootOwnedFiles {
+		if out, err := e.exec("chmod", "-R", "777", dir).CombinedOutput(); err != nil {
 			e.logger.Log(string(out))
-			e.logger.Log("Error while chmod sharedDir", e.dir, "err:", err)
-		}
-		if err := os.RemoveAll(e.dir); err != nil {
-			e.logger.Log("Error while removing sharedDir", e.dir, "err:", err)
+			e.logger.Log("Error while chmod sharedDir", dir, "err:", err)
 		}
 	}
+	if err := os.RemoveAll(dir); err != nil {
+		e.logger.Log("Error while removing sharedDir", dir, "err:", err)
+	}
 }
@@ -0,0 +1,239 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"gopkg.in/yaml.v2"
+)
+
+type composeFile struct {
+	Name     string                    `yaml:"name"`
+	Services map[string]composeService `yaml:"services"`
+	Networks map[string]composeNetwork `yaml:"networks"`
+	Volumes  map[string]composeVolume  `yaml:"volumes,omitempty"`
+}
+
+type composeService struct {
+	Image           string                           `yaml:"image,omitempty"`
+	Build           *composeBuild                    `yaml:"build,omitempty"`
+	PullPolicy      string                           `yaml:"pull_policy,omitempty"`
+	Hostname        string                           `yaml:"hostname,omitempty"`
+	Entrypoint      []string                         `yaml:"entrypoint,omitempty"`
+	Command         []string                         `yaml:"command,omitempty"`
+	Environment     map[string]string                `yaml:"environment,omitempty"`
+	User            string                           `yaml:"user,omitempty"`
+	UserNsMode      string                           `yaml:"userns_mode,omitempty"`
+	Privileged      bool                             `yaml:"privileged,omitempty"`
+	CapAdd          []string                         `yaml:"cap_add,omitempty"`
+	MemLimit        string                           `yaml:"mem_limit,omitempty"`
+	CPUs            string                           `yaml:"cpus,omitempty"`
+	Ports           []string                         `yaml:"ports,omitempty"`
+	StopSignal      string                           `yaml:"stop_signal,omitempty"`
+	StopGracePeriod string                           `yaml:"stop_grace_period,omitempty"`
+	Volumes         []string                         `yaml:"volumes,omitempty"`
+	Tmpfs           []string                         `yaml:"tmpfs,omitempty"`
+	DependsOn       []string                         `yaml:"depends_on,omitempty"`
+	Networks        map[string]composeServiceNetwork `yaml:"networks"`
+}
+
+// composePullPolicies maps pull policies to their compose equivalents. The default one is omitted.
+var composePullPolicies = map[PullPolicy]string{PullAlways: "always", PullNever: "never"}
+
+type composeBuild struct {
+	Context    string            `yaml:"context"`
+	Dockerfile string            `yaml:"dockerfile"`
+	Args       map[string]string `yaml:"args,omitempty"`
+}
+
+type composeServiceNetwork struct {
+	Aliases     []string `yaml:"aliases"`
+	IPv4Address string   `yaml:"ipv4_address,omitempty"`
+	IPv6Address string   `yaml:"ipv6_address,omitempty"`
+}
+
+type composeNetwork struct {
+	Name       string       `yaml:"name"`
+	Internal   bool         `yaml:"internal,omitempty"`
+	EnableIPv6 bool         `yaml:"enable_ipv6,omitempty"`
+	IPAM       *composeIPAM `yaml:"ipam,omitempty"`
+}
+
+type composeIPAM struct {
+	Config []composeIPAMConfig `yaml:"config"`
+}
+
+type composeIPAMConfig struct {
+	Subnet string `yaml:"subnet"`
+}
+
+// newComposeNetwork returns compose network equivalent to the network spec.
+func newComposeNetwork(spec dockerNetworkSpec) composeNetwork {
+	n := composeNetwork{Name: spec.Name, Internal: spec.Internal, EnableIPv6: spec.IPv6Subnet != ""}
+	for _, s := range []string{spec.Subnet, spec.IPv6Subnet} {
+		if s == "" {
+			continue
+		}
+		if n.IPAM == nil {
+			n.IPAM = &composeIPAM{}
+		}
+		n.IPAM.Config = append(n.IPAM.Config, composeIPAMConfig{Subnet: s})
+	}
+	return n
+}
+
+type composeVolume struct {
+	Name string `yaml:"name"`
+}
+
+// newComposeService returns compose service equivalent to the container spec.
+func newComposeService(spec dockerContainerSpec, stopGracePeriod time.Duration) composeService {
+	s := composeService{
+		Image:      spec.Image,
+		Hostname:   spec.Hostname,
+		Command:    spec.Cmd,
+		User:       spec.User,
+		UserNsMode: spec.UserNs,
+		Privileged: spec.Privileged,
+		CapAdd:     spec.Capabilities,
+		CPUs:       spec.CPUs,
+		Volumes:    spec.Volumes,
+		Tmpfs:      spec.Tmpfs,
+		Networks: map[string]composeServiceNetwork{
+			// Make service resolvable under the same address as its InternalEndpoint.
+			spec.NetworkMode: {Aliases: []string{spec.Name}},
+		},
+	}
+	if len(spec.Endpoints) > 0 {
+		s.Networks = map[string]composeServiceNetwork{}
+	}
+	for _, e := range spec.Endpoints {
+		s.Networks[e.Network] = composeServiceNetwork{
+			Aliases:     append([]string{spec.Name}, e.Aliases...),
+			IPv4Address: e.IPv4Address,
+			IPv6Address: e.IPv6Address,
+		}
+	}
+	if spec.DisableEntrypoint {
+		s.Entrypoint = []string{""}
+	}
+	if len(spec.Env) > 0 {
+		s.Environment = map[string]string{}
+		for _, kv := range spec.Env {
+			k, v, _ := strings.Cut(kv, "=")
+			s.Environment[k] = v
+		}
+	}
+	if spec.MemoryBytes > 0 {
+		s.MemLimit = strconv.FormatUint(uint64(spec.MemoryBytes), 10) + "b"
+	}
+	for _, p := range spec.Ports {
+		s.Ports = append(s.Ports, p.publishArg())
+	}
+	if spec.StopSignal != 0 {
+		s.StopSignal = strconv.Itoa(spec.StopSignal)
+	}
+	if stopGracePeriod > 0 {
+		s.StopGracePeriod = stopGracePeriod.String()
+	}
+	return s
+}
+
+// ExportCompose writes docker compose file equivalent to the environment, with a service for every initialized
+// runnable, so the scenario can be reproduced with `docker compose up` outside Go (e.g. when reporting a bug).
+//
+// Services use the same images (or build sections for runnables built with WithBuild), commands, environment
+// variables, limits and mounts (including the shared directory, files and named volumes) as runnables, and are
+// resolvable under their InternalEndpoint host names and aliases. Dependencies (see RunnableBuilder.DependsOn) are
+// exported as depends_on, so compose starts services in the same order. Host ports are random, unless runnable pins
+// them with StartOptions.PinHostPorts. Mounted paths are the host paths of this environment, so export it before Close
+// and copy the shared directory along, if the scenario depends on its content.
+func (e *DockerEnvironment) ExportCompose(w io.Writer) error {
+	f := composeFile{
+		// Compose project names have to be lower case.
+		Name:     strings.ToLower(e.networkName),
+		Services: map[string]composeService{},
+		Networks: map[string]composeNetwork{},
+	}
+	for _, n := range e.networkSpecs() {
+		f.Networks[n.Name] = newComposeNetwork(n)
+	}
+	e.mutex.Lock()
+	runnables := append([]*dockerRunnable{}, e.runnables...)
+	e.mutex.Unlock()
+	deps := map[string][]Linkable{}
+	for _, r := range runnables {
+		r.mutex.Lock()
+		opts, ports, build := r.opts, r.ports, r.build
+		var hostPorts map[string]int
+		if opts.PinHostPorts {
+			hostPorts = r.hostPorts
+		}
+		spec := e.containerSpec(r.Name(), ports, hostPorts, opts)
+		r.mutex.Unlock()
+
+		if opts.Image == "" && build == nil {
+			// Not initialized (yet).
+			continue
+		}
+		var stopGracePeriod time.Duration
+		if opts.StopGracePeriod > 0 {
+			stopGracePeriod = time.Duration(stopGracePeriodSeconds(opts)) * time.Second
+		}
+		s := newComposeService(spec, stopGracePeriod)
+		s.PullPolicy = composePullPolicies[opts.PullPolicy]
+		if build != nil {
+			// Compose tags the built image with the image name, if it's already known after the start.
+			s.Build = &composeBuild{Context: build.contextDir, Dockerfile: filepath.ToSlash(build.dockerfile), Args: build.args}
+		}
+		f.Services[r.Name()] = s
+		deps[r.Name()] = r.Dependencies()
+		for _, v := range opts.NamedVolumes {
+			if f.Volumes == nil {
+				f.Volumes = map[string]composeVolume{}
+			}
+			name := dockerVolumeName(e.networkName, v)
+			f.Volumes[name] = composeVolume{Name: name}
+		}
+	}
+
+	// Dependencies are known only once all services are, as compose rejects dependencies on undefined services.
+	for name, s := range f.Services {
+		s.DependsOn = composeDependsOn(f.Services, deps[name])
+		f.Services[name] = s
+	}
+
+	b, err := yaml.Marshal(f)
+	if err != nil {
+		return errors.Wrap(err, "marshal compose file")
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// composeDependsOn returns sorted names of the given dependencies defined as services. Dependencies that are not part of
+// the compose file (e.g. not initialized runnables) are omitted.
+func composeDependsOn(services map[string]composeService, deps []Linkable) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	for _, d := range deps {
+		if _, ok := services[d.Name()]; !ok {
+			continue
+		}
+		if _, ok := seen[d.Name()]; ok {
+			continue
+		}
+		seen[d.Name()] = struct{}{}
+		names = append(names, d.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestDockerEnvironment_ExportCompose(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-Test", dir: t.TempDir(), registered: map[string]struct{}{}}
+
+	app := e.Runnable("app").WithPorts(map[string]int{"http": 80, "grpc": 90}).Init(StartOptions{
+		Image:            "alpine:3.16",
+		Command:          NewCommandWithoutEntrypoint("sleep", "1000"),
+		EnvVars:          map[string]string{"B": "2", "A": "1=1"},
+		Volumes:          []string{"/data:/data:ro"},
+		LimitMemoryBytes: 1024,
+		StopSignal:       syscall.SIGINT,
+		StopGracePeriod:  1500 * time.Millisecond,
+	})
+	// Not initialized runnables are skipped, also as dependencies.
+	future := e.Runnable("future").Future()
+	pinned := e.Runnable("pinned").WithPorts(map[string]int{"http": 80}).DependsOn(future, app, app).Init(StartOptions{Image: "nginx", PinHostPorts: true, User: "1000"})
+	pinned.(*dockerRunnable).hostPorts["http"] = 8080
+
+	var b bytes.Buffer
+	testutil.Ok(t, e.ExportCompose(&b))
+	testutil.Equals(t, `name: e2e-test
+services:
+  app:
+    image: alpine:3.16
+    hostname: app
+    entrypoint:
+    - ""
+    command:
+    - sleep
+    - "1000"
+    environment:
+      A: 1=1
+      B: "2"
+    mem_limit: 1024b
+    ports:
+    - "90"
+    - "80"
+    stop_signal: "2"
+    stop_grace_period: 2s
+    volumes:
+    - `+e.dir+`:`+e.dir+`:z
+    - /data:/data:ro
+    networks:
+      e2e-Test:
+        aliases:
+        - e2e-Test-app
+  pinned:
+    image: nginx
+    hostname: pinned
+    user: "1000"
+    ports:
+    - 8080:80
+    volumes:
+    - `+e.dir+`:`+e.dir+`:z
+    depends_on:
+    - app
+    networks:
+      e2e-Test:
+        aliases:
+        - e2e-Test-pinned
+networks:
+  e2e-Test:
+    name: e2e-Test
+`, b.String())
+}
+
+func TestDockerEnvironment_ExportCompose_Build(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: t.TempDir(), registered: map[string]struct{}{}}
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine"), 0600))
+
+	// Built runnables are exported even before the start, when the image is not known yet.
+	r := e.Runnable("app").WithBuild(dir, "", map[string]string{"VERSION": "1"}).Init(StartOptions{})
+	testutil.Ok(t, r.BuildErr())
+
+	var b bytes.Buffer
+	testutil.Ok(t, e.ExportCompose(&b))
+	testutil.Equals(t, `name: e2e-test
+services:
+  app:
+    build:
+      context: `+dir+`
+      dockerfile: Dockerfile
+      args:
+        VERSION: "1"
+    hostname: app
+    volumes:
+    - `+e.dir+`:`+e.dir+`:z
+    networks:
+      e2e-test:
+        aliases:
+        - e2e-test-app
+networks:
+  e2e-test:
+    name: e2e-test
+`, b.String())
+}
+
+func TestDockerEnvironment_ExportCompose_Networks(t *testing.T) {
+	e := &DockerEnvironment{
+		networkName: "e2e-test",
+		dir:         t.TempDir(),
+		registered:  map[string]struct{}{},
+		networks:    []Network{{Name: "backend", Subnet: "172.30.0.0/24", Internal: true}},
+	}
+	r := e.Runnable("db").Init(StartOptions{
+		Image:    "postgres",
+		Networks: map[string]NetworkAttachment{"backend": {Aliases: []string{"postgres"}, IPv4Address: "172.30.0.10"}},
+	})
+	testutil.Ok(t, r.BuildErr())
+
+	var b bytes.Buffer
+	testutil.Ok(t, e.ExportCompose(&b))
+	testutil.Equals(t, `name: e2e-test
+services:
+  db:
+    image: postgres
+    hostname: db
+    volumes:
+    - `+e.dir+`:`+e.dir+`:z
+    networks:
+      e2e-test-backend:
+        aliases:
+        - e2e-test-db
+        - postgres
+        ipv4_address: 172.30.0.10
+networks:
+  e2e-test:
+    name: e2e-test
+  e2e-test-backend:
+    name: e2e-test-backend
+    internal: true
+    ipam:
+      config:
+      - subnet: 172.30.0.0/24
+`, b.String())
+}
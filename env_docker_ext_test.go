@@ -18,3 +18,52 @@ func TestDockerEnvironment(t *testing.T) {
 	t.Cleanup(e.Close)
 	testEnvironment(t, e)
 }
+
+func TestDockerEnvironment_EngineAPI(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.New(e2e.WithName("e2e-engine-api"), e2e.WithDockerEngineAPI(""))
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+	testEnvironment(t, e)
+}
+
+func TestDockerEnvironment_Reuse(t *testing.T) {
+	t.Parallel()
+
+	startApp := func(e e2e.Environment, envVars map[string]string) e2e.Runnable {
+		app := e.Runnable("app").WithPorts(map[string]int{"http": 80}).Init(e2e.StartOptions{
+			Image:   "nginx:1.23",
+			EnvVars: envVars,
+		})
+		testutil.Ok(t, e2e.StartAndWaitReady(app))
+		return app
+	}
+
+	e, err := e2e.New(e2e.WithName("e2e-reuse"), e2e.WithReuse())
+	testutil.Ok(t, err)
+	app := startApp(e, nil)
+	testutil.Ok(t, app.Exec(e2e.NewCommand("touch", "/marker")))
+	endpoint := app.Endpoint("http")
+	e.Close()
+
+	// Same spec, so the running container is reattached.
+	e, err = e2e.New(e2e.WithName("e2e-reuse"), e2e.WithReuse())
+	testutil.Ok(t, err)
+	app = startApp(e, nil)
+	testutil.Ok(t, app.Exec(e2e.NewCommand("test", "-f", "/marker")))
+	testutil.Equals(t, endpoint, app.Endpoint("http"))
+	e.Close()
+
+	// Changed spec, so the container is recreated.
+	e, err = e2e.New(e2e.WithName("e2e-reuse"), e2e.WithReuse())
+	testutil.Ok(t, err)
+	app = startApp(e, map[string]string{"CHANGED": "1"})
+	testutil.NotOk(t, app.Exec(e2e.NewCommand("test", "-f", "/marker")))
+	e.Close()
+
+	// Environment without reuse cleans everything up.
+	e, err = e2e.New(e2e.WithName("e2e-reuse"))
+	testutil.Ok(t, err)
+	e.Close()
+}
@@ -4,8 +4,19 @@
 package e2e
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/efficientgo/core/backoff"
 	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 )
@@ -74,3 +85,562 @@ func TestValidateName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDockerContainerState(t *testing.T) {
+	state, err := parseDockerContainerState([]byte(`{"Status":"exited","Running":false,"Paused":false,"Restarting":false,"OOMKilled":false,"Dead":false,"Pid":0,"ExitCode":3,"Error":"","StartedAt":"2022-11-03T10:00:00.123456789Z","FinishedAt":"2022-11-03T10:00:05Z"}
+`))
+	testutil.Ok(t, err)
+	testutil.Assert(t, state.exited())
+	testutil.Equals(t, ExitStatus{ExitCode: 3, FinishedAt: time.Date(2022, 11, 3, 10, 0, 5, 0, time.UTC)}, state.exitStatus())
+
+	state, err = parseDockerContainerState([]byte(`{"Status":"running","Running":true,"ExitCode":0}`))
+	testutil.Ok(t, err)
+	testutil.Assert(t, state.running())
+	testutil.Assert(t, !state.exited())
+
+	_, err = parseDockerContainerState([]byte(`running`))
+	testutil.NotOk(t, err)
+}
+
+func TestContainerSpec_Stop(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	args := e.containerSpec("app", nil, nil, StartOptions{Image: "alpine", StopSignal: syscall.SIGINT, StopGracePeriod: 1500 * time.Millisecond}).runArgs()
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "-v", "/tmp/e2e:/tmp/e2e:z", "--stop-signal", "2", "alpine",
+	}, args)
+	testutil.Equals(t, 2, stopGracePeriodSeconds(StartOptions{StopGracePeriod: 1500 * time.Millisecond}))
+	testutil.Equals(t, 30, stopGracePeriodSeconds(StartOptions{}))
+
+	_, err := signalNumber(fakeSignal{})
+	testutil.NotOk(t, err)
+}
+
+func TestContainerSpec_HostPorts(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	args := e.containerSpec("app", tcpPortSpecs(map[string]int{"http": 80}), map[string]int{"http": 32768, "grpc": 32769}, StartOptions{Image: "alpine"}).runArgs()
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "-v", "/tmp/e2e:/tmp/e2e:z", "-p", "32768:80", "alpine",
+	}, args)
+
+	args = e.containerSpec("app", tcpPortSpecs(map[string]int{"http": 80}), nil, StartOptions{Image: "alpine"}).runArgs()
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "-v", "/tmp/e2e:/tmp/e2e:z", "-p", "80", "alpine",
+	}, args)
+}
+
+func TestContainerSpec_PortSpecs(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	args := e.containerSpec("app", map[string]PortSpec{
+		"dns":     UDPPort(53),
+		"http":    {Port: 80, HostPort: 8080},
+		"metrics": {Port: 8125, Protocol: UDP, HostPort: 8125, HostIP: "127.0.0.1"},
+		"zipkin":  {Port: 9411, HostIP: "::1"},
+	}, map[string]int{"dns": 32768, "http": 32769}, StartOptions{Image: "alpine"}).runArgs()
+	// Fixed host ports take precedence over pinned ones.
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "-v", "/tmp/e2e:/tmp/e2e:z",
+		"-p", "32768:53/udp", "-p", "8080:80", "-p", "127.0.0.1:8125:8125/udp", "-p", "[::1]::9411", "alpine",
+	}, args)
+}
+
+func TestContainerSpec_Files(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	args := e.containerSpec("app", nil, nil, StartOptions{
+		Image:        "alpine",
+		Files:        map[string]File{"/etc/b.yaml": NewFile(nil), "/etc/a.yaml": NewFile(nil)},
+		Tmpfs:        []string{"/tmp"},
+		NamedVolumes: map[string]string{"/data": "cache"},
+	}).runArgs()
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app",
+		"-v", "/tmp/e2e:/tmp/e2e:z",
+		"-v", "/tmp/e2e/files/app/etc/a.yaml:/etc/a.yaml:ro,z",
+		"-v", "/tmp/e2e/files/app/etc/b.yaml:/etc/b.yaml:ro,z",
+		"-v", "e2e-test_cache:/data",
+		"--tmpfs", "/tmp",
+		"alpine",
+	}, args)
+}
+
+func TestContainerSpec_Networks(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	spec := e.containerSpec("app", nil, nil, StartOptions{
+		Image: "alpine",
+		Networks: map[string]NetworkAttachment{
+			"frontend": {IPv6Address: "fd00:e2e::10"},
+			"backend":  {Aliases: []string{"api"}, IPv4Address: "172.30.0.10"},
+			"e2e-test": {Aliases: []string{"app"}},
+		},
+	})
+	// The default network goes first, so the container is resolvable there as soon as it starts.
+	testutil.Equals(t, []dockerNetworkEndpoint{
+		{Network: "e2e-test", Aliases: []string{"app"}},
+		{Network: "e2e-test-backend", Aliases: []string{"api"}, IPv4Address: "172.30.0.10"},
+		{Network: "e2e-test-frontend", IPv6Address: "fd00:e2e::10"},
+	}, spec.Endpoints)
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "--network-alias=app", "-v", "/tmp/e2e:/tmp/e2e:z", "alpine",
+	}, spec.runArgs())
+	testutil.Equals(t, spec.Endpoints[1:], spec.extraEndpoints())
+
+	// Runnable not attached to the default network is created in the first of the extra ones.
+	spec = e.containerSpec("app", nil, nil, StartOptions{
+		Image:    "alpine",
+		Networks: map[string]NetworkAttachment{"backend": {Aliases: []string{"api"}, IPv4Address: "172.30.0.10"}},
+	})
+	testutil.Equals(t, []string{
+		"--net=e2e-test-backend", "--name=e2e-test-app", "--hostname=app", "--network-alias=api", "--ip=172.30.0.10", "-v", "/tmp/e2e:/tmp/e2e:z", "alpine",
+	}, spec.runArgs())
+	testutil.Equals(t, 0, len(spec.extraEndpoints()))
+
+	testutil.Equals(t, []string{"network", "create", "-d", "bridge", "e2e-test"}, dockerNetworkSpec{Name: "e2e-test"}.createArgs())
+	testutil.Equals(t, []string{
+		"network", "create", "-d", "bridge", "--subnet", "172.30.0.0/24", "--ipv6", "--subnet", "fd00:e2e::/64", "--internal", "e2e-test-backend",
+	}, dockerNetworkSpec{Name: "e2e-test-backend", Subnet: "172.30.0.0/24", IPv6Subnet: "fd00:e2e::/64", Internal: true}.createArgs())
+}
+
+func TestContainerSpec_Reuse(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e"}
+	testutil.Assert(t, e.containerSpec("app", nil, nil, StartOptions{Image: "alpine"}).Labels == nil)
+
+	e.reuse = true
+	spec := e.containerSpec("app", nil, nil, StartOptions{Image: "alpine"})
+	hash := spec.Labels[dockerSpecHashLabel]
+	testutil.Equals(t, 64, len(hash))
+	testutil.Equals(t, []string{
+		"--net=e2e-test", "--name=e2e-test-app", "--hostname=app", "--label", dockerSpecHashLabel + "=" + hash, "-v", "/tmp/e2e:/tmp/e2e:z", "alpine",
+	}, spec.runArgs())
+
+	testutil.Equals(t, hash, e.containerSpec("app", nil, nil, StartOptions{Image: "alpine"}).Labels[dockerSpecHashLabel])
+	testutil.Assert(t, hash != e.containerSpec("app", nil, nil, StartOptions{Image: "alpine", EnvVars: map[string]string{"A": "1"}}).Labels[dockerSpecHashLabel])
+}
+
+type fakeSignal struct{}
+
+func (fakeSignal) String() string { return "fake" }
+func (fakeSignal) Signal()        {}
+
+// fakeDockerBackend is in-memory dockerBackend. Its containers run until they are stopped or removed.
+type fakeDockerBackend struct {
+	mtx        sync.Mutex
+	containers map[string]*fakeContainer
+	nextPort   int
+}
+
+type fakeContainer struct {
+	state    dockerContainerState
+	hostPort int
+	exited   chan struct{}
+}
+
+func newFakeDockerBackend() *fakeDockerBackend {
+	return &fakeDockerBackend{containers: map[string]*fakeContainer{}, nextPort: 32768}
+}
+
+func (b *fakeDockerBackend) container(name string) (*fakeContainer, error) {
+	c, ok := b.containers[name]
+	if !ok {
+		return nil, errors.Newf("no such container %s", name)
+	}
+	return c, nil
+}
+
+func (c *fakeContainer) exit(code int) {
+	if c.state.exited() {
+		return
+	}
+	c.state = dockerContainerState{Status: "exited", ExitCode: code, FinishedAt: time.Now()}
+	close(c.exited)
+}
+
+func (*fakeDockerBackend) createNetwork(context.Context, dockerNetworkSpec) error { return nil }
+func (*fakeDockerBackend) networkGateway(context.Context, string) (string, error) {
+	return "172.18.0.1", nil
+}
+func (*fakeDockerBackend) networkExists(context.Context, string) (bool, error)   { return true, nil }
+func (*fakeDockerBackend) removeNetwork(context.Context, string) error           { return nil }
+func (*fakeDockerBackend) listVolumes(context.Context, string) ([]string, error) { return nil, nil }
+func (*fakeDockerBackend) removeVolume(context.Context, string) error            { return nil }
+
+func (b *fakeDockerBackend) listContainers(context.Context, string) ([]string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	names := make([]string, 0, len(b.containers))
+	for name := range b.containers {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (*fakeDockerBackend) imageExists(context.Context, string) (bool, error)  { return true, nil }
+func (*fakeDockerBackend) pullImage(context.Context, string, io.Writer) error { return nil }
+func (*fakeDockerBackend) buildImage(context.Context, *imageBuild, string, io.Writer) error {
+	return nil
+}
+func (*fakeDockerBackend) loadImage(context.Context, string) error         { return nil }
+func (*fakeDockerBackend) saveImage(context.Context, string, string) error { return nil }
+
+func (b *fakeDockerBackend) startContainer(_ context.Context, spec dockerContainerSpec, stdout, _ io.Writer) (<-chan struct{}, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.containers[spec.Name]; ok {
+		return nil, errors.Newf("container %s already exists", spec.Name)
+	}
+	c := &fakeContainer{state: dockerContainerState{Status: "running"}, hostPort: b.nextPort, exited: make(chan struct{})}
+	b.nextPort++
+	b.containers[spec.Name] = c
+	_, _ = fmt.Fprintln(stdout, "started")
+	return c.exited, nil
+}
+
+func (*fakeDockerBackend) runContainer(context.Context, dockerContainerSpec) ([]byte, error) {
+	return nil, nil
+}
+
+func (b *fakeDockerBackend) waitStarted(ctx context.Context, name string, _ backoff.Config) (dockerContainerState, error) {
+	return b.inspectState(ctx, name)
+}
+
+func (b *fakeDockerBackend) inspectState(_ context.Context, name string) (dockerContainerState, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return dockerContainerState{}, err
+	}
+	return c.state, nil
+}
+
+func (b *fakeDockerBackend) inspect(ctx context.Context, name string) ([]byte, error) {
+	state, err := b.inspectState(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(state)
+}
+
+func (*fakeDockerBackend) containerLabels(context.Context, string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (*fakeDockerBackend) attachContainer(context.Context, string, io.Writer, io.Writer) (<-chan struct{}, error) {
+	return nil, errors.New("not supported")
+}
+
+func (b *fakeDockerBackend) hostPort(_ context.Context, name string, _ int, _ string) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return 0, err
+	}
+	return c.hostPort, nil
+}
+
+func (*fakeDockerBackend) containerIP(context.Context, string, string) (string, error) {
+	return "172.18.0.2", nil
+}
+
+func (b *fakeDockerBackend) stopContainer(_ context.Context, name string, _ int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	c.exit(0)
+	return nil
+}
+
+func (b *fakeDockerBackend) removeContainer(_ context.Context, name string, force bool) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	if !c.state.exited() {
+		if !force {
+			return errors.Newf("container %s is running", name)
+		}
+		c.exit(137)
+	}
+	delete(b.containers, name)
+	return nil
+}
+
+func (b *fakeDockerBackend) setStatus(name, status string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	c, err := b.container(name)
+	if err != nil {
+		return err
+	}
+	c.state.Status = status
+	return nil
+}
+
+func (b *fakeDockerBackend) pauseContainer(_ context.Context, name string) error {
+	return b.setStatus(name, "paused")
+}
+
+func (b *fakeDockerBackend) unpauseContainer(_ context.Context, name string) error {
+	return b.setStatus(name, "running")
+}
+
+func (*fakeDockerBackend) signalContainer(context.Context, string, int) error { return nil }
+
+func (*fakeDockerBackend) copyTo(context.Context, string, string, string) error   { return nil }
+func (*fakeDockerBackend) copyFrom(context.Context, string, string, string) error { return nil }
+
+func (b *fakeDockerBackend) exec(_ context.Context, name string, cmd []string, _ io.Reader, stdout, _ io.Writer) error {
+	state, err := b.inspectState(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	if !state.running() {
+		return errors.Newf("container %s is %s", name, state.Status)
+	}
+	_, err = fmt.Fprintln(stdout, strings.Join(cmd, " "))
+	return err
+}
+
+func (b *fakeDockerBackend) stats(_ context.Context, name string) (RunnableStats, error) {
+	state, err := b.inspectState(context.Background(), name)
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	if !state.running() {
+		return RunnableStats{}, errors.Newf("container %s is %s", name, state.Status)
+	}
+	return RunnableStats{PIDs: 1}, nil
+}
+
+type endpointsListener struct{}
+
+func (endpointsListener) OnRunnableChange(started []Runnable) error {
+	for _, r := range started {
+		_ = r.Endpoint("http")
+	}
+	return nil
+}
+
+func TestDockerEnvironment_PrePull(t *testing.T) {
+	e := &DockerEnvironment{
+		logger:      NewLogger(io.Discard),
+		networkName: "e2e-prepull",
+		dir:         t.TempDir(),
+		registered:  map[string]struct{}{},
+		backend:     newFakeDockerBackend(),
+	}
+
+	a := e.Runnable("a").Init(StartOptions{Image: "a", PullPolicy: PullAlways})
+	b := e.Runnable("b").Init(StartOptions{Image: "b"})
+	// Not initialized runnables are skipped.
+	_ = e.Runnable("future").Future()
+	testutil.NotOk(t, e.Runnable("invalid").Init(StartOptions{Image: "c", PullPolicy: "sometimes"}).BuildErr())
+
+	testutil.Ok(t, e.PrePull(context.Background()))
+	testutil.Assert(t, a.(*dockerRunnable).prePulled)
+	testutil.Assert(t, b.(*dockerRunnable).prePulled)
+
+	// Image is not pulled again on start.
+	testutil.Ok(t, a.Start())
+	testutil.Assert(t, !a.(*dockerRunnable).prePulled)
+	testutil.Ok(t, a.Kill())
+
+	testutil.NotOk(t, e.PrePull(context.Background(), NewFailedRunnable("other", errors.New("not part of the environment"))))
+}
+
+// unavailableDockerBackend is dockerBackend which can't create networks, e.g. because docker daemon is not running.
+type unavailableDockerBackend struct {
+	*fakeDockerBackend
+}
+
+func (unavailableDockerBackend) createNetwork(context.Context, dockerNetworkSpec) error {
+	return errors.New("docker daemon is not running")
+}
+func (unavailableDockerBackend) networkExists(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func TestDockerEnvironment_SetupReusedFailure(t *testing.T) {
+	t.Setenv("E2E_TEMP_DIR", t.TempDir())
+	e := &DockerEnvironment{
+		logger:      NewLogger(io.Discard),
+		networkName: "e2e-reuse-failure",
+		registered:  map[string]struct{}{},
+		backend:     unavailableDockerBackend{newFakeDockerBackend()},
+		reuse:       true,
+	}
+	testutil.NotOk(t, e.setup(context.Background()))
+
+	// Shared directory kept for reuse is not left behind by failed setup.
+	dir, err := getReusedTmpDirectory(e.networkName)
+	testutil.Ok(t, err)
+	_, err = os.Stat(dir)
+	testutil.Assert(t, os.IsNotExist(err), "expected %s to not exist, got %v", dir, err)
+}
+
+// contextDockerBackend is dockerBackend which fails to create networks once context is done.
+type contextDockerBackend struct {
+	*fakeDockerBackend
+}
+
+func (contextDockerBackend) createNetwork(ctx context.Context, _ dockerNetworkSpec) error {
+	return ctx.Err()
+}
+
+func TestDockerEnvironment_SetupContext(t *testing.T) {
+	t.Setenv("E2E_TEMP_DIR", t.TempDir())
+	e := &DockerEnvironment{
+		logger:      NewLogger(io.Discard),
+		networkName: "e2e-setup-ctx",
+		registered:  map[string]struct{}{},
+		backend:     contextDockerBackend{newFakeDockerBackend()},
+	}
+	testutil.Ok(t, e.setup(context.Background()))
+	e.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := e.setup(ctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, context.Canceled), "expected context error, got %v", err)
+}
+
+// netAdminDockerBackend is dockerBackend recording commands run by network admin containers.
+type netAdminDockerBackend struct {
+	*fakeDockerBackend
+	cmds []string
+}
+
+func (b *netAdminDockerBackend) runContainer(_ context.Context, spec dockerContainerSpec) ([]byte, error) {
+	b.cmds = append(b.cmds, strings.TrimPrefix(spec.NetworkMode, "container:")+": "+strings.Join(spec.Cmd, " "))
+	return nil, nil
+}
+
+func (*netAdminDockerBackend) containerIP(_ context.Context, name, network string) (string, error) {
+	return name + "@" + network, nil
+}
+
+func TestDockerEnvironment_Partition(t *testing.T) {
+	backend := &netAdminDockerBackend{fakeDockerBackend: newFakeDockerBackend()}
+	e := &DockerEnvironment{
+		logger:      NewLogger(io.Discard),
+		networkName: "e2e-partition",
+		dir:         t.TempDir(),
+		registered:  map[string]struct{}{},
+		backend:     backend,
+		networks:    []Network{{Name: "backend"}},
+	}
+	a := e.Runnable("a").Init(StartOptions{Image: "a", Networks: map[string]NetworkAttachment{"e2e-partition": {}, "backend": {}}})
+	b := e.Runnable("b").Init(StartOptions{Image: "b"})
+	testutil.Ok(t, a.BuildErr())
+	testutil.Ok(t, b.BuildErr())
+
+	f, err := e.Partition(a, b)
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Heal())
+	testutil.Equals(t, []string{
+		"e2e-partition-a: iptables -A INPUT -s e2e-partition-b@e2e-partition -j DROP",
+		"e2e-partition-b: iptables -A INPUT -s e2e-partition-a@e2e-partition,e2e-partition-a@e2e-partition-backend -j DROP",
+		"e2e-partition-a: iptables -D INPUT -s e2e-partition-b@e2e-partition -j DROP",
+		"e2e-partition-b: iptables -D INPUT -s e2e-partition-a@e2e-partition,e2e-partition-a@e2e-partition-backend -j DROP",
+	}, backend.cmds)
+}
+
+// TestDockerEnvironment_Concurrent is meant to be run with the race detector.
+func TestDockerEnvironment_Concurrent(t *testing.T) {
+	backend := newFakeDockerBackend()
+	e := &DockerEnvironment{
+		logger:      NewLogger(io.Discard),
+		networkName: "e2e-concurrent",
+		dir:         t.TempDir(),
+		registered:  map[string]struct{}{},
+		backend:     backend,
+	}
+
+	var events int32
+	e.AddListener(endpointsListener{})
+	e.AddEventListener(RunnableEventListenerFunc(func(event RunnableEvent) {
+		atomic.AddInt32(&events, 1)
+		_ = event.Runnable.Endpoint("http")
+	}))
+
+	t.Run("replicas", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("replica-%d", i)
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+
+				r := e.Runnable(name).WithPorts(map[string]int{"http": 80}).Init(StartOptions{Image: "app"})
+				testutil.Ok(t, r.Start())
+
+				errs := make(chan error, 10)
+				for j := 0; j < cap(errs); j++ {
+					go func(j int) {
+						r.SetMetadata(j, j)
+						if r.Endpoint("http") == "" || r.InternalEndpoint("http") == "" {
+							errs <- errors.Newf("no endpoint of %s", r.Name())
+							return
+						}
+						if j%5 == 0 {
+							_, err := r.InjectLatency(time.Millisecond, 0)
+							errs <- err
+							return
+						}
+						errs <- r.Exec(NewCommand("echo", name))
+					}(j)
+				}
+				for j := 0; j < cap(errs); j++ {
+					testutil.Ok(t, <-errs)
+				}
+
+				testutil.Ok(t, r.Restart(context.Background()))
+				testutil.Ok(t, r.Stop())
+				testutil.Assert(t, !r.IsRunning())
+			})
+		}
+	})
+
+	t.Run("same runnable", func(t *testing.T) {
+		testutil.NotOk(t, e.Runnable("replica-0").Init(StartOptions{Image: "app"}).BuildErr())
+
+		r := e.Runnable("single").WithPorts(map[string]int{"http": 80}).Init(StartOptions{Image: "app"})
+		errs := make(chan error, 5)
+		for i := 0; i < cap(errs); i++ {
+			go func() { errs <- r.Start() }()
+		}
+		var failed int
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				failed++
+			}
+		}
+		testutil.Equals(t, cap(errs)-1, failed)
+
+		for i := 0; i < cap(errs); i++ {
+			go func(i int) {
+				if i%2 == 0 {
+					errs <- r.Kill()
+					return
+				}
+				errs <- r.Stop()
+			}(i)
+		}
+		for i := 0; i < cap(errs); i++ {
+			testutil.Ok(t, <-errs)
+		}
+		testutil.Assert(t, !r.IsRunning())
+
+		testutil.Ok(t, r.Start())
+	})
+
+	e.Close()
+	names, err := backend.listContainers(context.Background(), e.networkName)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(names))
+	testutil.Assert(t, atomic.LoadInt32(&events) > 0)
+	testutil.NotOk(t, e.Runnable("new").Init(StartOptions{Image: "app"}).BuildErr())
+}
@@ -5,11 +5,16 @@ package e2e_test
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"path/filepath"
+	"regexp"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/efficientgo/e2e"
 	e2edb "github.com/efficientgo/e2e/db"
@@ -36,11 +41,23 @@ func testEnvironment(t *testing.T, e e2e.Environment) {
 	testutil.Equals(t, "stopped", p1.Endpoint("http"))
 	testutil.Equals(t, "stopped", p1.Endpoint("not-existing"))
 
+	// Cancelled context should fail start and leave runnable stopped.
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	testutil.NotOk(t, p1.StartContext(cancelledCtx))
+	testutil.Assert(t, !p1.IsRunning())
+
 	p2 := e2edb.NewPrometheus(e, "prometheus-2")
-	testutil.Ok(t, e2e.StartAndWaitReady(p1, p2))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	t.Cleanup(cancel)
+	testutil.Ok(t, e2e.StartAndWaitReadyContext(ctx, p1, p2))
 	testutil.Ok(t, p1.WaitReady())
 	testutil.Ok(t, p1.WaitReady())
 
+	l, err := p1.WaitLogLine(ctx, regexp.MustCompile("Server is ready to receive web requests"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, l.Offset >= p1.Logs().StartOffset())
+
 	testutil.Ok(t, p1.WaitSumMetrics(e2emon.Greater(50), "prometheus_tsdb_head_samples_appended_total"))
 
 	testutil.Equals(t, "prometheus-1", p1.Name())
@@ -69,6 +86,40 @@ func testEnvironment(t *testing.T, e e2e.Environment) {
 	testutil.Ok(t, p1.Exec(wgetFlagsCmd(p2.InternalEndpoint("http")), e2e.WithExecOptionStdout(&out)))
 	testutil.Equals(t, expectedFlagsOutputProm2, out.String())
 
+	// Network faults.
+	readyCmd := e2e.NewCommandWithoutEntrypoint("wget", "-T", "2", "-O", "/dev/null", "http://"+p2.InternalEndpoint("http")+"/-/ready")
+	partition, err := e.Partition(p1, p2)
+	testutil.Ok(t, err)
+	testutil.NotOk(t, p1.Exec(readyCmd))
+	testutil.Ok(t, partition.Heal())
+	testutil.Ok(t, partition.Heal())
+	testutil.Ok(t, p1.Exec(readyCmd))
+
+	latency, err := p1.InjectLatency(500*time.Millisecond, 0)
+	testutil.Ok(t, err)
+	start := time.Now()
+	testutil.Ok(t, p1.Exec(readyCmd))
+	testutil.Assert(t, time.Since(start) >= 500*time.Millisecond)
+	testutil.Ok(t, latency.Heal())
+
+	// Paused runnable does not respond.
+	testutil.Ok(t, p2.Pause())
+	testutil.NotOk(t, p1.Exec(readyCmd))
+	testutil.Ok(t, p2.Unpause())
+	testutil.Ok(t, p1.Exec(readyCmd))
+
+	// Restart keeps host ports.
+	endpoint := p2.Endpoint("http")
+	testutil.Ok(t, p2.Restart(ctx))
+	testutil.Equals(t, endpoint, p2.Endpoint("http"))
+	testutil.Ok(t, p1.Exec(readyCmd))
+
+	// Prometheus reloads configuration on SIGHUP.
+	offset := p2.Logs().Len()
+	testutil.Ok(t, p2.Signal(syscall.SIGHUP))
+	_, err = p2.WaitLogLine(ctx, regexp.MustCompile("Completed loading of configuration file"), e2e.WithLogLineSince(offset))
+	testutil.Ok(t, err)
+
 	testutil.NotOk(t, p1.Start()) // Starting ok, should fail.
 
 	// Batch job example and test.
@@ -80,6 +131,34 @@ func testEnvironment(t *testing.T, e e2e.Environment) {
 		testutil.Equals(t, "yolo\n", out.String())
 	}
 
+	// One-shot job that exits on its own.
+	job := e.Runnable("job").Init(e2e.StartOptions{Image: "ubuntu:20.04", Command: e2e.NewCommand("sh", "-c", "echo done && exit 3"), Job: true})
+	_, err = batch.Wait(ctx)
+	testutil.NotOk(t, err) // Not a job.
+	testutil.Ok(t, job.Start())
+	_, err = job.WaitLogLine(ctx, regexp.MustCompile("^done$"))
+	testutil.Ok(t, err)
+	status, err := job.Wait(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, status.ExitCode)
+	testutil.Assert(t, !status.OOMKilled)
+	testutil.Assert(t, !job.IsRunning())
+
+	// Crashing runnable fails fast with exit details.
+	crash := e.Runnable("crash").Init(e2e.StartOptions{
+		Image:     "ubuntu:20.04",
+		Command:   e2e.NewCommand("sh", "-c", "echo flag provided but not defined && exit 2"),
+		Readiness: e2e.NewCmdReadinessProbe(e2e.NewCommand("true")),
+	})
+	err = e2e.StartAndWaitReadyContext(ctx, crash)
+	testutil.NotOk(t, err)
+	var terr *e2e.TerminatedError
+	testutil.Assert(t, errors.As(err, &terr), "expected TerminatedError, got %v", err)
+	testutil.Equals(t, 2, terr.Status.ExitCode)
+	testutil.Assert(t, len(terr.LastLogs) > 0)
+	testutil.Equals(t, "flag provided but not defined", terr.LastLogs[len(terr.LastLogs)-1].Text)
+	testutil.Ok(t, crash.Kill())
+
 	e.Close()
 	afterClose := e2edb.NewPrometheus(e, "prometheus-3") // Should fail.
 	testutil.NotOk(t, afterClose.Start())
@@ -6,6 +6,7 @@ package e2e
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -13,14 +14,17 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/efficientgo/core/backoff"
 	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
 )
 
 var (
@@ -38,15 +42,30 @@ type KindEnvironment struct {
 	nodeIP  net.IP
 	volumes []string
 	verbose bool
+	// images manages images in the host Docker, which are then loaded into the cluster.
+	images *dockerCLI
+	// imageCacheDir is the directory of image tarballs, if configured (see WithImageCache).
+	imageCacheDir string
+	// logHistoryLimit is the maximum number of lines in log history of runnables, 0 means no limit.
+	logHistoryLimit int
+
+	// events has its own lock, as listeners are notified without holding the mutex.
+	events runnableEvents
+
+	// netAdminMtx guards netAdminPods, names of pods running the ephemeral container used to inject network faults.
+	netAdminMtx  sync.Mutex
+	netAdminPods map[string]struct{}
 
 	mutex sync.Mutex
 	// Access to the following fields must be guarded
 	// by a mutex.
 	registered map[string]struct{}
-	listeners  []EnvironmentListener
-	started    []Runnable
-	closers    []func()
-	closed     bool
+	// runnables contains all runnables created in the environment, in creation order.
+	runnables []*kindRunnable
+	listeners []EnvironmentListener
+	started   []Runnable
+	closers   []func()
+	closed    bool
 }
 
 func validateKindName(name string) error {
@@ -78,6 +97,12 @@ nodes:
 
 // NewKindEnvironment creates a new, isolated kind environment.
 func NewKindEnvironment(opts ...EnvironmentOption) (_ *KindEnvironment, err error) {
+	return NewKindEnvironmentContext(context.Background(), opts...)
+}
+
+// NewKindEnvironmentContext creates a new, isolated kind environment. Context bounds the setup of the environment,
+// e.g. `kind create cluster`. If setup fails, the cluster is deleted regardless of the context.
+func NewKindEnvironmentContext(ctx context.Context, opts ...EnvironmentOption) (_ *KindEnvironment, err error) {
 	e := environmentOptions{}
 	for _, o := range opts {
 		o(&e)
@@ -92,6 +117,9 @@ func NewKindEnvironment(opts ...EnvironmentOption) (_ *KindEnvironment, err erro
 	if err := validateKindName(e.name); err != nil {
 		return nil, err
 	}
+	if len(e.networks) > 0 {
+		return nil, errNetworksNotSupported
+	}
 
 	if e.logger == nil {
 		e.logger = NewLogger(os.Stdout)
@@ -103,11 +131,18 @@ func NewKindEnvironment(opts ...EnvironmentOption) (_ *KindEnvironment, err erro
 		verbose:     e.verbose,
 		registered:  map[string]struct{}{},
 		volumes:     e.volumes,
+
+		netAdminPods: map[string]struct{}{},
+
+		images:        newDockerCLI(e.logger, e.verbose),
+		imageCacheDir: e.imageCacheDirectory(),
+
+		logHistoryLimit: e.logHistoryLimitOrDefault(),
 	}
 
 	// Force a shutdown in order to cleanup from a spurious situation in case
 	// the previous tests run didn't cleanup correctly.
-	k.close()
+	k.close(ctx)
 
 	dir, err := getTmpDirectory()
 	if err != nil {
@@ -126,13 +161,13 @@ func NewKindEnvironment(opts ...EnvironmentOption) (_ *KindEnvironment, err erro
 	}
 
 	// Setup the kind cluster.
-	if out, err := k.exec("kind", "create", "cluster", "--kubeconfig", k.kubeconfig(), "--config", kindConfigPath, "--name", k.clusterName).CombinedOutput(); err != nil {
+	if out, err := k.execContext(ctx, "kind", "create", "cluster", "--kubeconfig", k.kubeconfig(), "--config", kindConfigPath, "--name", k.clusterName).CombinedOutput(); err != nil {
 		e.logger.Log(string(out))
 		k.Close()
 		return nil, errors.Wrapf(err, "create kind cluster %q", k.clusterName)
 	}
 
-	out, err := k.exec("kubectl", "--kubeconfig", k.kubeconfig(), "get", "nodes", fmt.Sprintf("%s-control-plane", k.clusterName), "--output", `jsonpath='{.status.addresses}'`).CombinedOutput()
+	out, err := k.execContext(ctx, "kubectl", "--kubeconfig", k.kubeconfig(), "get", "nodes", fmt.Sprintf("%s-control-plane", k.clusterName), "--output", `jsonpath='{.status.addresses}'`).CombinedOutput()
 	if err != nil {
 		e.logger.Log(string(out))
 		k.Close()
@@ -165,6 +200,12 @@ func NewKindEnvironment(opts ...EnvironmentOption) (_ *KindEnvironment, err erro
 	}
 	k.nodeIP = net.ParseIP(internalIPs[0].Address)
 
+	if c := e.artifactsCloser(k.logger, func(ctx context.Context, dir string) error {
+		// Closers are invoked with the mutex held.
+		return k.collectArtifacts(ctx, dir, k.runnables)
+	}); c != nil {
+		k.AddCloser(c)
+	}
 	return k, e.logger.Log("msg", "started kind environment", "name", k.clusterName)
 }
 
@@ -184,6 +225,14 @@ func (e *KindEnvironment) AddCloser(f func()) {
 // If a runnable of a different Kubernetes kind is needed, then it must be
 // manually deployed using the kubeconfig in the environment's shared directory.
 func (e *KindEnvironment) Runnable(name string) RunnableBuilder {
+	b := e.runnable(name)
+	if r, ok := b.(*kindRunnable); ok {
+		e.events.emit(RunnableEvent{Type: RunnableCreated, Runnable: r})
+	}
+	return b
+}
+
+func (e *KindEnvironment) runnable(name string) RunnableBuilder {
 	defer e.mutex.Unlock()
 	e.mutex.Lock()
 	if e.closed {
@@ -198,7 +247,8 @@ func (e *KindEnvironment) Runnable(name string) RunnableBuilder {
 		env:        e,
 		name:       name,
 		logger:     e.logger,
-		ports:      map[string]int{},
+		logs:       newLogs(e.logHistoryLimit),
+		ports:      map[string]PortSpec{},
 		hostPorts:  map[string]int{},
 		extensions: map[any]any{},
 	}
@@ -206,9 +256,48 @@ func (e *KindEnvironment) Runnable(name string) RunnableBuilder {
 		return errorer{name: name, err: err}
 	}
 	e.register(name)
+	e.runnables = append(e.runnables, r)
 	return r
 }
 
+// CollectArtifacts writes artifacts of every runnable created in the environment into its own subdirectory of dir,
+// including `kubectl describe` output of running workloads and their pods. See WithArtifacts for details.
+func (e *KindEnvironment) CollectArtifacts(ctx context.Context, dir string) error {
+	e.mutex.Lock()
+	runnables := append([]*kindRunnable{}, e.runnables...)
+	e.mutex.Unlock()
+	return e.collectArtifacts(ctx, dir, runnables)
+}
+
+func (e *KindEnvironment) collectArtifacts(ctx context.Context, dir string, runnables []*kindRunnable) error {
+	rs := make([]Runnable, 0, len(runnables))
+	for _, r := range runnables {
+		rs = append(rs, r)
+	}
+	return collectArtifacts(ctx, dir, rs, func(ctx context.Context, r Runnable, dir string) error {
+		k := r.(*kindRunnable)
+		if !k.IsRunning() {
+			return nil
+		}
+		k.mutex.Lock()
+		workload := k.workload()
+		k.mutex.Unlock()
+
+		var out bytes.Buffer
+		for _, args := range [][]string{
+			{"describe", workload},
+			{"describe", "pod", "--selector", fmt.Sprintf("app.kubernetes.io/name=%s", k.Name())},
+		} {
+			b, err := e.execContext(ctx, "kubectl", append([]string{"--kubeconfig", e.kubeconfig()}, args...)...).CombinedOutput()
+			if err != nil {
+				return errors.Wrapf(err, "kubectl %s: %s", strings.Join(args, " "), strings.TrimSpace(string(b)))
+			}
+			out.Write(b)
+		}
+		return os.WriteFile(filepath.Join(dir, "describe.txt"), out.Bytes(), 0644)
+	})
+}
+
 // AddListener registers the given listener to be notified on environment runnable changes.
 func (e *KindEnvironment) AddListener(listener EnvironmentListener) {
 	defer e.mutex.Unlock()
@@ -216,6 +305,13 @@ func (e *KindEnvironment) AddListener(listener EnvironmentListener) {
 	e.listeners = append(e.listeners, listener)
 }
 
+// AddEventListener registers the given listener to be notified on the given lifecycle events of all runnables in the environment.
+// Listener is notified on all events, if no event types are given. Crashes are detected only while starting runnables
+// or waiting for them to get ready, as kind environment doesn't watch running pods.
+func (e *KindEnvironment) AddEventListener(listener RunnableEventListener, types ...RunnableEventType) {
+	e.events.add(listener, types...)
+}
+
 func (e *KindEnvironment) isRegistered(name string) bool {
 	_, ok := e.registered[name]
 	return ok
@@ -226,6 +322,9 @@ func (e *KindEnvironment) register(name string) {
 }
 
 func (e *KindEnvironment) registerStarted(r Runnable) error {
+	defer e.mutex.Unlock()
+	e.mutex.Lock()
+
 	e.started = append(e.started, r)
 
 	for _, l := range e.listeners {
@@ -237,6 +336,9 @@ func (e *KindEnvironment) registerStarted(r Runnable) error {
 }
 
 func (e *KindEnvironment) registerStopped(name string) error {
+	defer e.mutex.Unlock()
+	e.mutex.Lock()
+
 	for i, r := range e.started {
 		if r.Name() == name {
 			e.started = append(e.started[:i], e.started[i+1:]...)
@@ -255,13 +357,16 @@ func (e *KindEnvironment) SharedDir() string {
 	return e.dir
 }
 
-func (e *KindEnvironment) buildManifest(name string, ports map[string]int, opts StartOptions) (io.Reader, error) {
+// buildManifest returns Kubernetes manifest for the runnable. Ports with fixed host port are exposed on that node port.
+// Other ports with non-zero node port in nodePorts are exposed on that node port, others on random one.
+func (e *KindEnvironment) buildManifest(name string, ports map[string]PortSpec, nodePorts map[string]int, opts StartOptions) (io.Reader, error) {
 	values := kindManifestValues{
 		Name:         name,
 		Image:        opts.Image,
 		Command:      opts.Command.Cmd,
 		Args:         opts.Command.Args,
-		Ports:        ports,
+		Ports:        map[string]int{},
+		NodePorts:    map[string]int{},
 		Envs:         opts.EnvVars,
 		Bytes:        opts.LimitMemoryBytes,
 		CPUs:         opts.LimitCPUs,
@@ -273,13 +378,50 @@ func (e *KindEnvironment) buildManifest(name string, ports map[string]int, opts
 		},
 		User:   opts.User,
 		UserNs: opts.UserNs,
+		Job:    opts.Job,
+	}
+	if opts.StopGracePeriod > 0 {
+		values.TerminationGracePeriodSeconds = stopGracePeriodSeconds(opts)
 	}
 	for i, v := range e.volumes {
 		values.Volumes[fmt.Sprintf("volume%d", i)] = v
 	}
+	for n, p := range ports {
+		values.Ports[n] = p.Port
+		// Protocol is set only for non-TCP ports, as TCP is the default.
+		if p.protocol() == UDP {
+			if values.Protocols == nil {
+				values.Protocols = map[string]string{}
+			}
+			values.Protocols[n] = "UDP"
+		}
+		if p.HostPort > 0 {
+			values.NodePorts[n] = p.HostPort
+		} else if np := nodePorts[n]; np > 0 {
+			values.NodePorts[n] = np
+		}
+	}
 	for i, v := range opts.Volumes {
 		values.Volumes[fmt.Sprintf("volume%d", i+len(e.volumes))] = v
 	}
+	for i, p := range filePaths(opts.Files) {
+		f := kindFile{
+			Key:     fmt.Sprintf("file%d", i),
+			Path:    p,
+			Mode:    int(opts.Files[p].mode()),
+			Content: template.HTML(base64.StdEncoding.EncodeToString(opts.Files[p].Content)),
+		}
+		if opts.Files[p].Secret {
+			values.SecretFiles = append(values.SecretFiles, f)
+			continue
+		}
+		values.Files = append(values.Files, f)
+	}
+	values.Tmpfs = opts.Tmpfs
+	for _, p := range volumePaths(opts.NamedVolumes) {
+		// There is a single node, so volumes can be shared node directories. They are removed together with the cluster.
+		values.NamedVolumes = append(values.NamedVolumes, kindNamedVolume{Path: p, NodePath: path.Join(kindVolumesDir, opts.NamedVolumes[p])})
+	}
 	var buf bytes.Buffer
 	if err := kindManifest.Execute(&buf, values); err != nil {
 		return nil, err
@@ -287,21 +429,34 @@ func (e *KindEnvironment) buildManifest(name string, ports map[string]int, opts
 	return &buf, nil
 }
 
-var kindManifest = template.Must(template.New("manifest").Parse(`apiVersion: apps/v1
+var kindManifest = template.Must(template.New("manifest").Parse(`{{if .Job}}apiVersion: batch/v1
+kind: Job
+{{- else}}apiVersion: apps/v1
 kind: Deployment
+{{- end}}
 metadata:
   labels:
     app.kubernetes.io/name: "{{.Name}}"
   name: "{{.Name}}"
 spec:
+  {{- if .Job}}
+  backoffLimit: 0
+  {{- else}}
   selector:
     matchLabels:
       app.kubernetes.io/name: "{{.Name}}"
+  {{- end}}
   template:
     metadata:
       labels:
         app.kubernetes.io/name: "{{.Name}}"
     spec:
+      {{- if .Job}}
+      restartPolicy: Never
+      {{- end}}
+      {{- with .TerminationGracePeriodSeconds}}
+      terminationGracePeriodSeconds: {{.}}
+      {{- end}}
       containers:
       - name: "{{.Name}}"
         image: "{{.Image}}"
@@ -320,6 +475,9 @@ spec:
         {{- range $k, $v := .}}
         - name: "{{$k}}"
           containerPort: {{$v}}
+          {{- with index $.Protocols $k}}
+          protocol: {{.}}
+          {{- end}}
         {{- end}}
         {{- end}}
         {{- with .Envs}}
@@ -362,20 +520,73 @@ spec:
             {{- end}}
           {{- end}}
         {{- end}}
-        {{- with .Volumes}}
+        {{- if or .Volumes .Files .SecretFiles .Tmpfs .NamedVolumes}}
         volumeMounts:
-        {{- range $k, $v := .}}
+        {{- range $k, $v := .Volumes}}
         - name: "{{$k}}"
           mountPath: {{$v}}
         {{- end}}
+        {{- range .Files}}
+        - name: "files"
+          mountPath: "{{.Path}}"
+          subPath: "{{.Key}}"
+          readOnly: true
+        {{- end}}
+        {{- range .SecretFiles}}
+        - name: "secret-files"
+          mountPath: "{{.Path}}"
+          subPath: "{{.Key}}"
+          readOnly: true
+        {{- end}}
+        {{- range $i, $p := .Tmpfs}}
+        - name: "tmpfs{{$i}}"
+          mountPath: "{{$p}}"
         {{- end}}
-      {{- with .Volumes}}
+        {{- range $i, $v := .NamedVolumes}}
+        - name: "named-volume{{$i}}"
+          mountPath: "{{$v.Path}}"
+        {{- end}}
+        {{- end}}
+      {{- if or .Volumes .Files .SecretFiles .Tmpfs .NamedVolumes}}
       volumes:
-      {{- range $k, $v := .}}
+      {{- range $k, $v := .Volumes}}
       - name: "{{$k}}"
         hostPath:
           path: {{$v}}
       {{- end}}
+      {{- with .Files}}
+      - name: "files"
+        configMap:
+          name: "{{$.Name}}-files"
+          items:
+          {{- range .}}
+          - key: "{{.Key}}"
+            path: "{{.Key}}"
+            mode: {{.Mode}}
+          {{- end}}
+      {{- end}}
+      {{- with .SecretFiles}}
+      - name: "secret-files"
+        secret:
+          secretName: "{{$.Name}}-files"
+          items:
+          {{- range .}}
+          - key: "{{.Key}}"
+            path: "{{.Key}}"
+            mode: {{.Mode}}
+          {{- end}}
+      {{- end}}
+      {{- range $i, $p := .Tmpfs}}
+      - name: "tmpfs{{$i}}"
+        emptyDir:
+          medium: Memory
+      {{- end}}
+      {{- range $i, $v := .NamedVolumes}}
+      - name: "named-volume{{$i}}"
+        hostPath:
+          path: "{{$v.NodePath}}"
+          type: DirectoryOrCreate
+      {{- end}}
       {{- end}}
 {{- if .Ports}}
 ---
@@ -394,34 +605,99 @@ spec:
   {{- range $k, $v := .}}
   - name: "{{$k}}"
     port: {{$v}}
+    {{- with index $.Protocols $k}}
+    protocol: {{.}}
+    {{- end}}
+    {{- with index $.NodePorts $k}}
+    nodePort: {{.}}
+    {{- end}}
+  {{- end}}
+  {{- end}}
+{{- end}}
+{{- with .Files}}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/name: "{{$.Name}}"
+  name: "{{$.Name}}-files"
+binaryData:
+  {{- range .}}
+  {{.Key}}: "{{.Content}}"
   {{- end}}
+{{- end}}
+{{- with .SecretFiles}}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  labels:
+    app.kubernetes.io/name: "{{$.Name}}"
+  name: "{{$.Name}}-files"
+data:
+  {{- range .}}
+  {{.Key}}: "{{.Content}}"
   {{- end}}
 {{- end}}
 `))
 
+// kindVolumesDir is the directory on the kind node named volumes are stored in.
+const kindVolumesDir = "/var/local/e2e-volumes"
+
+// kindFile is the file of StartOptions.Files stored under Key in ConfigMap or Secret.
+type kindFile struct {
+	Key  string
+	Path string
+	Mode int
+	// Content is base64 encoded, so binary files are supported. It's marked as safe, so the manifest template doesn't
+	// escape `+` of the encoding.
+	Content template.HTML
+}
+
+type kindNamedVolume struct {
+	Path     string
+	NodePath string
+}
+
 type kindManifestValues struct {
 	Name         string
 	Image        string
 	Command      string
 	Args         []string
 	Ports        map[string]int
+	NodePorts    map[string]int
+	Protocols    map[string]string
 	Envs         map[string]string
 	Bytes        uint
 	CPUs         float64
 	Privileged   bool
 	Capabilities []RunnableCapabilities
 	Volumes      map[string]string
+	Files        []kindFile
+	SecretFiles  []kindFile
+	Tmpfs        []string
+	NamedVolumes []kindNamedVolume
 	User         string
 	UserNs       string
+	Job          bool
+
+	TerminationGracePeriodSeconds int
 }
 
 func (e *KindEnvironment) Close() {
+	e.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but context bounds `kind delete cluster`. Closers added with AddCloser are not bound by
+// the context.
+func (e *KindEnvironment) CloseContext(ctx context.Context) {
 	defer e.mutex.Unlock()
 	e.mutex.Lock()
 	for _, c := range e.closers {
 		c()
 	}
-	e.close()
+	e.close(ctx)
 	e.closed = true
 }
 
@@ -437,14 +713,14 @@ func (e *KindEnvironment) execContext(ctx context.Context, cmd string, args ...s
 	return c.exec(ctx)
 }
 
-func (e *KindEnvironment) close() {
+func (e *KindEnvironment) close(ctx context.Context) {
 	if e == nil || e.closed {
 		return
 	}
 
 	// Teardown the kind cluter.
 	// Kind is idempotent and doesn't care if the cluster doesn't exist, it won't throw an error.
-	if out, err := e.exec("kind", "delete", "cluster", "--name", e.clusterName).CombinedOutput(); err != nil {
+	if out, err := e.execContext(ctx, "kind", "delete", "cluster", "--name", e.clusterName).CombinedOutput(); err != nil {
 		e.logger.Log(string(out))
 		e.logger.Log("Unable to delete kind cluster", e.clusterName, ":", err.Error())
 	}
@@ -464,16 +740,22 @@ type kindRunnable struct {
 	env    *KindEnvironment
 	name   string
 	logger Logger
+	logs   *Logs
 
 	mutex sync.Mutex
 	// Access to the following fields must be guarded
 	// by a mutex.
-	ports            map[string]int
-	opts             StartOptions
-	running          bool
-	hostPorts        map[string]int
-	extensions       map[any]any
-	waitBackoffReady *backoff.Backoff
+	ports      map[string]PortSpec
+	deps       []Linkable
+	opts       StartOptions
+	running    bool
+	hostPorts  map[string]int
+	extensions map[any]any
+	netem      netemConfig
+	paused     bool
+	build      *imageBuild
+	// prePulled is true if image was loaded into the cluster by PrePull after the last start.
+	prePulled bool
 }
 
 func (r *kindRunnable) Name() string {
@@ -503,13 +785,40 @@ func (r *kindRunnable) Init(opts StartOptions) Runnable {
 			MaxRetries: 50, // Sometimes the CI is slow ¯\_(ツ)_/¯.
 		}
 	}
+	if opts.StopSignal != nil {
+		if _, err := signalNumber(opts.StopSignal); err != nil {
+			return errorer{name: r.Name(), err: err}
+		}
+	}
+	if err := validateMounts(opts); err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+	if err := opts.PullPolicy.validate(); err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+	if len(opts.Networks) > 0 {
+		return errorer{name: r.Name(), err: errNetworksNotSupported}
+	}
 
 	r.opts = opts
-	r.waitBackoffReady = backoff.New(context.Background(), *opts.WaitReadyBackoff)
 	return r
 }
 
 func (r *kindRunnable) WithPorts(ports map[string]int) RunnableBuilder {
+	return r.WithPortSpecs(tcpPortSpecs(ports))
+}
+
+// WithPortSpecs exposes ports on node ports, fixed ones if HostPort is set. Host IP is not supported.
+func (r *kindRunnable) WithPortSpecs(ports map[string]PortSpec) RunnableBuilder {
+	if err := validatePortSpecs(ports); err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+	for name, p := range ports {
+		if p.HostIP != "" {
+			return errorer{name: r.Name(), err: errors.Newf("port %q: host IP is not supported by kind environment", name)}
+		}
+	}
+
 	defer r.mutex.Unlock()
 	r.mutex.Lock()
 
@@ -517,6 +826,34 @@ func (r *kindRunnable) WithPorts(ports map[string]int) RunnableBuilder {
 	return r
 }
 
+func (r *kindRunnable) DependsOn(deps ...Linkable) RunnableBuilder {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	r.deps = append(r.deps, deps...)
+	return r
+}
+
+func (r *kindRunnable) WithBuild(contextDir, dockerfile string, buildArgs map[string]string) RunnableBuilder {
+	b, err := newImageBuild(contextDir, dockerfile, buildArgs)
+	if err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	r.build = b
+	return r
+}
+
+func (r *kindRunnable) Dependencies() []Linkable {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	return r.deps
+}
+
 func (r *kindRunnable) SetMetadata(key, value any) {
 	defer r.mutex.Unlock()
 	r.mutex.Lock()
@@ -532,6 +869,14 @@ func (r *kindRunnable) GetMetadata(key any) (any, bool) {
 	return v, ok
 }
 
+func (r *kindRunnable) Logs() *Logs {
+	return r.logs
+}
+
+func (r *kindRunnable) WaitLogLine(ctx context.Context, pattern *regexp.Regexp, opts ...LogLineOption) (LogLine, error) {
+	return r.logs.waitLine(ctx, r.Name(), r.IsRunning, pattern, opts...)
+}
+
 func (r *kindRunnable) Future() FutureRunnable {
 	return r
 }
@@ -544,40 +889,57 @@ func (r *kindRunnable) IsRunning() bool {
 }
 
 // Start starts the runnable.
-func (r *kindRunnable) Start() (err error) {
+func (r *kindRunnable) Start() error {
+	return r.StartContext(context.Background())
+}
+
+// StartContext starts the runnable. If the context is done before the pod is running, created resources are removed.
+func (r *kindRunnable) StartContext(ctx context.Context) (err error) {
 	if r.IsRunning() {
 		return errors.Newf("%q is running; stop or kill it first to restart", r.Name())
 	}
 
 	r.logger.Log("Starting", r.Name())
+	begin := time.Now()
 
 	// In case of any error, if the container was already created, we
-	// have to cleanup removing it.
+	// have to cleanup removing it. Events are emitted here, as the mutex is released already.
 	defer func() {
-		if err != nil {
-			if out, err := r.env.exec("kubernetes", "delete", "deployment", r.Name(), "--ignore-not-found", "--grace-period", "0", "--force").CombinedOutput(); err != nil {
-				r.logger.Log(string(out))
-				return
-			}
-			if out, err := r.env.exec("kubernetes", "delete", "service", r.Name(), "--ignore-not-found", "--grace-period", "0", "--force").CombinedOutput(); err != nil {
-				r.logger.Log(string(out))
-				return
-			}
+		if err == nil {
+			r.env.events.emit(RunnableEvent{Type: RunnableStarted, Runnable: r, Duration: time.Since(begin)})
+			return
+		}
+		var terminated *TerminatedError
+		if errors.As(err, &terminated) {
+			r.env.events.emit(crashEvent(r, terminated.Status))
 		}
+		if derr := r.delete(context.Background(), "0"); derr != nil {
+			r.logger.Log("Unable to cleanup", r.Name(), ":", derr.Error())
+		}
+		r.mutex.Lock()
+		r.running = false
+		r.mutex.Unlock()
 	}()
 
+	if err := r.buildImage(ctx); err != nil {
+		return err
+	}
 	// Make sure the image is available locally; if not wait for it to download.
-	if err := r.prePullImage(context.TODO()); err != nil {
+	if err := r.prePullImage(ctx); err != nil {
 		return err
 	}
 
 	defer r.mutex.Unlock()
 	r.mutex.Lock()
-	manifest, err := r.env.buildManifest(r.name, r.ports, r.opts)
+	var nodePorts map[string]int
+	if r.opts.PinHostPorts {
+		nodePorts = r.hostPorts
+	}
+	manifest, err := r.env.buildManifest(r.name, r.ports, nodePorts, r.opts)
 	if err != nil {
 		return errors.Wrap(err, "building manifest")
 	}
-	cmd := r.env.exec("kubectl", "--kubeconfig", r.env.kubeconfig(), "apply", "--filename", "-")
+	cmd := r.env.execContext(ctx, "kubectl", "--kubeconfig", r.env.kubeconfig(), "apply", "--filename", "-")
 	l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
 	cmd.Stdout = l
 	cmd.Stderr = l
@@ -586,19 +948,26 @@ func (r *kindRunnable) Start() (err error) {
 		return err
 	}
 	r.running = true
+	r.netem = netemConfig{}
+	r.paused = false
+	r.logs.markStart()
 
 	// Wait until the container has been started.
-	if err := r.waitForRunning(); err != nil {
+	if err := r.waitForRunning(ctx); err != nil {
 		return err
 	}
 
+	if err := r.followLogs(); err != nil {
+		return errors.Wrap(err, "follow logs")
+	}
+
 	if err := r.env.registerStarted(r); err != nil {
 		return err
 	}
 
 	if len(r.ports) > 0 {
 		// Get the dynamic local ports mapped to the container.
-		out, err := r.env.exec("kubectl", "--kubeconfig", r.env.kubeconfig(), "get", "service", r.Name(), "--output", `jsonpath='{.spec.ports}'`).CombinedOutput()
+		out, err := r.env.execContext(ctx, "kubectl", "--kubeconfig", r.env.kubeconfig(), "get", "service", r.Name(), "--output", `jsonpath='{.spec.ports}'`).CombinedOutput()
 		if err != nil {
 			return errors.Wrapf(err, "unable to get mapping for ports for service %q; output: %q", r.Name(), out)
 		}
@@ -626,45 +995,761 @@ func (r *kindRunnable) Start() (err error) {
 	return nil
 }
 
+// workload returns kubectl reference to the Kubernetes resource running this runnable.
+// Runnables are modeled as Deployments, unless they are jobs.
+func (r *kindRunnable) workload() string {
+	if r.opts.Job {
+		return "job/" + r.Name()
+	}
+	return "deployment/" + r.Name()
+}
+
+// Restart deletes the pod of the runnable, so it's recreated by the deployment. The service stays the same, so host
+// ports are reused.
+func (r *kindRunnable) Restart(ctx context.Context) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+	r.mutex.Lock()
+	opts, paused := r.opts, r.paused
+	r.mutex.Unlock()
+	if opts.Job {
+		return errors.Newf("service %q is a job; jobs can't be restarted, wait for it and start it again instead", r.Name())
+	}
+
+	r.logger.Log("Restarting", r.Name())
+	// Paused processes can't handle the stop signal.
+	if paused {
+		if err := r.Unpause(); err != nil {
+			return err
+		}
+	}
+	if opts.StopSignal != nil {
+		if err := r.Signal(opts.StopSignal); err != nil {
+			return err
+		}
+	}
+
+	if err := func() error {
+		defer r.mutex.Unlock()
+		r.mutex.Lock()
+
+		if out, err := r.env.execContext(
+			ctx,
+			"kubectl",
+			"--kubeconfig",
+			r.env.kubeconfig(),
+			"delete",
+			"pod",
+			"--selector",
+			fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
+			"--grace-period",
+			strconv.Itoa(stopGracePeriodSeconds(opts)),
+		).CombinedOutput(); err != nil {
+			r.logger.Log(string(out))
+			return errors.Wrapf(err, "delete pod of %q", r.Name())
+		}
+		r.netem = netemConfig{}
+		r.logs.markStart()
+
+		if err := r.waitForRunning(ctx); err != nil {
+			return err
+		}
+		return errors.Wrap(r.followLogs(), "follow logs")
+	}(); err != nil {
+		return err
+	}
+	return r.WaitReadyContext(ctx)
+}
+
+// followLogs streams the container output to the logger and logs history until the pod is deleted.
+func (r *kindRunnable) followLogs() error {
+	cmd := r.env.exec("kubectl", "--kubeconfig", r.env.kubeconfig(), "logs", "--follow", r.workload())
+	l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
+	// Kubectl merges container stdout and stderr, so we can't tell them apart.
+	w := r.logs.writer(LogStreamStdout)
+	cmd.Stdout = io.MultiWriter(l, w)
+	cmd.Stderr = l
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+		_ = w.Close()
+	}()
+	return nil
+}
+
 func (r *kindRunnable) Stop() error {
+	return r.StopContext(context.Background())
+}
+
+func (r *kindRunnable) StopContext(ctx context.Context) error {
 	if !r.IsRunning() {
 		return nil
 	}
 
 	r.logger.Log("Stopping", r.Name())
-	if out, err := r.env.exec("kubernetes", "delete", "deployment", r.Name(), "--ignore-not-found", "--grace-period", "30").CombinedOutput(); err != nil {
-		r.logger.Log(string(out))
-		return err
+	begin := time.Now()
+	r.mutex.Lock()
+	opts, paused := r.opts, r.paused
+	r.mutex.Unlock()
+	// Paused processes can't handle the stop signal.
+	if paused {
+		if err := r.Unpause(); err != nil {
+			return err
+		}
 	}
-	if out, err := r.env.exec("kubernetes", "delete", "service", r.Name(), "--ignore-not-found", "--grace-period", "30").CombinedOutput(); err != nil {
-		r.logger.Log(string(out))
+	// Kubernetes always sends SIGTERM on deletion, so custom stop signal is sent just before.
+	if opts.StopSignal != nil {
+		if err := r.Signal(opts.StopSignal); err != nil {
+			return err
+		}
+	}
+	if err := r.delete(ctx, strconv.Itoa(stopGracePeriodSeconds(opts))); err != nil {
 		return err
 	}
-	defer r.mutex.Unlock()
 	r.mutex.Lock()
 	r.running = false
+	r.mutex.Unlock()
+	r.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: r, Duration: time.Since(begin)})
 	return r.env.registerStopped(r.Name())
 }
 
+func (r *kindRunnable) Pause() error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+
+	r.logger.Log("Pausing", r.Name())
+	if err := r.ctrTask("pause"); err != nil {
+		return err
+	}
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+	r.paused = true
+	return nil
+}
+
+func (r *kindRunnable) Unpause() error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+
+	r.logger.Log("Unpausing", r.Name())
+	if err := r.ctrTask("resume"); err != nil {
+		return err
+	}
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+	r.paused = false
+	return nil
+}
+
+func (r *kindRunnable) Signal(sig os.Signal) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+
+	n, err := signalNumber(sig)
+	if err != nil {
+		return err
+	}
+	return r.ctrTask("kill", "--signal", strconv.Itoa(n))
+}
+
+// ctrTask runs containerd task command against the container of the runnable, directly on the kind node, as
+// Kubernetes has no API for pausing containers or sending signals to them.
+func (r *kindRunnable) ctrTask(args ...string) error {
+	_, err := r.ctrTaskOutput(context.Background(), args...)
+	return err
+}
+
+// ctrTaskOutput is like ctrTask, but it returns the command output.
+func (r *kindRunnable) ctrTaskOutput(ctx context.Context, args ...string) ([]byte, error) {
+	id, err := r.env.podField(r.Name(), "status.containerStatuses[0].containerID")
+	if err != nil {
+		return nil, err
+	}
+	cmdArgs := append([]string{"exec", r.env.clusterName + "-control-plane", "ctr", "--namespace", "k8s.io", "task"}, args...)
+	cmdArgs = append(cmdArgs, strings.TrimPrefix(id, "containerd://"))
+	out, err := r.env.execContext(ctx, "docker", cmdArgs...).CombinedOutput()
+	if err != nil {
+		r.logger.Log(string(out))
+		return nil, errors.Wrapf(err, "ctr task %s for %q", args[0], r.Name())
+	}
+	return out, nil
+}
+
+// Stats returns resource usage of the container of the runnable. Kubernetes metrics API reports only CPU and
+// memory usage averaged over time, so all stats are read by containerd directly on the kind node instead.
+func (r *kindRunnable) Stats(ctx context.Context) (RunnableStats, error) {
+	if !r.IsRunning() {
+		return RunnableStats{}, errors.Newf("service %q is stopped", r.Name())
+	}
+
+	out, err := r.ctrTaskOutput(ctx, "metrics", "--format", "json")
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	stats, err := parseCtrMetrics(out)
+	if err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "parse metrics of %q", r.Name())
+	}
+
+	// Network counters are not part of cgroup metrics, so read them from the network namespace of the container.
+	out, err = r.ctrTaskOutput(ctx, "ps")
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	pid, err := parseCtrTaskPID(out)
+	if err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "get process of %q", r.Name())
+	}
+	out, err = r.env.execContext(ctx, "docker", "exec", r.env.clusterName+"-control-plane", "cat", fmt.Sprintf("/proc/%d/net/dev", pid)).CombinedOutput()
+	if err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "read network stats of %q: %s", r.Name(), strings.TrimSpace(string(out)))
+	}
+	if stats.NetworkRxBytes, stats.NetworkTxBytes, err = parseNetDev(out); err != nil {
+		return RunnableStats{}, err
+	}
+	return stats, nil
+}
+
+// CopyTo copies the host file or directory to the container of the runnable with `kubectl cp`, which requires `tar`
+// in the image.
+func (r *kindRunnable) CopyTo(ctx context.Context, hostPath, containerPath string) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+	pod, err := r.env.podField(r.Name(), "metadata.name")
+	if err != nil {
+		return err
+	}
+	return r.kubectlCp(ctx, hostPath, pod+":"+containerPath)
+}
+
+// CopyFrom copies the file or directory from the container of the runnable to the host with `kubectl cp`, which
+// requires `tar` in the image.
+func (r *kindRunnable) CopyFrom(ctx context.Context, containerPath, hostPath string) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %q is stopped", r.Name())
+	}
+	pod, err := r.env.podField(r.Name(), "metadata.name")
+	if err != nil {
+		return err
+	}
+	return r.kubectlCp(ctx, pod+":"+containerPath, hostCopyDestination(containerPath, hostPath))
+}
+
+func (r *kindRunnable) kubectlCp(ctx context.Context, src, dst string) error {
+	if out, err := r.env.execContext(ctx, "kubectl", "--kubeconfig", r.env.kubeconfig(), "cp", src, dst).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "copy %s to %s: %s", src, dst, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// parseCtrMetrics parses `ctr task metrics --format json` output, which is either cgroup v1 or v2 metrics.
+func parseCtrMetrics(out []byte) (RunnableStats, error) {
+	var m struct {
+		Pids struct {
+			Current uint64 `json:"current"`
+		} `json:"pids"`
+		CPU struct {
+			// UsageUsec is set with cgroup v2.
+			UsageUsec uint64 `json:"usage_usec"`
+			// Usage is set with cgroup v1.
+			Usage struct {
+				Total uint64 `json:"total"`
+			} `json:"usage"`
+		} `json:"cpu"`
+		Memory struct {
+			// Usage is a number with cgroup v2 and an object with cgroup v1.
+			Usage             json.RawMessage `json:"usage"`
+			Anon              uint64          `json:"anon"`
+			InactiveFile      uint64          `json:"inactive_file"`
+			RSS               uint64          `json:"rss"`
+			TotalRSS          uint64          `json:"total_rss"`
+			TotalInactiveFile uint64          `json:"total_inactive_file"`
+		} `json:"memory"`
+		IO struct {
+			Usage []struct {
+				Rbytes uint64 `json:"rbytes"`
+				Wbytes uint64 `json:"wbytes"`
+			} `json:"usage"`
+		} `json:"io"`
+		Blkio struct {
+			IOServiceBytesRecursive []struct {
+				Op    string `json:"op"`
+				Value uint64 `json:"value"`
+			} `json:"io_service_bytes_recursive"`
+		} `json:"blkio"`
+	}
+	if err := json.Unmarshal(out, &m); err != nil {
+		return RunnableStats{}, err
+	}
+
+	stats := RunnableStats{
+		CPUTime: time.Duration(m.CPU.UsageUsec) * time.Microsecond,
+		PIDs:    m.Pids.Current,
+	}
+	if m.CPU.UsageUsec == 0 {
+		stats.CPUTime = time.Duration(m.CPU.Usage.Total)
+	}
+
+	var (
+		usage   uint64
+		memStat = map[string]uint64{"anon": m.Memory.Anon, "inactive_file": m.Memory.InactiveFile}
+	)
+	if bytes.HasPrefix(bytes.TrimSpace(m.Memory.Usage), []byte("{")) {
+		var v1Usage struct {
+			Usage uint64 `json:"usage"`
+		}
+		if err := json.Unmarshal(m.Memory.Usage, &v1Usage); err != nil {
+			return RunnableStats{}, errors.Wrap(err, "parse memory usage")
+		}
+		usage = v1Usage.Usage
+		memStat = map[string]uint64{"rss": m.Memory.RSS, "total_rss": m.Memory.TotalRSS, "total_inactive_file": m.Memory.TotalInactiveFile}
+	} else if len(m.Memory.Usage) > 0 {
+		if err := json.Unmarshal(m.Memory.Usage, &usage); err != nil {
+			return RunnableStats{}, errors.Wrap(err, "parse memory usage")
+		}
+	}
+	stats.MemoryRSSBytes, stats.MemoryWorkingSetBytes = cgroupMemory(usage, memStat)
+
+	for _, e := range m.IO.Usage {
+		stats.BlockReadBytes += e.Rbytes
+		stats.BlockWriteBytes += e.Wbytes
+	}
+	for _, e := range m.Blkio.IOServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			stats.BlockReadBytes += e.Value
+		case "write":
+			stats.BlockWriteBytes += e.Value
+		}
+	}
+	return stats, nil
+}
+
+// parseCtrTaskPID returns the first process ID listed by `ctr task ps`.
+func parseCtrTaskPID(out []byte) (int, error) {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) < 2 {
+		return 0, errors.Newf("no processes listed in %q", string(out))
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) == 0 {
+		return 0, errors.Newf("unexpected process line %q", lines[1])
+	}
+	return strconv.Atoi(fields[0])
+}
+
 func (r *kindRunnable) Kill() error {
 	if !r.IsRunning() {
 		return nil
 	}
 
 	r.logger.Log("Killing", r.Name())
-	if out, err := r.env.exec("kubernetes", "delete", "deployment", r.Name(), "--ignore-not-found", "--grace-period", "0", "--force").CombinedOutput(); err != nil {
-		r.logger.Log(string(out))
+	if err := r.delete(context.Background(), "0"); err != nil {
 		return err
 	}
-	if out, err := r.env.exec("kubernetes", "delete", "service", r.Name(), "--ignore-not-found", "--grace-period", "0", "--force").CombinedOutput(); err != nil {
-		r.logger.Log(string(out))
+
+	r.mutex.Lock()
+	r.running = false
+	r.mutex.Unlock()
+	r.env.events.emit(RunnableEvent{Type: RunnableKilled, Runnable: r})
+	return r.env.registerStopped(r.Name())
+}
+
+func (r *kindRunnable) InjectLatency(latency, jitter time.Duration) (Fault, error) {
+	return r.injectNetem(
+		func(c *netemConfig) { c.latency, c.jitter = latency, jitter },
+		func(c *netemConfig) { c.latency, c.jitter = 0, 0 },
+	)
+}
+
+func (r *kindRunnable) InjectPacketLoss(percent float64) (Fault, error) {
+	if percent < 0 || percent > 100 {
+		return nil, errors.Newf("packet loss has to be between 0 and 100 percent, got %v", percent)
+	}
+	return r.injectNetem(
+		func(c *netemConfig) { c.lossPercent = percent },
+		func(c *netemConfig) { c.lossPercent = 0 },
+	)
+}
+
+func (r *kindRunnable) LimitBandwidth(bitsPerSecond uint64) (Fault, error) {
+	return r.injectNetem(
+		func(c *netemConfig) { c.bitsPerSecond = bitsPerSecond },
+		func(c *netemConfig) { c.bitsPerSecond = 0 },
+	)
+}
+
+// injectNetem applies network conditions modified by inject and returns fault that reverts the modification with heal.
+func (r *kindRunnable) injectNetem(inject, heal func(*netemConfig)) (Fault, error) {
+	if !r.IsRunning() {
+		return nil, errors.Newf("service %q is stopped", r.Name())
+	}
+
+	apply := func(modify func(*netemConfig)) error {
+		defer r.mutex.Unlock()
+		r.mutex.Lock()
+
+		c := r.netem
+		modify(&c)
+		if c == r.netem {
+			return nil
+		}
+		pod, err := r.env.podField(r.Name(), "metadata.name")
+		if err != nil {
+			return err
+		}
+		if err := r.env.runNetAdmin(pod, c.netemArgs()...); err != nil {
+			return errors.Wrapf(err, "apply network conditions to %q", r.Name())
+		}
+		r.netem = c
+		return nil
+	}
+	if err := apply(inject); err != nil {
+		return nil, err
+	}
+	return newFault(func() error {
+		// Restarted pod starts without faults.
+		if !r.IsRunning() {
+			return nil
+		}
+		return apply(heal)
+	}), nil
+}
+
+// PrePull makes images of the given runnables available in the cluster in parallel, see Environment.PrePull.
+func (e *KindEnvironment) PrePull(ctx context.Context, runnables ...Linkable) error {
+	all := len(runnables) == 0
+	e.mutex.Lock()
+	byName := make(map[string]*kindRunnable, len(e.runnables))
+	for _, r := range e.runnables {
+		byName[r.Name()] = r
+		if all && r.initialized() {
+			runnables = append(runnables, r)
+		}
+	}
+	e.mutex.Unlock()
+
+	return prePullParallel(runnables, func(l Linkable) error {
+		r, ok := byName[l.Name()]
+		if !ok {
+			return errors.Newf("runnable %s is not part of the environment", l.Name())
+		}
+		return r.prePull(ctx)
+	})
+}
+
+// Partition drops all network traffic between given running runnables until returned fault is healed.
+// It requires kubectl supporting `debug --profile=netadmin` (v1.27+). Network faults are injected from an ephemeral
+// container, which can't be removed, so it's started once per pod and stays there until the pod is deleted.
+func (e *KindEnvironment) Partition(a, b Linkable) (Fault, error) {
+	var pods, ips [2]string
+	for i, r := range []Linkable{a, b} {
+		var err error
+		if pods[i], err = e.podField(r.Name(), "metadata.name"); err != nil {
+			return nil, err
+		}
+		if ips[i], err = e.podField(r.Name(), "status.podIP"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.runNetAdmin(pods[0], iptablesDropArgs("-A", []string{ips[1]})...); err != nil {
+		return nil, errors.Wrapf(err, "partition %q from %q", a.Name(), b.Name())
+	}
+	if err := e.runNetAdmin(pods[1], iptablesDropArgs("-A", []string{ips[0]})...); err != nil {
+		_ = e.runNetAdmin(pods[0], iptablesDropArgs("-D", []string{ips[1]})...)
+		return nil, errors.Wrapf(err, "partition %q from %q", b.Name(), a.Name())
+	}
+	e.logger.Log("Partitioned", a.Name(), "and", b.Name())
+
+	return newFault(func() error {
+		errs := merrors.New()
+		errs.Add(e.runNetAdmin(pods[0], iptablesDropArgs("-D", []string{ips[1]})...))
+		errs.Add(e.runNetAdmin(pods[1], iptablesDropArgs("-D", []string{ips[0]})...))
+		if err := errs.Err(); err != nil {
+			return errors.Wrapf(err, "heal partition between %q and %q", a.Name(), b.Name())
+		}
+		e.logger.Log("Healed partition between", a.Name(), "and", b.Name())
+		return nil
+	}), nil
+}
+
+// podField returns value of the given field of the pod running the given runnable.
+func (e *KindEnvironment) podField(name, field string) (string, error) {
+	out, err := e.exec(
+		"kubectl",
+		"--kubeconfig",
+		e.kubeconfig(),
+		"get",
+		"pod",
+		"--selector",
+		fmt.Sprintf("app.kubernetes.io/name=%s", name),
+		"--output",
+		fmt.Sprintf("jsonpath={.items[0].%s}", field),
+	).CombinedOutput()
+	if err != nil {
+		e.logger.Log(string(out))
+		return "", errors.Wrapf(err, "get %s of pod %q", field, name)
+	}
+	v := strings.TrimSpace(string(out))
+	if v == "" {
+		return "", errors.Newf("pod %q has no %s; is it running?", name, field)
+	}
+	return v, nil
+}
+
+// kindNetAdminContainer is the name of the ephemeral container used to inject network faults into pods.
+const kindNetAdminContainer = "e2e-netadmin"
+
+// runNetAdmin runs given command in the network namespace of the given pod with NET_ADMIN capability.
+// It uses ephemeral debug container, which shares network namespace with the pod.
+func (e *KindEnvironment) runNetAdmin(pod string, cmd ...string) error {
+	if err := e.startNetAdmin(pod); err != nil {
+		return errors.Wrapf(err, "start %s container in pod %q", kindNetAdminContainer, pod)
+	}
+	args := append([]string{"--kubeconfig", e.kubeconfig(), "exec", pod, "--container", kindNetAdminContainer, "--"}, cmd...)
+	if out, err := e.exec("kubectl", args...).CombinedOutput(); err != nil {
+		e.logger.Log(string(out))
+		return err
+	}
+	return nil
+}
+
+// startNetAdmin starts long-running ephemeral debug container in the given pod, unless it's started already.
+// Ephemeral containers can't be removed from the pod, so a single container is reused by all faults of the pod.
+func (e *KindEnvironment) startNetAdmin(pod string) error {
+	e.netAdminMtx.Lock()
+	defer e.netAdminMtx.Unlock()
+	if _, ok := e.netAdminPods[pod]; ok {
+		return nil
+	}
+
+	args := []string{"--kubeconfig", e.kubeconfig(), "debug", "pod/" + pod, "--image", netAdminImage, "--profile", "netadmin", "--container", kindNetAdminContainer, "--quiet", "--", "sleep", "infinity"}
+	if out, err := e.exec("kubectl", args...).CombinedOutput(); err != nil {
+		e.logger.Log(string(out))
 		return err
 	}
 
-	defer r.mutex.Unlock()
+	var err error
+	for b := backoff.New(context.Background(), backoff.Config{Min: 100 * time.Millisecond, Max: time.Second, MaxRetries: 60}); b.Ongoing(); {
+		var out []byte
+		out, err = e.exec(
+			"kubectl",
+			"--kubeconfig",
+			e.kubeconfig(),
+			"get",
+			"pod",
+			pod,
+			"--output",
+			fmt.Sprintf(`jsonpath={.status.ephemeralContainerStatuses[?(@.name=="%s")].state.running.startedAt}`, kindNetAdminContainer),
+		).CombinedOutput()
+		if err == nil && strings.TrimSpace(string(out)) != "" {
+			e.netAdminPods[pod] = struct{}{}
+			return nil
+		}
+		if err == nil {
+			err = errors.New("container is not running yet")
+		}
+		b.Wait()
+	}
+	return err
+}
+
+// Wait waits until the job pod terminates, returns its exit status and deletes the job.
+func (r *kindRunnable) Wait(ctx context.Context) (ExitStatus, error) {
+	r.mutex.Lock()
+	job := r.opts.Job
+	r.mutex.Unlock()
+	if !job {
+		return ExitStatus{}, errors.Newf("service %q is not a job; only runnables started with StartOptions.Job can be waited for", r.Name())
+	}
+	if !r.IsRunning() {
+		return ExitStatus{}, errors.Newf("service %q is stopped", r.Name())
+	}
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var status ExitStatus
+	for {
+		out, err := r.env.execContext(
+			ctx,
+			"kubectl",
+			"--kubeconfig",
+			r.env.kubeconfig(),
+			"get",
+			"pod",
+			"--selector",
+			fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
+			"--output",
+			"jsonpath={.items[0].status.containerStatuses[0].state.terminated}",
+		).CombinedOutput()
+		if err == nil {
+			var terminated bool
+			status, terminated, err = getKindExitStatus(out)
+			if err != nil {
+				return ExitStatus{}, errors.Wrapf(err, "exit status of job %q", r.Name())
+			}
+			if terminated {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ExitStatus{}, errors.Wrapf(ctx.Err(), "waiting for job %q to exit", r.Name())
+		case <-ticker.C:
+		}
+	}
+
+	if err := r.delete(ctx, "30"); err != nil {
+		return status, err
+	}
+	r.logger.Log("Job", r.Name(), "exited with code", status.ExitCode)
+
 	r.mutex.Lock()
 	r.running = false
-	return r.env.registerStopped(r.Name())
+	r.mutex.Unlock()
+	r.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: r, Status: status})
+	return status, r.env.registerStopped(r.Name())
+}
+
+type kindTerminatedState struct {
+	ExitCode   int       `json:"exitCode"`
+	Reason     string    `json:"reason"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+func (s kindTerminatedState) exitStatus() ExitStatus {
+	return ExitStatus{ExitCode: s.ExitCode, OOMKilled: s.Reason == "OOMKilled", FinishedAt: s.FinishedAt}
+}
+
+// getKindExitStatus parses terminated state of the pod container. It returns false if container has not terminated yet.
+func getKindExitStatus(out []byte) (ExitStatus, bool, error) {
+	out = bytes.TrimSpace(unwrapQuotes(out))
+	if len(out) == 0 {
+		return ExitStatus{}, false, nil
+	}
+
+	var terminated kindTerminatedState
+	if err := json.Unmarshal(out, &terminated); err != nil {
+		return ExitStatus{}, false, errors.Wrapf(err, "unmarshal terminated state %q", string(out))
+	}
+	return terminated.exitStatus(), true, nil
+}
+
+// getKindCrashStatus parses status of the pod container. It returns false if container has not crashed. Since pods of
+// deployments are restarted, crash is detected either by terminated state or by the previous run terminated
+// and container being restarted (or in CrashLoopBackOff); in the latter case previous is true.
+func getKindCrashStatus(out []byte) (_ ExitStatus, crashed bool, previous bool, _ error) {
+	out = bytes.TrimSpace(unwrapQuotes(out))
+	if len(out) == 0 {
+		return ExitStatus{}, false, false, nil
+	}
+
+	var status struct {
+		RestartCount int `json:"restartCount"`
+		State        struct {
+			Waiting *struct {
+				Reason string `json:"reason"`
+			} `json:"waiting"`
+			Terminated *kindTerminatedState `json:"terminated"`
+		} `json:"state"`
+		LastState struct {
+			Terminated *kindTerminatedState `json:"terminated"`
+		} `json:"lastState"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return ExitStatus{}, false, false, errors.Wrapf(err, "unmarshal container status %q", string(out))
+	}
+	if status.State.Terminated != nil {
+		return status.State.Terminated.exitStatus(), true, false, nil
+	}
+	restarting := status.RestartCount > 0 || (status.State.Waiting != nil && status.State.Waiting.Reason == "CrashLoopBackOff")
+	if restarting && status.LastState.Terminated != nil {
+		return status.LastState.Terminated.exitStatus(), true, true, nil
+	}
+	return ExitStatus{}, false, false, nil
+}
+
+// crashed returns TerminatedError if the pod container crashed, nil if not or its status is not known yet. If fetchLogs is true, the last
+// logs are fetched from the cluster first, which is needed when logs are not followed yet.
+func (r *kindRunnable) crashed(ctx context.Context, workload string, fetchLogs bool) *TerminatedError {
+	out, err := r.env.execContext(
+		ctx,
+		"kubectl",
+		"--kubeconfig",
+		r.env.kubeconfig(),
+		"get",
+		"pod",
+		"--selector",
+		fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
+		"--output",
+		"jsonpath={.items[0].status.containerStatuses[0]}",
+	).CombinedOutput()
+	if err != nil {
+		// Pod might not be scheduled yet.
+		return nil
+	}
+	status, crashed, previous, err := getKindCrashStatus(out)
+	if err != nil {
+		r.logger.Log("Unable to check if", r.Name(), "crashed:", err.Error())
+		return nil
+	}
+	if !crashed {
+		return nil
+	}
+
+	if fetchLogs {
+		args := []string{"--kubeconfig", r.env.kubeconfig(), "logs", workload, fmt.Sprintf("--tail=%d", terminatedErrorLogLines)}
+		if previous {
+			args = append(args, "--previous")
+		}
+		w := r.logs.writer(LogStreamStdout)
+		cmd := r.env.execContext(ctx, "kubectl", args...)
+		cmd.Stdout = w
+		if err := cmd.Run(); err != nil {
+			r.logger.Log("Unable to get logs of crashed", r.Name(), ":", err.Error())
+		}
+		_ = w.Close()
+	}
+	return &TerminatedError{Name: r.Name(), Status: status, LastLogs: r.logs.lastLines(terminatedErrorLogLines)}
+}
+
+// delete removes deployment (or job), service and files of this runnable with the given grace period in seconds.
+// Zero grace period means immediate, forced removal.
+func (r *kindRunnable) delete(ctx context.Context, gracePeriod string) error {
+	for _, c := range r.deleteCommands(gracePeriod) {
+		if out, err := r.env.execContext(ctx, c.Cmd, c.Args...).CombinedOutput(); err != nil {
+			r.logger.Log(string(out))
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCommands returns kubectl commands removing resources of this runnable, see delete.
+func (r *kindRunnable) deleteCommands(gracePeriod string) []Command {
+	r.mutex.Lock()
+	workload := r.workload()
+	r.mutex.Unlock()
+
+	var cmds []Command
+	for _, resource := range []string{workload, "service/" + r.Name(), "configmap/" + r.Name() + "-files", "secret/" + r.Name() + "-files"} {
+		args := []string{"--kubeconfig", r.env.kubeconfig(), "delete", resource, "--ignore-not-found", "--grace-period", gracePeriod}
+		if gracePeriod == "0" {
+			args = append(args, "--force")
+		}
+		cmds = append(cmds, NewCommand("kubectl", args...))
+	}
+	return cmds
 }
 
 // Endpoint returns the external service endpoint (host:port) for a given port name.
@@ -700,7 +1785,7 @@ func (r *kindRunnable) InternalEndpoint(portName string) string {
 		return ""
 	}
 
-	return fmt.Sprintf("%s:%d", r.Name(), port)
+	return fmt.Sprintf("%s:%d", r.Name(), port.Port)
 }
 
 func (r *kindRunnable) Ready() error {
@@ -719,34 +1804,58 @@ func (r *kindRunnable) Ready() error {
 	return readiness.Ready(r)
 }
 
-func (r *kindRunnable) waitForRunning() (err error) {
+func (r *kindRunnable) waitForRunning(ctx context.Context) (err error) {
 	if !r.running {
 		return errors.Newf("service %s is stopped", r.Name())
 	}
 
 	var out []byte
-	for r.waitBackoffReady.Reset(); r.waitBackoffReady.Ongoing(); {
+	for b := backoff.New(ctx, *r.opts.WaitReadyBackoff); b.Ongoing(); {
 		// Enforce a timeout on the command execution because we've seen some flaky tests
 		// stuck here.
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		out, err = r.env.execContext(
-			ctx,
-			"kubectl",
-			"--kubeconfig",
-			r.env.kubeconfig(),
-			"wait",
-			"pod",
-			"--for",
-			"condition=Ready",
-			"--selector",
-			fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
-			"--timeout",
-			"5s",
-		).CombinedOutput()
+		waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		if r.opts.Job {
+			// Job pod might terminate before it's observed ready, so it's enough for it to be scheduled and started.
+			out, err = r.env.execContext(
+				waitCtx,
+				"kubectl",
+				"--kubeconfig",
+				r.env.kubeconfig(),
+				"get",
+				"pod",
+				"--selector",
+				fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
+				"--output",
+				"jsonpath={.items[*].status.phase}",
+			).CombinedOutput()
+			if phase := strings.TrimSpace(string(out)); err == nil && phase != "Running" && phase != "Succeeded" && phase != "Failed" {
+				err = errors.Newf("unexpected pod phase: %q", phase)
+			}
+		} else {
+			out, err = r.env.execContext(
+				waitCtx,
+				"kubectl",
+				"--kubeconfig",
+				r.env.kubeconfig(),
+				"wait",
+				"pod",
+				"--for",
+				"condition=Ready",
+				"--selector",
+				fmt.Sprintf("app.kubernetes.io/name=%s", r.Name()),
+				"--timeout",
+				"5s",
+			).CombinedOutput()
+		}
+		cancel()
 		if err != nil {
-			r.waitBackoffReady.Wait()
+			// There is no point in waiting for crashed container.
+			if !r.opts.Job {
+				if cerr := r.crashed(ctx, r.workload(), true); cerr != nil {
+					return cerr
+				}
+			}
+			b.Wait()
 			continue
 		}
 
@@ -756,9 +1865,46 @@ func (r *kindRunnable) waitForRunning() (err error) {
 	if len(out) > 0 {
 		r.logger.Log(string(out))
 	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	return errors.Wrapf(err, "pod %q failed to start", r.Name())
 }
 
+// buildImage builds image of the runnable declared with WithBuild using Docker, unless it's built already, and uses
+// it as the image of the runnable. Like pulled images, it's then loaded into the cluster by prePullImage.
+func (r *kindRunnable) buildImage(ctx context.Context) error {
+	r.mutex.Lock()
+	b := r.build
+	r.mutex.Unlock()
+	if b == nil {
+		return nil
+	}
+
+	tag, err := b.imageTag(r.Name())
+	if err != nil {
+		return err
+	}
+	ok, err := r.env.images.imageExists(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
+		begin := time.Now()
+		if err := r.env.images.buildImage(ctx, b, tag, l); err != nil {
+			return errors.Wrapf(err, "docker image %q failed to build", tag)
+		}
+		r.env.events.emit(RunnableEvent{Type: RunnableImageBuilt, Runnable: r, Duration: time.Since(begin)})
+	}
+
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	r.opts.Image = tag
+	return nil
+}
+
 // We want to pre-pull all images using Docker and then load them into the cluster.
 // This ensures that the cluster will always have access to any locally built images.
 func (r *kindRunnable) prePullImage(ctx context.Context) (err error) {
@@ -766,19 +1912,61 @@ func (r *kindRunnable) prePullImage(ctx context.Context) (err error) {
 		return errors.Newf("service %q is running; expected stopped", r.Name())
 	}
 
-	if _, err = r.env.execContext(ctx, "docker", "image", "inspect", r.opts.Image).CombinedOutput(); err != nil {
-		cmd := r.env.execContext(ctx, "docker", "pull", r.opts.Image)
+	r.mutex.Lock()
+	prePulled := r.prePulled
+	r.prePulled = false
+	r.mutex.Unlock()
+	if prePulled {
+		return nil
+	}
+	return r.pullImage(ctx)
+}
+
+// pullImage makes the image available in the host Docker according to the pull policy of the runnable, and loads it
+// into the cluster.
+func (r *kindRunnable) pullImage(ctx context.Context) error {
+	r.mutex.Lock()
+	opts, built := r.opts, r.build != nil
+	r.mutex.Unlock()
+
+	if !built {
 		l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
-		cmd.Stdout = l
-		cmd.Stderr = l
-		if err = cmd.Run(); err != nil {
-			return errors.Wrapf(err, "docker image %q failed to download", r.opts.Image)
+		begin := time.Now()
+		pulled, err := ensureImage(ctx, r.env.images, opts.Image, opts.PullPolicy, r.env.imageCacheDir, l)
+		if pulled {
+			r.env.events.emit(RunnableEvent{Type: RunnableImagePulled, Runnable: r, Duration: time.Since(begin)})
+		}
+		if err != nil {
+			return err
 		}
 	}
-
 	return r.loadImageIntoKindCluster(ctx)
 }
 
+// prePull builds or pulls the image of the runnable and loads it into the cluster, so the next start doesn't have to.
+func (r *kindRunnable) prePull(ctx context.Context) error {
+	if err := r.buildImage(ctx); err != nil {
+		return err
+	}
+	if err := r.pullImage(ctx); err != nil {
+		return err
+	}
+
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	r.prePulled = true
+	return nil
+}
+
+// initialized returns true if runnable was initialized with image or with image build.
+func (r *kindRunnable) initialized() bool {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+
+	return r.opts.Image != "" || r.build != nil
+}
+
 func (r *kindRunnable) loadImageIntoKindCluster(ctx context.Context) error {
 	cmd := r.env.execContext(ctx, "kind", "load", "docker-image", "--name", r.env.clusterName, r.opts.Image)
 	l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
@@ -787,18 +1975,38 @@ func (r *kindRunnable) loadImageIntoKindCluster(ctx context.Context) error {
 	return cmd.Run()
 }
 
-func (r *kindRunnable) WaitReady() (err error) {
+func (r *kindRunnable) WaitReady() error {
+	return r.WaitReadyContext(context.Background())
+}
+
+func (r *kindRunnable) WaitReadyContext(ctx context.Context) (err error) {
 	if !r.IsRunning() {
 		return errors.Newf("service %s is stopped", r.Name())
 	}
 
-	for r.waitBackoffReady.Reset(); r.waitBackoffReady.Ongoing(); {
+	r.mutex.Lock()
+	b := backoff.New(ctx, *r.opts.WaitReadyBackoff)
+	job, workload := r.opts.Job, r.workload()
+	r.mutex.Unlock()
+	begin := time.Now()
+	for b.Ongoing() {
 		err = r.Ready()
 		if err == nil {
+			r.env.events.emit(RunnableEvent{Type: RunnableReady, Runnable: r, Duration: time.Since(begin)})
 			return nil
 		}
+		// There is no point in waiting for crashed container. Its logs are already followed.
+		if !job {
+			if cerr := r.crashed(ctx, workload, false); cerr != nil {
+				r.env.events.emit(crashEvent(r, cerr.Status))
+				return cerr
+			}
+		}
 
-		r.waitBackoffReady.Wait()
+		b.Wait()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
 	return errors.Wrapf(err, "service %q is not ready", r.Name())
 }
@@ -806,6 +2014,12 @@ func (r *kindRunnable) WaitReady() (err error) {
 // Exec runs the provided command in the container specified by this
 // service.
 func (r *kindRunnable) Exec(command Command, opts ...ExecOption) error {
+	return r.ExecContext(context.Background(), command, opts...)
+}
+
+// ExecContext runs the provided command in the container specified by this
+// service. The command is killed when the context is done.
+func (r *kindRunnable) ExecContext(ctx context.Context, command Command, opts ...ExecOption) error {
 	if !r.IsRunning() {
 		return errors.Newf("service %q is stopped", r.Name())
 	}
@@ -816,11 +2030,17 @@ func (r *kindRunnable) Exec(command Command, opts ...ExecOption) error {
 		opt(&o)
 	}
 
-	args := []string{"kubectl", "--kubeconfig", r.env.kubeconfig(), "exec", "deployment/" + r.name, "--"}
+	r.mutex.Lock()
+	workload := r.workload()
+	r.mutex.Unlock()
+	args := []string{"kubectl", "--kubeconfig", r.env.kubeconfig(), "exec", workload, "--"}
 	args = append(args, command.Cmd)
 	args = append(args, command.Args...)
-	cmd := r.env.exec(args[0], args[1:]...)
+	cmd := r.env.execContext(ctx, args[0], args[1:]...)
 	cmd.Stdout = o.Stdout
 	cmd.Stderr = o.Stderr
-	return cmd.Run()
+	begin := time.Now()
+	err := cmd.Run()
+	r.env.events.emit(RunnableEvent{Type: RunnableExecRun, Runnable: r, Duration: time.Since(begin), Command: command, Err: err})
+	return err
 }
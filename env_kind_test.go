@@ -6,6 +6,9 @@ package e2e
 import (
 	"bytes"
 	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
 )
 
 func TestKindManifest(t *testing.T) {
@@ -327,6 +330,239 @@ spec:
       - name: "foo"
         hostPath:
           path: /bar
+`,
+		},
+		{
+			values: kindManifestValues{
+				Name:    "job",
+				Image:   "alpine",
+				Command: "true",
+				Job:     true,
+			},
+			out: `apiVersion: batch/v1
+kind: Job
+metadata:
+  labels:
+    app.kubernetes.io/name: "job"
+  name: "job"
+spec:
+  backoffLimit: 0
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: "job"
+    spec:
+      restartPolicy: Never
+      containers:
+      - name: "job"
+        image: "alpine"
+        command:
+        - "true"
+`,
+		},
+		{
+			values: kindManifestValues{
+				Name:                          "grace",
+				Image:                         "alpine",
+				TerminationGracePeriodSeconds: 5,
+			},
+			out: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app.kubernetes.io/name: "grace"
+  name: "grace"
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: "grace"
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: "grace"
+    spec:
+      terminationGracePeriodSeconds: 5
+      containers:
+      - name: "grace"
+        image: "alpine"
+`,
+		},
+		{
+			values: kindManifestValues{
+				Name:      "node-ports",
+				Image:     "alpine",
+				Ports:     map[string]int{"http": 80, "grpc": 9090},
+				NodePorts: map[string]int{"http": 30080},
+			},
+			out: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app.kubernetes.io/name: "node-ports"
+  name: "node-ports"
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: "node-ports"
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: "node-ports"
+    spec:
+      containers:
+      - name: "node-ports"
+        image: "alpine"
+        ports:
+        - name: "grpc"
+          containerPort: 9090
+        - name: "http"
+          containerPort: 80
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app.kubernetes.io/name: "node-ports"
+  name: "node-ports"
+spec:
+  type: NodePort
+  selector:
+    app.kubernetes.io/name: "node-ports"
+  ports:
+  - name: "grpc"
+    port: 9090
+  - name: "http"
+    port: 80
+    nodePort: 30080
+`,
+		},
+		{
+			values: kindManifestValues{
+				Name:      "statsd",
+				Image:     "statsd",
+				Ports:     map[string]int{"metrics": 8125},
+				NodePorts: map[string]int{},
+				Protocols: map[string]string{"metrics": "UDP"},
+			},
+			out: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app.kubernetes.io/name: "statsd"
+  name: "statsd"
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: "statsd"
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: "statsd"
+    spec:
+      containers:
+      - name: "statsd"
+        image: "statsd"
+        ports:
+        - name: "metrics"
+          containerPort: 8125
+          protocol: UDP
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    app.kubernetes.io/name: "statsd"
+  name: "statsd"
+spec:
+  type: NodePort
+  selector:
+    app.kubernetes.io/name: "statsd"
+  ports:
+  - name: "metrics"
+    port: 8125
+    protocol: UDP
+`,
+		},
+		{
+			values: kindManifestValues{
+				Name:         "files",
+				Image:        "alpine",
+				Files:        []kindFile{{Key: "file0", Path: "/etc/app.yaml", Mode: 0644, Content: "YTogPj4+Cg=="}},
+				SecretFiles:  []kindFile{{Key: "file1", Path: "/etc/tls/key.pem", Mode: 0600, Content: "a2V5"}},
+				Tmpfs:        []string{"/tmp"},
+				NamedVolumes: []kindNamedVolume{{Path: "/data", NodePath: "/var/local/e2e-volumes/cache"}},
+			},
+			out: `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app.kubernetes.io/name: "files"
+  name: "files"
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: "files"
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: "files"
+    spec:
+      containers:
+      - name: "files"
+        image: "alpine"
+        volumeMounts:
+        - name: "files"
+          mountPath: "/etc/app.yaml"
+          subPath: "file0"
+          readOnly: true
+        - name: "secret-files"
+          mountPath: "/etc/tls/key.pem"
+          subPath: "file1"
+          readOnly: true
+        - name: "tmpfs0"
+          mountPath: "/tmp"
+        - name: "named-volume0"
+          mountPath: "/data"
+      volumes:
+      - name: "files"
+        configMap:
+          name: "files-files"
+          items:
+          - key: "file0"
+            path: "file0"
+            mode: 420
+      - name: "secret-files"
+        secret:
+          secretName: "files-files"
+          items:
+          - key: "file1"
+            path: "file1"
+            mode: 384
+      - name: "tmpfs0"
+        emptyDir:
+          medium: Memory
+      - name: "named-volume0"
+        hostPath:
+          path: "/var/local/e2e-volumes/cache"
+          type: DirectoryOrCreate
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app.kubernetes.io/name: "files"
+  name: "files-files"
+binaryData:
+  file0: "YTogPj4+Cg=="
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  labels:
+    app.kubernetes.io/name: "files"
+  name: "files-files"
+data:
+  file1: "a2V5"
 `,
 		},
 	} {
@@ -341,3 +577,111 @@ spec:
 		})
 	}
 }
+
+func TestKindRunnable_DeleteCommands(t *testing.T) {
+	r := &kindRunnable{env: &KindEnvironment{dir: "/tmp/e2e"}, name: "app"}
+
+	cmds := r.deleteCommands("30")
+	testutil.Equals(t, 4, len(cmds))
+	testutil.Equals(t, NewCommand("kubectl", "--kubeconfig", "/tmp/e2e/kubeconfig", "delete", "deployment/app", "--ignore-not-found", "--grace-period", "30"), cmds[0])
+	testutil.Equals(t, NewCommand("kubectl", "--kubeconfig", "/tmp/e2e/kubeconfig", "delete", "service/app", "--ignore-not-found", "--grace-period", "30"), cmds[1])
+
+	r.opts.Job = true
+	for i, c := range r.deleteCommands("0") {
+		testutil.Equals(t, "kubectl", c.Cmd)
+		testutil.Equals(t, []string{"--grace-period", "0", "--force"}, c.Args[len(c.Args)-3:], "command %d", i)
+	}
+	testutil.Equals(t, "job/app", r.deleteCommands("0")[0].Args[3])
+}
+
+func TestGetKindExitStatus(t *testing.T) {
+	status, terminated, err := getKindExitStatus([]byte("''"))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !terminated)
+	testutil.Equals(t, ExitStatus{}, status)
+
+	status, terminated, err = getKindExitStatus([]byte(`{"containerID":"containerd://d3adb33f","exitCode":137,"finishedAt":"2022-11-03T10:00:05Z","reason":"OOMKilled","startedAt":"2022-11-03T10:00:00Z"}`))
+	testutil.Ok(t, err)
+	testutil.Assert(t, terminated)
+	testutil.Equals(t, ExitStatus{ExitCode: 137, OOMKilled: true, FinishedAt: time.Date(2022, 11, 3, 10, 0, 5, 0, time.UTC)}, status)
+
+	_, _, err = getKindExitStatus([]byte("{"))
+	testutil.NotOk(t, err)
+}
+
+func TestGetKindCrashStatus(t *testing.T) {
+	for _, tcase := range []struct {
+		out              string
+		expectedStatus   ExitStatus
+		expectedCrashed  bool
+		expectedPrevious bool
+	}{
+		{out: "''"},
+		{out: `{"name":"app","ready":true,"restartCount":0,"state":{"running":{"startedAt":"2022-11-03T10:00:00Z"}}}`},
+		{
+			out:             `{"name":"app","ready":false,"restartCount":0,"state":{"terminated":{"exitCode":1,"finishedAt":"2022-11-03T10:00:05Z","reason":"Error"}}}`,
+			expectedStatus:  ExitStatus{ExitCode: 1, FinishedAt: time.Date(2022, 11, 3, 10, 0, 5, 0, time.UTC)},
+			expectedCrashed: true,
+		},
+		{
+			out:              `{"name":"app","ready":false,"restartCount":3,"lastState":{"terminated":{"exitCode":137,"finishedAt":"2022-11-03T10:00:05Z","reason":"OOMKilled"}},"state":{"waiting":{"reason":"CrashLoopBackOff"}}}`,
+			expectedStatus:   ExitStatus{ExitCode: 137, OOMKilled: true, FinishedAt: time.Date(2022, 11, 3, 10, 0, 5, 0, time.UTC)},
+			expectedCrashed:  true,
+			expectedPrevious: true,
+		},
+	} {
+		t.Run("", func(t *testing.T) {
+			status, crashed, previous, err := getKindCrashStatus([]byte(tcase.out))
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedStatus, status)
+			testutil.Equals(t, tcase.expectedCrashed, crashed)
+			testutil.Equals(t, tcase.expectedPrevious, previous)
+		})
+	}
+}
+
+func TestParseCtrMetrics(t *testing.T) {
+	t.Run("cgroup v2", func(t *testing.T) {
+		stats, err := parseCtrMetrics([]byte(`{
+			"pids": {"current": 4, "limit": 100},
+			"cpu": {"usage_usec": 2500000, "user_usec": 2000000, "system_usec": 500000},
+			"memory": {"anon": 6000, "file": 4000, "inactive_file": 3000, "usage": 10000, "usage_limit": 1000000},
+			"io": {"usage": [{"major": 8, "minor": 0, "rbytes": 100, "wbytes": 200}, {"major": 8, "minor": 16, "rbytes": 1, "wbytes": 2}]}
+		}`))
+		testutil.Ok(t, err)
+		testutil.Equals(t, RunnableStats{
+			CPUTime:               2500 * time.Millisecond,
+			MemoryRSSBytes:        6000,
+			MemoryWorkingSetBytes: 7000,
+			BlockReadBytes:        101,
+			BlockWriteBytes:       202,
+			PIDs:                  4,
+		}, stats)
+	})
+	t.Run("cgroup v1", func(t *testing.T) {
+		stats, err := parseCtrMetrics([]byte(`{
+			"pids": {"current": 2},
+			"cpu": {"usage": {"total": 1500000000, "kernel": 500000000, "user": 1000000000}},
+			"memory": {"rss": 5000, "total_rss": 6000, "total_inactive_file": 3000, "usage": {"usage": 10000, "limit": 1000000}},
+			"blkio": {"io_service_bytes_recursive": [{"op": "Read", "value": 100}, {"op": "Write", "value": 200}, {"op": "Total", "value": 300}]}
+		}`))
+		testutil.Ok(t, err)
+		testutil.Equals(t, RunnableStats{
+			CPUTime:               1500 * time.Millisecond,
+			MemoryRSSBytes:        6000,
+			MemoryWorkingSetBytes: 7000,
+			BlockReadBytes:        100,
+			BlockWriteBytes:       200,
+			PIDs:                  2,
+		}, stats)
+	})
+}
+
+func TestParseCtrTaskPID(t *testing.T) {
+	pid, err := parseCtrTaskPID([]byte("PID     INFO\n12345   -\n12400   -\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 12345, pid)
+
+	_, err = parseCtrTaskPID([]byte("PID     INFO\n"))
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,255 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
+)
+
+const podmanGatewayAddr = "host.containers.internal"
+
+var _ Environment = &PodmanEnvironment{}
+
+// PodmanEnvironment defines single node, rootless podman engine that allows to run Services. Every runnable runs in its
+// own pod, reachable from other runnables under the same internal endpoint as in DockerEnvironment.
+//
+// Containers run with `--userns=keep-id` by default (unless StartOptions.UserNs is set), so files they create in
+// Dir() and SharedDir() are owned by the user running tests.
+type PodmanEnvironment struct {
+	*DockerEnvironment
+}
+
+// NewPodmanEnvironment creates new, isolated podman environment.
+func NewPodmanEnvironment(opts ...EnvironmentOption) (_ *PodmanEnvironment, err error) {
+	return NewPodmanEnvironmentContext(context.Background(), opts...)
+}
+
+// NewPodmanEnvironmentContext creates new, isolated podman environment. See NewContext for how context is used.
+func NewPodmanEnvironmentContext(ctx context.Context, opts ...EnvironmentOption) (_ *PodmanEnvironment, err error) {
+	e := environmentOptions{}
+	for _, o := range opts {
+		o(&e)
+	}
+	if e.name == "" {
+		e.name, err = generateName()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := validateName(e.name); err != nil {
+		return nil, err
+	}
+	if err := validateNetworks(e.name, e.networks); err != nil {
+		return nil, err
+	}
+
+	if e.logger == nil {
+		e.logger = NewLogger(os.Stdout)
+	}
+
+	d := &DockerEnvironment{
+		logger:        e.logger,
+		networkName:   e.name,
+		verbose:       e.verbose,
+		registered:    map[string]struct{}{},
+		dockerVolumes: e.volumes,
+		cpus:          e.cpus,
+		backend:       newPodmanCLI(e.logger, e.verbose),
+		imageCacheDir: e.imageCacheDirectory(),
+		networks:      e.networks,
+		// Rootless containers can't reach host through the network gateway, but podman resolves this name for them.
+		hostAddr: podmanGatewayAddr,
+		userNs:   "keep-id",
+		reuse:    e.reuseEnabled(),
+
+		logHistoryLimit: e.logHistoryLimitOrDefault(),
+	}
+	if err := d.setup(ctx); err != nil {
+		return nil, err
+	}
+	d.addArtifactsCloser(e)
+	return &PodmanEnvironment{DockerEnvironment: d}, e.logger.Log("msg", "started podman environment", "name", d.networkName)
+}
+
+// podmanCLI is dockerBackend that shells out to the podman command line tool. Every started container
+// is grouped in its own pod, which owns the network namespace of the container.
+type podmanCLI struct {
+	*dockerCLI
+}
+
+func newPodmanCLI(logger Logger, verbose bool) *podmanCLI {
+	return &podmanCLI{dockerCLI: &dockerCLI{bin: "podman", logger: logger, verbose: verbose}}
+}
+
+func podName(containerName string) string      { return containerName + "-pod" }
+func podInfraName(containerName string) string { return containerName + "-infra" }
+
+// podCreateArgs returns `podman pod create` arguments for the pod of the container described by spec.
+// The pod owns network and user namespace, so it gets hostname, network alias, published ports and user namespace of the spec.
+func podCreateArgs(spec dockerContainerSpec) []string {
+	args := []string{
+		"--name=" + podName(spec.Name),
+		"--infra-name=" + podInfraName(spec.Name),
+	}
+	if len(spec.Endpoints) == 0 {
+		args = append(args,
+			"--network="+spec.NetworkMode,
+			// Containers in the pod are not resolvable under their names, so make the pod resolvable under the container one.
+			"--network-alias="+spec.Name,
+		)
+	}
+	// Pod is connected to all of its networks on creation, with per-network options.
+	for _, e := range spec.Endpoints {
+		opts := []string{"alias=" + spec.Name}
+		for _, a := range e.Aliases {
+			opts = append(opts, "alias="+a)
+		}
+		if e.IPv4Address != "" {
+			opts = append(opts, "ip="+e.IPv4Address)
+		}
+		if e.IPv6Address != "" {
+			opts = append(opts, "ip6="+e.IPv6Address)
+		}
+		args = append(args, "--network="+e.Network+":"+strings.Join(opts, ","))
+	}
+	if spec.Hostname != "" {
+		args = append(args, "--hostname="+spec.Hostname)
+	}
+	for _, p := range spec.Ports {
+		args = append(args, "-p", p.publishArg())
+	}
+	if spec.UserNs != "" {
+		args = append(args, "--userns="+spec.UserNs)
+	}
+	return args
+}
+
+// podRunArgs returns `podman run` arguments for the container described by spec, joining its pod.
+func podRunArgs(spec dockerContainerSpec) []string {
+	spec.NetworkMode, spec.Endpoints, spec.Hostname, spec.Ports, spec.UserNs = "", nil, "", nil, ""
+	return append([]string{"--pod=" + podName(spec.Name)}, spec.runArgs()...)
+}
+
+func (p *podmanCLI) startContainer(ctx context.Context, spec dockerContainerSpec, stdout, stderr io.Writer) (<-chan struct{}, error) {
+	if _, err := p.run(ctx, append([]string{"pod", "create"}, podCreateArgs(spec)...)...); err != nil {
+		return nil, err
+	}
+	return p.runAttached(podRunArgs(spec), stdout, stderr)
+}
+
+// removeContainer removes the container together with its pod, if any.
+func (p *podmanCLI) removeContainer(ctx context.Context, name string, force bool) error {
+	errs := merrors.New()
+	errs.Add(p.dockerCLI.removeContainer(ctx, name, force))
+	_, err := p.run(ctx, "pod", "rm", "--force", "--ignore", podName(name))
+	errs.Add(err)
+	return errs.Err()
+}
+
+// listContainers returns IDs of all containers connected to the given network, except pod infra containers,
+// which are removed together with their pods.
+func (p *podmanCLI) listContainers(ctx context.Context, network string) ([]string, error) {
+	out, err := p.run(ctx, "ps", "-a", "--format={{.ID}} {{.IsInfra}}", "--filter", fmt.Sprintf("network=%s", network))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] == "true" {
+			continue
+		}
+		ids = append(ids, fields[0])
+	}
+	return ids, nil
+}
+
+// removeNetwork removes the network together with leftover pods using it.
+func (p *podmanCLI) removeNetwork(ctx context.Context, name string) error {
+	_, err := p.run(ctx, "network", "rm", "--force", name)
+	return err
+}
+
+// networkGateway is not used, as rootless containers can't reach the host through the gateway.
+func (p *podmanCLI) networkGateway(context.Context, string) (string, error) {
+	return "", errors.New("not supported by podman environment; use host.containers.internal instead")
+}
+
+// hostPort returns host port published by the pod of the container.
+func (p *podmanCLI) hostPort(ctx context.Context, name string, containerPort int, protocol string) (int, error) {
+	return p.dockerCLI.hostPort(ctx, podInfraName(name), containerPort, protocol)
+}
+
+// containerIP returns IP address of the pod of the container.
+func (p *podmanCLI) containerIP(ctx context.Context, name, network string) (string, error) {
+	return p.dockerCLI.containerIP(ctx, podInfraName(name), network)
+}
+
+// stats returns resource usage reported by `podman stats`, which differs in format from the docker one. RSS is not
+// reported there, so it's zero, see RunnableStats.
+func (p *podmanCLI) stats(ctx context.Context, name string) (RunnableStats, error) {
+	p.logUnsupportedStats("RSS is not reported by `podman stats`, so it's zero")
+	out, err := p.run(ctx, "stats", "--no-stream", "--no-reset", "--format=json", name)
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	stats, err := parsePodmanStats(out)
+	if err != nil {
+		return RunnableStats{}, errors.Wrapf(err, "parse stats of container %s", name)
+	}
+	return stats, nil
+}
+
+// parsePodmanStats parses `podman stats --format=json` output of single container.
+func parsePodmanStats(out []byte) (RunnableStats, error) {
+	var s []struct {
+		CPUTime  string `json:"cpu_time"`
+		MemUsage string `json:"mem_usage"`
+		NetIO    string `json:"net_io"`
+		BlockIO  string `json:"block_io"`
+		PIDs     string `json:"pids"`
+	}
+	if err := json.Unmarshal(out, &s); err != nil {
+		return RunnableStats{}, err
+	}
+	if len(s) != 1 {
+		return RunnableStats{}, errors.Newf("expected stats of single container, got %d", len(s))
+	}
+
+	var (
+		stats RunnableStats
+		err   error
+	)
+	if s[0].CPUTime != "" {
+		if stats.CPUTime, err = time.ParseDuration(s[0].CPUTime); err != nil {
+			return RunnableStats{}, errors.Wrapf(err, "parse CPU time %q", s[0].CPUTime)
+		}
+	}
+	if stats.MemoryWorkingSetBytes, _, err = parseHumanSizePair(s[0].MemUsage); err != nil {
+		return RunnableStats{}, err
+	}
+	if stats.NetworkRxBytes, stats.NetworkTxBytes, err = parseHumanSizePair(s[0].NetIO); err != nil {
+		return RunnableStats{}, err
+	}
+	if stats.BlockReadBytes, stats.BlockWriteBytes, err = parseHumanSizePair(s[0].BlockIO); err != nil {
+		return RunnableStats{}, err
+	}
+	if s[0].PIDs != "" && s[0].PIDs != "--" {
+		if stats.PIDs, err = strconv.ParseUint(s[0].PIDs, 10, 64); err != nil {
+			return RunnableStats{}, errors.Wrapf(err, "parse PIDs %q", s[0].PIDs)
+		}
+	}
+	return stats, nil
+}
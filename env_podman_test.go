@@ -0,0 +1,79 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestPodArgs(t *testing.T) {
+	e := &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e", userNs: "keep-id"}
+	spec := e.containerSpec("app", tcpPortSpecs(map[string]int{"http": 80, "grpc": 90}), map[string]int{"grpc": 32769}, StartOptions{
+		Image:   "alpine",
+		EnvVars: map[string]string{"B": "2", "A": "1"},
+		Command: NewCommandWithoutEntrypoint("sleep", "1000"),
+	})
+
+	testutil.Equals(t, []string{
+		"--name=e2e-test-app-pod", "--infra-name=e2e-test-app-infra", "--network=e2e-test", "--network-alias=e2e-test-app",
+		"--hostname=app", "-p", "32769:90", "-p", "80", "--userns=keep-id",
+	}, podCreateArgs(spec))
+	testutil.Equals(t, []string{
+		"--pod=e2e-test-app-pod", "--name=e2e-test-app", "-v", "/tmp/e2e:/tmp/e2e:z", "-e", "A=1", "-e", "B=2", "--entrypoint", "", "alpine", "sleep", "1000",
+	}, podRunArgs(spec))
+
+	// Pod is connected to all of its networks on creation.
+	spec = e.containerSpec("app", nil, nil, StartOptions{
+		Image: "alpine",
+		Networks: map[string]NetworkAttachment{
+			"e2e-test": {},
+			"backend":  {Aliases: []string{"api"}, IPv4Address: "172.30.0.10", IPv6Address: "fd00:e2e::10"},
+		},
+	})
+	testutil.Equals(t, []string{
+		"--name=e2e-test-app-pod", "--infra-name=e2e-test-app-infra",
+		"--network=e2e-test:alias=e2e-test-app",
+		"--network=e2e-test-backend:alias=e2e-test-app,alias=api,ip=172.30.0.10,ip6=fd00:e2e::10",
+		"--hostname=app", "--userns=keep-id",
+	}, podCreateArgs(spec))
+	testutil.Equals(t, []string{
+		"--pod=e2e-test-app-pod", "--name=e2e-test-app", "-v", "/tmp/e2e:/tmp/e2e:z", "alpine",
+	}, podRunArgs(spec))
+
+	// Explicit user namespace takes precedence over the environment default.
+	spec = e.containerSpec("app", nil, nil, StartOptions{Image: "alpine", UserNs: "host"})
+	testutil.Equals(t, "host", spec.UserNs)
+}
+
+func TestParsePodmanStats(t *testing.T) {
+	stats, err := parsePodmanStats([]byte(`[
+ {
+  "id": "e1c1ee1bdc8c",
+  "name": "e2e-test-app",
+  "cpu_time": "1.5s",
+  "cpu_percent": "0.31%",
+  "avg_cpu": "0.31%",
+  "mem_usage": "1.2MB / 8.2GB",
+  "mem_percent": "0.01%",
+  "net_io": "2.5kB / 1.1kB",
+  "block_io": "0B / 12.3kB",
+  "pids": "3"
+ }
+]`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, RunnableStats{
+		CPUTime:               1500 * time.Millisecond,
+		MemoryWorkingSetBytes: 1200000,
+		NetworkRxBytes:        2500,
+		NetworkTxBytes:        1100,
+		BlockWriteBytes:       12300,
+		PIDs:                  3,
+	}, stats)
+
+	_, err = parsePodmanStats([]byte(`[]`))
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,958 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+)
+
+const processHostAddr = "127.0.0.1"
+
+var _ Environment = &ProcessEnvironment{}
+
+// errNetworkFaultsNotSupported is returned on network fault injection in environments sharing host network.
+var errNetworkFaultsNotSupported = errors.New("network faults are not supported by process environment; all runnables share the host network")
+
+// ProcessEnvironment runs runnables as local host processes, without containers. It's useful for benchmarks and
+// machines without container engine, as well as for quick iterations on already built binaries.
+//
+// Runnables run StartOptions.Command (Image and container specific options like Volumes, User or limits are ignored)
+// in their Dir(), with environment of the test process extended with StartOptions.EnvVars. Every port declared with
+// WithPorts keeps its number if it's free on the host and not allocated to another runnable yet, otherwise it gets
+// a random free local port. Processes should listen on the port from InternalEndpoint (e.g. passed in flags built
+// using Future), as runnables listening on the declared port work only as long as it's free. Endpoint and
+// InternalEndpoint return the same, local address.
+type ProcessEnvironment struct {
+	dir    string
+	name   string
+	logger Logger
+	// logHistoryLimit is the maximum number of lines in log history of runnables, 0 means no limit.
+	logHistoryLimit int
+
+	// mutex guards registered, runnables, closers and closed, as runnables can be created concurrently.
+	mutex      sync.Mutex
+	registered map[string]struct{}
+	// runnables contains all runnables created in the environment, in creation order.
+	runnables []*processRunnable
+
+	// startedMtx guards listeners and started, as runnables can be started concurrently.
+	startedMtx sync.Mutex
+	listeners  []EnvironmentListener
+	started    []Runnable
+
+	events runnableEvents
+
+	closers []func()
+	closed  bool
+	// ports contains local ports allocated to runnables of the environment, released on Close.
+	ports []localPort
+}
+
+// NewProcessEnvironment creates new environment running runnables as local processes.
+func NewProcessEnvironment(opts ...EnvironmentOption) (_ *ProcessEnvironment, err error) {
+	e := environmentOptions{}
+	for _, o := range opts {
+		o(&e)
+	}
+	if e.name == "" {
+		e.name, err = generateName()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(e.networks) > 0 {
+		return nil, errNetworksNotSupported
+	}
+	if e.logger == nil {
+		e.logger = NewLogger(os.Stdout)
+	}
+
+	dir, err := getTmpDirectory()
+	if err != nil {
+		return nil, err
+	}
+	p := &ProcessEnvironment{
+		dir:        dir,
+		name:       e.name,
+		logger:     e.logger,
+		registered: map[string]struct{}{},
+
+		logHistoryLimit: e.logHistoryLimitOrDefault(),
+	}
+	if c := e.artifactsCloser(p.logger, p.CollectArtifacts); c != nil {
+		p.AddCloser(c)
+	}
+	return p, e.logger.Log("msg", "started process environment", "name", p.name)
+}
+
+func (e *ProcessEnvironment) Name() string      { return e.name }
+func (e *ProcessEnvironment) SharedDir() string { return e.dir }
+func (e *ProcessEnvironment) HostAddr() string  { return processHostAddr }
+
+func (e *ProcessEnvironment) AddCloser(f func()) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.closers = append(e.closers, f)
+}
+
+// AddListener registers given listener to be notified on environment runnable changes.
+func (e *ProcessEnvironment) AddListener(listener EnvironmentListener) {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
+	e.listeners = append(e.listeners, listener)
+}
+
+// AddEventListener registers given listener to be notified on given lifecycle events of all runnables in the environment.
+// Listener is notified on all events, if no event types are given.
+func (e *ProcessEnvironment) AddEventListener(listener RunnableEventListener, types ...RunnableEventType) {
+	e.events.add(listener, types...)
+}
+
+// PrePull does nothing, as processes don't run images.
+func (e *ProcessEnvironment) PrePull(context.Context, ...Linkable) error {
+	return nil
+}
+
+// Partition is not supported, as all processes share the host network.
+func (e *ProcessEnvironment) Partition(_, _ Linkable) (Fault, error) {
+	return nil, errNetworkFaultsNotSupported
+}
+
+func (e *ProcessEnvironment) Runnable(name string) RunnableBuilder {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.closed {
+		return errorer{name: name, err: errors.New("environment close was invoked already.")}
+	}
+	if _, ok := e.registered[name]; ok {
+		return errorer{name: name, err: errors.Newf("there is already one runnable created with the same name %v", name)}
+	}
+
+	r := &processRunnable{
+		env:        e,
+		name:       name,
+		logger:     e.logger,
+		ports:      map[string]int{},
+		extensions: map[any]any{},
+		logs:       newLogs(e.logHistoryLimit),
+	}
+	if err := os.MkdirAll(r.Dir(), 0750); err != nil {
+		return errorer{name: name, err: err}
+	}
+	e.registered[name] = struct{}{}
+	e.runnables = append(e.runnables, r)
+	e.events.emit(RunnableEvent{Type: RunnableCreated, Runnable: r})
+	return r
+}
+
+// CollectArtifacts writes artifacts of every runnable created in the environment into its own subdirectory of dir.
+// See WithArtifacts for details.
+func (e *ProcessEnvironment) CollectArtifacts(ctx context.Context, dir string) error {
+	e.mutex.Lock()
+	runnables := make([]Runnable, 0, len(e.runnables))
+	for _, r := range e.runnables {
+		runnables = append(runnables, r)
+	}
+	e.mutex.Unlock()
+	return collectArtifacts(ctx, dir, runnables, nil)
+}
+
+func (e *ProcessEnvironment) registerStarted(r Runnable) error {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
+
+	e.started = append(e.started, r)
+	for _, l := range e.listeners {
+		if err := l.OnRunnableChange(e.started); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ProcessEnvironment) registerStopped(name string) error {
+	e.startedMtx.Lock()
+	defer e.startedMtx.Unlock()
+
+	for i, r := range e.started {
+		if r.Name() == name {
+			e.started = append(e.started[:i], e.started[i+1:]...)
+			for _, l := range e.listeners {
+				if err := l.OnRunnableChange(e.started); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (e *ProcessEnvironment) Close() {
+	e.mutex.Lock()
+	closed, closers := e.closed, append([]func(){}, e.closers...)
+	e.closed = true
+	e.mutex.Unlock()
+	if closed {
+		return
+	}
+	for _, c := range closers {
+		c()
+	}
+
+	e.startedMtx.Lock()
+	started := append([]Runnable{}, e.started...)
+	e.startedMtx.Unlock()
+
+	// Kill the processes in the opposite order.
+	for i := len(started) - 1; i >= 0; i-- {
+		if err := started[i].Kill(); err != nil {
+			e.logger.Log("Unable to kill process", started[i].Name(), ":", err.Error())
+		}
+	}
+	if err := os.RemoveAll(e.dir); err != nil {
+		e.logger.Log("Error while removing sharedDir", e.dir, "err:", err)
+	}
+
+	e.mutex.Lock()
+	ports := e.ports
+	e.ports = nil
+	e.mutex.Unlock()
+	releaseLocalPorts(ports)
+}
+
+// allocatePort returns local port for the given port: its host port if set, the declared port if it's free,
+// or a random free port otherwise.
+func (e *ProcessEnvironment) allocatePort(p PortSpec) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	port, err := reserveLocalPort(p)
+	if err != nil {
+		return 0, err
+	}
+	e.ports = append(e.ports, localPort{protocol: p.protocol(), port: port})
+	return port, nil
+}
+
+type localPort struct {
+	protocol Protocol
+	port     int
+}
+
+// reservedLocalPorts contains local ports allocated to runnables of all process environments. Processes listen on
+// them only once started, so ports have to be reserved in order not to be allocated twice, e.g. by parallel tests.
+var reservedLocalPorts = struct {
+	sync.Mutex
+	ports map[localPort]struct{}
+}{ports: map[localPort]struct{}{}}
+
+// reserveLocalPort reserves and returns local port for the given port, see ProcessEnvironment.allocatePort.
+func reserveLocalPort(p PortSpec) (int, error) {
+	reservedLocalPorts.Lock()
+	defer reservedLocalPorts.Unlock()
+
+	port := p.HostPort
+	if port <= 0 {
+		if _, ok := reservedLocalPorts.ports[localPort{protocol: p.protocol(), port: p.Port}]; !ok && checkLocalPortFree(p.protocol(), p.Port) == nil {
+			port = p.Port
+		}
+	}
+	for port <= 0 {
+		l, err := listenLocalPort(p.protocol(), 0)
+		if err != nil {
+			return 0, err
+		}
+		port = l.port
+		_ = l.Close()
+		// Random port might have been allocated already, while not being listened on yet.
+		if _, ok := reservedLocalPorts.ports[localPort{protocol: p.protocol(), port: port}]; ok {
+			port = 0
+		}
+	}
+	reservedLocalPorts.ports[localPort{protocol: p.protocol(), port: port}] = struct{}{}
+	return port, nil
+}
+
+func releaseLocalPorts(ports []localPort) {
+	reservedLocalPorts.Lock()
+	defer reservedLocalPorts.Unlock()
+	for _, p := range ports {
+		delete(reservedLocalPorts.ports, p)
+	}
+}
+
+// checkLocalPortFree returns error if the given port is not free on the local interface at the moment.
+func checkLocalPortFree(protocol Protocol, port int) error {
+	l, err := listenLocalPort(protocol, port)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+type localListener struct {
+	io.Closer
+	port int
+}
+
+// listenLocalPort listens on the given port of the local interface, or on a random one if port is zero.
+func listenLocalPort(protocol Protocol, port int) (localListener, error) {
+	addr := net.JoinHostPort(processHostAddr, strconv.Itoa(port))
+	if protocol == UDP {
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return localListener{}, err
+		}
+		return localListener{Closer: c, port: c.LocalAddr().(*net.UDPAddr).Port}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return localListener{}, err
+	}
+	return localListener{Closer: l, port: l.Addr().(*net.TCPAddr).Port}, nil
+}
+
+type processRunnable struct {
+	env    *ProcessEnvironment
+	name   string
+	logger Logger
+	logs   *Logs
+
+	// lifecycle serializes operations changing the process state (e.g. start, stop or kill), so they don't interleave.
+	lifecycle sync.Mutex
+	// paused is true if the running process is paused. Guarded by lifecycle.
+	paused bool
+
+	// mutex guards the following fields, so runnable can be used from multiple goroutines.
+	mutex sync.Mutex
+	// ports maps port name to the local port allocated for it.
+	ports map[string]int
+	deps  []Linkable
+	opts  StartOptions
+
+	extensions map[any]any
+
+	// cmd is the process started by the latest Start. If nil, runnable is stopped.
+	cmd *exec.Cmd
+	// exited is closed once process started by the latest Start exits and its output is flushed.
+	exited chan struct{}
+	// status is the exit status of the process started by the latest Start, set before exited is closed.
+	status ExitStatus
+	// stopping is set once process started by the latest Start is stopped or killed on purpose, so its exit is not
+	// reported as crash.
+	stopping *int32
+}
+
+func (r *processRunnable) Name() string        { return r.name }
+func (r *processRunnable) BuildErr() error     { return nil }
+func (r *processRunnable) Dir() string         { return filepath.Join(r.env.dir, "data", r.Name()) }
+func (r *processRunnable) InternalDir() string { return r.Dir() }
+func (r *processRunnable) Logs() *Logs         { return r.logs }
+func (r *processRunnable) Future() FutureRunnable {
+	return r
+}
+
+func (r *processRunnable) IsRunning() bool {
+	cmd, _ := r.process()
+	return cmd != nil
+}
+
+// process returns the process started by the latest Start (nil if runnable is stopped) and channel closed once it exits.
+func (r *processRunnable) process() (*exec.Cmd, chan struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cmd, r.exited
+}
+
+// setStopped marks the runnable as stopped.
+func (r *processRunnable) setStopped() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cmd = nil
+}
+
+// options returns start options of the runnable.
+func (r *processRunnable) options() StartOptions {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.opts
+}
+
+func (r *processRunnable) Init(opts StartOptions) Runnable {
+	if opts.WaitReadyBackoff == nil {
+		opts.WaitReadyBackoff = &backoff.Config{
+			Min:        300 * time.Millisecond,
+			Max:        600 * time.Millisecond,
+			MaxRetries: 50,
+		}
+	}
+	if opts.StopSignal != nil {
+		if _, err := signalNumber(opts.StopSignal); err != nil {
+			return errorer{name: r.Name(), err: err}
+		}
+	}
+	if opts.Command.Cmd == "" {
+		return errorer{name: r.Name(), err: errors.Newf("runnable %s has no command; process environment runs StartOptions.Command, not images", r.Name())}
+	}
+	if err := validateMounts(opts); err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+	if len(opts.Networks) > 0 {
+		return errorer{name: r.Name(), err: errNetworksNotSupported}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.opts = opts
+	return r
+}
+
+// WithPorts allocates local port for every given port name: the declared port if it's free, a random free port
+// otherwise. See ProcessEnvironment for details.
+func (r *processRunnable) WithPorts(ports map[string]int) RunnableBuilder {
+	return r.WithPortSpecs(tcpPortSpecs(ports))
+}
+
+// WithPortSpecs allocates local port of the given protocol for every port without fixed host port: the declared port if
+// it's free, a random free port otherwise. Host IP is not supported.
+func (r *processRunnable) WithPortSpecs(ports map[string]PortSpec) RunnableBuilder {
+	if err := validatePortSpecs(ports); err != nil {
+		return errorer{name: r.Name(), err: err}
+	}
+	for name, p := range ports {
+		if p.HostIP != "" {
+			return errorer{name: r.Name(), err: errors.Newf("port %q: host IP is not supported by process environment", name)}
+		}
+	}
+
+	// Ports are allocated in order of names, so allocation doesn't depend on map iteration order.
+	names := make([]string, 0, len(ports))
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		port, err := r.env.allocatePort(ports[name])
+		if err != nil {
+			return errorer{name: r.Name(), err: errors.Wrapf(err, "allocate local port %s", name)}
+		}
+		r.mutex.Lock()
+		r.ports[name] = port
+		r.mutex.Unlock()
+	}
+	return r
+}
+
+// WithBuild returns errorer, as processes don't run images.
+func (r *processRunnable) WithBuild(string, string, map[string]string) RunnableBuilder {
+	return errorer{name: r.Name(), err: errors.Newf("runnable %s can't be built from Dockerfile; process environment runs StartOptions.Command, not images", r.Name())}
+}
+
+func (r *processRunnable) DependsOn(deps ...Linkable) RunnableBuilder {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deps = append(r.deps, deps...)
+	return r
+}
+
+func (r *processRunnable) Dependencies() []Linkable {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.deps
+}
+
+func (r *processRunnable) SetMetadata(key, value any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.extensions[key] = value
+}
+
+func (r *processRunnable) GetMetadata(key any) (any, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	v, ok := r.extensions[key]
+	return v, ok
+}
+
+func (r *processRunnable) WaitLogLine(ctx context.Context, pattern *regexp.Regexp, opts ...LogLineOption) (LogLine, error) {
+	return r.logs.waitLine(ctx, r.Name(), r.IsRunning, pattern, opts...)
+}
+
+// Endpoint returns local endpoint (host:port) for given port name. It's the same as InternalEndpoint,
+// but returns `stopped` if runnable is not running.
+func (r *processRunnable) Endpoint(portName string) string {
+	if !r.IsRunning() {
+		return "stopped"
+	}
+	return r.InternalEndpoint(portName)
+}
+
+// InternalEndpoint returns local endpoint (host:port) for given port name, which the process is expected to listen on.
+func (r *processRunnable) InternalEndpoint(portName string) string {
+	r.mutex.Lock()
+	port, ok := r.ports[portName]
+	r.mutex.Unlock()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", processHostAddr, port)
+}
+
+// environ returns environment of the process: the test process environment extended with StartOptions.EnvVars.
+func (r *processRunnable) environ(opts StartOptions) []string {
+	env := os.Environ()
+	keys := make([]string, 0, len(opts.EnvVars))
+	for k := range opts.EnvVars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+opts.EnvVars[k])
+	}
+	return env
+}
+
+func (r *processRunnable) Start() error {
+	return r.StartContext(context.Background())
+}
+
+func (r *processRunnable) StartContext(ctx context.Context) error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	return r.start(ctx)
+}
+
+// start starts the process. The lifecycle mutex must be held.
+func (r *processRunnable) start(ctx context.Context) error {
+	if r.IsRunning() {
+		return errors.Newf("%v is running. Stop or kill it first to restart.", r.Name())
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.logger.Log("Starting", r.Name())
+	begin := time.Now()
+	opts := r.options()
+	if err := writeFiles(r.Dir(), opts.Files); err != nil {
+		return errors.Wrapf(err, "write files of %s", r.Name())
+	}
+
+	// Process lives longer than the start, so it can't be bound to the start context.
+	cmd := exec.Command(opts.Command.Cmd, opts.Command.Args...)
+	cmd.Dir = r.Dir()
+	cmd.Env = r.environ(opts)
+	setProcessGroup(cmd)
+
+	l := &LinePrefixLogger{prefix: r.Name() + ": ", logger: r.logger}
+	stdout, stderr := r.logs.writer(LogStreamStdout), r.logs.writer(LogStreamStderr)
+	cmd.Stdout = io.MultiWriter(l, stdout)
+	cmd.Stderr = io.MultiWriter(l, stderr)
+	r.logs.markStart()
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start process %s", r.Name())
+	}
+
+	exited, stopping := make(chan struct{}), new(int32)
+	r.mutex.Lock()
+	r.cmd, r.exited, r.stopping = cmd, exited, stopping
+	r.mutex.Unlock()
+	r.paused = false
+	go func(job bool) {
+		_ = cmd.Wait()
+		// Flush incomplete lines once process exits.
+		_ = stdout.Close()
+		_ = stderr.Close()
+		status := ExitStatus{ExitCode: processExitCode(cmd.ProcessState), FinishedAt: time.Now()}
+		r.mutex.Lock()
+		r.status = status
+		r.mutex.Unlock()
+		if !job && atomic.LoadInt32(stopping) == 0 {
+			r.env.events.emit(crashEvent(r, status))
+		}
+		close(exited)
+	}(opts.Job)
+
+	if err := r.env.registerStarted(r); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.logger.Log("Ports for process", r.Name(), ">> Local ports:", r.ports)
+	r.mutex.Unlock()
+	r.env.events.emit(RunnableEvent{Type: RunnableStarted, Runnable: r, Duration: time.Since(begin)})
+	return nil
+}
+
+// hasExited returns true if process started by the latest Start has exited.
+func (r *processRunnable) hasExited() bool {
+	_, exited := r.process()
+	select {
+	case <-exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// exitStatus returns exit status of the exited process.
+func (r *processRunnable) exitStatus() ExitStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.status
+}
+
+// terminatedError returns TerminatedError for process that exited unexpectedly.
+func (r *processRunnable) terminatedError() error {
+	return &TerminatedError{Name: r.Name(), Status: r.exitStatus(), LastLogs: r.logs.lastLines(terminatedErrorLogLines)}
+}
+
+func (r *processRunnable) Ready() error {
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+	readiness := r.options().Readiness
+	if readiness == nil {
+		return nil
+	}
+	return readiness.Ready(r)
+}
+
+func (r *processRunnable) WaitReady() error {
+	return r.WaitReadyContext(context.Background())
+}
+
+func (r *processRunnable) WaitReadyContext(ctx context.Context) (err error) {
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+
+	begin := time.Now()
+	opts := r.options()
+	for b := backoff.New(ctx, *opts.WaitReadyBackoff); b.Ongoing(); {
+		err = r.Ready()
+		if err == nil {
+			r.env.events.emit(RunnableEvent{Type: RunnableReady, Runnable: r, Duration: time.Since(begin)})
+			return nil
+		}
+		// There is no point in waiting for crashed process.
+		if !opts.Job && r.hasExited() {
+			return r.terminatedError()
+		}
+
+		b.Wait()
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return errors.Wrapf(err, "the service %s is not ready", r.Name())
+}
+
+func (r *processRunnable) Stop() error {
+	return r.StopContext(context.Background())
+}
+
+// StopContext sends stop signal (SIGTERM by default) to the process group and kills it if it doesn't exit
+// within the stop grace period or before the context is done. In the latter case, the context error is returned.
+func (r *processRunnable) StopContext(ctx context.Context) error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	return r.stop(ctx)
+}
+
+// stop stops the process. The lifecycle mutex must be held.
+func (r *processRunnable) stop(ctx context.Context) error {
+	cmd, exited := r.process()
+	if cmd == nil {
+		return nil
+	}
+
+	r.logger.Log("Stopping", r.Name())
+	begin := time.Now()
+	atomic.StoreInt32(r.stopping, 1)
+	// Paused processes can't handle the stop signal.
+	if r.paused {
+		if err := r.unpause(); err != nil {
+			return err
+		}
+	}
+
+	opts := r.options()
+	sig := opts.StopSignal
+	if sig == nil {
+		sig = syscall.SIGTERM
+	}
+	gracePeriod := opts.StopGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultStopGracePeriod
+	}
+	if err := signalProcessGroup(cmd.Process, sig); err != nil && !r.hasExited() {
+		r.logger.Log("Unable to send stop signal to", r.Name(), "killing it instead; err:", err)
+		gracePeriod = 0
+	}
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-exited:
+	case <-timer.C:
+		r.logger.Log("Process", r.Name(), "did not stop within", gracePeriod, "killing it")
+		if err := r.kill(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		r.logger.Log("Stopping", r.Name(), "was cancelled, killing it")
+		if err := r.kill(); err != nil {
+			return err
+		}
+		r.setStopped()
+		r.env.events.emit(RunnableEvent{Type: RunnableKilled, Runnable: r})
+		if err := r.env.registerStopped(r.Name()); err != nil {
+			return err
+		}
+		return errors.Wrapf(ctx.Err(), "stopping %s", r.Name())
+	}
+
+	r.setStopped()
+	r.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: r, Duration: time.Since(begin)})
+	return r.env.registerStopped(r.Name())
+}
+
+// kill kills the process group and waits until the process exits. The lifecycle mutex must be held.
+func (r *processRunnable) kill() error {
+	cmd, exited := r.process()
+	if err := signalProcessGroup(cmd.Process, os.Kill); err != nil && !r.hasExited() {
+		return errors.Wrapf(err, "kill process %s", r.Name())
+	}
+	<-exited
+	return nil
+}
+
+func (r *processRunnable) Kill() error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	if !r.IsRunning() {
+		return nil
+	}
+
+	r.logger.Log("Killing", r.Name())
+	atomic.StoreInt32(r.stopping, 1)
+	if err := r.kill(); err != nil {
+		return err
+	}
+	r.setStopped()
+	r.env.events.emit(RunnableEvent{Type: RunnableKilled, Runnable: r})
+	return r.env.registerStopped(r.Name())
+}
+
+// Restart stops and starts the process again. Local ports stay the same.
+func (r *processRunnable) Restart(ctx context.Context) error {
+	if err := r.restart(ctx); err != nil {
+		return err
+	}
+	return r.WaitReadyContext(ctx)
+}
+
+func (r *processRunnable) restart(ctx context.Context) error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+	if r.options().Job {
+		return errors.Newf("service %s is a job; jobs can't be restarted, wait for it and start it again instead", r.Name())
+	}
+
+	r.logger.Log("Restarting", r.Name())
+	if err := r.stop(ctx); err != nil {
+		return err
+	}
+	return r.start(ctx)
+}
+
+// Wait waits until the job process exits and returns its exit status.
+func (r *processRunnable) Wait(ctx context.Context) (ExitStatus, error) {
+	if !r.options().Job {
+		return ExitStatus{}, errors.Newf("service %s is not a job; only runnables started with StartOptions.Job can be waited for", r.Name())
+	}
+	cmd, exited := r.process()
+	if cmd == nil {
+		return ExitStatus{}, errors.Newf("service %s is stopped", r.Name())
+	}
+
+	select {
+	case <-ctx.Done():
+		return ExitStatus{}, errors.Wrapf(ctx.Err(), "waiting for job %s to exit", r.Name())
+	case <-exited:
+	}
+
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	// Job might have been killed or waited for concurrently.
+	if current, _ := r.process(); current != cmd {
+		return ExitStatus{}, errors.Newf("service %s is stopped", r.Name())
+	}
+
+	status := r.exitStatus()
+	r.logger.Log("Job", r.Name(), "exited with code", status.ExitCode)
+	r.setStopped()
+	r.env.events.emit(RunnableEvent{Type: RunnableStopped, Runnable: r, Status: status})
+	return status, r.env.registerStopped(r.Name())
+}
+
+func (r *processRunnable) Pause() error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+
+	cmd, _ := r.process()
+	if cmd == nil {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+
+	r.logger.Log("Pausing", r.Name())
+	if err := pauseProcessGroup(cmd.Process); err != nil {
+		return errors.Wrapf(err, "pause process %s", r.Name())
+	}
+	r.paused = true
+	return nil
+}
+
+func (r *processRunnable) Unpause() error {
+	r.lifecycle.Lock()
+	defer r.lifecycle.Unlock()
+	return r.unpause()
+}
+
+// unpause resumes the paused process group. The lifecycle mutex must be held.
+func (r *processRunnable) unpause() error {
+	cmd, _ := r.process()
+	if cmd == nil {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+
+	r.logger.Log("Unpausing", r.Name())
+	if err := resumeProcessGroup(cmd.Process); err != nil {
+		return errors.Wrapf(err, "unpause process %s", r.Name())
+	}
+	r.paused = false
+	return nil
+}
+
+func (r *processRunnable) Signal(sig os.Signal) error {
+	cmd, _ := r.process()
+	if cmd == nil {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+	if _, err := signalNumber(sig); err != nil {
+		return err
+	}
+	return signalProcessGroup(cmd.Process, sig)
+}
+
+// CopyTo copies the host file or directory to the given path. Processes run on the host, so it's a plain copy, with
+// containerPath resolved under Dir, like StartOptions.Files.
+func (r *processRunnable) CopyTo(_ context.Context, hostPath, containerPath string) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+	p, err := r.path(containerPath)
+	if err != nil {
+		return err
+	}
+	return copyHostPath(hostPath, p)
+}
+
+// CopyFrom copies the file or directory from the given path to the host. Processes run on the host, so it's a plain
+// copy, with containerPath resolved under Dir, like StartOptions.Files.
+func (r *processRunnable) CopyFrom(_ context.Context, containerPath, hostPath string) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+	p, err := r.path(containerPath)
+	if err != nil {
+		return err
+	}
+	return copyHostPath(p, hostPath)
+}
+
+// path resolves the given container path under Dir, the working directory of the process. Both absolute and relative
+// paths are resolved against it, so copying never touches host files outside of Dir.
+func (r *processRunnable) path(p string) (string, error) {
+	resolved := filepath.Join(r.Dir(), filepath.FromSlash(p))
+	if rel, err := filepath.Rel(r.Dir(), resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Newf("path %q is outside of the directory of service %s", p, r.Name())
+	}
+	return resolved, nil
+}
+
+// Stats returns resource usage summed over all processes of the runnable (its process group). It's supported only
+// on Linux.
+func (r *processRunnable) Stats(context.Context) (RunnableStats, error) {
+	cmd, _ := r.process()
+	if cmd == nil {
+		return RunnableStats{}, errors.Newf("service %s is stopped", r.Name())
+	}
+	return processGroupStats(cmd.Process.Pid)
+}
+
+func (r *processRunnable) Exec(command Command, opts ...ExecOption) error {
+	return r.ExecContext(context.Background(), command, opts...)
+}
+
+// ExecContext runs the provided command on the host, in Dir() and with the environment of the runnable.
+// The command is killed when the context is done.
+func (r *processRunnable) ExecContext(ctx context.Context, command Command, opts ...ExecOption) error {
+	if !r.IsRunning() {
+		return errors.Newf("service %s is stopped", r.Name())
+	}
+
+	l := &LinePrefixLogger{prefix: r.Name() + "-exec: ", logger: r.logger}
+	o := ExecOptions{Stdout: l, Stderr: l}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cmd := exec.CommandContext(ctx, command.Cmd, command.Args...)
+	cmd.Dir = r.Dir()
+	cmd.Env = r.environ(r.options())
+	cmd.Stdin = o.Stdin
+	cmd.Stdout = o.Stdout
+	cmd.Stderr = o.Stderr
+	begin := time.Now()
+	err := cmd.Run()
+	r.env.events.emit(RunnableEvent{Type: RunnableExecRun, Runnable: r, Duration: time.Since(begin), Command: command, Err: err})
+	return err
+}
+
+func (r *processRunnable) InjectLatency(_, _ time.Duration) (Fault, error) {
+	return nil, errNetworkFaultsNotSupported
+}
+
+func (r *processRunnable) InjectPacketLoss(float64) (Fault, error) {
+	return nil, errNetworkFaultsNotSupported
+}
+
+func (r *processRunnable) LimitBandwidth(uint64) (Fault, error) {
+	return nil, errNetworkFaultsNotSupported
+}
@@ -0,0 +1,422 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/efficientgo/e2e"
+)
+
+const processHelperEnv = "E2E_PROCESS_HELPER"
+
+// TestProcessHelper is not a real test, but the process started by TestProcessEnvironment.
+func TestProcessHelper(t *testing.T) {
+	if os.Getenv(processHelperEnv) == "" {
+		return
+	}
+
+	args := os.Args
+	for i, a := range args {
+		if a == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Exit(runProcessHelper(args))
+}
+
+func runProcessHelper(args []string) int {
+	switch args[0] {
+	case "exit":
+		code, _ := strconv.Atoi(args[1])
+		fmt.Println("done")
+		return code
+	case "serve":
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM)
+
+		http.HandleFunc("/ready", func(http.ResponseWriter, *http.Request) {})
+		go func() { _ = http.ListenAndServe(args[1], nil) }()
+		fmt.Println("serving on", args[1])
+		for s := range sigs {
+			if s == syscall.SIGTERM {
+				fmt.Println("bye")
+				return 0
+			}
+			fmt.Println("reloaded")
+		}
+	}
+	return 2
+}
+
+func processHelperCommand(args ...string) e2e.Command {
+	return e2e.NewCommand(os.Args[0], append([]string{"-test.run=^TestProcessHelper$", "--"}, args...)...)
+}
+
+func TestProcessEnvironment(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	t.Cleanup(cancel)
+
+	f := e.Runnable("server").WithPorts(map[string]int{"http": 8080}).Future()
+	testutil.Assert(t, strings.HasPrefix(f.InternalEndpoint("http"), "127.0.0.1:"))
+
+	server := f.Init(e2e.StartOptions{
+		Command:         processHelperCommand("serve", f.InternalEndpoint("http")),
+		EnvVars:         map[string]string{processHelperEnv: "1"},
+		Readiness:       e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+		StopGracePeriod: 5 * time.Second,
+		Files:           map[string]e2e.File{"/etc/server.yaml": e2e.NewFile([]byte("a: 1"))},
+	})
+	testutil.Ok(t, e2e.StartAndWaitReady(server))
+	testutil.Equals(t, f.InternalEndpoint("http"), server.Endpoint("http"))
+
+	_, err = server.WaitLogLine(ctx, regexp.MustCompile("^serving on "))
+	testutil.Ok(t, err)
+
+	t.Run("port specs", func(t *testing.T) {
+		r := e.Runnable("statsd").WithPortSpecs(map[string]e2e.PortSpec{"metrics": e2e.UDPPort(8125), "admin": {Port: 8126, HostPort: 18126}}).Future()
+		testutil.Assert(t, strings.HasPrefix(r.InternalEndpoint("metrics"), "127.0.0.1:"))
+		testutil.Equals(t, "127.0.0.1:18126", r.InternalEndpoint("admin"))
+
+		testutil.NotOk(t, e.Runnable("invalid").WithPortSpecs(map[string]e2e.PortSpec{"metrics": {Port: 8125, HostIP: "127.0.0.1"}}).Init(e2e.StartOptions{}).BuildErr())
+	})
+	t.Run("declared ports", func(t *testing.T) {
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		testutil.Ok(t, err)
+		defer busy.Close()
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		testutil.Ok(t, err)
+		freePort := free.Addr().(*net.TCPAddr).Port
+		testutil.Ok(t, free.Close())
+
+		// Declared port is used if it's free, so processes listening on it work as well.
+		a := e.Runnable("declared-a").WithPorts(map[string]int{"http": freePort, "busy": busy.Addr().(*net.TCPAddr).Port}).Future()
+		testutil.Equals(t, fmt.Sprintf("127.0.0.1:%d", freePort), a.InternalEndpoint("http"))
+		testutil.Assert(t, a.InternalEndpoint("busy") != busy.Addr().String())
+
+		// Port allocated to other runnable is not free anymore, even though nothing listens on it yet.
+		b := e.Runnable("declared-b").WithPorts(map[string]int{"http": freePort}).Future()
+		testutil.Assert(t, b.InternalEndpoint("http") != a.InternalEndpoint("http"))
+	})
+	t.Run("exec in runnable dir", func(t *testing.T) {
+		var out bytes.Buffer
+		testutil.Ok(t, server.Exec(e2e.NewCommand("sh", "-c", "pwd && echo $"+processHelperEnv), e2e.WithExecOptionStdout(&out)))
+		testutil.Equals(t, server.Dir()+"\n1\n", out.String())
+		testutil.NotOk(t, server.Exec(e2e.NewCommand("false")))
+	})
+	t.Run("files", func(t *testing.T) {
+		// Files are written under the runnable dir.
+		b, err := os.ReadFile(filepath.Join(server.Dir(), "etc", "server.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+	})
+	t.Run("copy", func(t *testing.T) {
+		host := filepath.Join(t.TempDir(), "config.yaml")
+		testutil.Ok(t, os.WriteFile(host, []byte("a: 1"), 0600))
+
+		// Relative paths are relative to the runnable dir.
+		testutil.Ok(t, server.CopyTo(ctx, host, "conf.yaml"))
+		b, err := os.ReadFile(filepath.Join(server.Dir(), "conf.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+
+		dir := t.TempDir()
+		testutil.Ok(t, server.CopyFrom(ctx, "conf.yaml", dir))
+		b, err = os.ReadFile(filepath.Join(dir, "conf.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+
+		// Absolute paths are resolved under the runnable dir too, so host files are not touched.
+		testutil.Ok(t, server.CopyTo(ctx, host, "/etc/e2e-conf.yaml"))
+		b, err = os.ReadFile(filepath.Join(server.Dir(), "etc", "e2e-conf.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+		_, err = os.Stat("/etc/e2e-conf.yaml")
+		testutil.Assert(t, os.IsNotExist(err))
+		testutil.Ok(t, server.CopyFrom(ctx, "/etc/server.yaml", dir))
+		b, err = os.ReadFile(filepath.Join(dir, "server.yaml"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a: 1", string(b))
+
+		testutil.NotOk(t, server.CopyTo(ctx, host, "../escape.yaml"))
+		testutil.NotOk(t, server.CopyFrom(ctx, "/../../escape.yaml", dir))
+	})
+	t.Run("signal", func(t *testing.T) {
+		offset := server.Logs().Len()
+		testutil.Ok(t, server.Signal(syscall.SIGHUP))
+		_, err := server.WaitLogLine(ctx, regexp.MustCompile("^reloaded$"), e2e.WithLogLineSince(offset))
+		testutil.Ok(t, err)
+	})
+	t.Run("pause", func(t *testing.T) {
+		testutil.Ok(t, server.Pause())
+		_, err := (&http.Client{Timeout: 500 * time.Millisecond}).Get("http://" + server.Endpoint("http") + "/ready")
+		testutil.NotOk(t, err)
+		testutil.Ok(t, server.Unpause())
+		testutil.Ok(t, server.WaitReady())
+	})
+	t.Run("restart", func(t *testing.T) {
+		endpoint := server.Endpoint("http")
+		testutil.Ok(t, server.Restart(ctx))
+		testutil.Equals(t, endpoint, server.Endpoint("http"))
+		testutil.Equals(t, 1, strings.Count(server.Logs().String(), "bye"))
+	})
+	t.Run("network faults", func(t *testing.T) {
+		_, err := server.InjectLatency(time.Second, 0)
+		testutil.NotOk(t, err)
+		_, err = e.Partition(server, server)
+		testutil.NotOk(t, err)
+	})
+	t.Run("build", func(t *testing.T) {
+		testutil.NotOk(t, e.Runnable("built").WithBuild(t.TempDir(), "", nil).Init(e2e.StartOptions{}).BuildErr())
+	})
+
+	job := e.Runnable("job").Init(e2e.StartOptions{
+		Command: processHelperCommand("exit", "3"),
+		EnvVars: map[string]string{processHelperEnv: "1"},
+		Job:     true,
+	})
+	testutil.Ok(t, job.Start())
+	status, err := job.Wait(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, status.ExitCode)
+	testutil.Assert(t, !job.IsRunning())
+
+	crash := e.Runnable("crash").WithPorts(map[string]int{"http": 8080}).Init(e2e.StartOptions{
+		Command:   processHelperCommand("exit", "1"),
+		EnvVars:   map[string]string{processHelperEnv: "1"},
+		Readiness: e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+	})
+	err = e2e.StartAndWaitReady(crash)
+	var terminated *e2e.TerminatedError
+	testutil.Assert(t, errors.As(err, &terminated), "expected TerminatedError, got %v", err)
+	testutil.Equals(t, 1, terminated.Status.ExitCode)
+	testutil.Equals(t, "done", terminated.LastLogs[len(terminated.LastLogs)-1].Text)
+	testutil.Ok(t, crash.Kill())
+
+	testutil.Ok(t, server.Stop())
+	testutil.Assert(t, !server.IsRunning())
+	testutil.Equals(t, "stopped", server.Endpoint("http"))
+}
+
+func TestProcessEnvironment_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	// Runnables are created and used from multiple goroutines, which is meant to be run with -race.
+	runnables := make([]e2e.Runnable, 4)
+	var wg sync.WaitGroup
+	for i := range runnables {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			f := e.Runnable(fmt.Sprintf("server-%d", i)).WithPorts(map[string]int{"http": 8080}).Future()
+			runnables[i] = f.Init(e2e.StartOptions{
+				Command:   processHelperCommand("serve", f.InternalEndpoint("http")),
+				EnvVars:   map[string]string{processHelperEnv: "1"},
+				Readiness: e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	errs := make(chan error, 3*len(runnables))
+	for _, r := range runnables {
+		testutil.Ok(t, r.BuildErr())
+
+		wg.Add(3)
+		go func(r e2e.Runnable) {
+			defer wg.Done()
+			errs <- r.Start()
+		}(r)
+		go func(r e2e.Runnable) {
+			defer wg.Done()
+			errs <- r.Stop()
+		}(r)
+		go func(r e2e.Runnable) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				_ = r.IsRunning()
+				_ = r.Endpoint("http")
+				r.SetMetadata("i", i)
+				_, _ = r.GetMetadata("i")
+			}
+			errs <- nil
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		testutil.Ok(t, err)
+	}
+
+	for _, r := range runnables {
+		testutil.Ok(t, r.Stop())
+		testutil.Assert(t, !r.IsRunning())
+	}
+}
+
+func TestProcessEnvironment_Events(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	var (
+		mtx    sync.Mutex
+		events []e2e.RunnableEvent
+	)
+	e.AddEventListener(e2e.RunnableEventListenerFunc(func(event e2e.RunnableEvent) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		events = append(events, event)
+	}))
+	var crashes []e2e.RunnableEvent
+	e.AddEventListener(e2e.RunnableEventListenerFunc(func(event e2e.RunnableEvent) {
+		crashes = append(crashes, event)
+	}), e2e.RunnableCrashed, e2e.RunnableOOMKilled)
+
+	f := e.Runnable("server").WithPorts(map[string]int{"http": 8080}).Future()
+	server := f.Init(e2e.StartOptions{
+		Command:   processHelperCommand("serve", f.InternalEndpoint("http")),
+		EnvVars:   map[string]string{processHelperEnv: "1"},
+		Readiness: e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+	})
+	testutil.Ok(t, e2e.StartAndWaitReady(server))
+	testutil.NotOk(t, server.Exec(e2e.NewCommand("false")))
+	testutil.Ok(t, server.Stop())
+
+	crash := e.Runnable("crash").WithPorts(map[string]int{"http": 8080}).Init(e2e.StartOptions{
+		Command:   processHelperCommand("exit", "1"),
+		EnvVars:   map[string]string{processHelperEnv: "1"},
+		Readiness: e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+	})
+	testutil.NotOk(t, e2e.StartAndWaitReady(crash))
+	testutil.Ok(t, crash.Kill())
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	var got []string
+	for _, event := range events {
+		testutil.Assert(t, !event.Time.IsZero())
+		got = append(got, event.Runnable.Name()+" "+string(event.Type))
+	}
+	testutil.Equals(t, []string{
+		"server created",
+		"server started",
+		"server ready",
+		"server exec_run",
+		"server stopped",
+		"crash created",
+		"crash started",
+		"crash crashed",
+		"crash killed",
+	}, got)
+
+	exec := events[3]
+	testutil.Equals(t, "false", exec.Command.Cmd)
+	testutil.NotOk(t, exec.Err)
+	testutil.Assert(t, exec.Duration > 0)
+
+	testutil.Equals(t, 1, len(crashes))
+	testutil.Equals(t, 1, crashes[0].Status.ExitCode)
+}
+
+func TestProcessEnvironment_StopCancelled(t *testing.T) {
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	// Server doesn't exit on SIGHUP, so it's stopped only once the grace period passes.
+	f := e.Runnable("server").WithPorts(map[string]int{"http": 8080}).Future()
+	server := f.Init(e2e.StartOptions{
+		Command:         processHelperCommand("serve", f.InternalEndpoint("http")),
+		EnvVars:         map[string]string{processHelperEnv: "1"},
+		Readiness:       e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+		StopSignal:      syscall.SIGHUP,
+		StopGracePeriod: time.Minute,
+	})
+	testutil.Ok(t, e2e.StartAndWaitReady(server))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = server.StopContext(ctx)
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+
+	// Process is killed, so it doesn't outlive the cancelled stop.
+	testutil.Assert(t, !server.IsRunning())
+	_, err = (&http.Client{Timeout: 500 * time.Millisecond}).Get("http://" + f.InternalEndpoint("http") + "/ready")
+	testutil.NotOk(t, err)
+}
+
+func TestProcessEnvironment_Stats(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("stats of processes are supported only on Linux")
+	}
+	t.Parallel()
+
+	e, err := e2e.NewProcessEnvironment()
+	testutil.Ok(t, err)
+	t.Cleanup(e.Close)
+
+	f := e.Runnable("server").WithPorts(map[string]int{"http": 8080}).Future()
+	server := f.Init(e2e.StartOptions{
+		Command:   processHelperCommand("serve", f.InternalEndpoint("http")),
+		EnvVars:   map[string]string{processHelperEnv: "1"},
+		Readiness: e2e.NewHTTPReadinessProbe("http", "/ready", 200, 200),
+	})
+	testutil.Ok(t, e2e.StartAndWaitReady(server))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	stats, err := e2e.WaitStats(ctx, server,
+		e2e.StatGreater(e2e.StatMemoryWorkingSetBytes, 0),
+		e2e.StatGreater(e2e.StatMemoryRSSBytes, 0),
+		e2e.StatGreaterOrEqual(e2e.StatPIDs, 1),
+	)
+	testutil.Ok(t, err)
+	testutil.Assert(t, stats.MemoryRSSBytes <= stats.MemoryWorkingSetBytes, "%+v", stats)
+	// Processes share the host network.
+	testutil.Equals(t, uint64(0), stats.NetworkRxBytes)
+
+	// Expectations that are never met time out.
+	shortCtx, shortCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer shortCancel()
+	_, err = e2e.WaitStats(shortCtx, server, e2e.StatLess(e2e.StatPIDs, 1))
+	testutil.NotOk(t, err)
+
+	testutil.Ok(t, server.Stop())
+	_, err = server.Stats(ctx)
+	testutil.NotOk(t, err)
+}
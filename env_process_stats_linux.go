@@ -0,0 +1,133 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// clockTicksPerSecond is USER_HZ, the unit of CPU times in /proc. It's 100 on all architectures Go supports on Linux.
+const clockTicksPerSecond = 100
+
+// processGroupStats sums resource usage of all processes in the given process group from /proc. Processes share
+// the host network, so network stats are not reported.
+func processGroupStats(pgid int) (RunnableStats, error) {
+	stats, err := processStats(pgid)
+	if err != nil {
+		return RunnableStats{}, err
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return RunnableStats{}, err
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == pgid {
+			continue
+		}
+		s, err := processStats(pid)
+		if err != nil {
+			// Process exited in the meantime.
+			continue
+		}
+		if s.pgrp != pgid {
+			continue
+		}
+		stats.add(s)
+	}
+	return stats.RunnableStats, nil
+}
+
+// waitProcessStopped waits until the process with the given pid is stopped by signal (or exits), for up to a second.
+func waitProcessStopped(pid int) {
+	stat := filepath.Join("/proc", strconv.Itoa(pid), "stat")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		b, err := os.ReadFile(stat)
+		if err != nil {
+			return
+		}
+		// State is the first field after the command name, which can contain spaces and parentheses.
+		i := strings.LastIndexByte(string(b), ')')
+		if i < 0 || i+2 >= len(b) {
+			return
+		}
+		switch b[i+2] {
+		case 'T', 'Z', 'X':
+			return
+		}
+	}
+}
+
+type procStats struct {
+	RunnableStats
+	pgrp int
+}
+
+func (s *procStats) add(o procStats) {
+	s.CPUTime += o.CPUTime
+	s.MemoryRSSBytes += o.MemoryRSSBytes
+	s.MemoryWorkingSetBytes += o.MemoryWorkingSetBytes
+	s.BlockReadBytes += o.BlockReadBytes
+	s.BlockWriteBytes += o.BlockWriteBytes
+	s.PIDs += o.PIDs
+}
+
+// processStats reads resource usage of single process from /proc/<pid>/stat, /proc/<pid>/status and /proc/<pid>/io.
+func processStats(pid int) (procStats, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	b, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return procStats{}, err
+	}
+
+	// Command name can contain spaces and parentheses, so fields are counted from the last closing parenthesis,
+	// starting with the 3rd field (state).
+	i := strings.LastIndexByte(string(b), ')')
+	if i < 0 {
+		return procStats{}, errors.Newf("unexpected content of %s/stat", dir)
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 22 {
+		return procStats{}, errors.Newf("unexpected content of %s/stat", dir)
+	}
+	field := func(n int) uint64 {
+		v, _ := strconv.ParseUint(fields[n-3], 10, 64)
+		return v
+	}
+
+	s := procStats{pgrp: int(field(5))}
+	s.CPUTime = time.Duration(field(14)+field(15)) * time.Second / clockTicksPerSecond
+	// Processes are not in pids cgroup, but like the cgroup, PIDs counts tasks, so threads of every process.
+	s.PIDs = field(20)
+	s.MemoryWorkingSetBytes = field(24) * uint64(os.Getpagesize())
+
+	if b, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if f := strings.Fields(line); len(f) == 3 && f[0] == "RssAnon:" {
+				kb, _ := strconv.ParseUint(f[1], 10, 64)
+				s.MemoryRSSBytes = kb << 10
+			}
+		}
+	}
+	// I/O accounting might not be enabled in the kernel.
+	if b, err := os.ReadFile(filepath.Join(dir, "io")); err == nil {
+		kv := map[string]uint64{}
+		for _, line := range strings.Split(string(b), "\n") {
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				continue
+			}
+			kv[k], _ = strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		}
+		s.BlockReadBytes, s.BlockWriteBytes = kv["read_bytes"], kv["write_bytes"]
+	}
+	return s, nil
+}
@@ -0,0 +1,15 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !linux
+
+package e2e
+
+import "github.com/efficientgo/core/errors"
+
+func processGroupStats(int) (RunnableStats, error) {
+	return RunnableStats{}, errors.New("stats of processes are supported only on Linux")
+}
+
+// waitProcessStopped is no-op, as state of processes can't be observed without /proc.
+func waitProcessStopped(int) {}
@@ -0,0 +1,48 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build !windows
+
+package e2e
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command start in its own process group, so signals reach also its child processes.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends the signal to the process group led by the given process.
+func signalProcessGroup(p *os.Process, sig os.Signal) error {
+	n, err := signalNumber(sig)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-p.Pid, syscall.Signal(n))
+}
+
+func pauseProcessGroup(p *os.Process) error {
+	if err := signalProcessGroup(p, syscall.SIGSTOP); err != nil {
+		return err
+	}
+	// Signal is delivered asynchronously, so the process might still be running for a moment.
+	waitProcessStopped(p.Pid)
+	return nil
+}
+
+func resumeProcessGroup(p *os.Process) error {
+	return signalProcessGroup(p, syscall.SIGCONT)
+}
+
+// processExitCode returns exit code of the process. Like container engines, it reports 128 + signal number for
+// processes terminated by signal.
+func processExitCode(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,35 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+//go:build windows
+
+package e2e
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/efficientgo/core/errors"
+)
+
+func setProcessGroup(*exec.Cmd) {}
+
+// signalProcessGroup kills the process. Other signals are not supported on Windows.
+func signalProcessGroup(p *os.Process, sig os.Signal) error {
+	if sig == os.Kill {
+		return p.Kill()
+	}
+	return errors.Newf("sending signal %v is not supported on windows", sig)
+}
+
+func pauseProcessGroup(*os.Process) error {
+	return errors.New("pausing processes is not supported on windows")
+}
+
+func resumeProcessGroup(*os.Process) error {
+	return errors.New("resuming processes is not supported on windows")
+}
+
+func processExitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
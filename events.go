@@ -0,0 +1,121 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"sync"
+	"time"
+)
+
+// RunnableEventType is the type of lifecycle event of runnable.
+type RunnableEventType string
+
+const (
+	// RunnableCreated is emitted when runnable is created in the environment (see Environment.Runnable).
+	RunnableCreated RunnableEventType = "created"
+	// RunnableImagePulled is emitted when image of the runnable was pulled, because it was not available locally.
+	RunnableImagePulled RunnableEventType = "image_pulled"
+	// RunnableImageBuilt is emitted when image of the runnable was built, because it changed since the last build
+	// (see RunnableBuilder.WithBuild).
+	RunnableImageBuilt RunnableEventType = "image_built"
+	// RunnableStarted is emitted when runnable is started and running.
+	RunnableStarted RunnableEventType = "started"
+	// RunnableReady is emitted when runnable got ready after WaitReady.
+	RunnableReady RunnableEventType = "ready"
+	// RunnableExecRun is emitted when command executed in runnable (see Runnable.Exec) finished.
+	RunnableExecRun RunnableEventType = "exec_run"
+	// RunnableStopped is emitted when runnable was stopped or job runnable exited and was waited for.
+	RunnableStopped RunnableEventType = "stopped"
+	// RunnableKilled is emitted when runnable was killed.
+	RunnableKilled RunnableEventType = "killed"
+	// RunnableCrashed is emitted when runnable terminated, while it was expected to run.
+	RunnableCrashed RunnableEventType = "crashed"
+	// RunnableOOMKilled is emitted instead of RunnableCrashed, when runnable terminated due to exceeding its memory limit.
+	RunnableOOMKilled RunnableEventType = "oom_killed"
+)
+
+// RunnableEvent represents lifecycle event of runnable.
+type RunnableEvent struct {
+	Type     RunnableEventType
+	Runnable Runnable
+	// Time is the time the event happened at.
+	Time time.Time
+	// Duration is the duration of the operation event concludes (e.g. image pull, start, waiting for readiness, exec or stop).
+	// Zero for events that don't conclude any operation.
+	Duration time.Duration
+
+	// Command is the executed command of RunnableExecRun event.
+	Command Command
+	// Err is the error of RunnableExecRun event, if command failed.
+	Err error
+	// Status is the exit status of RunnableCrashed and RunnableOOMKilled events, as well as of RunnableStopped event of jobs.
+	Status ExitStatus
+}
+
+// RunnableEventListener is notified about runnable lifecycle events, see Environment.AddEventListener.
+type RunnableEventListener interface {
+	// OnRunnableEvent is invoked synchronously by the goroutine performing the operation, so it should return quickly.
+	// Events of the same runnable are delivered in order they happened.
+	OnRunnableEvent(event RunnableEvent)
+}
+
+// RunnableEventListenerFunc is an adapter allowing to use ordinary function as RunnableEventListener.
+type RunnableEventListenerFunc func(event RunnableEvent)
+
+func (f RunnableEventListenerFunc) OnRunnableEvent(event RunnableEvent) { f(event) }
+
+// runnableEvents dispatches runnable events to registered listeners.
+type runnableEvents struct {
+	mtx       sync.Mutex
+	listeners []filteredEventListener
+}
+
+type filteredEventListener struct {
+	listener RunnableEventListener
+	// types are the types listener is interested in. All, if empty.
+	types map[RunnableEventType]struct{}
+}
+
+func (e *runnableEvents) add(listener RunnableEventListener, types ...RunnableEventType) {
+	l := filteredEventListener{listener: listener}
+	if len(types) > 0 {
+		l.types = map[RunnableEventType]struct{}{}
+		for _, t := range types {
+			l.types[t] = struct{}{}
+		}
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.listeners = append(e.listeners, l)
+}
+
+// emit notifies listeners interested in the event. Event time defaults to now.
+func (e *runnableEvents) emit(event RunnableEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	e.mtx.Lock()
+	listeners := append([]filteredEventListener{}, e.listeners...)
+	e.mtx.Unlock()
+
+	for _, l := range listeners {
+		if l.types != nil {
+			if _, ok := l.types[event.Type]; !ok {
+				continue
+			}
+		}
+		l.listener.OnRunnableEvent(event)
+	}
+}
+
+// crashEvent returns RunnableCrashed or RunnableOOMKilled event for runnable that terminated with the given status.
+func crashEvent(r Runnable, status ExitStatus) RunnableEvent {
+	t := RunnableCrashed
+	if status.OOMKilled {
+		t = RunnableOOMKilled
+	}
+	return RunnableEvent{Type: t, Runnable: r, Status: status}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// File represents file created in the runnable, see StartOptions.Files.
+type File struct {
+	Content []byte
+	// Mode is the permission mode of the file. Defaults to 0644.
+	Mode os.FileMode
+	// Secret marks sensitive content (e.g. private keys), which Kind environment stores in a Secret instead of ConfigMap.
+	Secret bool
+}
+
+// NewFile returns File with the given content and default mode.
+func NewFile(content []byte) File {
+	return File{Content: content}
+}
+
+func (f File) mode() os.FileMode {
+	if f.Mode == 0 {
+		return 0644
+	}
+	return f.Mode.Perm()
+}
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z\d][a-zA-Z\d_.-]*$`)
+
+// validateMounts returns error if Files, Tmpfs or NamedVolumes of the options are invalid.
+func validateMounts(opts StartOptions) error {
+	for p := range opts.Files {
+		if !path.IsAbs(p) {
+			return errors.Newf("file path %q is not absolute", p)
+		}
+	}
+	for _, p := range opts.Tmpfs {
+		if !path.IsAbs(p) {
+			return errors.Newf("tmpfs path %q is not absolute", p)
+		}
+	}
+	for p, name := range opts.NamedVolumes {
+		if !path.IsAbs(p) {
+			return errors.Newf("path %q of volume %q is not absolute", p, name)
+		}
+		if !volumeNamePattern.MatchString(name) {
+			return errors.Newf("volume name %q has to match %s", name, volumeNamePattern.String())
+		}
+	}
+	return nil
+}
+
+// filePaths returns container paths of the given files in order, so mounts are deterministic.
+func filePaths(files map[string]File) []string {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// volumePaths returns container paths of the given named volumes in order, so mounts are deterministic.
+func volumePaths(volumes map[string]string) []string {
+	paths := make([]string, 0, len(volumes))
+	for p := range volumes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeFiles writes files to dir, each at its container path.
+func writeFiles(dir string, files map[string]File) error {
+	for _, p := range filePaths(files) {
+		hostPath := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(hostPath), 0750); err != nil {
+			return err
+		}
+		// File might be read-only since the previous start.
+		_ = os.Chmod(hostPath, 0600)
+		if err := os.WriteFile(hostPath, files[p].Content, files[p].mode()); err != nil {
+			return errors.Wrapf(err, "write file %s", p)
+		}
+		// Ensure mode of the existing file is updated too.
+		if err := os.Chmod(hostPath, files[p].mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
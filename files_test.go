@@ -0,0 +1,51 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestValidateMounts(t *testing.T) {
+	testutil.Ok(t, validateMounts(StartOptions{
+		Files:        map[string]File{"/etc/app.yaml": NewFile(nil)},
+		Tmpfs:        []string{"/tmp"},
+		NamedVolumes: map[string]string{"/data": "cache-1.0"},
+	}))
+	testutil.NotOk(t, validateMounts(StartOptions{Files: map[string]File{"etc/app.yaml": NewFile(nil)}}))
+	testutil.NotOk(t, validateMounts(StartOptions{Tmpfs: []string{"tmp"}}))
+	testutil.NotOk(t, validateMounts(StartOptions{NamedVolumes: map[string]string{"data": "cache"}}))
+	testutil.NotOk(t, validateMounts(StartOptions{NamedVolumes: map[string]string{"/data": "cache/1"}}))
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]File{
+		"/etc/app.yaml":    NewFile([]byte("a: 1")),
+		"/etc/tls/key.pem": {Content: []byte("key"), Mode: 0400, Secret: true},
+	}
+	testutil.Ok(t, writeFiles(dir, files))
+	// Files are rewritten on restart, even if read-only.
+	files["/etc/tls/key.pem"] = File{Content: []byte("key2"), Mode: 0400}
+	testutil.Ok(t, writeFiles(dir, files))
+
+	b, err := os.ReadFile(filepath.Join(dir, "etc", "app.yaml"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "a: 1", string(b))
+
+	b, err = os.ReadFile(filepath.Join(dir, "etc", "tls", "key.pem"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "key2", string(b))
+
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(filepath.Join(dir, "etc", "tls", "key.pem"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, os.FileMode(0400), fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
+)
+
+// PullPolicy tells when image of the runnable is pulled, see StartOptions.PullPolicy.
+type PullPolicy string
+
+const (
+	// PullIfNotPresent pulls the image only if it's not available locally (nor in the image cache). It's the default.
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullAlways pulls the image on every start, so mutable tags (e.g. `latest`) are up-to-date.
+	PullAlways PullPolicy = "Always"
+	// PullNever never pulls the image. Start fails if the image is not available locally (nor in the image cache).
+	PullNever PullPolicy = "Never"
+)
+
+func (p PullPolicy) validate() error {
+	switch p {
+	case "", PullIfNotPresent, PullAlways, PullNever:
+		return nil
+	}
+	return errors.Newf("unknown pull policy %q; expected %s, %s or %s", p, PullIfNotPresent, PullAlways, PullNever)
+}
+
+const imageCacheEnvName = "E2E_IMAGE_CACHE"
+
+// WithImageCache tells environment to use the given directory as image cache, e.g. for air-gapped CI. Images missing
+// locally are loaded from image tarballs (as created by `docker save`) in the directory instead of pulling, and pulled
+// images are saved there, so the next run doesn't need registry access. It can also be enabled with E2E_IMAGE_CACHE
+// environment variable.
+func WithImageCache(dir string) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.imageCacheDir = dir
+	}
+}
+
+// imageCacheDirectory returns image cache directory, or empty string if images should not be cached.
+func (o environmentOptions) imageCacheDirectory() string {
+	if o.imageCacheDir != "" {
+		return o.imageCacheDir
+	}
+	return os.Getenv(imageCacheEnvName)
+}
+
+// imageCacheFile returns path of the tarball of the given image in the image cache directory. Image reference is
+// escaped, so it's a valid file name on every platform.
+func imageCacheFile(dir, image string) string {
+	return filepath.Join(dir, url.QueryEscape(image)+".tar")
+}
+
+// imageStore is the subset of dockerBackend managing images.
+type imageStore interface {
+	imageExists(ctx context.Context, image string) (bool, error)
+	pullImage(ctx context.Context, image string, progress io.Writer) error
+	loadImage(ctx context.Context, path string) error
+	saveImage(ctx context.Context, image, path string) error
+}
+
+// ensureImage makes the image available in the store according to the pull policy, loading it from the image cache
+// directory (if any) instead of pulling. Pulled images are saved into the cache. It returns true if image was pulled.
+func ensureImage(ctx context.Context, s imageStore, image string, policy PullPolicy, cacheDir string, progress io.Writer) (pulled bool, _ error) {
+	if policy != PullAlways {
+		if ok, err := s.imageExists(ctx, image); err != nil || ok {
+			return false, err
+		}
+		if cacheDir != "" {
+			f := imageCacheFile(cacheDir, image)
+			if _, err := os.Stat(f); err == nil {
+				return false, errors.Wrapf(s.loadImage(ctx, f), "load image %s from %s", image, f)
+			}
+		}
+		if policy == PullNever {
+			return false, errors.Newf("image %s is not available locally and pull policy is %s", image, PullNever)
+		}
+	}
+
+	if err := s.pullImage(ctx, image, progress); err != nil {
+		return false, errors.Wrapf(err, "docker image %s failed to download", image)
+	}
+	if cacheDir == "" {
+		return true, nil
+	}
+	if err := os.MkdirAll(cacheDir, 0750); err != nil {
+		return true, err
+	}
+	// Save to temporary file first, so concurrent runs never load partially written tarball.
+	tmp, err := os.CreateTemp(cacheDir, "save-*.tmp")
+	if err != nil {
+		return true, err
+	}
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if err := s.saveImage(ctx, image, tmp.Name()); err != nil {
+		return true, errors.Wrapf(err, "save image %s to %s", image, cacheDir)
+	}
+	return true, os.Rename(tmp.Name(), imageCacheFile(cacheDir, image))
+}
+
+// prePullParallel invokes pull for all given runnables in parallel and returns combined errors.
+func prePullParallel(runnables []Linkable, pull func(r Linkable) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = merrors.New()
+	)
+	for _, r := range runnables {
+		wg.Add(1)
+		go func(r Linkable) {
+			defer wg.Done()
+
+			if err := pull(r); err != nil {
+				mu.Lock()
+				errs.Add(errors.Wrapf(err, "pre-pull image of %s", r.Name()))
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+	return errs.Err()
+}
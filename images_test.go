@@ -0,0 +1,112 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+// fakeImageStore is imageStore with images kept in memory, recording pulled and loaded images.
+type fakeImageStore struct {
+	images map[string]bool
+	pulled []string
+	loaded []string
+}
+
+func (s *fakeImageStore) imageExists(_ context.Context, image string) (bool, error) {
+	return s.images[image], nil
+}
+
+func (s *fakeImageStore) pullImage(_ context.Context, image string, _ io.Writer) error {
+	if image == "missing" {
+		return errors.New("manifest unknown")
+	}
+	s.images[image] = true
+	s.pulled = append(s.pulled, image)
+	return nil
+}
+
+func (s *fakeImageStore) loadImage(_ context.Context, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s.images[string(b)] = true
+	s.loaded = append(s.loaded, string(b))
+	return nil
+}
+
+func (s *fakeImageStore) saveImage(_ context.Context, image, path string) error {
+	return os.WriteFile(path, []byte(image), 0600)
+}
+
+func TestEnsureImage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("without cache", func(t *testing.T) {
+		s := &fakeImageStore{images: map[string]bool{"local": true}}
+
+		pulled, err := ensureImage(ctx, s, "local", "", "", io.Discard)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !pulled)
+		pulled, err = ensureImage(ctx, s, "remote", PullIfNotPresent, "", io.Discard)
+		testutil.Ok(t, err)
+		testutil.Assert(t, pulled)
+		pulled, err = ensureImage(ctx, s, "local", PullAlways, "", io.Discard)
+		testutil.Ok(t, err)
+		testutil.Assert(t, pulled)
+		testutil.Equals(t, []string{"remote", "local"}, s.pulled)
+
+		_, err = ensureImage(ctx, s, "other", PullNever, "", io.Discard)
+		testutil.NotOk(t, err)
+		_, err = ensureImage(ctx, s, "missing", PullIfNotPresent, "", io.Discard)
+		testutil.NotOk(t, err)
+	})
+	t.Run("with cache", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "images")
+		s := &fakeImageStore{images: map[string]bool{}}
+
+		// Pulled images are saved to the cache.
+		pulled, err := ensureImage(ctx, s, "quay.io/prometheus/prometheus:v2.37.0", PullIfNotPresent, dir, io.Discard)
+		testutil.Ok(t, err)
+		testutil.Assert(t, pulled)
+		b, err := os.ReadFile(imageCacheFile(dir, "quay.io/prometheus/prometheus:v2.37.0"))
+		testutil.Ok(t, err)
+		testutil.Equals(t, "quay.io/prometheus/prometheus:v2.37.0", string(b))
+
+		// Cached images are loaded instead of pulled, also with PullNever.
+		for _, policy := range []PullPolicy{PullIfNotPresent, PullNever} {
+			s = &fakeImageStore{images: map[string]bool{}}
+			pulled, err = ensureImage(ctx, s, "quay.io/prometheus/prometheus:v2.37.0", policy, dir, io.Discard)
+			testutil.Ok(t, err)
+			testutil.Assert(t, !pulled)
+			testutil.Equals(t, []string{"quay.io/prometheus/prometheus:v2.37.0"}, s.loaded)
+			testutil.Equals(t, 0, len(s.pulled))
+		}
+
+		// No temporary files are left behind.
+		entries, err := os.ReadDir(dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(entries))
+	})
+}
+
+func TestImageCacheFile(t *testing.T) {
+	testutil.Equals(t, filepath.Join("cache", "quay.io%2Fthanos%2Fthanos%3Av0.27.0.tar"), imageCacheFile("cache", "quay.io/thanos/thanos:v0.27.0"))
+	testutil.Assert(t, imageCacheFile("cache", "a/b_c") != imageCacheFile("cache", "a_b/c"))
+}
+
+func TestPullPolicy_Validate(t *testing.T) {
+	for _, p := range []PullPolicy{"", PullIfNotPresent, PullAlways, PullNever} {
+		testutil.Ok(t, p.validate())
+	}
+	testutil.NotOk(t, PullPolicy("always").validate())
+}
@@ -16,10 +16,9 @@ import (
 )
 
 // Containerize inspects startFn and builds Go shim with local process endpoint that imports given `startFn` function.
-// Binary is then put in adhoc container and returned as runnable ready to be started.
+// Binary is then put in adhoc container (see RunnableBuilder.WithBuild) and returned as runnable ready to be started.
 func Containerize(e Environment, name string, startFn func(context.Context) error) (Runnable, error) {
-	de, ok := e.(*DockerEnvironment)
-	if !ok {
+	if _, ok := e.(*ProcessEnvironment); ok {
 		return nil, errors.New("not implemented")
 	}
 
@@ -52,8 +51,8 @@ func Containerize(e Environment, name string, startFn func(context.Context) erro
 		return nil, errors.Newf("not a Go module %v", wd)
 	}
 
-	f := e.Runnable(name).WithPorts(map[string]int{"http": 80}).Future()
-	dir := filepath.Join(f.Dir(), "shim")
+	b := e.Runnable(name).WithPorts(map[string]int{"http": 80})
+	dir := filepath.Join(b.Future().Dir(), "shim")
 
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
@@ -70,25 +69,23 @@ func Containerize(e Environment, name string, startFn func(context.Context) erro
 		return nil, err
 	}
 
-	cmd := de.exec("go", "mod", "tidy")
+	cmd := NewCommand("go", "mod", "tidy").exec(context.Background())
 	cmd.Dir = dir
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return nil, errors.Wrap(err, string(out))
 	}
 
-	cmd = de.exec("go", "build", "-o", "exe", "main.go")
+	cmd = NewCommand("go", "build", "-o", "exe", "main.go").exec(context.Background())
 	cmd.Dir = dir
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return nil, errors.Wrap(err, string(out))
 	}
 
-	imageTag := fmt.Sprintf("e2e-local-%v:dynamic", name)
-	cmd = de.exec("docker", "build", "-t", imageTag, ".")
-	cmd.Dir = dir
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, errors.Wrap(err, string(out))
+	r := b.WithBuild(dir, "Dockerfile", nil).Init(StartOptions{})
+	if err := r.BuildErr(); err != nil {
+		return nil, err
 	}
-	return f.Init(StartOptions{Image: imageTag}), nil
+	return r, nil
 }
 
 const (
@@ -0,0 +1,288 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// LogStream identifies the output stream of the runnable.
+type LogStream string
+
+const (
+	LogStreamStdout LogStream = "stdout"
+	LogStreamStderr LogStream = "stderr"
+)
+
+// LogLine represents single line printed by the runnable.
+type LogLine struct {
+	// Offset is the position of the line in the runnable log history. Use it with WithLogLineSince to seek.
+	Offset int
+	Time   time.Time
+	Stream LogStream
+	Text   string
+}
+
+// DefaultLogHistoryLimit is the default maximum number of lines kept in the log history of every runnable.
+const DefaultLogHistoryLimit = 100000
+
+// WithLogHistoryLimit sets the maximum number of lines kept in the log history of every runnable (see Logs). When the
+// limit is reached, the oldest lines are evicted. Zero means DefaultLogHistoryLimit, negative limit keeps all lines.
+func WithLogHistoryLimit(lines int) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.logHistoryLimit = lines
+	}
+}
+
+// logHistoryLimitOrDefault returns maximum number of lines in the log history, or 0 if the history is not limited.
+func (o environmentOptions) logHistoryLimitOrDefault() int {
+	switch {
+	case o.logHistoryLimit == 0:
+		return DefaultLogHistoryLimit
+	case o.logHistoryLimit < 0:
+		return 0
+	}
+	return o.logHistoryLimit
+}
+
+// Logs is a history of lines printed by the runnable to stdout and stderr. History is kept across restarts, up to
+// the limit of lines (see WithLogHistoryLimit), after which the oldest lines are evicted. Offsets of lines never change,
+// so the evicted ones are just no longer returned. It is safe to use concurrently.
+type Logs struct {
+	mtx sync.Mutex
+	// lines is a ring buffer of kept lines. Line with offset o is at lines[o%len(lines)].
+	lines []LogLine
+	// limit is the maximum length of lines, 0 means no limit.
+	limit int
+	// next is the offset of the next line, i.e. the number of lines ever appended.
+	next        int
+	startOffset int
+	// updated is closed (and replaced) every time new line is appended.
+	updated chan struct{}
+}
+
+// newLogs returns empty history keeping up to limit lines. Zero limit means no limit.
+func newLogs(limit int) *Logs {
+	return &Logs{limit: limit, updated: make(chan struct{})}
+}
+
+// Lines returns all lines kept in the history.
+func (l *Logs) Lines() []LogLine {
+	return l.Since(0)
+}
+
+// Since returns all kept lines with offset equal or greater than given one.
+func (l *Logs) Since(offset int) []LogLine {
+	lines, _ := l.since(offset)
+	return lines
+}
+
+// Len returns number of lines ever printed, including evicted ones, which is also the offset of the next line.
+func (l *Logs) Len() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.next
+}
+
+// FirstOffset returns offset of the oldest line kept in the history. Lines with lower offsets were evicted.
+func (l *Logs) FirstOffset() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.firstOffset()
+}
+
+func (l *Logs) firstOffset() int {
+	return l.next - len(l.lines)
+}
+
+// linesFrom returns copy of kept lines starting from the given offset. It has to be called with mtx held.
+func (l *Logs) linesFrom(offset int) []LogLine {
+	if first := l.firstOffset(); offset < first {
+		offset = first
+	}
+	if offset >= l.next {
+		return nil
+	}
+	ret := make([]LogLine, 0, l.next-offset)
+	for o := offset; o < l.next; o++ {
+		ret = append(ret, l.lines[o%len(l.lines)])
+	}
+	return ret
+}
+
+// StartOffset returns offset of the first line printed after the latest start of the runnable.
+func (l *Logs) StartOffset() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.startOffset
+}
+
+// String returns the whole history, one line per line.
+func (l *Logs) String() string {
+	b := strings.Builder{}
+	for _, line := range l.Lines() {
+		b.WriteString(line.Text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (l *Logs) since(offset int) ([]LogLine, <-chan struct{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.linesFrom(offset), l.updated
+}
+
+// lastLines returns up to n last lines printed since the latest start.
+func (l *Logs) lastLines(n int) []LogLine {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	from := l.next - n
+	if from < l.startOffset {
+		from = l.startOffset
+	}
+	return l.linesFrom(from)
+}
+
+// markStart marks the point in the history where the new run of runnable begins.
+func (l *Logs) markStart() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.startOffset = l.next
+}
+
+func (l *Logs) append(stream LogStream, text string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	line := LogLine{Offset: l.next, Time: time.Now(), Stream: stream, Text: text}
+	if l.limit > 0 && len(l.lines) == l.limit {
+		l.lines[l.next%l.limit] = line
+	} else {
+		l.lines = append(l.lines, line)
+	}
+	l.next++
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// writer returns io.Writer that appends written lines to the history. Incomplete lines are buffered until newline or Close.
+func (l *Logs) writer(stream LogStream) io.WriteCloser {
+	return &logsWriter{logs: l, stream: stream}
+}
+
+type logsWriter struct {
+	logs   *Logs
+	stream LogStream
+
+	mtx sync.Mutex
+	buf []byte
+}
+
+func (w *logsWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logs.append(w.stream, strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *logsWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.buf) > 0 {
+		w.logs.append(w.stream, string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+type logLineOptions struct {
+	since  int
+	stream LogStream
+}
+
+// LogLineOption is a variadic option for WaitLogLine.
+type LogLineOption func(*logLineOptions)
+
+// WithLogLineSince makes WaitLogLine look for the line starting from the given offset in the history.
+// By default, lines printed since the latest start of the runnable are considered (see Logs.StartOffset).
+// If lines from the given offset were already evicted from the history, the search starts from the oldest kept line
+// (see Logs.FirstOffset).
+func WithLogLineSince(offset int) LogLineOption {
+	return func(o *logLineOptions) {
+		o.since = offset
+	}
+}
+
+// WithLogLineStream makes WaitLogLine consider only lines printed to the given stream. By default, both are considered.
+func WithLogLineStream(stream LogStream) LogLineOption {
+	return func(o *logLineOptions) {
+		o.stream = stream
+	}
+}
+
+// waitLine waits until line matching given pattern appears in the history. It returns error if context is done or
+// isRunning starts to return false before the line is found. Lines evicted from the history before they are checked
+// are skipped.
+func (l *Logs) waitLine(ctx context.Context, name string, isRunning func() bool, pattern *regexp.Regexp, opts ...LogLineOption) (LogLine, error) {
+	o := logLineOptions{since: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	offset := o.since
+	if offset < 0 {
+		offset = l.StartOffset()
+	}
+
+	// Runnable state is not observable via history, so check it from time to time.
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		lines, updated := l.since(offset)
+		for _, line := range lines {
+			offset = line.Offset + 1
+			if o.stream != "" && line.Stream != o.stream {
+				continue
+			}
+			if pattern.MatchString(line.Text) {
+				return line, nil
+			}
+		}
+
+		if !isRunning() {
+			return LogLine{}, errors.Newf("service %s is stopped; no log line matching %q found", name, pattern.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			return LogLine{}, errors.Wrapf(ctx.Err(), "waiting for log line matching %q in %s", pattern.String(), name)
+		case <-updated:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+func texts(lines []LogLine) []string {
+	var ret []string
+	for _, l := range lines {
+		ret = append(ret, string(l.Stream)+": "+l.Text)
+	}
+	return ret
+}
+
+func TestLogs(t *testing.T) {
+	l := newLogs(0)
+	stdout, stderr := l.writer(LogStreamStdout), l.writer(LogStreamStderr)
+
+	_, err := stdout.Write([]byte("first\nsec"))
+	testutil.Ok(t, err)
+	_, err = stderr.Write([]byte("error\r\n"))
+	testutil.Ok(t, err)
+	_, err = stdout.Write([]byte("ond\nincomplete"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"stdout: first", "stderr: error", "stdout: second"}, texts(l.Lines()))
+
+	testutil.Ok(t, stdout.Close())
+	testutil.Equals(t, 4, l.Len())
+	testutil.Equals(t, []string{"stdout: second", "stdout: incomplete"}, texts(l.Since(2)))
+	testutil.Equals(t, 3, l.Since(3)[0].Offset)
+	testutil.Equals(t, 0, len(l.Since(4)))
+	testutil.Equals(t, "first\nerror\nsecond\nincomplete\n", l.String())
+
+	// Simulate restart.
+	l.markStart()
+	testutil.Equals(t, 4, l.StartOffset())
+	_, err = stdout.Write([]byte("restarted\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"stdout: restarted"}, texts(l.Since(l.StartOffset())))
+}
+
+func TestLogs_Limit(t *testing.T) {
+	l := newLogs(3)
+	w := l.writer(LogStreamStdout)
+	_, err := w.Write([]byte("1\n2\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"stdout: 1", "stdout: 2"}, texts(l.Lines()))
+
+	_, err = w.Write([]byte("3\n4\n5\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, l.Len())
+	testutil.Equals(t, 2, l.FirstOffset())
+	testutil.Equals(t, []string{"stdout: 3", "stdout: 4", "stdout: 5"}, texts(l.Lines()))
+	testutil.Equals(t, []string{"stdout: 4", "stdout: 5"}, texts(l.Since(3)))
+	testutil.Equals(t, 3, l.Since(3)[0].Offset)
+
+	// Evicted lines are not found, even if the offset points to them.
+	l.markStart()
+	_, err = w.Write([]byte("6\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"stdout: 6"}, texts(l.lastLines(5)))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	t.Cleanup(cancel)
+	_, err = l.waitLine(ctx, "test", func() bool { return true }, regexp.MustCompile(`^2$`), WithLogLineSince(0))
+	testutil.NotOk(t, err)
+	line, err := l.waitLine(context.Background(), "test", func() bool { return true }, regexp.MustCompile(`^4$`), WithLogLineSince(0))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, line.Offset)
+
+	testutil.Equals(t, DefaultLogHistoryLimit, environmentOptions{}.logHistoryLimitOrDefault())
+	testutil.Equals(t, 0, environmentOptions{logHistoryLimit: -1}.logHistoryLimitOrDefault())
+}
+
+func TestLogs_WaitLine(t *testing.T) {
+	l := newLogs(0)
+	w := l.writer(LogStreamStderr)
+	_, err := w.Write([]byte("level=info msg=\"starting\"\n"))
+	testutil.Ok(t, err)
+
+	running := func() bool { return true }
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("level=info msg=\"ready\"\n"))
+	}()
+	line, err := l.waitLine(ctx, "test", running, regexp.MustCompile(`msg="ready"`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, line.Offset)
+	testutil.Equals(t, LogStreamStderr, line.Stream)
+
+	// Already printed lines are found too, unless offset or stream says otherwise.
+	line, err = l.waitLine(ctx, "test", running, regexp.MustCompile(`starting`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, line.Offset)
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	t.Cleanup(shortCancel)
+	_, err = l.waitLine(shortCtx, "test", running, regexp.MustCompile(`starting`), WithLogLineSince(1))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded))
+
+	shortCtx, shortCancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	t.Cleanup(shortCancel)
+	_, err = l.waitLine(shortCtx, "test", running, regexp.MustCompile(`starting`), WithLogLineStream(LogStreamStdout))
+	testutil.NotOk(t, err)
+
+	// Stopped runnable won't print anything anymore.
+	_, err = l.waitLine(ctx, "test", func() bool { return false }, regexp.MustCompile(`never`))
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "service test is stopped; no log line matching \"never\" found", err.Error())
+}
+
+func TestTerminatedError(t *testing.T) {
+	l := newLogs(0)
+	w := l.writer(LogStreamStdout)
+	_, err := w.Write([]byte("previous run\n"))
+	testutil.Ok(t, err)
+	l.markStart()
+	for i := 0; i < terminatedErrorLogLines+2; i++ {
+		_, err = w.Write([]byte("line\n"))
+		testutil.Ok(t, err)
+	}
+	_, err = w.Write([]byte("flag provided but not defined: -typo\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, terminatedErrorLogLines, len(l.lastLines(terminatedErrorLogLines)))
+	testutil.Equals(t, []string{"stdout: line", "stdout: flag provided but not defined: -typo"}, texts(l.lastLines(2)))
+
+	l.markStart()
+	_, err = w.Write([]byte("boom\n"))
+	testutil.Ok(t, err)
+	terr := &TerminatedError{Name: "app", Status: ExitStatus{ExitCode: 137, OOMKilled: true}, LastLogs: l.lastLines(terminatedErrorLogLines)}
+	testutil.Equals(t, "service app terminated with exit code 137 (OOM killed); last logs:\n\tboom", terr.Error())
+
+	var target *TerminatedError
+	testutil.Assert(t, errors.As(errors.Wrap(terr, "start"), &target))
+	testutil.Equals(t, 137, target.Status.ExitCode)
+}
@@ -0,0 +1,30 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2emon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/efficientgo/e2e"
+)
+
+func init() {
+	e2e.AddArtifactCollector("e2emon.metrics", collectMetrics)
+}
+
+// collectMetrics writes current metrics of the running instrumented runnable into metrics.txt.
+func collectMetrics(_ context.Context, r e2e.Runnable, dir string) error {
+	instr, ok := r.GetMetadata(metaKey)
+	if !ok || !r.IsRunning() {
+		return nil
+	}
+
+	metrics, err := instr.(Instrumented).Metrics()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "metrics.txt"), []byte(metrics), 0644)
+}
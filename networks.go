@@ -0,0 +1,152 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"net"
+	"regexp"
+	"sort"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// Network describes extra network of the environment, see WithNetworks.
+type Network struct {
+	// Name identifies the network in StartOptions.Networks. The engine network is named `<environment name>-<name>`.
+	// It has to start with a letter or digit, followed by letters, digits, `_`, `.` or `-`.
+	Name string
+	// Subnet is the IPv4 subnet of the network in CIDR notation (e.g. `172.30.0.0/24`). Engine picks one, if empty.
+	// It's required for static IPv4 addresses of runnables.
+	Subnet string
+	// IPv6Subnet enables IPv6 in the network with the given subnet in CIDR notation (e.g. `fd00:e2e::/64`).
+	IPv6Subnet string
+	// Internal isolates the network from the outside world, e.g. to model backend network reachable only through DMZ.
+	Internal bool
+}
+
+// WithNetworks tells environment to create the given networks in addition to the default one, named after the
+// environment. Runnables are attached to them with StartOptions.Networks. Supported only by docker and podman
+// environments.
+func WithNetworks(networks ...Network) EnvironmentOption {
+	return func(o *environmentOptions) {
+		o.networks = append(o.networks, networks...)
+	}
+}
+
+// NetworkAttachment configures how runnable is attached to the network, see StartOptions.Networks.
+type NetworkAttachment struct {
+	// Aliases are additional DNS names of the runnable in the network, e.g. stable host names without the environment
+	// prefix expected by clients.
+	Aliases []string
+	// IPv4Address is the static IPv4 address of the runnable in the network. It requires Network.Subnet.
+	IPv4Address string
+	// IPv6Address is the static IPv6 address of the runnable in the network. It requires Network.IPv6Subnet.
+	IPv6Address string
+}
+
+// errNetworksNotSupported is returned by environments that can't attach runnables to extra networks.
+var errNetworksNotSupported = errors.New("extra networks are supported only by docker and podman environments")
+
+// networkNamePattern matches names of extra networks, which are valid engine network names once prefixed with the
+// environment name.
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z\d][a-zA-Z\d_.-]*$`)
+
+// validateNetworks returns error if extra networks of the environment with the given name are invalid.
+func validateNetworks(envName string, networks []Network) error {
+	names := map[string]struct{}{envName: {}}
+	for _, n := range networks {
+		if !networkNamePattern.MatchString(n.Name) {
+			return errors.Newf("network name %q has to match %s", n.Name, networkNamePattern.String())
+		}
+		if _, ok := names[n.Name]; ok {
+			return errors.Newf("network %q is declared more than once or collides with the default network", n.Name)
+		}
+		names[n.Name] = struct{}{}
+
+		if n.Subnet != "" {
+			if ip, _, err := net.ParseCIDR(n.Subnet); err != nil || ip.To4() == nil {
+				return errors.Newf("subnet %q of network %q is not IPv4 CIDR", n.Subnet, n.Name)
+			}
+		}
+		if n.IPv6Subnet != "" {
+			if ip, _, err := net.ParseCIDR(n.IPv6Subnet); err != nil || ip.To4() != nil {
+				return errors.Newf("IPv6 subnet %q of network %q is not IPv6 CIDR", n.IPv6Subnet, n.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNetworkAttachments returns error if attachments refer to unknown networks or their addresses don't fit
+// subnets of the networks. Attachment named after the environment refers to its default network.
+func validateNetworkAttachments(envName string, networks []Network, attachments map[string]NetworkAttachment) error {
+	for name, a := range attachments {
+		n, ok := Network{Name: envName}, name == envName
+		for _, extra := range networks {
+			if extra.Name == name {
+				n, ok = extra, true
+			}
+		}
+		if !ok {
+			return errors.Newf("network %q is not declared; use WithNetworks to declare it", name)
+		}
+
+		for _, alias := range a.Aliases {
+			if alias == "" {
+				return errors.Newf("empty alias in network %q", name)
+			}
+		}
+		if err := validateAddress(a.IPv4Address, n.Subnet, false); err != nil {
+			return errors.Wrapf(err, "network %q", name)
+		}
+		if err := validateAddress(a.IPv6Address, n.IPv6Subnet, true); err != nil {
+			return errors.Wrapf(err, "network %q", name)
+		}
+	}
+	return nil
+}
+
+// validateAddress returns error if the static address, if any, is not within the subnet.
+func validateAddress(addr, subnet string, ipv6 bool) error {
+	if addr == "" {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil || (ip.To4() == nil) != ipv6 {
+		return errors.Newf("invalid address %q", addr)
+	}
+	if subnet == "" {
+		return errors.Newf("static address %s requires subnet of the network", addr)
+	}
+	// Subnet was validated already.
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	if !ipNet.Contains(ip) {
+		return errors.Newf("address %s is not within subnet %s", addr, subnet)
+	}
+	return nil
+}
+
+// attachedNetworks returns names of networks in attachments in order they are connected: the default network (named
+// after the environment) first, if present, and the rest sorted, so specs are deterministic.
+func attachedNetworks(envName string, attachments map[string]NetworkAttachment) []string {
+	names := make([]string, 0, len(attachments))
+	for name := range attachments {
+		if name != envName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := attachments[envName]; ok {
+		names = append([]string{envName}, names...)
+	}
+	return names
+}
+
+// dockerNetworkName returns name of the engine network for the network of the environment with the given name.
+func dockerNetworkName(envName, network string) string {
+	if network == envName {
+		return envName
+	}
+	return envName + "-" + network
+}
@@ -0,0 +1,52 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestValidateNetworks(t *testing.T) {
+	testutil.Ok(t, validateNetworks("e2e-test", []Network{
+		{Name: "frontend"},
+		{Name: "backend", Subnet: "172.30.0.0/24", IPv6Subnet: "fd00:e2e::/64", Internal: true},
+	}))
+
+	err := validateNetworks("e2e-test", []Network{{Name: "back/end"}})
+	testutil.NotOk(t, err)
+	testutil.Equals(t, `network name "back/end" has to match ^[a-zA-Z\d][a-zA-Z\d_.-]*$`, err.Error())
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "-backend"}}))
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "backend"}, {Name: "backend"}}))
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "e2e-test"}}))
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "backend", Subnet: "172.30.0.0"}}))
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "backend", Subnet: "fd00:e2e::/64"}}))
+	testutil.NotOk(t, validateNetworks("e2e-test", []Network{{Name: "backend", IPv6Subnet: "172.30.0.0/24"}}))
+}
+
+func TestValidateNetworkAttachments(t *testing.T) {
+	networks := []Network{{Name: "backend", Subnet: "172.30.0.0/24", IPv6Subnet: "fd00:e2e::/64"}, {Name: "frontend"}}
+
+	testutil.Ok(t, validateNetworkAttachments("e2e-test", networks, nil))
+	testutil.Ok(t, validateNetworkAttachments("e2e-test", networks, map[string]NetworkAttachment{
+		"e2e-test": {Aliases: []string{"app"}},
+		"backend":  {IPv4Address: "172.30.0.10", IPv6Address: "fd00:e2e::10"},
+		"frontend": {Aliases: []string{"api"}},
+	}))
+
+	for _, attachments := range []map[string]NetworkAttachment{
+		{"missing": {}},
+		{"backend": {Aliases: []string{""}}},
+		{"backend": {IPv4Address: "172.31.0.10"}},
+		{"backend": {IPv4Address: "fd00:e2e::10"}},
+		{"backend": {IPv6Address: "172.30.0.10"}},
+		{"backend": {IPv4Address: "invalid"}},
+		// Static addresses require subnet of the network.
+		{"frontend": {IPv4Address: "172.30.0.10"}},
+		{"e2e-test": {IPv4Address: "172.30.0.10"}},
+	} {
+		testutil.NotOk(t, validateNetworkAttachments("e2e-test", networks, attachments), "%v", attachments)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// Protocol is the transport protocol of the port, see PortSpec.
+type Protocol string
+
+const (
+	// TCP is the default protocol of ports.
+	TCP Protocol = "tcp"
+	// UDP is the protocol of e.g. DNS servers, statsd or Jaeger agent ports.
+	UDP Protocol = "udp"
+)
+
+// PortSpec describes port of the runnable, see RunnableBuilder.WithPortSpecs.
+type PortSpec struct {
+	// Port is the port runnable listens on. Process environment allocates it on the host if it's free, and a random
+	// free local port otherwise, unless HostPort is set.
+	Port int
+	// Protocol of the port. Defaults to TCP.
+	Protocol Protocol
+	// HostPort is the fixed host port the port is published on. Random free port is used, if zero. Kind environment
+	// uses it as node port, so it has to be within the node port range of the cluster (30000-32767 by default).
+	HostPort int
+	// HostIP is the host address the port is published on, e.g. `127.0.0.1` to keep it private. All interfaces, if
+	// empty. Endpoint returns this address, unless it's unspecified (e.g. `0.0.0.0`). Supported only by docker and
+	// podman environments.
+	HostIP string
+}
+
+// TCPPort returns spec of TCP port published on random host port, as declared with RunnableBuilder.WithPorts.
+func TCPPort(port int) PortSpec {
+	return PortSpec{Port: port, Protocol: TCP}
+}
+
+// UDPPort returns spec of UDP port published on random host port.
+func UDPPort(port int) PortSpec {
+	return PortSpec{Port: port, Protocol: UDP}
+}
+
+func (p PortSpec) protocol() Protocol {
+	if p.Protocol == "" {
+		return TCP
+	}
+	return p.Protocol
+}
+
+// endpointHost returns host address Endpoint should use for the port, or empty string if it's published on all
+// interfaces.
+func (p PortSpec) endpointHost() string {
+	if ip := net.ParseIP(p.HostIP); ip != nil && !ip.IsUnspecified() {
+		return p.HostIP
+	}
+	return ""
+}
+
+// tcpPortSpecs returns specs of TCP ports with the given numbers, see RunnableBuilder.WithPorts.
+func tcpPortSpecs(ports map[string]int) map[string]PortSpec {
+	specs := make(map[string]PortSpec, len(ports))
+	for name, port := range ports {
+		specs[name] = TCPPort(port)
+	}
+	return specs
+}
+
+// validatePortSpecs returns error if any of the port specs is invalid.
+func validatePortSpecs(ports map[string]PortSpec) error {
+	for name, p := range ports {
+		if p.Port <= 0 || p.Port > 65535 {
+			return errors.Newf("port %q: invalid port %d", name, p.Port)
+		}
+		if p.HostPort < 0 || p.HostPort > 65535 {
+			return errors.Newf("port %q: invalid host port %d", name, p.HostPort)
+		}
+		if p := p.protocol(); p != TCP && p != UDP {
+			return errors.Newf("port %q: unknown protocol %q; expected %s or %s", name, p, TCP, UDP)
+		}
+		if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+			return errors.Newf("port %q: invalid host IP %q", name, p.HostIP)
+		}
+	}
+	return nil
+}
+
+// endpointAddress returns host:port address of the given port of the host, preferring host IP of the port spec.
+func endpointAddress(host string, spec PortSpec, port int) string {
+	if h := spec.endpointHost(); h != "" {
+		host = h
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
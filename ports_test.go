@@ -0,0 +1,35 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestValidatePortSpecs(t *testing.T) {
+	testutil.Ok(t, validatePortSpecs(map[string]PortSpec{
+		"http":    {Port: 80},
+		"dns":     UDPPort(53),
+		"metrics": {Port: 8125, Protocol: UDP, HostPort: 8125, HostIP: "127.0.0.1"},
+	}))
+
+	for _, p := range []PortSpec{
+		{},
+		{Port: 70000},
+		{Port: 80, HostPort: -1},
+		{Port: 80, Protocol: "sctp"},
+		{Port: 80, HostIP: "localhost"},
+	} {
+		testutil.NotOk(t, validatePortSpecs(map[string]PortSpec{"p": p}), "%v", p)
+	}
+}
+
+func TestEndpointAddress(t *testing.T) {
+	testutil.Equals(t, "127.0.0.1:32768", endpointAddress("127.0.0.1", TCPPort(80), 32768))
+	testutil.Equals(t, "127.0.0.1:32768", endpointAddress("127.0.0.1", PortSpec{Port: 80, HostIP: "0.0.0.0"}, 32768))
+	testutil.Equals(t, "192.168.1.2:8125", endpointAddress("127.0.0.1", PortSpec{Port: 8125, Protocol: UDP, HostIP: "192.168.1.2"}, 8125))
+	testutil.Equals(t, "[::1]:9411", endpointAddress("127.0.0.1", PortSpec{Port: 9411, HostIP: "::1"}, 9411))
+}
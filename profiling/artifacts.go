@@ -0,0 +1,70 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2eprof
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/e2e"
+)
+
+func init() {
+	e2e.AddArtifactCollector("e2eprof.pprof", collectProfiles)
+}
+
+// collectProfiles writes heap and goroutine profiles of the running profiled runnable into heap.pprof and goroutine.pprof.
+func collectProfiles(ctx context.Context, r e2e.Runnable, dir string) error {
+	p, ok := r.GetMetadata(metaKey)
+	if !ok || !r.IsRunning() {
+		return nil
+	}
+	profiled, ok := p.(*ProfiledRunnable)
+	if !ok {
+		return nil
+	}
+
+	client := http.DefaultClient
+	if profiled.scheme == "https" {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
+	for _, profile := range []string{"heap", "goroutine"} {
+		url := profiled.scheme + "://" + r.Endpoint(profiled.pprofPort) + "/debug/pprof/" + profile
+		if err := fetchProfile(ctx, client, url, filepath.Join(dir, profile+".pprof")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fetchProfile(ctx context.Context, client *http.Client, url, path string) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer errcapture.ExhaustClose(&err, res.Body, "profile response")
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Newf("unexpected status code %d while fetching %s", res.StatusCode, url)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer errcapture.Do(&err, f.Close, "close profile file")
+
+	_, err = io.Copy(f, res.Body)
+	return err
+}
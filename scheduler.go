@@ -0,0 +1,168 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/merrors"
+)
+
+type scheduledRunnable struct {
+	Runnable
+
+	// prev is the runnable without declared dependencies passed right before this one, if this one has no declared
+	// dependencies either. It has to be ready before this one starts, as StartAndWaitReady used to be sequential.
+	prev *scheduledRunnable
+
+	// done is closed once runnable is ready or failed.
+	done chan struct{}
+	err  error
+}
+
+// errPredecessorFailed is returned by runnables not started because preceding runnable failed. It's not reported,
+// the same as when StartAndWaitReady was sequential.
+var errPredecessorFailed = errors.New("preceding runnable failed")
+
+// StartAndWaitReadyContext is like StartAndWaitReady, but it returns early with error when the given context is done.
+func StartAndWaitReadyContext(ctx context.Context, runnables ...Runnable) error {
+	scheduled := make(map[string]*scheduledRunnable, len(runnables))
+	var prev *scheduledRunnable
+	for _, r := range runnables {
+		if _, ok := scheduled[r.Name()]; ok {
+			return errors.Newf("runnable %q was passed more than once", r.Name())
+		}
+		s := &scheduledRunnable{Runnable: r, done: make(chan struct{})}
+		if len(r.Dependencies()) == 0 {
+			// Runnables with dependencies are never predecessors, so this doesn't introduce cycles.
+			s.prev, prev = prev, s
+		}
+		scheduled[r.Name()] = s
+	}
+	if err := validateDependencies(scheduled); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = merrors.New()
+	)
+	for _, r := range runnables {
+		wg.Add(1)
+		go func(s *scheduledRunnable) {
+			defer wg.Done()
+
+			s.err = startAfterDependencies(ctx, s, scheduled)
+			// Don't report runnables interrupted only because some other runnable failed.
+			if s.err != nil && s.err != errPredecessorFailed && (ctx.Err() == nil || !errors.Is(s.err, context.Canceled)) {
+				mu.Lock()
+				errs.Add(s.err)
+				mu.Unlock()
+			}
+			// Dependents have to see the failure before the interruption.
+			close(s.done)
+			if s.err != nil {
+				cancel()
+			}
+		}(scheduled[r.Name()])
+	}
+	wg.Wait()
+
+	if err := errs.Err(); err != nil {
+		return err
+	}
+	// All runnables could be interrupted by the parent context.
+	return ctx.Err()
+}
+
+func startAfterDependencies(ctx context.Context, s *scheduledRunnable, scheduled map[string]*scheduledRunnable) error {
+	if s.prev != nil {
+		if err := waitDone(ctx, s.prev); err != nil {
+			return errors.Wrapf(err, "waiting for %q preceding %q", s.prev.Name(), s.Name())
+		}
+		if s.prev.err != nil {
+			return errPredecessorFailed
+		}
+	}
+	for _, dep := range s.Dependencies() {
+		d, ok := scheduled[dep.Name()]
+		if !ok {
+			// Dependency is not started by this call, so it's managed by the caller, e.g. started earlier, started
+			// later by the runnable itself or running outside the environment.
+			continue
+		}
+
+		if err := waitDone(ctx, d); err != nil {
+			return errors.Wrapf(err, "waiting for dependency %q of %q", dep.Name(), s.Name())
+		}
+		if d.err != nil {
+			return errors.Newf("dependency %q of %q failed", dep.Name(), s.Name())
+		}
+	}
+
+	if err := s.StartContext(ctx); err != nil {
+		return err
+	}
+	return s.WaitReadyContext(ctx)
+}
+
+// waitDone waits until the scheduled runnable is ready or failed. It returns error if the context is done first.
+func waitDone(ctx context.Context, s *scheduledRunnable) error {
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		select {
+		case <-s.done:
+			return nil
+		default:
+			return ctx.Err()
+		}
+	}
+}
+
+// validateDependencies returns error if scheduled runnables have cyclic dependencies.
+func validateDependencies(scheduled map[string]*scheduledRunnable) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(scheduled))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return errors.Newf("cyclic dependency between runnables: %v", append(path, name))
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, dep := range scheduled[name].Dependencies() {
+			if _, ok := scheduled[dep.Name()]; !ok {
+				continue
+			}
+			if err := visit(dep.Name(), append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for name := range scheduled {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+)
+
+type fakeRunnable struct {
+	Runnable
+
+	name     string
+	deps     []Linkable
+	startErr error
+	readyErr error
+
+	mu      *sync.Mutex
+	events  *[]string
+	running bool
+}
+
+func (f *fakeRunnable) Name() string             { return f.name }
+func (f *fakeRunnable) Dependencies() []Linkable { return f.deps }
+
+func (f *fakeRunnable) IsRunning() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running
+}
+
+func (f *fakeRunnable) StartContext(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*f.events = append(*f.events, "start "+f.name)
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.running = true
+	return nil
+}
+
+func (f *fakeRunnable) WaitReadyContext(context.Context) error {
+	// Give dependents a chance to start too early, if scheduler would be broken.
+	time.Sleep(10 * time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.readyErr != nil {
+		return f.readyErr
+	}
+	*f.events = append(*f.events, "ready "+f.name)
+	return nil
+}
+
+func newFakeRunnables(names ...string) (map[string]*fakeRunnable, *[]string) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	ret := map[string]*fakeRunnable{}
+	for _, n := range names {
+		ret[n] = &fakeRunnable{name: n, mu: &mu, events: &events}
+	}
+	return ret, &events
+}
+
+func indexOf(events []string, event string) int {
+	for i, e := range events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestStartAndWaitReady(t *testing.T) {
+	t.Run("dependencies are ready before dependents start", func(t *testing.T) {
+		r, events := newFakeRunnables("db", "cache", "app", "frontend")
+		r["app"].deps = []Linkable{r["db"], r["cache"]}
+		r["frontend"].deps = []Linkable{r["app"]}
+
+		testutil.Ok(t, StartAndWaitReady(r["frontend"], r["app"], r["cache"], r["db"]))
+		testutil.Equals(t, 8, len(*events))
+		testutil.Assert(t, indexOf(*events, "ready db") < indexOf(*events, "start app"))
+		testutil.Assert(t, indexOf(*events, "ready cache") < indexOf(*events, "start app"))
+		testutil.Assert(t, indexOf(*events, "ready app") < indexOf(*events, "start frontend"))
+	})
+	t.Run("failed dependency is reported with the edge and dependents are not started", func(t *testing.T) {
+		r, events := newFakeRunnables("db", "app")
+		r["db"].readyErr = errors.New("db not ready")
+		r["app"].deps = []Linkable{r["db"]}
+
+		err := StartAndWaitReady(r["app"], r["db"])
+		testutil.NotOk(t, err)
+		testutil.Assert(t, indexOf(*events, "start app") == -1)
+		testutil.Equals(t, "2 errors: db not ready; dependency \"db\" of \"app\" failed", err.Error())
+	})
+	t.Run("dependency outside of scheduled runnables is satisfied", func(t *testing.T) {
+		r, events := newFakeRunnables("db", "app")
+		r["app"].deps = []Linkable{r["db"]}
+
+		// Dependency is managed by the caller, e.g. it's started later or runs outside the environment.
+		testutil.Ok(t, StartAndWaitReady(r["app"]))
+		testutil.Equals(t, []string{"start app", "ready app"}, *events)
+		testutil.Assert(t, !r["db"].IsRunning())
+	})
+	t.Run("runnables without dependencies are started in order", func(t *testing.T) {
+		r, events := newFakeRunnables("a", "b", "c")
+
+		testutil.Ok(t, StartAndWaitReady(r["c"], r["a"], r["b"]))
+		testutil.Equals(t, []string{"start c", "ready c", "start a", "ready a", "start b", "ready b"}, *events)
+	})
+	t.Run("runnables without dependencies are not started after failure", func(t *testing.T) {
+		r, events := newFakeRunnables("a", "b")
+		r["a"].startErr = errors.New("a failed")
+
+		err := StartAndWaitReady(r["a"], r["b"])
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "a failed", err.Error())
+		testutil.Equals(t, []string{"start a"}, *events)
+	})
+	t.Run("runnables with dependencies don't wait for preceding ones", func(t *testing.T) {
+		r, events := newFakeRunnables("prom", "sidecar", "minio")
+		r["sidecar"].deps = []Linkable{r["prom"]}
+
+		// Sidecar passed before its dependency doesn't block it.
+		testutil.Ok(t, StartAndWaitReady(r["sidecar"], r["prom"], r["minio"]))
+		testutil.Equals(t, 6, len(*events))
+		testutil.Assert(t, indexOf(*events, "ready prom") < indexOf(*events, "start sidecar"))
+		testutil.Assert(t, indexOf(*events, "ready prom") < indexOf(*events, "start minio"))
+	})
+	t.Run("cyclic dependencies", func(t *testing.T) {
+		r, events := newFakeRunnables("a", "b")
+		r["a"].deps = []Linkable{r["b"]}
+		r["b"].deps = []Linkable{r["a"]}
+
+		err := StartAndWaitReady(r["a"], r["b"])
+		testutil.NotOk(t, err)
+		testutil.Equals(t, 0, len(*events))
+	})
+	t.Run("cancelled context", func(t *testing.T) {
+		r, _ := newFakeRunnables("db", "app")
+		r["app"].deps = []Linkable{r["db"]}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		testutil.NotOk(t, StartAndWaitReadyContext(ctx, r["app"], r["db"]))
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/backoff"
+	"github.com/efficientgo/core/errors"
+)
+
+// RunnableStats represents resource usage of the running runnable, see Runnable.Stats.
+//
+// Stats not reported by the environment are zero, and the environment logs which ones once:
+//   - Docker environment using the docker CLI (the default) doesn't report CPUTime and MemoryRSSBytes, as `docker stats`
+//     doesn't. Use WithDockerEngineAPI to get them.
+//   - Podman environment doesn't report MemoryRSSBytes, as `podman stats` doesn't.
+//   - Process environment doesn't report network stats, as processes share the host network.
+//
+// Expectations on stats that are not reported (see WaitStats) are never met.
+type RunnableStats struct {
+	// CPUTime is the total (user and system) CPU time consumed since the start. Not reported by docker CLI.
+	CPUTime time.Duration
+	// MemoryRSSBytes is the anonymous memory (resident set size without page cache) in use. Not reported by docker
+	// and podman CLIs.
+	MemoryRSSBytes uint64
+	// MemoryWorkingSetBytes is the memory in use without inactive page cache. Memory limit is enforced against it,
+	// the same as `container_memory_working_set_bytes` of cadvisor.
+	MemoryWorkingSetBytes uint64
+	// NetworkRxBytes and NetworkTxBytes are the total bytes received and transmitted over all network interfaces.
+	// They are zero for runnables sharing the host network.
+	NetworkRxBytes uint64
+	NetworkTxBytes uint64
+	// BlockReadBytes and BlockWriteBytes are the total bytes read from and written to block devices.
+	BlockReadBytes  uint64
+	BlockWriteBytes uint64
+	// PIDs is the number of tasks (processes and their threads) running, as counted by pids cgroup controller. Process
+	// environment counts threads of all processes in the process group of the runnable instead, which is the same for
+	// runnables without other processes in their process group.
+	PIDs uint64
+}
+
+// Stat returns single value of resource usage stats, e.g. StatMemoryWorkingSetBytes.
+type Stat func(s RunnableStats) float64
+
+var (
+	StatCPUSeconds            Stat = func(s RunnableStats) float64 { return s.CPUTime.Seconds() }
+	StatMemoryRSSBytes        Stat = func(s RunnableStats) float64 { return float64(s.MemoryRSSBytes) }
+	StatMemoryWorkingSetBytes Stat = func(s RunnableStats) float64 { return float64(s.MemoryWorkingSetBytes) }
+	StatNetworkRxBytes        Stat = func(s RunnableStats) float64 { return float64(s.NetworkRxBytes) }
+	StatNetworkTxBytes        Stat = func(s RunnableStats) float64 { return float64(s.NetworkTxBytes) }
+	StatBlockReadBytes        Stat = func(s RunnableStats) float64 { return float64(s.BlockReadBytes) }
+	StatBlockWriteBytes       Stat = func(s RunnableStats) float64 { return float64(s.BlockWriteBytes) }
+	StatPIDs                  Stat = func(s RunnableStats) float64 { return float64(s.PIDs) }
+)
+
+// StatsExpectation returns true if resource usage stats are as expected, see WaitStats.
+type StatsExpectation func(s RunnableStats) bool
+
+// StatEquals is a StatsExpectation for WaitStats that returns true if given stat equals to given value.
+func StatEquals(stat Stat, value float64) StatsExpectation {
+	return func(s RunnableStats) bool { return stat(s) == value }
+}
+
+// StatGreater is a StatsExpectation for WaitStats that returns true if given stat is greater than given value.
+func StatGreater(stat Stat, value float64) StatsExpectation {
+	return func(s RunnableStats) bool { return stat(s) > value }
+}
+
+// StatGreaterOrEqual is a StatsExpectation for WaitStats that returns true if given stat is greater or equal than given value.
+func StatGreaterOrEqual(stat Stat, value float64) StatsExpectation {
+	return func(s RunnableStats) bool { return stat(s) >= value }
+}
+
+// StatLess is a StatsExpectation for WaitStats that returns true if given stat is less than given value.
+func StatLess(stat Stat, value float64) StatsExpectation {
+	return func(s RunnableStats) bool { return stat(s) < value }
+}
+
+// StatBetween is a StatsExpectation for WaitStats that returns true if given stat is between the lower and upper
+// bounds (non-inclusive, as in `lower < x < upper`).
+func StatBetween(stat Stat, lower, upper float64) StatsExpectation {
+	return func(s RunnableStats) bool { return stat(s) > lower && stat(s) < upper }
+}
+
+// WaitStats polls resource usage stats of the runnable until they meet all given expectations, and returns them.
+// It gives up once the context is done.
+func WaitStats(ctx context.Context, r Runnable, expected ...StatsExpectation) (RunnableStats, error) {
+	var (
+		stats RunnableStats
+		err   error
+	)
+	for b := backoff.New(ctx, backoff.Config{Min: 300 * time.Millisecond, Max: 1 * time.Second}); b.Ongoing(); b.Wait() {
+		stats, err = r.Stats(ctx)
+		if err != nil {
+			continue
+		}
+		if statsExpected(stats, expected) {
+			return stats, nil
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return stats, errors.Wrapf(err, "unable to get expected stats of %s; last stats: %+v", r.Name(), stats)
+}
+
+func statsExpected(stats RunnableStats, expected []StatsExpectation) bool {
+	for _, e := range expected {
+		if !e(stats) {
+			return false
+		}
+	}
+	return true
+}
+
+// cgroupMemory returns RSS and working set from the memory usage and memory.stat entries of cgroup. Entries
+// differ between cgroup v1 and v2, so both are handled.
+func cgroupMemory(usage uint64, stat map[string]uint64) (rss, workingSet uint64) {
+	rss = stat["anon"]
+	if v, ok := stat["total_rss"]; ok {
+		rss = v
+	} else if v, ok := stat["rss"]; ok {
+		rss = v
+	}
+
+	inactiveFile := stat["inactive_file"]
+	if v, ok := stat["total_inactive_file"]; ok {
+		inactiveFile = v
+	}
+	if inactiveFile < usage {
+		workingSet = usage - inactiveFile
+	}
+	return rss, workingSet
+}
+
+// parseNetDev returns total received and transmitted bytes of all, but loopback, interfaces from /proc/net/dev.
+func parseNetDev(out []byte) (rx, tx uint64, _ error) {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		iface, counters, ok := strings.Cut(s.Text(), ":")
+		if !ok || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			return 0, 0, errors.Newf("unexpected /proc/net/dev line %q", s.Text())
+		}
+		r, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "parse received bytes of %s", iface)
+		}
+		t, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "parse transmitted bytes of %s", iface)
+		}
+		rx, tx = rx+r, tx+t
+	}
+	return rx, tx, nil
+}
+
+var humanSizeUnits = map[string]float64{
+	"b":  1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9, "tb": 1e12, "pb": 1e15,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40, "pib": 1 << 50,
+}
+
+// parseHumanSize parses sizes printed by docker and podman CLI, e.g. `1.5MiB` or `12.3kB`. Unknown values (`--`) are zero.
+func parseHumanSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "--" {
+		return 0, nil
+	}
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, errors.Newf("unexpected size %q", s)
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse size %q", s)
+	}
+	unit, ok := humanSizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, errors.Newf("unexpected unit of size %q", s)
+	}
+	return uint64(math.Round(v * unit)), nil
+}
+
+// parseHumanSizePair parses pair of sizes separated with slash (e.g. `1.2kB / 3.4kB`), as printed for I/O by docker
+// and podman CLI.
+func parseHumanSizePair(s string) (first, second uint64, err error) {
+	a, b, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, errors.Newf("unexpected size pair %q", s)
+	}
+	if first, err = parseHumanSize(a); err != nil {
+		return 0, 0, err
+	}
+	if second, err = parseHumanSize(b); err != nil {
+		return 0, 0, err
+	}
+	return first, second, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestParseHumanSize(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"0B":      0,
+		"--":      0,
+		"512B":    512,
+		"12.3kB":  12300,
+		"1.5MB":   1500000,
+		"2GB":     2000000000,
+		"1.5MiB":  1572864,
+		"1GiB":    1 << 30,
+		" 3.2KiB": 3277,
+	} {
+		got, err := parseHumanSize(s)
+		testutil.Ok(t, err, s)
+		testutil.Equals(t, expected, got, s)
+	}
+
+	for _, s := range []string{"MB", "12", "1.5XB"} {
+		_, err := parseHumanSize(s)
+		testutil.NotOk(t, err, s)
+	}
+}
+
+func TestParseDockerCLIStats(t *testing.T) {
+	stats, err := parseDockerCLIStats([]byte(`{"BlockIO":"4.1kB / 8.19kB","CPUPerc":"0.02%","Container":"e2e-test-app","ID":"3f4e5c0a5d1b","MemPerc":"0.05%","MemUsage":"3.5MiB / 7.7GiB","Name":"e2e-test-app","NetIO":"1.05kB / 0B","PIDs":"7"}` + "\n"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, RunnableStats{
+		MemoryWorkingSetBytes: 3670016,
+		NetworkRxBytes:        1050,
+		BlockReadBytes:        4100,
+		BlockWriteBytes:       8190,
+		PIDs:                  7,
+	}, stats)
+
+	_, err = parseDockerCLIStats([]byte(`{"BlockIO":"4.1kB","MemUsage":"3.5MiB / 7.7GiB","NetIO":"1.05kB / 0B","PIDs":"7"}`))
+	testutil.NotOk(t, err)
+}
+
+func TestDockerCLI_LogUnsupportedStats(t *testing.T) {
+	var out bytes.Buffer
+	c := newDockerCLI(NewLogger(&out), false)
+	c.logUnsupportedStats("CPU time is zero")
+	c.logUnsupportedStats("CPU time is zero")
+	testutil.Equals(t, 1, strings.Count(out.String(), "CPU time is zero"))
+}
+
+func TestCgroupStats(t *testing.T) {
+	kv := map[string]uint64{"anon": 6000, "inactive_file": 3000}
+
+	rss, ws := cgroupMemory(10000, kv)
+	testutil.Equals(t, uint64(6000), rss)
+	testutil.Equals(t, uint64(7000), ws)
+
+	// Working set can't be negative.
+	_, ws = cgroupMemory(1000, kv)
+	testutil.Equals(t, uint64(0), ws)
+}
+
+func TestParseNetDev(t *testing.T) {
+	rx, tx, err := parseNetDev([]byte(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0:    2500      20    0    0    0     0          0         0      700       8    0    0    0     0       0          0
+  eth1:     500       5    0    0    0     0          0         0      300       3    0    0    0     0       0          0
+`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, uint64(3000), rx)
+	testutil.Equals(t, uint64(1000), tx)
+}
+
+func TestStatsExpectations(t *testing.T) {
+	s := RunnableStats{PIDs: 3, MemoryWorkingSetBytes: 1 << 20}
+
+	testutil.Assert(t, StatEquals(StatPIDs, 3)(s))
+	testutil.Assert(t, !StatEquals(StatPIDs, 2)(s))
+	testutil.Assert(t, StatGreater(StatMemoryWorkingSetBytes, 1000)(s))
+	testutil.Assert(t, StatGreaterOrEqual(StatPIDs, 3)(s))
+	testutil.Assert(t, !StatLess(StatPIDs, 3)(s))
+	testutil.Assert(t, StatBetween(StatPIDs, 2, 4)(s))
+	testutil.Assert(t, !StatBetween(StatPIDs, 3, 4)(s))
+	testutil.Assert(t, statsExpected(s, []StatsExpectation{StatEquals(StatPIDs, 3), StatLess(StatCPUSeconds, 1)}))
+	testutil.Assert(t, !statsExpected(s, []StatsExpectation{StatEquals(StatPIDs, 3), StatGreater(StatCPUSeconds, 1)}))
+}
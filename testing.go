@@ -0,0 +1,159 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const keepOnFailureEnvName = "E2E_KEEP_ON_FAILURE"
+
+// keepOnFailureEnabled returns true if environment should be kept on test failure, either because of WithKeepOnFailure
+// or E2E_KEEP_ON_FAILURE environment variable.
+func (o environmentOptions) keepOnFailureEnabled() bool {
+	if o.keepOnFailure {
+		return true
+	}
+	keep, _ := strconv.ParseBool(os.Getenv(keepOnFailureEnvName))
+	return keep
+}
+
+// NewForTest creates new, isolated docker environment for the given test and closes it when the test and all its
+// subtests complete. Unless WithName is used, environment name is derived from the test name.
+// Test fails immediately, if the environment can't be created.
+//
+// If artifacts collection is configured (see WithArtifacts), artifacts are collected only if the test fails, into
+// the subdirectory named after the test.
+//
+// If the test fails and WithKeepOnFailure or E2E_KEEP_ON_FAILURE=1 is set, the environment is not closed. Instead,
+// endpoints of all started runnables, the shared directory and commands to tear the environment down are logged.
+func NewForTest(t testing.TB, opts ...EnvironmentOption) *DockerEnvironment {
+	t.Helper()
+
+	o := environmentOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	opts = append([]EnvironmentOption{WithName(testEnvironmentName(t.Name()))}, opts...)
+	if dir := o.artifactsDirectory(); dir != "" {
+		opts = append(opts, WithArtifacts(filepath.Join(dir, filepath.FromSlash(t.Name()))), withArtifactsCondition(t.Failed))
+	}
+
+	e, err := New(opts...)
+	if err != nil {
+		t.Fatalf("create e2e environment: %v", err)
+	}
+	t.Cleanup(func() {
+		if t.Failed() && o.keepOnFailureEnabled() {
+			if e.artifactsCloser != nil {
+				e.artifactsCloser()
+			}
+			e.keepForDebugging()
+			return
+		}
+		e.Close()
+	})
+	return e
+}
+
+// testEnvironmentName returns valid environment name unique for the given test name.
+func testEnvironmentName(testName string) string {
+	return fmt.Sprintf("e2e-%x", sha256.Sum256([]byte(testName)))[:16]
+}
+
+// keepForDebugging logs how to access and tear down the environment, that is left running.
+func (e *DockerEnvironment) keepForDebugging() {
+	e.logger.Log("Test failed; keeping environment", e.networkName, "for debugging")
+
+	e.startedMtx.Lock()
+	started := append([]Runnable{}, e.started...)
+	e.startedMtx.Unlock()
+
+	for _, r := range started {
+		d, ok := r.(*dockerRunnable)
+		if !ok {
+			e.logger.Log("Runnable", r.Name())
+			continue
+		}
+
+		d.mutex.Lock()
+		portNames := make([]string, 0, len(d.ports))
+		for portName := range d.ports {
+			portNames = append(portNames, portName)
+		}
+		d.mutex.Unlock()
+		sort.Strings(portNames)
+
+		e.logger.Log("Runnable", d.Name(), "container:", d.containerName(), "dir:", d.Dir())
+		for _, portName := range portNames {
+			e.logger.Log("  port", portName, "endpoint:", d.Endpoint(portName), "internal endpoint:", d.InternalEndpoint(portName))
+		}
+	}
+
+	e.logger.Log("Shared dir:", e.dir)
+	e.logger.Log("To tear the environment down, run:")
+	for _, c := range e.teardownCommands() {
+		e.logger.Log("  " + c)
+	}
+}
+
+// teardownCommands returns shell commands that remove all environment resources: containers, networks (including
+// extra ones, see WithNetworks), named volumes and the shared directory.
+func (e *DockerEnvironment) teardownCommands() []string {
+	var networks, filters []string
+	for _, n := range e.networkSpecs() {
+		networks = append(networks, n.Name)
+		// Filters with the same key are ORed, so containers attached to multiple networks are listed once.
+		filters = append(filters, "--filter network="+n.Name)
+	}
+	volumes := e.volumeNames()
+
+	var cmds []string
+	if _, ok := e.backend.(*podmanCLI); ok {
+		cmds = append(cmds,
+			fmt.Sprintf("podman pod rm --force $(podman pod ps --quiet %s)", strings.Join(filters, " ")),
+			fmt.Sprintf("podman network rm --force %s", strings.Join(networks, " ")),
+		)
+		if len(volumes) > 0 {
+			cmds = append(cmds, fmt.Sprintf("podman volume rm --force %s", strings.Join(volumes, " ")))
+		}
+	} else {
+		cmds = append(cmds,
+			fmt.Sprintf("docker rm --force $(docker ps -a --quiet %s)", strings.Join(filters, " ")),
+			fmt.Sprintf("docker network rm %s", strings.Join(networks, " ")),
+		)
+		if len(volumes) > 0 {
+			cmds = append(cmds, fmt.Sprintf("docker volume rm --force %s", strings.Join(volumes, " ")))
+		}
+	}
+	return append(cmds, fmt.Sprintf("rm -rf %s", e.dir))
+}
+
+// volumeNames returns sorted names of docker volumes for named volumes of all runnables in the environment.
+func (e *DockerEnvironment) volumeNames() []string {
+	e.mutex.Lock()
+	runnables := append([]*dockerRunnable{}, e.runnables...)
+	e.mutex.Unlock()
+
+	names := map[string]struct{}{}
+	for _, r := range runnables {
+		for _, v := range r.options().NamedVolumes {
+			names[dockerVolumeName(e.networkName, v)] = struct{}{}
+		}
+	}
+	volumes := make([]string, 0, len(names))
+	for v := range names {
+		volumes = append(volumes, v)
+	}
+	sort.Strings(volumes)
+	return volumes
+}
@@ -0,0 +1,76 @@
+// Copyright (c) The EfficientGo Authors.
+// Licensed under the Apache License 2.0.
+
+package e2e
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestTestEnvironmentName(t *testing.T) {
+	name := testEnvironmentName(t.Name())
+	testutil.Ok(t, validateName(name))
+	testutil.Equals(t, name, testEnvironmentName("TestTestEnvironmentName"))
+	testutil.Assert(t, name != testEnvironmentName("TestTestEnvironmentName/subtest"))
+}
+
+func TestKeepForDebugging(t *testing.T) {
+	var out bytes.Buffer
+	e := &DockerEnvironment{
+		networkName: "e2e-test",
+		dir:         "/tmp/e2e",
+		logger:      NewLogger(&out),
+		backend:     newDockerCLI(NewLogger(&out), false),
+		networks:    []Network{{Name: "backend"}},
+	}
+	app := &dockerRunnable{
+		env:             e,
+		name:            "app",
+		ports:           tcpPortSpecs(map[string]int{"http": 80, "grpc": 9090}),
+		hostPorts:       map[string]int{"http": 32768, "grpc": 32769},
+		usedNetworkName: "e2e-test",
+		opts:            StartOptions{NamedVolumes: map[string]string{"/data": "data", "/cache": "cache"}},
+	}
+	// Volumes shared by runnables are removed once.
+	e.runnables = append(e.runnables, app, &dockerRunnable{env: e, name: "db", opts: StartOptions{NamedVolumes: map[string]string{"/cache": "cache"}}})
+	e.started = append(e.started, app)
+	e.keepForDebugging()
+
+	var lines []string
+	for _, l := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		// Trim timestamp.
+		lines = append(lines, l[len("15:04:05 "):])
+	}
+	testutil.Equals(t, []string{
+		"Test failed; keeping environment e2e-test for debugging",
+		"Runnable app container: e2e-test-app dir: /tmp/e2e/data/app",
+		"  port grpc endpoint: 127.0.0.1:32769 internal endpoint: e2e-test-app:9090",
+		"  port http endpoint: 127.0.0.1:32768 internal endpoint: e2e-test-app:80",
+		"Shared dir: /tmp/e2e",
+		"To tear the environment down, run:",
+		"  docker rm --force $(docker ps -a --quiet --filter network=e2e-test --filter network=e2e-test-backend)",
+		"  docker network rm e2e-test e2e-test-backend",
+		"  docker volume rm --force e2e-test_cache e2e-test_data",
+		"  rm -rf /tmp/e2e",
+	}, lines)
+
+	e.backend = newPodmanCLI(NewLogger(&out), false)
+	testutil.Equals(t, []string{
+		"podman pod rm --force $(podman pod ps --quiet --filter network=e2e-test --filter network=e2e-test-backend)",
+		"podman network rm --force e2e-test e2e-test-backend",
+		"podman volume rm --force e2e-test_cache e2e-test_data",
+		"rm -rf /tmp/e2e",
+	}, e.teardownCommands())
+
+	// Environment without extra networks and named volumes.
+	e = &DockerEnvironment{networkName: "e2e-test", dir: "/tmp/e2e", backend: newDockerCLI(NewLogger(&out), false)}
+	testutil.Equals(t, []string{
+		"docker rm --force $(docker ps -a --quiet --filter network=e2e-test)",
+		"docker network rm e2e-test",
+		"rm -rf /tmp/e2e",
+	}, e.teardownCommands())
+}